@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// AdjacentBlock is a block of the same size next to the queried one.
+// Allocations are the records inside or overlapping it, excluding records
+// that also contain the queried block, since a shared parent does not stand
+// in the way of growth.
+type AdjacentBlock struct {
+	CIDR        string       `json:"cidr"`
+	Free        bool         `json:"free"`
+	Allocations []CIDRRecord `json:"allocations"`
+}
+
+// AdjacentResult is the response of GET /adjacent. Previous or Next is nil
+// when the neighbour would fall outside the permitted base containing the
+// block, or outside the address space.
+type AdjacentResult struct {
+	CIDR     string         `json:"cidr"`
+	Base     string         `json:"base,omitempty"`
+	Previous *AdjacentBlock `json:"previous"`
+	Next     *AdjacentBlock `json:"next"`
+}
+
+// AdjacentBlocks reports whether the blocks immediately before and after
+// cidr, at the same prefix length, are free.
+func (c *CIDRService) AdjacentBlocks(ctx context.Context, cidr string) (*AdjacentResult, error) {
+	_, network, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR format: %w", err)
+	}
+
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	var base *net.IPNet
+	for _, permitted := range c.permittedBases() {
+		if netContains(permitted, network) {
+			base = permitted
+			break
+		}
+	}
+
+	return adjacentBlocks(withoutExpired(records, time.Now()), network, base), nil
+}
+
+// adjacentBlocks computes the neighbours of network by address arithmetic and
+// checks each against records. A nil base bounds them by the address space
+// only.
+func adjacentBlocks(records []CIDRRecord, network, base *net.IPNet) *AdjacentResult {
+	result := &AdjacentResult{CIDR: network.String()}
+	if base != nil {
+		result.Base = base.String()
+	}
+
+	var neighbours [2]*net.IPNet
+	if prev := prevIP(network.IP); prev != nil {
+		neighbours[0] = &net.IPNet{IP: prev.Mask(network.Mask), Mask: network.Mask}
+	}
+	if next := nextIP(lastIP(network)); next != nil {
+		neighbours[1] = &net.IPNet{IP: next, Mask: network.Mask}
+	}
+
+	for i, neighbour := range neighbours {
+		if neighbour == nil || (base != nil && !netContains(base, neighbour)) {
+			continue
+		}
+
+		block := &AdjacentBlock{CIDR: neighbour.String(), Allocations: []CIDRRecord{}}
+		for _, record := range records {
+			_, recordNet, err := parseCIDR(record.CIDR)
+			if err != nil || !netsOverlap(recordNet, neighbour) || netContains(recordNet, network) {
+				continue
+			}
+			block.Allocations = append(block.Allocations, record)
+		}
+		block.Free = len(block.Allocations) == 0
+
+		if i == 0 {
+			result.Previous = block
+		} else {
+			result.Next = block
+		}
+	}
+
+	return result
+}
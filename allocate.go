@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AllocationOptions override the service defaults for a single allocation.
+// Zero values fall back to BASE_CIDR and ALLOCATION_PREFIX.
+type AllocationOptions struct {
+	// Base is the supernet to allocate from. It must lie within BASE_CIDR or
+	// one of ALLOWED_BASES.
+	Base   string
+	Prefix int
+	// Prefer is a range within the base searched first; the rest of the
+	// base is only used once it has no block left.
+	Prefer string
+	// Pool selects a configured pool, whose range is the default base and
+	// whose prefix rules and excluded ranges apply.
+	Pool string
+	// Tenant and Account limit the records considered taken when
+	// UNIQUENESS_SCOPE is tenant or account.
+	Tenant  string
+	Account string
+	// Key seeds the starting block with ALLOCATION_STRATEGY=hashed.
+	Key string
+	// NoFragment places the block best-fit into the free space and fails
+	// rather than leave free space too small for another block of its size.
+	NoFragment bool
+	// Emergency lets the allocation use the space RESERVE_HEADROOM holds
+	// back.
+	Emergency bool
+	// ActiveFrom and ActiveUntil are the window a scheduled reservation
+	// needs the block for; blocks held only outside it count as free.
+	ActiveFrom  int64
+	ActiveUntil int64
+}
+
+const (
+	allocationStrategySequential = "sequential"
+	allocationStrategyHashed     = "hashed"
+)
+
+func parseAllocationStrategy(value string) (string, error) {
+	switch value {
+	case "", allocationStrategySequential:
+		return allocationStrategySequential, nil
+	case allocationStrategyHashed:
+		return value, nil
+	default:
+		return "", fmt.Errorf("ALLOCATION_STRATEGY must be %q or %q, got %q",
+			allocationStrategySequential, allocationStrategyHashed, value)
+	}
+}
+
+// hashedIndex maps a key to a stable subnet index, so the same key starts
+// probing at the same block every time.
+func hashedIndex(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// parseAllocationOptions builds AllocationOptions from the base, prefer,
+// prefix, pool and tenant query parameters, any of which may be empty. query
+// returns the value of a parameter.
+func parseAllocationOptions(query func(string) string) (AllocationOptions, error) {
+	opts := AllocationOptions{Base: query("base"), Prefer: query("prefer"), Pool: query("pool"), Tenant: query("tenant"), Account: query("account"), Key: query("key")}
+	if prefix := query("prefix"); prefix != "" {
+		value, err := strconv.Atoi(prefix)
+		if err != nil {
+			return opts, fmt.Errorf("prefix parameter must be an integer")
+		}
+		// The base's own family limit is checked once the base is known.
+		if err := checkPrefixLength(value, maxIPv6Prefix); err != nil {
+			return opts, fmt.Errorf("prefix parameter %w", err)
+		}
+		opts.Prefix = value
+	}
+	if noFragment := query("noFragment"); noFragment != "" {
+		value, err := strconv.ParseBool(noFragment)
+		if err != nil {
+			return opts, fmt.Errorf("noFragment parameter must be true or false")
+		}
+		opts.NoFragment = value
+	}
+	if emergency := query("emergency"); emergency != "" {
+		value, err := strconv.ParseBool(emergency)
+		if err != nil {
+			return opts, fmt.Errorf("emergency parameter must be true or false")
+		}
+		opts.Emergency = value
+	}
+	from, until, err := parseActiveWindow(query)
+	if err != nil {
+		return opts, err
+	}
+	opts.ActiveFrom, opts.ActiveUntil = from, until
+	return opts, nil
+}
+
+// parsePrefixList parses a comma-separated list of prefix lengths such as
+// "16,20,24".
+func parsePrefixList(value string) ([]int, error) {
+	var prefixes []int
+	for _, entry := range strings.Split(value, ",") {
+		prefix, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(entry), "/"))
+		if err != nil || prefix < 1 {
+			return nil, fmt.Errorf("prefixes must be a comma-separated list of prefix lengths, got %q", value)
+		}
+		if err := checkPrefixLength(prefix, maxIPv6Prefix); err != nil {
+			return nil, fmt.Errorf("prefixes entry %w", err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// permittedBases returns the default base followed by any ALLOWED_BASES.
+func (c *CIDRService) permittedBases() []*net.IPNet {
+	var bases []*net.IPNet
+	if _, base, err := parseCIDR(c.baseCIDR); err == nil {
+		bases = append(bases, base)
+	}
+	return append(bases, c.allowedBases...)
+}
+
+// resolveBase parses the requested base, or the default base when empty, and
+// returns it together with the permitted base that contains it.
+func (c *CIDRService) resolveBase(requested string) (base, permitted *net.IPNet, err error) {
+	if requested == "" {
+		requested = c.baseCIDR
+	}
+
+	_, base, err = parseCIDR(requested)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid base CIDR %q: %w", requested, err)
+	}
+
+	for _, allowed := range c.permittedBases() {
+		if netContains(allowed, base) {
+			return base, allowed, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("base %s is not within an allowed base", base)
+}
+
+// resolveAllocation validates opts and returns the base to allocate from and
+// the prefix length to allocate.
+func (c *CIDRService) resolveAllocation(opts AllocationOptions) (base, permitted *net.IPNet, prefix int, err error) {
+	var pool Pool
+	if opts.Pool != "" {
+		pool, err = c.pool(opts.Pool)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if opts.Base == "" {
+			opts.Base = pool.Base.String()
+		}
+		if opts.Prefix == 0 {
+			opts.Prefix = pool.RequiredPrefix
+		}
+		if opts.Prefix == 0 {
+			opts.Prefix = pool.DefaultPrefix
+		}
+	}
+
+	base, permitted, err = c.resolveBase(opts.Base)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if pool.Base != nil && !netContains(pool.Base, base) {
+		return nil, nil, 0, fmt.Errorf("base %s is outside pool %q (%s)", base, pool.Name, pool.Base)
+	}
+
+	prefix = opts.Prefix
+	if prefix == 0 {
+		prefix = c.allocationPrefix
+	}
+	if opts.Pool != "" {
+		if err := pool.checkPrefix(prefix); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	basePrefix, bits := base.Mask.Size()
+	if prefix < basePrefix || prefix > bits {
+		return nil, nil, 0, fmt.Errorf("prefix must be between /%d and /%d, got /%d", basePrefix, bits, prefix)
+	}
+	if opts.NoFragment && bits != 32 {
+		return nil, nil, 0, fmt.Errorf("noFragment applies to IPv4 bases only, not %s", base)
+	}
+
+	if opts.Prefer != "" {
+		if _, err := parsePreferredRange(opts.Prefer, base, prefix); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	return base, permitted, prefix, nil
+}
+
+// parsePreferredRange parses the prefer parameter, which must lie within the
+// base and be able to hold a block of prefix.
+func parsePreferredRange(value string, base *net.IPNet, prefix int) (*net.IPNet, error) {
+	_, prefer, err := parseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefer range %q: %w", value, err)
+	}
+	if !netContains(base, prefer) {
+		return nil, fmt.Errorf("prefer range %s is outside base %s", prefer, base)
+	}
+	if preferPrefix, _ := prefer.Mask.Size(); preferPrefix > prefix {
+		return nil, fmt.Errorf("prefer range %s is smaller than a /%d block", prefer, prefix)
+	}
+	return prefer, nil
+}
+
+// allocationRange is the range an allocated block came from: the prefer
+// range when it holds the block, otherwise the base.
+func (c *CIDRService) allocationRange(opts AllocationOptions, cidr string) string {
+	base, _, prefix, err := c.resolveAllocation(opts)
+	if err != nil {
+		return ""
+	}
+	_, block, err := parseCIDR(cidr)
+	if err != nil {
+		return base.String()
+	}
+	if opts.Prefer != "" {
+		if prefer, err := parsePreferredRange(opts.Prefer, base, prefix); err == nil && netContains(prefer, block) {
+			return prefer.String()
+		}
+	}
+	return base.String()
+}
+
+// GetNextAvailableCIDR returns the lowest block of the requested prefix length
+// within the requested base that does not overlap any registered CIDR. Once
+// the default base is full, the search continues in OVERFLOW_CIDR.
+func (c *CIDRService) GetNextAvailableCIDR(ctx context.Context, opts AllocationOptions) (string, error) {
+	base, permitted, prefix, err := c.resolveAllocation(opts)
+	if err != nil {
+		return "", err
+	}
+
+	used, err := c.usedNetworks(ctx, permitted, opts)
+	if err != nil {
+		return "", err
+	}
+	released, err := c.releasedNetworks(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	next, ok := c.nextPreferred(base, prefix, used, released, opts)
+	if !ok && c.overflows(base, prefix, opts) {
+		base = c.overflow
+		next, used, ok, err = c.nextOverflow(ctx, prefix, released, opts)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		return "", &ExhaustedError{Prefix: prefix, Base: base, NoFragment: opts.NoFragment}
+	}
+	if !opts.Emergency {
+		if err := c.checkHeadroom(base, next, used); err != nil {
+			return "", err
+		}
+	}
+
+	return next.String(), nil
+}
+
+// NextAvailableCIDRs is GetNextAvailableCIDR for several prefix lengths at
+// once, reading the registered records only once, and those of OVERFLOW_CIDR
+// once more if a prefix overflows. Exhausted prefixes, and those whose next
+// block would reach the headroom, map to nil.
+func (c *CIDRService) NextAvailableCIDRs(ctx context.Context, opts AllocationOptions, prefixes []int) (map[int]*string, error) {
+	var (
+		bases     []*net.IPNet
+		permitted *net.IPNet
+	)
+	for _, prefix := range prefixes {
+		opts.Prefix = prefix
+		base, allowed, _, err := c.resolveAllocation(opts)
+		if err != nil {
+			return nil, err
+		}
+		bases, permitted = append(bases, base), allowed
+	}
+
+	used, err := c.usedNetworks(ctx, permitted, opts)
+	if err != nil {
+		return nil, err
+	}
+	released, err := c.releasedNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var overflowUsed []*net.IPNet
+	next := make(map[int]*string, len(prefixes))
+	for i, prefix := range prefixes {
+		next[prefix] = nil
+		base, baseUsed := bases[i], used
+		subnet, ok := c.nextPreferred(base, prefix, used, released, opts)
+		if !ok && c.overflows(base, prefix, opts) {
+			if overflowUsed == nil {
+				if overflowUsed, err = c.usedNetworks(ctx, c.overflow, opts); err != nil {
+					return nil, err
+				}
+			}
+			base, baseUsed = c.overflow, overflowUsed
+			subnet, ok = c.nextFree(base, prefix, baseUsed, released, opts)
+		}
+		if ok && !opts.Emergency && c.checkHeadroom(base, subnet, baseUsed) != nil {
+			ok = false
+		}
+		if ok {
+			cidr := subnet.String()
+			next[prefix] = &cidr
+		}
+	}
+	return next, nil
+}
+
+// poolExhaustedCode tags the error response of an allocation that found no
+// block to give.
+const poolExhaustedCode = "POOL_EXHAUSTED"
+
+// ExhaustedError reports that no block of the requested size is left in a
+// base, or, with NoFragment, none that can be placed without fragmenting it.
+type ExhaustedError struct {
+	Prefix     int
+	Base       *net.IPNet
+	NoFragment bool
+}
+
+func (e *ExhaustedError) Error() string {
+	if e.NoFragment {
+		return fmt.Sprintf("no /%d CIDR can be placed in %s without fragmenting the free space", e.Prefix, e.Base)
+	}
+	return fmt.Sprintf("no available /%d CIDRs remaining in %s", e.Prefix, e.Base)
+}
+
+// usedNetworks returns the blocks an allocation within permitted must avoid:
+// the unexpired records in the allocation's uniqueness scope that are active
+// during its window, the forbidden ranges and, for a pool, its excluded
+// ranges.
+func (c *CIDRService) usedNetworks(ctx context.Context, permitted *net.IPNet, opts AllocationOptions) ([]*net.IPNet, error) {
+	records, err := c.GetCIDRsInBase(ctx, permitted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	return c.usedBy(records, opts), nil
+}
+
+// usedBy is usedNetworks for records already read.
+func (c *CIDRService) usedBy(records []CIDRRecord, opts AllocationOptions) []*net.IPNet {
+	scope := CIDRRecord{Pool: opts.Pool, Tenant: opts.Tenant, Account: opts.Account}
+	var used []*net.IPNet
+	live := recordsActiveDuring(withoutExpired(records, time.Now()), opts.ActiveFrom, opts.ActiveUntil)
+	for _, record := range inScope(live, scope, c.uniquenessScope) {
+		if _, network, err := parseCIDR(record.CIDR); err == nil {
+			used = append(used, network)
+		}
+	}
+	used = append(used, c.forbidden...)
+	if opts.Pool != "" {
+		pool, _ := c.pool(opts.Pool)
+		used = append(used, pool.Excluded...)
+	}
+	return used
+}
+
+// nextPreferred is nextFree searching the prefer range first and falling
+// back to the whole base when it has no block left. The headroom still
+// applies to the base as a whole.
+func (c *CIDRService) nextPreferred(base *net.IPNet, prefix int, used, released []*net.IPNet, opts AllocationOptions) (*net.IPNet, bool) {
+	if opts.Prefer != "" {
+		if prefer, err := parsePreferredRange(opts.Prefer, base, prefix); err == nil {
+			if subnet, ok := c.nextFree(prefer, prefix, used, released, opts); ok {
+				return subnet, true
+			}
+		}
+	}
+	return c.nextFree(base, prefix, used, released, opts)
+}
+
+// nextFree applies the allocation strategy and gap to find a free block.
+// NoFragment, which resolveAllocation allows for IPv4 bases only, replaces
+// both with best-fit placement; otherwise free space in released blocks is
+// used before never-allocated space.
+func (c *CIDRService) nextFree(base *net.IPNet, prefix int, used, released []*net.IPNet, opts AllocationOptions) (*net.IPNet, bool) {
+	if opts.NoFragment && len(base.IP) == net.IPv4len {
+		return bestFitSubnet(base, prefix, used)
+	}
+	if subnet, ok := recycledSubnet(released, base, prefix, used); ok {
+		return subnet, true
+	}
+
+	// The hashed strategy starts at a block derived from the key and probes
+	// forward from there, so a key maps to the same block while it is free.
+	var index uint64
+	if c.allocationStrategy == allocationStrategyHashed && opts.Key != "" {
+		index = hashedIndex(opts.Key)
+	}
+	return nextFreeSubnetWithGap(base, prefix, used, index, c.allocationGap)
+}
+
+// PrefixForHosts returns the longest IPv4 prefix whose blocks hold at least
+// hosts usable addresses and still fit within the given base, or the default
+// base when base is empty. IPv6 blocks are sized by prefix, so an IPv6 base
+// is rejected.
+func (c *CIDRService) PrefixForHosts(hosts int, base string) (int, error) {
+	if hosts < 1 {
+		return 0, fmt.Errorf("hosts must be at least 1, got %d", hosts)
+	}
+
+	network, _, err := c.resolveBase(base)
+	if err != nil {
+		return 0, err
+	}
+	basePrefix, bits := network.Mask.Size()
+	if bits != 32 {
+		return 0, fmt.Errorf("hosts applies to IPv4 bases only; give a prefix for IPv6 base %s", network)
+	}
+
+	for prefix := 32; prefix >= basePrefix; prefix-- {
+		if usableHosts(prefix) >= uint64(hosts) {
+			return prefix, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%d hosts exceeds the %d usable hosts of base CIDR %s",
+		hosts, usableHosts(basePrefix), network)
+}
+
+// AllocateCIDR registers record under the next available block and returns
+// the stored record. Any CIDR already set on record is replaced. An attempt
+// that loses a race with a concurrent write backs out and picks the next
+// block again, up to maxAllocationAttempts times.
+func (c *CIDRService) AllocateCIDR(ctx context.Context, record CIDRRecord, opts AllocationOptions) (*CIDRRecord, error) {
+	opts.Key = record.Key
+	opts.ActiveFrom, opts.ActiveUntil = record.ActiveFrom, record.ActiveUntil
+	record.Pool = opts.Pool
+	record.Tenant = opts.Tenant
+	record.Account = opts.Account
+
+	var stored *CIDRRecord
+	for attempt := 0; ; attempt++ {
+		cidr, err := c.GetNextAvailableCIDR(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		record.CIDR = cidr
+		var serviceTags Tags
+		if source := c.allocationSource(opts, cidr); source != "" {
+			serviceTags = Tags{allocationSourceTag: source}
+		}
+		stored, _, err = c.registerCIDR(ctx, record, serviceTags, auditActionAllocate, requireParentNone)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errWriteConflict) || attempt+1 >= maxAllocationAttempts {
+			return nil, err
+		}
+		if err := sleepContext(ctx, allocationRetryDelay(attempt)); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.releasedTableName != "" {
+		if err := c.forgetReleased(ctx, stored.CIDR); err != nil {
+			logf(ctx, "failed to forget released block %s: %v", stored.CIDR, err)
+		}
+	}
+	return stored, nil
+}
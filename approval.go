@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	recordStatusPending = "pending"
+	recordStatusActive  = "active"
+)
+
+var errNotPending = errors.New("record is not pending approval")
+
+// approverToken is APPROVER_TOKEN, the bearer token POST /approve and
+// POST /reject require. The approval workflow is disabled while it is unset.
+func approverToken() string {
+	return os.Getenv("APPROVER_TOKEN")
+}
+
+// isApprover reports whether an Authorization header carries the approver
+// token.
+func isApprover(authorization string) bool {
+	return hasBearerToken(authorization, approverToken())
+}
+
+// ApproveRequest activates the pending record stored under key and returns
+// it. The update is conditional on the record still being pending, so two
+// approvers cannot both act on it.
+func (c *CIDRService) ApproveRequest(ctx context.Context, key string) (*CIDRRecord, error) {
+	record, err := c.pendingRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	updatedAt := time.Now().Unix()
+	values := pendingValue()
+	values[":updated"] = &types.AttributeValueMemberN{Value: fmt.Sprint(updatedAt)}
+	_, err = c.client(ctx).UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(c.table(ctx)),
+		Key:                       c.itemKey(*record),
+		UpdateExpression:          aws.String("SET #u = :updated REMOVE #s"),
+		ConditionExpression:       aws.String("#s = :pending"),
+		ExpressionAttributeNames:  map[string]string{"#s": "status", "#u": "updatedAt"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return nil, pendingWriteError(key, err)
+	}
+
+	record.Status = ""
+	record.UpdatedAt = updatedAt
+	c.notifyRecord(ctx, changeActionApprove, *record)
+	return record, nil
+}
+
+// RejectRequest deletes the pending record stored under key, freeing its
+// block, and returns it.
+func (c *CIDRService) RejectRequest(ctx context.Context, key string) (*CIDRRecord, error) {
+	record, err := c.pendingRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.client(ctx).DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(c.table(ctx)),
+		Key:                       c.itemKey(*record),
+		ConditionExpression:       aws.String("#s = :pending"),
+		ExpressionAttributeNames:  map[string]string{"#s": "status"},
+		ExpressionAttributeValues: pendingValue(),
+	})
+	if err != nil {
+		return nil, pendingWriteError(key, err)
+	}
+	c.countAdded(ctx, -1)
+	c.notifyRecord(ctx, changeActionReject, *record)
+	return record, nil
+}
+
+func (c *CIDRService) pendingRecord(ctx context.Context, key string) (*CIDRRecord, error) {
+	record, err := c.GetRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if record.Status != recordStatusPending {
+		return nil, fmt.Errorf("key '%s': %w", key, errNotPending)
+	}
+	return record, nil
+}
+
+func pendingValue() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":pending": &types.AttributeValueMemberS{Value: recordStatusPending},
+	}
+}
+
+func pendingWriteError(key string, err error) error {
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return fmt.Errorf("key '%s' was approved or rejected concurrently: %w", key, errNotPending)
+	}
+	return fmt.Errorf("failed to update item in DynamoDB: %w", err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	auditActionRegister = "register"
+	auditActionAllocate = "allocate"
+	auditActionReassign = "reassign"
+	auditActionUpdate   = "update"
+)
+
+// AuditEntry records a write to the registry. With AUDIT_TABLE_NAME set, one
+// is stored per registration, allocation, reassign or update, keyed by the
+// record key and the time of the write.
+type AuditEntry struct {
+	Key    string `json:"key" dynamodbav:"key"`
+	At     string `json:"at" dynamodbav:"at"`
+	Action string `json:"action" dynamodbav:"action"`
+	CIDR   string `json:"cidr" dynamodbav:"cidr"`
+	// Feed is the partition key of the feed-index, the same for every entry.
+	Feed string `json:"-" dynamodbav:"feed"`
+}
+
+func newAuditEntry(action string, record CIDRRecord, now time.Time) AuditEntry {
+	return AuditEntry{
+		Key:    record.Key,
+		At:     now.UTC().Format(time.RFC3339Nano),
+		Action: action,
+		CIDR:   record.CIDR,
+		Feed:   auditFeed,
+	}
+}
+
+// putWithAudit writes a record item and its audit entry in one transaction,
+// so neither is stored without the other. The record put is conditional on
+// its primary key being free, or held only by an expired reservation, which
+// closes the race between the uniqueness check and the write.
+func (c *CIDRService) putWithAudit(ctx context.Context, item map[string]types.AttributeValue, entry AuditEntry) error {
+	auditItem, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	primaryKey := "key"
+	if c.partitioned {
+		primaryKey = "cidr"
+	}
+
+	_, err = c.client(ctx).TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(c.table(ctx)),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(#pk) OR #e <= :now"),
+					ExpressionAttributeNames: map[string]string{
+						"#pk": primaryKey,
+						"#e":  "expiresAt",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":now": &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+					},
+				},
+			},
+			{
+				Put: &types.Put{
+					TableName: aws.String(c.auditTableName),
+					Item:      auditItem,
+				},
+			},
+		},
+	})
+	if err != nil {
+		if transactionConditionFailed(err) {
+			return fmt.Errorf("key '%s' or CIDR '%s' %w", entry.Key, entry.CIDR, errWriteConflict)
+		}
+		return fmt.Errorf("failed to write record and audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// auditPut returns the transaction item that stores entry in
+// AUDIT_TABLE_NAME, for writes that add it to a transaction of their own.
+func (c *CIDRService) auditPut(entry AuditEntry) (types.TransactWriteItem, error) {
+	auditItem, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: aws.String(c.auditTableName),
+			Item:      auditItem,
+		},
+	}, nil
+}
+
+// transactionConditionFailed reports whether err is a transaction cancelled
+// because one of its condition checks failed.
+func transactionConditionFailed(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	defaultAvailableLimit = 256
+	maxAvailableLimit     = 4096
+)
+
+// errInvalidAvailableToken reports a nextToken that was not returned by
+// GET /available-blocks.
+var errInvalidAvailableToken = errors.New("invalid nextToken")
+
+// AvailableBlocksPage is one page of GET /available-blocks: free blocks of
+// Prefix in Base, in address order. Total counts every free block, not just
+// this page's, and NextToken is set when more follow.
+type AvailableBlocksPage struct {
+	Base      string   `json:"base"`
+	Prefix    int      `json:"prefix"`
+	Total     uint64   `json:"total"`
+	Blocks    []string `json:"blocks"`
+	NextToken string   `json:"nextToken,omitempty"`
+}
+
+// parseAvailableLimit reads the limit query parameter of
+// GET /available-blocks.
+func parseAvailableLimit(value string) (int, error) {
+	if value == "" {
+		return defaultAvailableLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxAvailableLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d, got %q", maxAvailableLimit, value)
+	}
+	return limit, nil
+}
+
+// checkAvailableBase rejects a base whose free blocks cannot be listed. Only
+// IPv4 bases can be, since an IPv6 base holds too many blocks to count.
+func checkAvailableBase(base *net.IPNet) error {
+	if base.IP.To4() == nil {
+		return fmt.Errorf("available blocks can only be listed in IPv4 bases, got %s", base)
+	}
+	return nil
+}
+
+// AvailableBlocks lists the free prefix-sized blocks of an allocation's base,
+// skipping the same records, forbidden ranges and pool exclusions as
+// GET /next. Blocks are cut from the free ranges left between used networks,
+// aligned to their size, starting at the address from, as decoded from a
+// nextToken.
+func (c *CIDRService) AvailableBlocks(ctx context.Context, opts AllocationOptions, limit int, from uint64) (*AvailableBlocksPage, error) {
+	base, permitted, prefix, err := c.resolveAllocation(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAvailableBase(base); err != nil {
+		return nil, err
+	}
+
+	used, err := c.usedNetworks(ctx, permitted, opts)
+	if err != nil {
+		return nil, err
+	}
+	return availableBlocks(base, prefix, used, limit, from), nil
+}
+
+// availableBlocks is AvailableBlocks for used networks already read, listing
+// up to limit blocks that start at or after from.
+func availableBlocks(base *net.IPNet, prefix int, used []*net.IPNet, limit int, from uint64) *AvailableBlocksPage {
+	page := &AvailableBlocksPage{Base: base.String(), Prefix: prefix, Blocks: []string{}}
+	size := uint64(1) << uint(32-prefix)
+	mask := net.CIDRMask(prefix, 32)
+
+	for _, free := range freeRanges(base, used) {
+		first := (free.start + size - 1) / size * size
+		if first+size > free.end {
+			continue
+		}
+		page.Total += (free.end - first) / size
+
+		for addr := max(first, (from+size-1)/size*size); addr+size <= free.end; addr += size {
+			if len(page.Blocks) == limit {
+				if page.NextToken == "" {
+					page.NextToken = encodeAvailableToken(addr)
+				}
+				break
+			}
+			page.Blocks = append(page.Blocks, (&net.IPNet{IP: uint32ToIPv4(uint32(addr)), Mask: mask}).String())
+		}
+	}
+	return page
+}
+
+// encodeAvailableToken turns the address the next page starts at into an
+// opaque nextToken.
+func encodeAvailableToken(addr uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(addr, 10)))
+}
+
+func decodeAvailableToken(token string) (uint64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidAvailableToken
+	}
+	addr, err := strconv.ParseUint(string(data), 10, 32)
+	if err != nil {
+		return 0, errInvalidAvailableToken
+	}
+	return addr, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Records imported by POST /sync-aws are tagged cidrfinder:source=aws, so
+// that POST /reconcile-aws only ever removes records AWS put there. The tag
+// is one of the systemTags, which callers cannot set.
+const (
+	syncSourceTag = "cidrfinder:source"
+	syncSourceAWS = "aws"
+)
+
+// syncTarget is a region to import VPCs from, optionally in another account
+// reached by assuming RoleARN.
+type syncTarget struct {
+	Region  string
+	RoleARN string
+}
+
+// parseSyncTargets parses SYNC_AWS_TARGETS, a comma-separated list of region
+// or region=roleArn entries such as
+// "us-east-1,eu-west-1=arn:aws:iam::222222222222:role/cidrfinder-sync".
+func parseSyncTargets(value string) ([]syncTarget, error) {
+	var targets []syncTarget
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		region, roleARN, _ := strings.Cut(entry, "=")
+		if region == "" {
+			return nil, fmt.Errorf("invalid SYNC_AWS_TARGETS entry %q: want region[=roleArn]", entry)
+		}
+		if roleARN != "" && !strings.HasPrefix(roleARN, "arn:") {
+			return nil, fmt.Errorf("invalid SYNC_AWS_TARGETS entry %q: %q is not a role ARN", entry, roleARN)
+		}
+		targets = append(targets, syncTarget{Region: region, RoleARN: roleARN})
+	}
+	return targets, nil
+}
+
+type SyncConflict struct {
+	Key     string `json:"key"`
+	CIDR    string `json:"cidr"`
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Message string `json:"message"`
+}
+
+// SyncResult reports a POST /sync-aws import. Unlike a restore, blocks
+// without conflicts are imported even when others conflict.
+type SyncResult struct {
+	Imported  []CIDRRecord   `json:"imported"`
+	Skipped   int            `json:"skipped"`
+	Conflicts []SyncConflict `json:"conflicts"`
+}
+
+// SyncAWS imports the IPv4 CIDRs of the VPCs and subnets in every
+// SYNC_AWS_TARGETS region. Blocks that are already registered are skipped.
+func (c *CIDRService) SyncAWS(ctx context.Context) (*SyncResult, error) {
+	targets := c.syncTargets
+	if len(targets) == 0 {
+		targets = []syncTarget{{Region: c.awsConfig.Region}}
+	}
+
+	var discovered []CIDRRecord
+	for _, target := range targets {
+		records, err := c.discoverVPCs(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe VPCs in %s: %w", target.Region, err)
+		}
+		discovered = append(discovered, records...)
+	}
+
+	existing, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	now := time.Now()
+	imported, skipped, conflicts := planSync(existing, discovered, c.uniquenessScope, now)
+	if err := c.checkRecordLimit(ctx, len(imported)); err != nil {
+		return nil, err
+	}
+
+	var requests []types.WriteRequest
+	for i := range imported {
+		imported[i].CreatedAt = now.Unix()
+		record := imported[i]
+		record.Partition = ""
+		if c.partitioned {
+			_, network, _ := parseCIDR(record.CIDR)
+			record.Partition = c.partitionFor(network)
+		}
+
+		item, err := attributevalue.MarshalMap(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		requests = append(requests, types.WriteRequest{
+			PutRequest: &types.PutRequest{Item: item},
+		})
+	}
+	if err := c.batchWrite(ctx, requests); err != nil {
+		return nil, fmt.Errorf("failed to write imported records: %w", err)
+	}
+	c.countAdded(ctx, len(imported))
+	c.markChanged(ctx)
+
+	return &SyncResult{Imported: imported, Skipped: skipped, Conflicts: conflicts}, nil
+}
+
+// discoverVPCs lists the VPC and subnet blocks in one target as records. A
+// VPC's primary block is keyed by its VPC ID; secondary blocks and subnets are
+// keyed beneath it, e.g. "vpc-0abc/subnet-0def", so they group by VPC.
+func (c *CIDRService) discoverVPCs(ctx context.Context, target syncTarget) ([]CIDRRecord, error) {
+	client := ec2.NewFromConfig(c.awsConfig, func(o *ec2.Options) {
+		o.Region = target.Region
+		if target.RoleARN != "" {
+			o.Credentials = aws.NewCredentialsCache(
+				stscreds.NewAssumeRoleProvider(sts.NewFromConfig(c.awsConfig), target.RoleARN))
+		}
+	})
+
+	var records []CIDRRecord
+	vpcs := ec2.NewDescribeVpcsPaginator(client, &ec2.DescribeVpcsInput{})
+	for vpcs.HasMorePages() {
+		page, err := vpcs.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, vpc := range page.Vpcs {
+			vpcID := aws.ToString(vpc.VpcId)
+			for _, association := range vpc.CidrBlockAssociationSet {
+				if association.CidrBlockState == nil || association.CidrBlockState.State != ec2types.VpcCidrBlockStateCodeAssociated {
+					continue
+				}
+				key := vpcID
+				if aws.ToString(association.CidrBlock) != aws.ToString(vpc.CidrBlock) {
+					key = vpcID + namespaceSeparator + aws.ToString(association.AssociationId)
+				}
+				records = append(records, CIDRRecord{
+					Key:         key,
+					CIDR:        aws.ToString(association.CidrBlock),
+					Description: nameTag(vpc.Tags),
+					Account:     aws.ToString(vpc.OwnerId),
+					Region:      target.Region,
+					Tags:        Tags{syncSourceTag: syncSourceAWS},
+				})
+			}
+		}
+	}
+
+	subnets := ec2.NewDescribeSubnetsPaginator(client, &ec2.DescribeSubnetsInput{})
+	for subnets.HasMorePages() {
+		page, err := subnets.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, subnet := range page.Subnets {
+			if subnet.CidrBlock == nil {
+				continue
+			}
+			records = append(records, CIDRRecord{
+				Key:         aws.ToString(subnet.VpcId) + namespaceSeparator + aws.ToString(subnet.SubnetId),
+				CIDR:        aws.ToString(subnet.CidrBlock),
+				Description: nameTag(subnet.Tags),
+				Account:     aws.ToString(subnet.OwnerId),
+				Region:      target.Region,
+				Tags:        Tags{syncSourceTag: syncSourceAWS},
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// targetAccount returns the account a target's VPCs are described in: the
+// account of its role, or the service's own without one.
+func (c *CIDRService) targetAccount(ctx context.Context, target syncTarget) (string, error) {
+	client := sts.NewFromConfig(c.awsConfig, func(o *sts.Options) {
+		o.Region = target.Region
+		if target.RoleARN != "" {
+			o.Credentials = aws.NewCredentialsCache(
+				stscreds.NewAssumeRoleProvider(sts.NewFromConfig(c.awsConfig), target.RoleARN))
+		}
+	})
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(identity.Account), nil
+}
+
+func nameTag(tags []ec2types.Tag) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == "Name" {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// planSync decides which discovered blocks to import. A block already
+// registered in its uniqueness scope, under any key, is skipped. A block that
+// would break the registry's uniqueness rules, for example one that contains
+// a manually registered allocation, is reported as a conflict. Blocks are
+// checked largest first so a VPC is in place before its subnets.
+func planSync(existing, discovered []CIDRRecord, scope string, now time.Time) (imported []CIDRRecord, skipped int, conflicts []SyncConflict) {
+	against := withoutExpired(existing, now)
+	imported = []CIDRRecord{}
+	conflicts = []SyncConflict{}
+
+	ordered := make([]CIDRRecord, len(discovered))
+	copy(ordered, discovered)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return recordPrefix(ordered[i]) < recordPrefix(ordered[j])
+	})
+
+	for _, record := range ordered {
+		tracked := false
+		for _, other := range inScope(against, record, scope) {
+			if other.CIDR == record.CIDR {
+				tracked = true
+				break
+			}
+		}
+		if tracked {
+			skipped++
+			continue
+		}
+
+		if err := checkScopedUniqueness(against, record, scope); err != nil {
+			conflicts = append(conflicts, SyncConflict{
+				Key:     record.Key,
+				CIDR:    record.CIDR,
+				Account: record.Account,
+				Region:  record.Region,
+				Message: err.Error(),
+			})
+			continue
+		}
+
+		imported = append(imported, record)
+		against = append(against, record)
+	}
+
+	return imported, skipped, conflicts
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	backupVersion = 1
+
+	restoreModeMerge   = "merge"
+	restoreModeReplace = "replace"
+)
+
+// Backup is the document returned by GET /backup and accepted by
+// POST /restore.
+type Backup struct {
+	Version    int          `json:"version"`
+	ExportedAt int64        `json:"exportedAt"`
+	Count      int          `json:"count"`
+	Records    []CIDRRecord `json:"records"`
+}
+
+type RestoreConflict struct {
+	Key     string `json:"key"`
+	CIDR    string `json:"cidr"`
+	Message string `json:"message"`
+}
+
+// RestoreResult reports a restore. When Conflicts is non-empty nothing was
+// written.
+type RestoreResult struct {
+	Mode      string            `json:"mode"`
+	Restored  int               `json:"restored"`
+	Skipped   int               `json:"skipped"`
+	Conflicts []RestoreConflict `json:"conflicts"`
+}
+
+func (c *CIDRService) Backup(ctx context.Context) (*Backup, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CIDRs: %w", err)
+	}
+	if records == nil {
+		records = []CIDRRecord{}
+	}
+
+	return &Backup{
+		Version:    backupVersion,
+		ExportedAt: time.Now().Unix(),
+		Count:      len(records),
+		Records:    records,
+	}, nil
+}
+
+// parseRestoreMode validates the mode query parameter, defaulting to merge.
+func parseRestoreMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return restoreModeMerge, nil
+	case restoreModeMerge, restoreModeReplace:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("mode must be %q or %q, got %q", restoreModeMerge, restoreModeReplace, mode)
+	}
+}
+
+func (b Backup) validate() fieldErrors {
+	if b.Version != backupVersion {
+		return fieldErrors{"version": fmt.Sprintf("must be %d", backupVersion)}
+	}
+	return nil
+}
+
+// Restore loads a backup. In merge mode the records are added alongside the
+// existing ones; in replace mode the existing records are deleted first.
+// Every record is validated before anything is written, and any conflict
+// aborts the restore. Replace is not atomic: a failure while writing can leave
+// the table partially restored.
+func (c *CIDRService) Restore(ctx context.Context, backup Backup, mode string) (*RestoreResult, error) {
+	existing, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	var against []CIDRRecord
+	if mode == restoreModeMerge {
+		against = existing
+	}
+	accepted, skipped, conflicts := planRestore(against, backup.Records, time.Now())
+
+	result := &RestoreResult{
+		Mode:      mode,
+		Skipped:   skipped,
+		Conflicts: conflicts,
+	}
+	if len(conflicts) > 0 {
+		return result, nil
+	}
+
+	added := len(accepted)
+	if mode == restoreModeReplace {
+		added -= len(existing)
+	}
+	if err := c.checkRecordLimit(ctx, added); err != nil {
+		return nil, err
+	}
+
+	var requests []types.WriteRequest
+	if mode == restoreModeReplace {
+		for _, record := range existing {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: c.itemKey(record)},
+			})
+		}
+		// Deletes and puts of the same item may not share a batch.
+		if err := c.batchWrite(ctx, requests); err != nil {
+			return nil, fmt.Errorf("failed to clear existing records: %w", err)
+		}
+		c.countAdded(ctx, -len(existing))
+		c.markChanged(ctx)
+		requests = nil
+	}
+
+	for _, record := range accepted {
+		record.Partition = ""
+		if c.partitioned {
+			_, network, _ := parseCIDR(record.CIDR)
+			record.Partition = c.partitionFor(network)
+		}
+
+		item, err := attributevalue.MarshalMap(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		requests = append(requests, types.WriteRequest{
+			PutRequest: &types.PutRequest{Item: item},
+		})
+	}
+	if err := c.batchWrite(ctx, requests); err != nil {
+		return nil, fmt.Errorf("failed to write restored records: %w", err)
+	}
+	c.countAdded(ctx, len(accepted))
+	c.markChanged(ctx)
+
+	result.Restored = len(accepted)
+	return result, nil
+}
+
+// planRestore validates incoming records against existing ones and each
+// other, returning those to write. Records are checked largest block first, so
+// a block registered before the allocations inside it is accepted regardless
+// of its position in the backup. Reservations that have already expired are
+// skipped rather than restored.
+func planRestore(existing, incoming []CIDRRecord, now time.Time) (accepted []CIDRRecord, skipped int, conflicts []RestoreConflict) {
+	service := &CIDRService{}
+	against := withoutExpired(existing, now)
+	conflicts = []RestoreConflict{}
+
+	ordered := make([]CIDRRecord, len(incoming))
+	copy(ordered, incoming)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return recordPrefix(ordered[i]) < recordPrefix(ordered[j])
+	})
+
+	for _, record := range ordered {
+		if isExpired(record, now) {
+			skipped++
+			continue
+		}
+
+		err := func() error {
+			if record.Key == "" {
+				return fmt.Errorf("key is required")
+			}
+			if err := service.validateCIDR(record.CIDR); err != nil {
+				return err
+			}
+			if err := service.validateDescription(record.Description); err != nil {
+				return err
+			}
+			return checkUniqueness(against, record)
+		}()
+		if err != nil {
+			conflicts = append(conflicts, RestoreConflict{
+				Key:     record.Key,
+				CIDR:    record.CIDR,
+				Message: err.Error(),
+			})
+			continue
+		}
+
+		accepted = append(accepted, record)
+		against = append(against, record)
+	}
+
+	return accepted, skipped, conflicts
+}
+
+// recordPrefix is the prefix length of the record's CIDR, or -1 if it does not
+// parse.
+func recordPrefix(record CIDRRecord) int {
+	_, network, err := parseCIDR(record.CIDR)
+	if err != nil {
+		return -1
+	}
+	prefix, _ := network.Mask.Size()
+	return prefix
+}
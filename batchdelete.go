@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchDeleteKeys caps the keys of one POST /delete-batch request.
+const maxBatchDeleteKeys = 100
+
+// Outcomes of deleting one key of a batch.
+const (
+	batchDeleteDeleted  = "deleted"
+	batchDeleteNotFound = "not-found"
+	batchDeleteFailed   = "failed"
+)
+
+// batchDeleteRequest is the body of POST /delete-batch.
+type batchDeleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+func (r batchDeleteRequest) validate() fieldErrors {
+	if len(r.Keys) == 0 {
+		return fieldErrors{"keys": "required"}
+	}
+	if len(r.Keys) > maxBatchDeleteKeys {
+		return fieldErrors{"keys": fmt.Sprintf("must list at most %d keys", maxBatchDeleteKeys)}
+	}
+
+	errs := fieldErrors{}
+	seen := make(map[string]int, len(r.Keys))
+	for i, key := range r.Keys {
+		if key == "" {
+			errs[fmt.Sprintf("keys[%d]", i)] = "required"
+			continue
+		}
+		if first, ok := seen[key]; ok {
+			errs[fmt.Sprintf("keys[%d]", i)] = fmt.Sprintf("duplicate of keys[%d]", first)
+			continue
+		}
+		seen[key] = i
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// BatchDeleteResult is the outcome of deleting one key of a batch. CIDR is
+// the block the key held, and Error says why a failed delete failed.
+type BatchDeleteResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	CIDR   string `json:"cidr,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DeleteBatch deletes the records stored under keys with BatchWriteItem, in
+// chunks of 25, and returns one result per key in request order. Keys are
+// looked up in a single scan; a missing key is reported as not found rather
+// than failing the batch, and a chunk DynamoDB rejects is reported as failed
+// while the other chunks still go ahead. Children of the deleted blocks are
+// left alone, as for DELETE without cascade.
+func (c *CIDRService) DeleteBatch(ctx context.Context, keys []string) ([]BatchDeleteResult, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	byKey := make(map[string]CIDRRecord, len(records))
+	for _, record := range records {
+		byKey[record.Key] = record
+	}
+
+	results := make([]BatchDeleteResult, len(keys))
+	var found []int
+	for i, key := range keys {
+		results[i] = BatchDeleteResult{Key: key, Status: batchDeleteNotFound}
+		if record, ok := byKey[key]; ok {
+			results[i].CIDR = record.CIDR
+			found = append(found, i)
+		}
+	}
+
+	for start := 0; start < len(found); start += batchWriteLimit {
+		chunk := found[start:min(start+batchWriteLimit, len(found))]
+		requests := make([]types.WriteRequest, len(chunk))
+		for j, i := range chunk {
+			requests[j] = types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: c.itemKey(byKey[keys[i]])},
+			}
+		}
+
+		err := c.batchWrite(ctx, requests)
+		var removed []CIDRRecord
+		for _, i := range chunk {
+			if err != nil {
+				results[i].Status = batchDeleteFailed
+				results[i].Error = err.Error()
+				continue
+			}
+			results[i].Status = batchDeleteDeleted
+			removed = append(removed, byKey[keys[i]])
+		}
+		c.release(ctx, removed)
+	}
+
+	return results, nil
+}
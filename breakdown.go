@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StatusBreakdown is the result of GET /status-breakdown: every unexpired
+// record in exactly one of three groups. Held records are temporary, either
+// pending approval or carrying an expiresAt, whatever else they are; reserved
+// records are permanent reservations grouping other blocks; active records
+// are the remaining, permanent allocations.
+type StatusBreakdown struct {
+	Active   []CIDRRecord         `json:"active"`
+	Reserved []CIDRRecord         `json:"reserved"`
+	Held     []CIDRRecord         `json:"held"`
+	Counts   StatusBreakdownCount `json:"counts"`
+}
+
+// StatusBreakdownCount is the size of each group of a StatusBreakdown.
+type StatusBreakdownCount struct {
+	Active   int `json:"active"`
+	Reserved int `json:"reserved"`
+	Held     int `json:"held"`
+}
+
+// StatusBreakdown groups the registry's unexpired records into active,
+// reserved and held.
+func (c *CIDRService) StatusBreakdown(ctx context.Context) (*StatusBreakdown, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	now := time.Now()
+	return statusBreakdown(withAges(withoutExpired(records, now), now)), nil
+}
+
+func statusBreakdown(records []CIDRRecord) *StatusBreakdown {
+	breakdown := &StatusBreakdown{Active: []CIDRRecord{}, Reserved: []CIDRRecord{}, Held: []CIDRRecord{}}
+	for _, record := range records {
+		switch {
+		case record.Status == recordStatusPending || record.ExpiresAt != 0:
+			breakdown.Held = append(breakdown.Held, record)
+		case record.Reserved:
+			breakdown.Reserved = append(breakdown.Reserved, record)
+		default:
+			breakdown.Active = append(breakdown.Active, record)
+		}
+	}
+	breakdown.Counts = StatusBreakdownCount{
+		Active:   len(breakdown.Active),
+		Reserved: len(breakdown.Reserved),
+		Held:     len(breakdown.Held),
+	}
+	return breakdown
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Each records table holds one change marker, a meta item every write stamps
+// with its time, so that listings can date deletions too. Scans of records
+// leave out items with the marker attribute, and its key is reserved.
+const (
+	changeMarkerKey       = "cidrfinder:last-change"
+	changeMarkerAttribute = "lastChange"
+)
+
+// parseCacheMaxAge reads CACHE_MAX_AGE, how long clients may reuse a GET
+// response without revalidating it. It defaults to zero.
+func parseCacheMaxAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge < 0 {
+		return 0, fmt.Errorf("CACHE_MAX_AGE must be a duration such as 30s, got %q", value)
+	}
+	return maxAge, nil
+}
+
+// cacheControl is the Cache-Control value of cacheable GET responses. With no
+// max-age clients may keep a response but must revalidate it before reuse.
+func cacheControl(maxAge time.Duration) string {
+	if seconds := int64(maxAge / time.Second); seconds > 0 {
+		return fmt.Sprintf("max-age=%d", seconds)
+	}
+	return "no-cache"
+}
+
+// recordModified is when a record last changed, in Unix seconds, or zero for
+// records written before createdAt was introduced.
+func recordModified(record CIDRRecord) int64 {
+	return max(record.UpdatedAt, record.CreatedAt)
+}
+
+// changeMarkerItemKey is the primary key of the change marker. In a
+// partitioned table it has a partition of its own and no key attribute, so
+// neither base queries nor the key index see it.
+func (c *CIDRService) changeMarkerItemKey() map[string]types.AttributeValue {
+	if !c.partitioned {
+		return map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: changeMarkerKey},
+		}
+	}
+	return map[string]types.AttributeValue{
+		"partition": &types.AttributeValueMemberS{Value: changeMarkerKey},
+		"cidr":      &types.AttributeValueMemberS{Value: changeMarkerKey},
+	}
+}
+
+// markChanged stamps the change marker of the request's table with the
+// current time. The marker never moves back, so an instance with a slow
+// clock cannot hide a later change, and each instance stamps a table at most
+// once a second, the resolution of Last-Modified. The change itself has
+// already been written, so a failure is logged rather than returned.
+func (c *CIDRService) markChanged(ctx context.Context) {
+	now := time.Now().Unix()
+	table := c.table(ctx)
+	if last, ok := c.changeMarks.Load(table); ok && last.(int64) >= now {
+		return
+	}
+
+	_, err := c.client(ctx).UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(table),
+		Key:                      c.changeMarkerItemKey(),
+		UpdateExpression:         aws.String("SET #m = :now"),
+		ConditionExpression:      aws.String("attribute_not_exists(#m) OR #m < :now"),
+		ExpressionAttributeNames: map[string]string{"#m": changeMarkerAttribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionErr) {
+		logf(ctx, "failed to stamp the change marker: %v", err)
+		return
+	}
+	c.changeMarks.Store(table, now)
+}
+
+// lastChanged reads the change marker of the request's table, in Unix
+// seconds. It is zero when nothing has stamped the marker yet or it cannot
+// be read, which is logged.
+func (c *CIDRService) lastChanged(ctx context.Context) int64 {
+	result, err := c.client(ctx).GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(c.table(ctx)),
+		Key:            c.changeMarkerItemKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		logf(ctx, "failed to read the change marker: %v", err)
+		return 0
+	}
+	marker, ok := result.Item[changeMarkerAttribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	changed, err := strconv.ParseInt(marker.Value, 10, 64)
+	if err != nil {
+		logf(ctx, "change marker %q is not a time: %v", marker.Value, err)
+		return 0
+	}
+	return changed
+}
+
+// listModified is when the listing of records last changed: the latest of
+// the change marker, the records' own changes and the expiries that have
+// passed. Without a marker deletions cannot be dated, so it is zero. Read the
+// marker before the records, so a write racing the scan can only make the
+// result too old, never too new.
+func listModified(changed int64, records []CIDRRecord, now time.Time) int64 {
+	if changed == 0 {
+		return 0
+	}
+	modified := changed
+	for _, record := range records {
+		modified = max(modified, recordModified(record))
+		if record.ExpiresAt != 0 && record.ExpiresAt <= now.Unix() {
+			modified = max(modified, record.ExpiresAt)
+		}
+	}
+	return modified
+}
+
+// cacheHeaders returns the caching headers of a GET response last modified at
+// modified. Last-Modified is left out when modified is unknown.
+func (c *CIDRService) cacheHeaders(modified int64) map[string]string {
+	headers := map[string]string{"Cache-Control": cacheControl(c.cacheMaxAge)}
+	if modified > 0 {
+		headers["Last-Modified"] = time.Unix(modified, 0).UTC().Format(http.TimeFormat)
+	}
+	return headers
+}
+
+// notModified reports whether a response last modified at modified is
+// unchanged since an If-Modified-Since header, so a 304 may be sent instead.
+func notModified(ifModifiedSince string, modified int64) bool {
+	if ifModifiedSince == "" || modified == 0 {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	return err == nil && modified <= since.Unix()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Capacity statuses, from least to most urgent.
+const (
+	capacityStatusOK       = "ok"
+	capacityStatusWarning  = "warning"
+	capacityStatusCritical = "critical"
+)
+
+const (
+	defaultWarnAt = 80
+	defaultCritAt = 90
+)
+
+// capacityThresholds are the utilization percentages, WARN_AT and CRIT_AT, at
+// which GET /capacity reports a pool as warning or critical.
+type capacityThresholds struct {
+	warnAt float64
+	critAt float64
+}
+
+// parseCapacityThresholds parses WARN_AT and CRIT_AT, percentages such as
+// "80" or "80%". The warning threshold must be below the critical one.
+func parseCapacityThresholds(warnValue, critValue string) (capacityThresholds, error) {
+	thresholds := capacityThresholds{warnAt: defaultWarnAt, critAt: defaultCritAt}
+	for name, value := range map[string]string{"WARN_AT": warnValue, "CRIT_AT": critValue} {
+		if value == "" {
+			continue
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return capacityThresholds{}, fmt.Errorf("%s must be a percentage above 0 and at most 100, got %q", name, value)
+		}
+		if name == "WARN_AT" {
+			thresholds.warnAt = percent
+		} else {
+			thresholds.critAt = percent
+		}
+	}
+	if thresholds.warnAt >= thresholds.critAt {
+		return capacityThresholds{}, fmt.Errorf("WARN_AT (%g%%) must be below CRIT_AT (%g%%)", thresholds.warnAt, thresholds.critAt)
+	}
+	return thresholds, nil
+}
+
+// status classifies a utilization percentage. A pool with no block left is
+// critical whatever its utilization.
+func (t capacityThresholds) status(utilization float64, remaining uint64) string {
+	switch {
+	case remaining == 0 || utilization >= t.critAt:
+		return capacityStatusCritical
+	case utilization >= t.warnAt:
+		return capacityStatusWarning
+	}
+	return capacityStatusOK
+}
+
+// PoolCapacity is how much of a pool is left, counted in blocks of the size
+// the pool allocates by default. NextFree is what GET /next would return for
+// the pool, or null when it would fail.
+type PoolCapacity struct {
+	Pool            string  `json:"pool,omitempty"`
+	Base            string  `json:"base"`
+	Prefix          int     `json:"prefix"`
+	RemainingBlocks uint64  `json:"remainingBlocks"`
+	Utilization     float64 `json:"utilization"`
+	Status          string  `json:"status"`
+	NextFree        *string `json:"nextFree"`
+}
+
+// SkippedTarget is a pool or base left out of a report because its default
+// allocation cannot be resolved, e.g. a pool whose prefix does not fit its
+// base.
+type SkippedTarget struct {
+	Pool  string `json:"pool,omitempty"`
+	Base  string `json:"base,omitempty"`
+	Error string `json:"error"`
+}
+
+// CapacityReport is the result of GET /capacity.
+type CapacityReport struct {
+	WarnAt  float64         `json:"warnAt"`
+	CritAt  float64         `json:"critAt"`
+	Pools   []PoolCapacity  `json:"pools"`
+	Skipped []SkippedTarget `json:"skipped,omitempty"`
+}
+
+// Capacity reports the remaining blocks of every pool or, without POOLS, of
+// every permitted base. Excluded and forbidden ranges count as used, since
+// nothing can be allocated there. Only IPv4 ranges are reported, as for
+// GET /stats.
+func (c *CIDRService) Capacity(ctx context.Context) (*CapacityReport, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	released, err := c.releasedNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.capacityOf(records, released), nil
+}
+
+// capacityTarget is an allocation GET /capacity reports on, resolved to the
+// base and prefix it allocates.
+type capacityTarget struct {
+	opts   AllocationOptions
+	base   *net.IPNet
+	prefix int
+}
+
+// capacityTargets are the allocations GET /capacity reports on: one per pool
+// or, without POOLS, one per permitted base. IPv6 ones are left out, and
+// those that cannot be resolved are returned as skipped, so that one
+// misconfigured pool does not hide the others.
+func (c *CIDRService) capacityTargets() (targets []capacityTarget, skipped []SkippedTarget) {
+	var candidates []AllocationOptions
+	for _, pool := range c.pools {
+		if pool.Base.IP.To4() != nil {
+			candidates = append(candidates, AllocationOptions{Pool: pool.Name})
+		}
+	}
+	if len(c.pools) == 0 {
+		for _, base := range c.permittedBases() {
+			if base.IP.To4() != nil {
+				candidates = append(candidates, AllocationOptions{Base: base.String()})
+			}
+		}
+	}
+
+	for _, opts := range candidates {
+		base, _, prefix, err := c.resolveAllocation(opts)
+		if err != nil {
+			skipped = append(skipped, SkippedTarget{Pool: opts.Pool, Base: opts.Base, Error: err.Error()})
+			continue
+		}
+		targets = append(targets, capacityTarget{opts: opts, base: base, prefix: prefix})
+	}
+	return targets, skipped
+}
+
+// capacityOf is Capacity for records and released blocks already read.
+func (c *CIDRService) capacityOf(records []CIDRRecord, released []*net.IPNet) *CapacityReport {
+	targets, skipped := c.capacityTargets()
+	report := &CapacityReport{WarnAt: c.capacity.warnAt, CritAt: c.capacity.critAt, Pools: []PoolCapacity{}, Skipped: skipped}
+	for _, target := range targets {
+		opts, base, prefix := target.opts, target.base, target.prefix
+		used := c.usedBy(records, opts)
+		capacity := PoolCapacity{Pool: opts.Pool, Base: base.String(), Prefix: prefix}
+		var free uint64
+		for _, r := range freeRanges(base, used) {
+			free += r.end - r.start
+			capacity.RemainingBlocks += alignedBlocks(r, prefix)
+		}
+		start, end, _ := ipv4Range(base)
+		capacity.Utilization = float64(end-start-free) / float64(end-start) * 100
+		capacity.Status = c.capacity.status(capacity.Utilization, capacity.RemainingBlocks)
+
+		if next, ok := c.nextFree(base, prefix, used, released, opts); ok && c.checkHeadroom(base, next, used) == nil {
+			cidr := next.String()
+			capacity.NextFree = &cidr
+		}
+		report.Pools = append(report.Pools, capacity)
+	}
+	return report
+}
+
+// alignedBlocks counts the prefix-sized blocks that fit in r on their own
+// boundaries.
+func alignedBlocks(r addrRange, prefix int) uint64 {
+	size := uint64(1) << uint(32-prefix)
+	first := (r.start + size - 1) / size * size
+	if first >= r.end {
+		return 0
+	}
+	return (r.end - first) / size
+}
@@ -2,27 +2,110 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
+// CIDRRecord is a registered block. Its xml tags match the elements of XML
+// responses, so clients can decode a record with encoding/xml.
 type CIDRRecord struct {
-	Key  string `json:"key" dynamodbav:"key"`
-	CIDR string `json:"cidr" dynamodbav:"cidr"`
+	Key         string `json:"key" xml:"key" dynamodbav:"key"`
+	CIDR        string `json:"cidr" xml:"cidr" dynamodbav:"cidr"`
+	Description string `json:"description,omitempty" xml:"description,omitempty" dynamodbav:"description,omitempty"`
+	Reserved    bool   `json:"reserved,omitempty" xml:"reserved,omitempty" dynamodbav:"reserved,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt,omitempty" xml:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"`
+	Pool        string `json:"pool,omitempty" xml:"pool,omitempty" dynamodbav:"pool,omitempty"`
+	Tenant      string `json:"tenant,omitempty" xml:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	Account     string `json:"account,omitempty" xml:"account,omitempty" dynamodbav:"account,omitempty"`
+	Region      string `json:"region,omitempty" xml:"region,omitempty" dynamodbav:"region,omitempty"`
+	// Tags are free-form labels. encoding/xml cannot decode maps, so they are
+	// left out of the struct's XML mapping.
+	Tags Tags `json:"tags,omitempty" xml:"-" dynamodbav:"tags,omitempty"`
+	// Status is "pending" for a block requested through POST /request and not
+	// yet approved, and empty once it is active.
+	Status string `json:"status,omitempty" xml:"status,omitempty" dynamodbav:"status,omitempty"`
+	// CreatedAt is when the block was first registered, in Unix seconds.
+	// Records written before it was introduced have none.
+	CreatedAt int64 `json:"createdAt,omitempty" xml:"createdAt,omitempty" dynamodbav:"createdAt,omitempty"`
+	// UpdatedAt is when the record was last written, in Unix seconds.
+	UpdatedAt int64 `json:"updatedAt,omitempty" xml:"updatedAt,omitempty" dynamodbav:"updatedAt,omitempty"`
+	// ActiveFrom and ActiveUntil bound a scheduled reservation, in Unix
+	// seconds. The block is held only in between.
+	ActiveFrom  int64 `json:"activeFrom,omitempty" xml:"activeFrom,omitempty" dynamodbav:"activeFrom,omitempty"`
+	ActiveUntil int64 `json:"activeUntil,omitempty" xml:"activeUntil,omitempty" dynamodbav:"activeUntil,omitempty"`
+	// AgeSeconds is computed from CreatedAt for GET responses and not stored.
+	AgeSeconds *int64 `json:"ageSeconds,omitempty" xml:"ageSeconds,omitempty" dynamodbav:"-"`
+	Partition  string `json:"-" xml:"-" dynamodbav:"partition,omitempty"`
 }
 
+// setAge fills in AgeSeconds when the record has a createdAt.
+func (r *CIDRRecord) setAge(now time.Time) {
+	if r.CreatedAt == 0 {
+		return
+	}
+	age := max(now.Unix()-r.CreatedAt, 0)
+	r.AgeSeconds = &age
+}
+
+const (
+	defaultBaseCIDR         = "10.0.0.0/8"
+	defaultAllocationPrefix = 16
+
+	maxDescriptionLength = 1024
+)
+
 type CIDRService struct {
-	dynamoClient *dynamodb.Client
-	tableName    string
+	awsConfig           aws.Config
+	dynamoClient        *dynamodb.Client
+	tableName           string
+	baseCIDR            string
+	allocationPrefix    int
+	allowedBases        []*net.IPNet
+	partitioned         bool
+	keyIndexName        string
+	auditTableName      string
+	pools               []Pool
+	uniquenessScope     string
+	allocationStrategy  string
+	allocationGap       int
+	scanSegments        int
+	syncEnabled         bool
+	syncTargets         []syncTarget
+	releasedTableName   string
+	headroom            headroom
+	notifier            notifier
+	notifications       sync.WaitGroup
+	statusDetail        string
+	healthCountInterval time.Duration
+	healthCount         healthCount
+	fallback            dynamoReader
+	forbidden           []*net.IPNet
+	cacheMaxAge         time.Duration
+	capacity            capacityThresholds
+	requireParent       string
+	requiredTags        []string
+	allowedTagKeys      map[string]bool
+	lockTableName       string
+	tables              map[string]recordTable
+	maxRecords          int
+	overflow            *net.IPNet
+	recordCounts        recordCounts
+	changeMarks         sync.Map
 }
 
 func NewCIDRService(ctx context.Context) (*CIDRService, error) {
@@ -31,36 +114,309 @@ func NewCIDRService(ctx context.Context) (*CIDRService, error) {
 		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
 	}
 
+	roleSettings, err := assumeRoleSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg = withAssumedRole(cfg, roleSettings, sts.NewFromConfig(cfg))
+
 	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
 	if tableName == "" {
 		return nil, fmt.Errorf("DYNAMODB_TABLE_NAME environment variable is required")
 	}
 
+	layout := os.Getenv("TABLE_LAYOUT")
+	if layout == "" {
+		layout = tableLayoutKey
+	}
+	if layout != tableLayoutKey && layout != tableLayoutPartitioned {
+		return nil, fmt.Errorf("TABLE_LAYOUT must be %q or %q, got %q", tableLayoutKey, tableLayoutPartitioned, layout)
+	}
+
+	keyIndexName := os.Getenv("KEY_INDEX_NAME")
+	if keyIndexName == "" {
+		keyIndexName = defaultKeyIndexName
+	}
+
+	baseCIDR := os.Getenv("BASE_CIDR")
+	if baseCIDR == "" {
+		baseCIDR = defaultBaseCIDR
+	}
+
+	allocationPrefix := defaultAllocationPrefix
+	if value := os.Getenv("ALLOCATION_PREFIX"); value != "" {
+		allocationPrefix, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("ALLOCATION_PREFIX must be an integer, got %q", value)
+		}
+	}
+
+	var allowedBases []*net.IPNet
+	for _, value := range strings.Split(os.Getenv("ALLOWED_BASES"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		_, allowed, err := parseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALLOWED_BASES entry %q: %w", value, err)
+		}
+		allowedBases = append(allowedBases, allowed)
+	}
+
+	if err := validateAllocationConfig(baseCIDR, allocationPrefix); err != nil {
+		return nil, err
+	}
+
+	// The overflow is a permitted base of its own, so its records are
+	// partitioned, reported and checked like those of ALLOWED_BASES.
+	overflow, err := parseOverflowCIDR(os.Getenv("OVERFLOW_CIDR"), baseCIDR, allocationPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if overflow != nil {
+		covered := false
+		for _, allowed := range allowedBases {
+			covered = covered || netContains(allowed, overflow)
+		}
+		if !covered {
+			allowedBases = append(allowedBases, overflow)
+		}
+	}
+
+	pools, err := loadPools(os.Getenv("POLICY_FILE"), os.Getenv("POOLS"))
+	if err != nil {
+		return nil, err
+	}
+	_, base, _ := parseCIDR(baseCIDR)
+	if err := validatePoolLayout(pools, append([]*net.IPNet{base}, allowedBases...)); err != nil {
+		return nil, err
+	}
+
+	uniquenessScope, err := parseUniquenessScope(os.Getenv("UNIQUENESS_SCOPE"), layout == tableLayoutPartitioned)
+	if err != nil {
+		return nil, err
+	}
+
+	allocationStrategy, err := parseAllocationStrategy(os.Getenv("ALLOCATION_STRATEGY"))
+	if err != nil {
+		return nil, err
+	}
+
+	allocationGap := 0
+	if value := os.Getenv("ALLOCATION_GAP"); value != "" {
+		allocationGap, err = strconv.Atoi(value)
+		if err != nil || allocationGap < 0 {
+			return nil, fmt.Errorf("ALLOCATION_GAP must be a non-negative integer, got %q", value)
+		}
+	}
+
+	scanSegments, err := parseScanSegments(os.Getenv("SCAN_SEGMENTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	syncTargets, err := parseSyncTargets(os.Getenv("SYNC_AWS_TARGETS"))
+	if err != nil {
+		return nil, err
+	}
+
+	headroom, err := parseHeadroom(os.Getenv("RESERVE_HEADROOM"))
+	if err != nil {
+		return nil, err
+	}
+
+	releasedTableName, err := parseReleasedTable(os.Getenv("RECYCLE_RELEASED"), os.Getenv("RELEASED_TABLE_NAME"))
+	if err != nil {
+		return nil, err
+	}
+
+	notifier, err := loadNotifier()
+	if err != nil {
+		return nil, err
+	}
+
+	forbidden, err := parseForbiddenCIDRs(os.Getenv("FORBIDDEN_CIDRS"))
+	if err != nil {
+		return nil, err
+	}
+
+	statusDetail, err := parseStatusDetail(os.Getenv("STATUS_DETAIL"))
+	if err != nil {
+		return nil, err
+	}
+
+	healthCountInterval, err := parseHealthCountInterval(os.Getenv("HEALTH_COUNT_INTERVAL"))
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMaxAge, err := parseCacheMaxAge(os.Getenv("CACHE_MAX_AGE"))
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := parseCapacityThresholds(os.Getenv("WARN_AT"), os.Getenv("CRIT_AT"))
+	if err != nil {
+		return nil, err
+	}
+
+	requireParent, err := parseRequireParent("REQUIRE_PARENT", os.Getenv("REQUIRE_PARENT"))
+	if err != nil {
+		return nil, err
+	}
+
+	requiredTags, err := parseRequiredTags(os.Getenv("REQUIRED_TAGS"))
+	if err != nil {
+		return nil, err
+	}
+	allowedTagKeys, err := parseAllowedTagKeys(os.Getenv("ALLOWED_TAG_KEYS"), requiredTags)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRecords, err := parseMaxRecords(os.Getenv("MAX_RECORDS"))
+	if err != nil {
+		return nil, err
+	}
+
+	tableRoutes, err := parseTableRoutes(os.Getenv("TABLE_ROUTES"))
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range tableRoutes {
+		if route.Scope != tableRoutePool {
+			continue
+		}
+		if _, err := (&CIDRService{pools: pools}).pool(route.Value); err != nil {
+			return nil, fmt.Errorf("invalid TABLE_ROUTES: %w", err)
+		}
+	}
+
+	// DYNAMODB_ENDPOINT points the client at DynamoDB Local for development
+	// and the integration tests.
+	var dynamoOptions []func(*dynamodb.Options)
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		dynamoOptions = append(dynamoOptions, func(o *dynamodb.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+		})
+	}
+	dynamoClient := dynamodb.NewFromConfig(cfg, dynamoOptions...)
+
 	return &CIDRService{
-		dynamoClient: dynamodb.NewFromConfig(cfg),
-		tableName:    tableName,
+		awsConfig:           cfg,
+		dynamoClient:        dynamoClient,
+		tableName:           tableName,
+		baseCIDR:            baseCIDR,
+		allocationPrefix:    allocationPrefix,
+		allowedBases:        allowedBases,
+		partitioned:         layout == tableLayoutPartitioned,
+		keyIndexName:        keyIndexName,
+		auditTableName:      os.Getenv("AUDIT_TABLE_NAME"),
+		lockTableName:       os.Getenv("LOCK_TABLE_NAME"),
+		tables:              routedTables(cfg, tableRoutes, dynamoClient, dynamoOptions),
+		pools:               pools,
+		uniquenessScope:     uniquenessScope,
+		allocationStrategy:  allocationStrategy,
+		allocationGap:       allocationGap,
+		scanSegments:        scanSegments,
+		syncEnabled:         os.Getenv("SYNC_AWS_ENABLED") == "true",
+		syncTargets:         syncTargets,
+		releasedTableName:   releasedTableName,
+		headroom:            headroom,
+		notifier:            notifier,
+		statusDetail:        statusDetail,
+		healthCountInterval: healthCountInterval,
+		fallback:            fallbackClient(cfg),
+		forbidden:           forbidden,
+		cacheMaxAge:         cacheMaxAge,
+		capacity:            capacity,
+		requireParent:       requireParent,
+		requiredTags:        requiredTags,
+		allowedTagKeys:      allowedTagKeys,
+		maxRecords:          maxRecords,
+		overflow:            overflow,
 	}, nil
 }
 
-func (c *CIDRService) GetAllCIDRs(ctx context.Context) ([]CIDRRecord, error) {
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(c.tableName),
+// validateAllocationConfig checks BASE_CIDR and ALLOCATION_PREFIX up front so
+// a misconfiguration fails at startup instead of on the first allocation.
+func validateAllocationConfig(baseCIDR string, allocationPrefix int) error {
+	_, base, err := parseCIDR(baseCIDR)
+	if err != nil {
+		return fmt.Errorf("BASE_CIDR %q is not a valid CIDR: %w", baseCIDR, err)
+	}
+
+	basePrefix, bits := base.Mask.Size()
+	if bits != 32 {
+		return fmt.Errorf("BASE_CIDR %q must be an IPv4 network", baseCIDR)
+	}
+	if err := checkPrefixLength(allocationPrefix, maxIPv4Prefix); err != nil {
+		return fmt.Errorf("ALLOCATION_PREFIX %w", err)
+	}
+	if allocationPrefix < basePrefix {
+		return fmt.Errorf("ALLOCATION_PREFIX must be between /%d (the BASE_CIDR prefix) and /32, got /%d",
+			basePrefix, allocationPrefix)
+	}
+
+	return nil
+}
+
+var (
+	sharedServiceMu sync.Mutex
+	sharedService   *CIDRService
+)
+
+// getCIDRService returns a process-wide CIDRService, creating it on first use
+// so the AWS config and DynamoDB client are reused across requests and warm
+// Lambda invocations. A failed initialization is retried on the next call.
+func getCIDRService(ctx context.Context) (*CIDRService, error) {
+	sharedServiceMu.Lock()
+	defer sharedServiceMu.Unlock()
+
+	if sharedService != nil {
+		return sharedService, nil
 	}
 
-	result, err := c.dynamoClient.Scan(ctx, input)
+	service, err := NewCIDRService(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan DynamoDB table: %w", err)
+		return nil, err
 	}
+	sharedService = service
+
+	return sharedService, nil
+}
+
+func (c *CIDRService) GetAllCIDRs(ctx context.Context) ([]CIDRRecord, error) {
+	return readWithFallback(ctx, c, func(client dynamoReader) ([]CIDRRecord, error) {
+		return c.scanRecords(ctx, client, false)
+	})
+}
 
+// scanRecords reads every record from client, sorted by key. A consistent
+// scan reflects every write that succeeded before it started.
+func (c *CIDRService) scanRecords(ctx context.Context, client dynamoReader, consistent bool) ([]CIDRRecord, error) {
 	var records []CIDRRecord
-	for _, item := range result.Items {
-		var record CIDRRecord
-		if err := attributevalue.UnmarshalMap(item, &record); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal DynamoDB item: %w", err)
+	err := c.scanPages(ctx, client, &dynamodb.ScanInput{
+		TableName:                aws.String(c.table(ctx)),
+		ConsistentRead:           aws.Bool(consistent),
+		FilterExpression:         aws.String("attribute_not_exists(#m)"),
+		ExpressionAttributeNames: map[string]string{"#m": changeMarkerAttribute},
+	}, func(page *dynamodb.ScanOutput) error {
+		for _, item := range page.Items {
+			var record CIDRRecord
+			if err := attributevalue.UnmarshalMap(item, &record); err != nil {
+				return fmt.Errorf("failed to unmarshal DynamoDB item: %w", err)
+			}
+			records = append(records, record)
 		}
-		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan DynamoDB table: %w", err)
 	}
 
+	// Segments return pages in no particular order, so this sort is what
+	// makes the result deterministic.
 	sort.Slice(records, func(i, j int) bool {
 		return records[i].Key < records[j].Key
 	})
@@ -68,99 +424,415 @@ func (c *CIDRService) GetAllCIDRs(ctx context.Context) ([]CIDRRecord, error) {
 	return records, nil
 }
 
-func (c *CIDRService) RegisterCIDR(ctx context.Context, key, cidr string) error {
-	if err := c.validateCIDR(cidr); err != nil {
-		return fmt.Errorf("invalid CIDR: %w", err)
+// CountCIDRs returns the number of records without reading them, using a
+// Scan with Select COUNT across every page.
+func (c *CIDRService) CountCIDRs(ctx context.Context) (int, error) {
+	count := 0
+	err := c.scanPages(ctx, c.client(ctx), &dynamodb.ScanInput{
+		TableName:                aws.String(c.table(ctx)),
+		Select:                   types.SelectCount,
+		FilterExpression:         aws.String("attribute_not_exists(#m)"),
+		ExpressionAttributeNames: map[string]string{"#m": changeMarkerAttribute},
+	}, func(page *dynamodb.ScanOutput) error {
+		count += int(page.Count)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count DynamoDB items: %w", err)
 	}
 
-	if err := c.validateUniqueness(ctx, key, cidr); err != nil {
-		return err
+	return count, nil
+}
+
+// ListKeys returns every record key in order. The scan projects only the key
+// attribute, so it reads and returns far less than GetAllCIDRs.
+func (c *CIDRService) ListKeys(ctx context.Context) ([]string, error) {
+	keys := []string{}
+	err := c.scanPages(ctx, c.client(ctx), &dynamodb.ScanInput{
+		TableName:                aws.String(c.table(ctx)),
+		ProjectionExpression:     aws.String("#k"),
+		FilterExpression:         aws.String("attribute_not_exists(#m)"),
+		ExpressionAttributeNames: map[string]string{"#k": "key", "#m": changeMarkerAttribute},
+	}, func(page *dynamodb.ScanOutput) error {
+		for _, item := range page.Items {
+			if key, ok := item["key"].(*types.AttributeValueMemberS); ok {
+				keys = append(keys, key.Value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan DynamoDB table: %w", err)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// RegisterCIDR registers a caller-chosen block. The parent requirement is the
+// stricter of REQUIRE_PARENT and opts.RequireParent.
+func (c *CIDRService) RegisterCIDR(ctx context.Context, record CIDRRecord, opts RegistrationOptions) (*CIDRRecord, error) {
+	stored, _, err := c.registerCIDR(ctx, record, nil, auditActionRegister, stricterParentRequirement(c.requireParent, opts.RequireParent))
+	return stored, err
+}
+
+// registerCIDR validates and stores record, auditing the write as action when
+// an audit table is configured. serviceTags, the systemTags the service sets
+// itself, are added once the caller's tags have been checked. It returns the
+// record as written, with its audit entry when one was stored. PutItem cannot
+// return the new item, so this is the record the item was marshalled from
+// rather than a read-back.
+func (c *CIDRService) registerCIDR(ctx context.Context, record CIDRRecord, serviceTags Tags, action, requireParent string) (*CIDRRecord, *AuditEntry, error) {
+	record.CIDR = unmapCIDR(record.CIDR)
+	if err := c.validateCIDR(record.CIDR); err != nil {
+		return nil, nil, fmt.Errorf("invalid CIDR: %w", err)
+	}
+
+	if err := c.validateDescription(record.Description); err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.checkTags(record, nil); err != nil {
+		return nil, nil, err
+	}
+	if len(serviceTags) > 0 {
+		tags := make(Tags, len(record.Tags)+len(serviceTags))
+		for key, value := range record.Tags {
+			tags[key] = value
+		}
+		for key, value := range serviceTags {
+			tags[key] = value
+		}
+		record.Tags = tags
+	}
+
+	if err := c.validatePoolMembership(record); err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkForbidden(c.forbidden, record.CIDR); err != nil {
+		return nil, nil, err
 	}
 
-	record := CIDRRecord{
-		Key:  key,
-		CIDR: cidr,
+	if err := applyActiveWindow(&record, time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	if record.ExpiresAt != 0 && record.ExpiresAt <= time.Now().Unix() {
+		return nil, nil, fmt.Errorf("expiresAt must be in the future")
+	}
+
+	if err := c.validateUniqueness(ctx, record, requireParent); err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.checkRecordLimit(ctx, 1); err != nil {
+		return nil, nil, err
+	}
+
+	// A registration is a new record whatever the caller sent, so it is
+	// always dated here.
+	now := time.Now().Unix()
+	record.CreatedAt, record.UpdatedAt = now, now
+
+	record.Partition = ""
+	if c.partitioned {
+		_, network, _ := parseCIDR(record.CIDR)
+		record.Partition = c.partitionFor(network)
 	}
 
 	item, err := attributevalue.MarshalMap(record)
 	if err != nil {
-		return fmt.Errorf("failed to marshal record: %w", err)
+		return nil, nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	var entry *AuditEntry
+	if c.auditTableName != "" {
+		audit := newAuditEntry(action, record, time.Now())
+		entry = &audit
+		err = c.putWithAudit(ctx, item, audit)
+	} else {
+		err = c.putRecord(ctx, item, record)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.confirmWrite(ctx, record, entry); err != nil {
+		return nil, nil, err
 	}
+	c.countAdded(ctx, 1)
+
+	c.notifyRecord(ctx, action, record)
+	return &record, entry, nil
+}
 
+// putRecord writes a record item, conditional on its primary key being free.
+// With the key layout an expired reservation may be overwritten, as the
+// uniqueness check allows; partitioned tables key items by CIDR, so a
+// duplicate would otherwise overwrite another record.
+func (c *CIDRService) putRecord(ctx context.Context, item map[string]types.AttributeValue, record CIDRRecord) error {
 	input := &dynamodb.PutItemInput{
-		TableName: aws.String(c.tableName),
+		TableName: aws.String(c.table(ctx)),
 		Item:      item,
 	}
 
-	_, err = c.dynamoClient.PutItem(ctx, input)
+	if c.partitioned {
+		input.ConditionExpression = aws.String("attribute_not_exists(#c)")
+		input.ExpressionAttributeNames = map[string]string{"#c": "cidr"}
+	} else {
+		input.ConditionExpression = aws.String("attribute_not_exists(#k) OR #e <= :now")
+		input.ExpressionAttributeNames = map[string]string{"#k": "key", "#e": "expiresAt"}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+		}
+	}
+
+	_, err := c.client(ctx).PutItem(ctx, input)
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return fmt.Errorf("key '%s' or CIDR '%s' %w", record.Key, record.CIDR, errWriteConflict)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to put item in DynamoDB: %w", err)
 	}
-
 	return nil
 }
 
-func (c *CIDRService) DeleteCIDR(ctx context.Context, key string) error {
-	input := &dynamodb.DeleteItemInput{
-		TableName: aws.String(c.tableName),
-		Key: map[string]types.AttributeValue{
-			"key": &types.AttributeValueMemberS{Value: key},
-		},
+// DeleteResult lists the records a delete removed and, without cascade, the
+// registered children of the deleted block that were left behind.
+type DeleteResult struct {
+	Removed  []CIDRRecord `json:"removed"`
+	Orphaned []CIDRRecord `json:"orphaned"`
+}
+
+// DeleteCIDR deletes the record stored under key. With cascade, every record
+// registered inside its block is deleted too. Deleting a missing key is not an
+// error.
+func (c *CIDRService) DeleteCIDR(ctx context.Context, key string, cascade bool) (*DeleteResult, error) {
+	result := &DeleteResult{Removed: []CIDRRecord{}, Orphaned: []CIDRRecord{}}
+
+	record, err := c.GetRecord(ctx, key)
+	if errors.Is(err, errRecordNotFound) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	_, err := c.dynamoClient.DeleteItem(ctx, input)
+	records, err := c.GetAllCIDRs(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to delete item from DynamoDB: %w", err)
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
 	}
 
-	return nil
+	var children []CIDRRecord
+	if _, network, err := parseCIDR(record.CIDR); err == nil {
+		children = containedRecords(inScope(records, *record, c.uniquenessScope), network)
+	}
+
+	if !cascade {
+		_, err = c.client(ctx).DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(c.table(ctx)),
+			Key:       c.itemKey(*record),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete item from DynamoDB: %w", err)
+		}
+
+		result.Removed = append(result.Removed, *record)
+		result.Orphaned = append(result.Orphaned, children...)
+		c.release(ctx, result.Removed)
+		return result, nil
+	}
+
+	removed := append([]CIDRRecord{*record}, children...)
+	requests := make([]types.WriteRequest, len(removed))
+	for i, r := range removed {
+		requests[i] = types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{Key: c.itemKey(r)},
+		}
+	}
+	if err := c.batchWrite(ctx, requests); err != nil {
+		return nil, err
+	}
+
+	result.Removed = removed
+	c.release(ctx, removed)
+	return result, nil
+}
+
+// release sends a delete event for each deleted record, takes them off the
+// MAX_RECORDS count and, when RECYCLE_RELEASED is on, records their blocks
+// for reuse. The records are already gone, so a failure is logged rather than
+// returned.
+func (c *CIDRService) release(ctx context.Context, removed []CIDRRecord) {
+	c.countAdded(ctx, -len(removed))
+	for _, record := range removed {
+		c.notifyRecord(ctx, changeActionDelete, record)
+	}
+	if c.releasedTableName == "" {
+		return
+	}
+	if err := c.recordReleased(ctx, removed, time.Now()); err != nil {
+		logf(ctx, "failed to record released blocks: %v", err)
+	}
+}
+
+type CIDRDescription struct {
+	CIDR       string          `json:"cidr"`
+	Registered bool            `json:"registered"`
+	Record     *CIDRRecord     `json:"record,omitempty"`
+	Parent     *CIDRRecord     `json:"parent,omitempty"`
+	Children   []CIDRRecord    `json:"children"`
+	Siblings   []CIDRRecord    `json:"siblings"`
+	Details    *NetworkDetails `json:"details,omitempty"`
 }
 
-func (c *CIDRService) GetNextAvailableCIDR(ctx context.Context) (string, error) {
+func (c *CIDRService) DescribeCIDR(ctx context.Context, cidr string) (*CIDRDescription, error) {
+	_, network, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR format: %w", err)
+	}
+
 	records, err := c.GetAllCIDRs(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get existing CIDRs: %w", err)
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
 	}
 
-	usedCIDRs := make(map[string]bool)
+	return describeCIDR(records, network), nil
+}
+
+// describeCIDR places every registered record relative to network: the
+// narrowest record containing it is the parent, records inside it are
+// children, and records that border it without overlapping are siblings.
+func describeCIDR(records []CIDRRecord, network *net.IPNet) *CIDRDescription {
+	desc := &CIDRDescription{
+		CIDR:     network.String(),
+		Children: []CIDRRecord{},
+		Siblings: []CIDRRecord{},
+		Details:  networkDetails(network),
+	}
+
+	prefix, _ := network.Mask.Size()
+	parentPrefix := -1
+
 	for _, record := range records {
-		if strings.HasPrefix(record.CIDR, "10.") {
-			usedCIDRs[record.CIDR] = true
+		_, recordNet, err := parseCIDR(record.CIDR)
+		if err != nil {
+			continue
 		}
-	}
+		recordPrefix, _ := recordNet.Mask.Size()
 
-	for i := 0; i <= 255; i++ {
-		cidr := fmt.Sprintf("10.%d.0.0/16", i)
-		if !usedCIDRs[cidr] {
-			return cidr, nil
+		switch {
+		case recordPrefix == prefix && netContains(recordNet, network):
+			r := record
+			desc.Registered = true
+			desc.Record = &r
+		case netContains(recordNet, network):
+			if recordPrefix > parentPrefix {
+				r := record
+				desc.Parent = &r
+				parentPrefix = recordPrefix
+			}
+		case netContains(network, recordNet):
+			desc.Children = append(desc.Children, record)
+		case netsAdjacent(network, recordNet):
+			desc.Siblings = append(desc.Siblings, record)
 		}
 	}
 
-	return "", fmt.Errorf("no available 10.x.0.0/16 CIDRs remaining")
+	return desc
 }
 
 func (c *CIDRService) validateCIDR(cidr string) error {
-	_, _, err := net.ParseCIDR(cidr)
+	_, _, err := parseCIDR(cidr)
 	if err != nil {
 		return fmt.Errorf("invalid CIDR format: %w", err)
 	}
 	return nil
 }
 
-func (c *CIDRService) validateUniqueness(ctx context.Context, key, cidr string) error {
+func (c *CIDRService) validateDescription(description string) error {
+	if n := utf8.RuneCountInString(description); n > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters, got %d", maxDescriptionLength, n)
+	}
+	return nil
+}
+
+func (c *CIDRService) validateUniqueness(ctx context.Context, candidate CIDRRecord, requireParent string) error {
 	records, err := c.GetAllCIDRs(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to check existing records: %w", err)
 	}
 
+	live := withoutExpired(records, time.Now())
+	if err := checkScopedUniqueness(live, candidate, c.uniquenessScope); err != nil {
+		return err
+	}
+	return checkParent(live, candidate, requireParent)
+}
+
+// DuplicateKeyError reports a registration under a key that is already taken.
+// It carries the existing record so clients can adopt it or pick another key.
+type DuplicateKeyError struct {
+	Existing CIDRRecord
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("key '%s' already exists", e.Existing.Key)
+}
+
+// checkUniqueness rejects a candidate whose key or CIDR is already registered,
+// or whose CIDR would swallow registered blocks. Only reserved candidates may
+// contain existing allocations.
+func checkUniqueness(records []CIDRRecord, candidate CIDRRecord) error {
 	for _, record := range records {
-		if record.Key == key {
-			return fmt.Errorf("key '%s' already exists", key)
+		if record.Key == candidate.Key {
+			return &DuplicateKeyError{Existing: record}
 		}
-		if record.CIDR == cidr {
-			return fmt.Errorf("CIDR '%s' already exists", cidr)
+		// Records stored before mapped CIDRs were unmapped may still hold
+		// the IPv6 form of a block.
+		if unmapCIDR(record.CIDR) == unmapCIDR(candidate.CIDR) {
+			return fmt.Errorf("CIDR '%s' already exists", candidate.CIDR)
+		}
+	}
+
+	if candidate.Reserved {
+		return nil
+	}
+
+	_, network, err := parseCIDR(candidate.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR format: %w", err)
+	}
+
+	if children := containedRecords(records, network); len(children) > 0 {
+		contained := make([]string, len(children))
+		for i, child := range children {
+			contained[i] = fmt.Sprintf("%s (%s)", child.Key, child.CIDR)
 		}
+		return fmt.Errorf("CIDR '%s' contains existing allocations %s; register it as reserved to allow this",
+			candidate.CIDR, strings.Join(contained, ", "))
 	}
 
 	return nil
 }
+
+// containedRecords returns the records whose blocks lie strictly inside
+// network.
+func containedRecords(records []CIDRRecord, network *net.IPNet) []CIDRRecord {
+	prefix, _ := network.Mask.Size()
+
+	var contained []CIDRRecord
+	for _, record := range records {
+		_, recordNet, err := parseCIDR(record.CIDR)
+		if err != nil {
+			continue
+		}
+		if recordPrefix, _ := recordNet.Mask.Size(); recordPrefix > prefix && netContains(network, recordNet) {
+			contained = append(contained, record)
+		}
+	}
+
+	return contained
+}
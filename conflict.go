@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// maxAllocationAttempts bounds how often an allocation that lost a race
+	// picks another block.
+	maxAllocationAttempts = 8
+	// allocationRetryBackoff is the base of the jittered, doubling delay
+	// between allocation attempts.
+	allocationRetryBackoff = 20 * time.Millisecond
+)
+
+// errWriteConflict reports a write that raced with a concurrent write of the
+// same key or an overlapping block and was backed out.
+var errWriteConflict = errors.New("conflicts with a concurrent write")
+
+// confirmWrite checks, after record has been stored, that no concurrent
+// write stored an overlapping block in the same scope or the same key in a
+// partitioned table, and removes record again, with its audit entry, if one
+// did. The uniqueness check before a write cannot see a writer that checked
+// at the same time, but every writer confirms after its own write with a
+// consistent read, so of two racing writers at least one sees the other and
+// backs out. Both may, in which case both retry.
+func (c *CIDRService) confirmWrite(ctx context.Context, record CIDRRecord, entry *AuditEntry) error {
+	records, err := c.confirmationRecords(ctx, record)
+	if err != nil {
+		return fmt.Errorf("failed to confirm write: %w", err)
+	}
+
+	var others []CIDRRecord
+	var sameKey bool
+	for _, other := range withoutExpired(records, time.Now()) {
+		switch {
+		case other.Key == record.Key && other.CIDR == record.CIDR:
+		case other.Key == record.Key:
+			sameKey = true
+		default:
+			others = append(others, other)
+		}
+	}
+
+	var overlap error
+	if !sameKey {
+		overlap = checkUniqueness(concurrentRecords(inScope(others, record, c.uniquenessScope), record), record)
+		if overlap == nil {
+			return nil
+		}
+	}
+	if err := c.backOut(ctx, record, entry); err != nil {
+		return err
+	}
+	if sameKey {
+		return fmt.Errorf("key '%s' %w", record.Key, errWriteConflict)
+	}
+	return fmt.Errorf("CIDR %s %w: %v", record.CIDR, errWriteConflict, overlap)
+}
+
+// confirmationRecords reads, consistently, the records a write of record may
+// have raced with. A partitioned table keeps every record that can overlap
+// record in record's partition, so a Query of it suffices; a same-key write
+// in another partition is looked up in the key index, which can lag. The key
+// layout has nothing narrower than the table to read, since secondary
+// indexes cannot be read consistently, so there each write costs a
+// consistent Scan. Its conditional put already rules out a second record
+// under the same key.
+func (c *CIDRService) confirmationRecords(ctx context.Context, record CIDRRecord) ([]CIDRRecord, error) {
+	if !c.partitioned {
+		return c.scanRecords(ctx, c.client(ctx), true)
+	}
+
+	records, err := c.queryPartition(ctx, record.Partition, true)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.client(ctx).Query(ctx, &dynamodb.QueryInput{
+		TableName:                aws.String(c.table(ctx)),
+		IndexName:                aws.String(c.keyIndexName),
+		KeyConditionExpression:   aws.String("#k = :k"),
+		ExpressionAttributeNames: map[string]string{"#k": "key"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k": &types.AttributeValueMemberS{Value: record.Key},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key index: %w", err)
+	}
+	for _, item := range result.Items {
+		var other CIDRRecord
+		if err := attributevalue.UnmarshalMap(item, &other); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal DynamoDB item: %w", err)
+		}
+		if other.Partition != record.Partition {
+			records = append(records, other)
+		}
+	}
+	return records, nil
+}
+
+// backOut deletes a record that lost a race, as long as it is still the one
+// this request stored. The record's audit entry, when it has one, is deleted
+// in the same transaction, so a write that did not stick leaves no trace in
+// the audit log.
+func (c *CIDRService) backOut(ctx context.Context, record CIDRRecord, entry *AuditEntry) error {
+	recordDelete := types.Delete{
+		TableName:           aws.String(c.table(ctx)),
+		Key:                 c.itemKey(record),
+		ConditionExpression: aws.String("#k = :key AND #c = :cidr"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": "key",
+			"#c": "cidr",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":key":  &types.AttributeValueMemberS{Value: record.Key},
+			":cidr": &types.AttributeValueMemberS{Value: record.CIDR},
+		},
+	}
+
+	var err error
+	if entry == nil {
+		_, err = c.client(ctx).DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 recordDelete.TableName,
+			Key:                       recordDelete.Key,
+			ConditionExpression:       recordDelete.ConditionExpression,
+			ExpressionAttributeNames:  recordDelete.ExpressionAttributeNames,
+			ExpressionAttributeValues: recordDelete.ExpressionAttributeValues,
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			err = nil
+		}
+	} else {
+		auditDelete := types.Delete{
+			TableName: aws.String(c.auditTableName),
+			Key: map[string]types.AttributeValue{
+				"key": &types.AttributeValueMemberS{Value: entry.Key},
+				"at":  &types.AttributeValueMemberS{Value: entry.At},
+			},
+		}
+		_, err = c.client(ctx).TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{{Delete: &recordDelete}, {Delete: &auditDelete}},
+		})
+		// The record is no longer the one this request stored, but its
+		// audit entry still describes a write that did not stick.
+		if transactionConditionFailed(err) {
+			_, err = c.client(ctx).DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: auditDelete.TableName,
+				Key:       auditDelete.Key,
+			})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to back out conflicting write of '%s': %w", record.Key, err)
+	}
+	// A listing may have seen the record before it was backed out.
+	c.markChanged(ctx)
+	return nil
+}
+
+// allocationRetryDelay is the jittered delay before allocation attempt
+// attempt+1, so writers that backed out together do not collide again.
+func allocationRetryDelay(attempt int) time.Duration {
+	return rand.N(allocationRetryBackoff << attempt)
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+)
+
+// maxContiguousBlocks bounds the count of POST /allocate-contiguous, which
+// registers one record per block.
+const maxContiguousBlocks = 256
+
+// noContiguousRunCode tags the error response of a contiguous allocation
+// that found no run of free blocks long enough.
+const noContiguousRunCode = "NO_CONTIGUOUS_RUN"
+
+// NoContiguousRunError reports that no Count adjacent free blocks of Prefix
+// are left in Base, or, with Aggregate, none that form a single supernet.
+type NoContiguousRunError struct {
+	Count     int
+	Prefix    int
+	Base      *net.IPNet
+	Aggregate bool
+}
+
+func (e *NoContiguousRunError) Error() string {
+	if e.Aggregate {
+		return fmt.Sprintf("no %d contiguous /%d CIDRs forming a single supernet remain in %s", e.Count, e.Prefix, e.Base)
+	}
+	return fmt.Sprintf("no %d contiguous /%d CIDRs remain in %s", e.Count, e.Prefix, e.Base)
+}
+
+// ContiguousAllocation is the result of POST /allocate-contiguous. Supernet
+// is set when the blocks summarize into one network; with aggregate it is the
+// only record.
+type ContiguousAllocation struct {
+	Supernet string       `json:"supernet,omitempty"`
+	Records  []CIDRRecord `json:"records"`
+}
+
+// AllocateContiguous registers count adjacent free blocks of the allocation's
+// prefix, keyed record.Key/1 through record.Key/count, or, with aggregate,
+// the single supernet they form under record.Key. The blocks are written one
+// at a time; if one fails, those already written are backed out, and a run
+// that loses a race with a concurrent write is searched for again, up to
+// maxAllocationAttempts times.
+func (c *CIDRService) AllocateContiguous(ctx context.Context, record CIDRRecord, count int, aggregate bool, opts AllocationOptions) (*ContiguousAllocation, error) {
+	base, permitted, prefix, err := c.resolveAllocation(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAvailableBase(base); err != nil {
+		return nil, err
+	}
+
+	opts.Key = record.Key
+	opts.ActiveFrom, opts.ActiveUntil = record.ActiveFrom, record.ActiveUntil
+	record.Pool = opts.Pool
+	record.Tenant = opts.Tenant
+	record.Account = opts.Account
+
+	records := count
+	if aggregate {
+		records = 1
+	}
+	if err := c.checkRecordLimit(ctx, records); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		used, err := c.usedNetworks(ctx, permitted, opts)
+		if err != nil {
+			return nil, err
+		}
+		blocks, supernet, ok := contiguousRun(base, prefix, count, aggregate, used)
+		if !ok {
+			return nil, &NoContiguousRunError{Count: count, Prefix: prefix, Base: base, Aggregate: aggregate}
+		}
+		if !opts.Emergency {
+			last := len(blocks) - 1
+			if err := c.checkHeadroom(base, blocks[last], append(used, blocks[:last]...)); err != nil {
+				return nil, err
+			}
+		}
+
+		allocation, err := c.registerRun(ctx, record, blocks, supernet, aggregate)
+		if err == nil {
+			return allocation, nil
+		}
+		if !errors.Is(err, errWriteConflict) || attempt+1 >= maxAllocationAttempts {
+			return nil, err
+		}
+		if err := sleepContext(ctx, allocationRetryDelay(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// registerRun writes the records of a contiguous run, backing out the
+// records already written, with their audit entries, when one of them fails.
+func (c *CIDRService) registerRun(ctx context.Context, record CIDRRecord, blocks []*net.IPNet, supernet *net.IPNet, aggregate bool) (*ContiguousAllocation, error) {
+	allocation := &ContiguousAllocation{Records: []CIDRRecord{}}
+	if supernet != nil {
+		allocation.Supernet = supernet.String()
+	}
+
+	var wanted []CIDRRecord
+	if aggregate {
+		record.CIDR = supernet.String()
+		wanted = append(wanted, record)
+	} else {
+		for i, block := range blocks {
+			blockRecord := record
+			blockRecord.Key = record.Key + namespaceSeparator + strconv.Itoa(i+1)
+			blockRecord.CIDR = block.String()
+			wanted = append(wanted, blockRecord)
+		}
+	}
+
+	var entries []*AuditEntry
+	for _, want := range wanted {
+		stored, entry, err := c.registerCIDR(ctx, want, nil, auditActionAllocate, requireParentNone)
+		if err != nil {
+			for i, written := range allocation.Records {
+				if backOutErr := c.backOut(ctx, written, entries[i]); backOutErr != nil {
+					logf(ctx, "failed to back out %s of a contiguous run: %v", written.Key, backOutErr)
+					continue
+				}
+				c.countAdded(ctx, -1)
+			}
+			return nil, err
+		}
+		allocation.Records = append(allocation.Records, *stored)
+		entries = append(entries, entry)
+	}
+	return allocation, nil
+}
+
+// contiguousRun finds the lowest count adjacent free prefix-sized blocks of
+// an IPv4 base. A run that summarizes into one supernet, which needs a power
+// of two count aligned to the run's size, is preferred and is then returned
+// as supernet; with aggregate it is required.
+func contiguousRun(base *net.IPNet, prefix, count int, aggregate bool, used []*net.IPNet) (blocks []*net.IPNet, supernet *net.IPNet, ok bool) {
+	size := uint64(1) << uint(32-prefix)
+	span := size * uint64(count)
+	free := freeRanges(base, used)
+	find := func(align uint64) (uint64, bool) {
+		for _, r := range free {
+			if first := (r.start + align - 1) / align * align; first+span <= r.end {
+				return first, true
+			}
+		}
+		return 0, false
+	}
+
+	summarizes := count&(count-1) == 0
+	var start uint64
+	if summarizes {
+		start, ok = find(span)
+	}
+	if !ok && !aggregate {
+		start, ok = find(size)
+		summarizes = summarizes && start%span == 0
+	}
+	if !ok {
+		return nil, nil, false
+	}
+
+	mask := net.CIDRMask(prefix, 32)
+	for i := range uint64(count) {
+		blocks = append(blocks, &net.IPNet{IP: uint32ToIPv4(uint32(start + i*size)), Mask: mask})
+	}
+	if summarizes {
+		supernet = &net.IPNet{IP: uint32ToIPv4(uint32(start)), Mask: net.CIDRMask(prefix-bits.TrailingZeros(uint(count)), 32)}
+	}
+	return blocks, supernet, true
+}
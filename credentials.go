@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+const defaultAssumeRoleSessionName = "cidrfinder"
+
+// assumeRoleSettings are read from ASSUME_ROLE_ARN, ASSUME_ROLE_EXTERNAL_ID
+// and ASSUME_ROLE_SESSION_NAME. An empty RoleARN keeps the default
+// credential chain.
+type assumeRoleSettings struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+}
+
+func assumeRoleSettingsFromEnv() (assumeRoleSettings, error) {
+	settings := assumeRoleSettings{
+		RoleARN:     os.Getenv("ASSUME_ROLE_ARN"),
+		ExternalID:  os.Getenv("ASSUME_ROLE_EXTERNAL_ID"),
+		SessionName: os.Getenv("ASSUME_ROLE_SESSION_NAME"),
+	}
+	if settings.RoleARN != "" && !strings.HasPrefix(settings.RoleARN, "arn:") {
+		return settings, fmt.Errorf("ASSUME_ROLE_ARN %q is not a role ARN", settings.RoleARN)
+	}
+	return settings, nil
+}
+
+// withAssumedRole returns cfg with credentials obtained by assuming the
+// configured role through client, which is built from the default
+// credentials. The credentials are cached and refreshed before they expire.
+func withAssumedRole(cfg aws.Config, settings assumeRoleSettings, client stscreds.AssumeRoleAPIClient) aws.Config {
+	if settings.RoleARN == "" {
+		return cfg
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(client, settings.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = settings.SessionName
+		if o.RoleSessionName == "" {
+			o.RoleSessionName = defaultAssumeRoleSessionName
+		}
+		if settings.ExternalID != "" {
+			o.ExternalID = aws.String(settings.ExternalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	return cfg
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// How a proposed CIDR in POST /diff is covered by a current record.
+const (
+	diffExact     = "exact"
+	diffContained = "contained"
+)
+
+// DiffRecord is a current record named in a POST /diff report.
+type DiffRecord struct {
+	Key  string `json:"key"`
+	CIDR string `json:"cidr"`
+}
+
+// DiffUnchanged is a proposed CIDR that is already registered, exactly or
+// inside a larger record. Record is the most specific record covering it.
+type DiffUnchanged struct {
+	CIDR   string     `json:"cidr"`
+	Match  string     `json:"match"`
+	Record DiffRecord `json:"record"`
+}
+
+// DiffResult compares a proposed set of CIDRs with the current records.
+// Added are proposed CIDRs no record covers, and Removed are records that
+// overlap no proposed CIDR.
+type DiffResult struct {
+	Added     []string        `json:"added"`
+	Removed   []DiffRecord    `json:"removed"`
+	Unchanged []DiffUnchanged `json:"unchanged"`
+}
+
+// DiffCIDRs compares proposed networks with the unexpired records, without
+// writing anything.
+func (c *CIDRService) DiffCIDRs(ctx context.Context, proposed []*net.IPNet) (*DiffResult, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	return diffCIDRs(withoutExpired(records, time.Now()), proposed), nil
+}
+
+// diffCIDRs is DiffCIDRs for records already read. Added and Unchanged
+// follow the proposal's order, with repeats dropped; Removed is sorted by
+// key. Comparison is by containment: a proposed block inside a record is
+// unchanged, and a record inside a proposed block is kept, so only a record
+// sharing no address with the proposal is removed.
+func diffCIDRs(records []CIDRRecord, proposed []*net.IPNet) *DiffResult {
+	result := &DiffResult{Added: []string{}, Removed: []DiffRecord{}, Unchanged: []DiffUnchanged{}}
+
+	type parsedRecord struct {
+		DiffRecord
+		network *net.IPNet
+	}
+	var current []parsedRecord
+	for _, record := range records {
+		if _, network, err := parseCIDR(record.CIDR); err == nil {
+			current = append(current, parsedRecord{DiffRecord{record.Key, record.CIDR}, network})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, network := range proposed {
+		cidr := network.String()
+		if seen[cidr] {
+			continue
+		}
+		seen[cidr] = true
+
+		var covering *parsedRecord
+		for i, record := range current {
+			if !netContains(record.network, network) {
+				continue
+			}
+			if covering == nil {
+				covering = &current[i]
+				continue
+			}
+			ones, _ := record.network.Mask.Size()
+			coveringOnes, _ := covering.network.Mask.Size()
+			if ones > coveringOnes {
+				covering = &current[i]
+			}
+		}
+		if covering == nil {
+			result.Added = append(result.Added, cidr)
+			continue
+		}
+
+		match := diffContained
+		if covering.network.String() == cidr {
+			match = diffExact
+		}
+		result.Unchanged = append(result.Unchanged, DiffUnchanged{CIDR: cidr, Match: match, Record: covering.DiffRecord})
+	}
+
+	for _, record := range current {
+		kept := false
+		for _, network := range proposed {
+			kept = kept || netsOverlap(record.network, network)
+		}
+		if !kept {
+			result.Removed = append(result.Removed, record.DiffRecord)
+		}
+	}
+	sort.Slice(result.Removed, func(i, j int) bool { return result.Removed[i].Key < result.Removed[j].Key })
+	return result
+}
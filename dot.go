@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// contentTypeDOT is the media type of Graphviz DOT documents.
+const contentTypeDOT = "text/vnd.graphviz"
+
+// Listing formats of GET /.
+const (
+	listFormatJSON = "json"
+	listFormatDOT  = "dot"
+)
+
+func parseListFormat(value string) (string, error) {
+	switch value {
+	case "", listFormatJSON:
+		return listFormatJSON, nil
+	case listFormatDOT:
+		return listFormatDOT, nil
+	}
+	return "", fmt.Errorf("format must be %q or %q, got %q", listFormatJSON, listFormatDOT, value)
+}
+
+// dotGraph renders records as a Graphviz containment tree. Each permitted base
+// is a root, and every record hangs off the smallest record that strictly
+// contains it or, failing that, the base it lies in. Records outside every
+// base are roots of their own. Nodes are labelled with the key and CIDR.
+func dotGraph(bases []*net.IPNet, records []CIDRRecord) string {
+	networks := make([]*net.IPNet, len(records))
+	for i, record := range records {
+		_, networks[i], _ = parseCIDR(record.CIDR)
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph cidrfinder {\n")
+	b.WriteString("  node [shape=box];\n")
+	for i, base := range bases {
+		fmt.Fprintf(&b, "  base%d [label=%s, style=bold];\n", i, dotQuote(base.String()))
+	}
+	for i, record := range records {
+		fmt.Fprintf(&b, "  record%d [label=%s];\n", i, dotQuote(record.Key+"\n"+record.CIDR))
+	}
+
+	for i, network := range networks {
+		if network == nil {
+			continue
+		}
+		if parent := dotParent(networks, i); parent >= 0 {
+			fmt.Fprintf(&b, "  record%d -> record%d;\n", parent, i)
+			continue
+		}
+		for j, base := range bases {
+			if netContains(base, network) {
+				fmt.Fprintf(&b, "  base%d -> record%d;\n", j, i)
+				break
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotParent returns the index of the smallest network that strictly contains
+// networks[i], or -1 if none does.
+func dotParent(networks []*net.IPNet, i int) int {
+	parent, parentPrefix := -1, -1
+	prefix, _ := networks[i].Mask.Size()
+	for j, candidate := range networks {
+		if j == i || candidate == nil {
+			continue
+		}
+		candidatePrefix, _ := candidate.Mask.Size()
+		if candidatePrefix < prefix && candidatePrefix > parentPrefix && netContains(candidate, networks[i]) {
+			parent, parentPrefix = j, candidatePrefix
+		}
+	}
+	return parent
+}
+
+// dotQuote quotes s as a DOT string, with newlines as DOT line breaks.
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// contentTypeText is the media type of plain-text responses such as
+// GET /next?format=env.
+const contentTypeText = "text/plain; charset=utf-8"
+
+// Formats of GET /next.
+const (
+	nextFormatJSON = "json"
+	nextFormatEnv  = "env"
+)
+
+func parseNextFormat(value string) (string, error) {
+	switch value {
+	case "", nextFormatJSON:
+		return nextFormatJSON, nil
+	case nextFormatEnv:
+		return nextFormatEnv, nil
+	}
+	return "", fmt.Errorf("format must be %q or %q, got %q", nextFormatJSON, nextFormatEnv, value)
+}
+
+// envSnippet renders a block as shell variable assignments that provisioning
+// scripts can source. GATEWAY is the first usable address, the conventional
+// router of a subnet. NETMASK and BROADCAST are only written for IPv4, and
+// BROADCAST only for blocks that have one.
+func envSnippet(cidr string) (string, error) {
+	_, network, err := parseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR format: %w", err)
+	}
+	details := networkDetails(network)
+	if details == nil {
+		return "", fmt.Errorf("cannot describe CIDR '%s'", cidr)
+	}
+	prefix, _ := network.Mask.Size()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CIDR=%s\n", network)
+	fmt.Fprintf(&b, "NETWORK=%s\n", details.Network)
+	fmt.Fprintf(&b, "PREFIX=%d\n", prefix)
+	if details.Family == familyIPv4 {
+		fmt.Fprintf(&b, "NETMASK=%s\n", net.IP(net.CIDRMask(prefix, 32)))
+	}
+	fmt.Fprintf(&b, "GATEWAY=%s\n", details.FirstUsable)
+	if details.Broadcast != "" {
+		fmt.Fprintf(&b, "BROADCAST=%s\n", details.Broadcast)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Response envelope versions. Version 1 is the original envelope, whose
+// errors are a bare {"error": "..."}; version 2, the default, adds the
+// structured error fields such as "code", "errors" and "existing".
+const (
+	responseVersion1      = 1
+	responseVersion2      = 2
+	latestResponseVersion = responseVersion2
+
+	// vendorMediaType is the prefix of the versioned media types, such as
+	// application/vnd.cidrfinder.v1+json.
+	vendorMediaType = "application/vnd.cidrfinder.v"
+)
+
+// responseVersion picks the envelope version from the v query parameter or,
+// without one, from an Accept media type such as
+// application/json; version=1 or application/vnd.cidrfinder.v1+json. Clients
+// that ask for neither get the latest version.
+func responseVersion(query, accept string) (int, error) {
+	if query != "" {
+		return parseResponseVersion(query)
+	}
+
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if version, ok := strings.CutPrefix(mediaType, vendorMediaType); ok {
+			return parseResponseVersion(strings.TrimSuffix(version, "+json"))
+		}
+		if version, ok := params["version"]; ok && mediaType == contentTypeJSON {
+			return parseResponseVersion(version)
+		}
+	}
+	return latestResponseVersion, nil
+}
+
+func parseResponseVersion(value string) (int, error) {
+	version, err := strconv.Atoi(strings.TrimPrefix(value, "v"))
+	if err != nil || version < responseVersion1 || version > latestResponseVersion {
+		return 0, fmt.Errorf("unsupported response version %q; supported versions are 1 and 2", value)
+	}
+	return version, nil
+}
+
+// envelopeBody rewrites a JSON response body into the envelope of version.
+// Only version 1 error bodies change: they are cut down to their "error"
+// message.
+func envelopeBody(version, status int, body []byte) ([]byte, error) {
+	if version >= responseVersion2 || status < 400 || len(body) == 0 {
+		return body, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	errorField := naming.name("error")
+	message, ok := fields[errorField]
+	if !ok {
+		return body, nil
+	}
+	return json.Marshal(map[string]json.RawMessage{errorField: message})
+}
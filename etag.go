@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// totalCountHeader carries the record count on HEAD /.
+const totalCountHeader = "X-Total-Count"
+
+// etagFor returns a strong entity tag for a response body, so HEAD and GET
+// of an unchanged record yield the same tag.
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// recordETag is the entity tag of a stored record. The computed age is left
+// out, so the tag only changes when the record does.
+func recordETag(record CIDRRecord) (string, error) {
+	record.AgeSeconds = nil
+	body, err := marshalResponse(record)
+	if err != nil {
+		return "", err
+	}
+	return etagFor(body), nil
+}
+
+// representationETag derives the tag of another representation, such as XML,
+// from the JSON representation's tag.
+func representationETag(etag, contentType string) string {
+	return etagFor([]byte(etag + contentType))
+}
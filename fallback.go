@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// dynamoReader is the part of the DynamoDB client that reads use, so a read
+// can be served by the FALLBACK_REGION client instead of the primary one.
+type dynamoReader interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// fallbackClient returns the client for the replica of the table named by
+// FALLBACK_REGION and FALLBACK_ENDPOINT, such as a DynamoDB Global Tables
+// replica in another region, or nil when neither is set.
+func fallbackClient(cfg aws.Config) dynamoReader {
+	region, endpoint := os.Getenv("FALLBACK_REGION"), os.Getenv("FALLBACK_ENDPOINT")
+	if region == "" && endpoint == "" {
+		return nil
+	}
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if region != "" {
+			o.Region = region
+		}
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+}
+
+// readWithFallback runs read against the primary client and, if that fails
+// and a fallback is configured, once more against the fallback. A missing
+// record or a cancelled request is not a failure of the primary. Writes never
+// fail over: only the primary accepts them. The fallback replicates the
+// default table, so reads routed to a TABLE_ROUTES table never fail over.
+func readWithFallback[T any](ctx context.Context, c *CIDRService, read func(dynamoReader) (T, error)) (T, error) {
+	result, err := read(c.client(ctx))
+	if err == nil || c.fallback == nil || routedTable(ctx) != nil || errors.Is(err, errRecordNotFound) || ctx.Err() != nil {
+		return result, err
+	}
+
+	logf(ctx, "primary table read failed, reading from fallback: %v", err)
+	return read(c.fallback)
+}
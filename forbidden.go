@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseForbiddenCIDRs parses FORBIDDEN_CIDRS, a comma-separated list of
+// ranges no record may overlap, such as 100.64.0.0/10,169.254.0.0/16.
+func parseForbiddenCIDRs(value string) ([]*net.IPNet, error) {
+	var forbidden []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		_, network, err := parseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORBIDDEN_CIDRS entry %q: %w", entry, err)
+		}
+		forbidden = append(forbidden, network)
+	}
+	return forbidden, nil
+}
+
+// checkForbidden rejects a CIDR that overlaps any forbidden range, naming the
+// first range it hits. It is independent of the allowed bases: a block inside
+// an allowed base is still refused if it touches a forbidden range.
+func checkForbidden(forbidden []*net.IPNet, cidr string) error {
+	_, network, err := parseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR format: %w", err)
+	}
+	for _, blocked := range forbidden {
+		if netsOverlap(blocked, network) {
+			return fmt.Errorf("CIDR %s overlaps forbidden range %s", network, blocked)
+		}
+	}
+	return nil
+}
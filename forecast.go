@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultForecastWindow is how far back GET /forecast looks for allocations
+// when no window is given.
+const defaultForecastWindow = 30 * 24 * time.Hour
+
+// parseForecastWindow parses the window query parameter of GET /forecast, a
+// number of days such as "30d" or a Go duration such as "72h".
+func parseForecastWindow(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultForecastWindow, nil
+	}
+	window, err := parseAge(value)
+	if err != nil {
+		return 0, fmt.Errorf("window %w", err)
+	}
+	if window == 0 {
+		return 0, fmt.Errorf("window must be longer than zero")
+	}
+	return window, nil
+}
+
+// PoolForecast projects when a pool runs out at its recent allocation rate.
+// BlocksPerDay counts the address space allocated during the window in blocks
+// of the pool's default size, so a /16 taken from a /24 pool counts as 256.
+// DaysRemaining and ExhaustsAt are null when nothing was allocated during the
+// window.
+type PoolForecast struct {
+	Pool              string   `json:"pool,omitempty"`
+	Base              string   `json:"base"`
+	Prefix            int      `json:"prefix"`
+	RemainingBlocks   uint64   `json:"remainingBlocks"`
+	AllocatedInWindow int      `json:"allocatedInWindow"`
+	BlocksPerDay      float64  `json:"blocksPerDay"`
+	DaysRemaining     *float64 `json:"daysRemaining"`
+	ExhaustsAt        *string  `json:"exhaustsAt"`
+}
+
+// ForecastReport is the result of GET /forecast.
+type ForecastReport struct {
+	WindowStart string          `json:"windowStart"`
+	WindowDays  float64         `json:"windowDays"`
+	Pools       []PoolForecast  `json:"pools"`
+	Skipped     []SkippedTarget `json:"skipped,omitempty"`
+}
+
+// Forecast projects the exhaustion of every pool reported by GET /capacity
+// from the records created during the window before now. Only records that
+// still exist and carry a createdAt count, so deleted and expired blocks
+// don't contribute to the rate.
+func (c *CIDRService) Forecast(ctx context.Context, window time.Duration, now time.Time) (*ForecastReport, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	released, err := c.releasedNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.forecastOf(records, released, window, now)
+}
+
+// forecastOf is Forecast for records and released blocks already read.
+func (c *CIDRService) forecastOf(records []CIDRRecord, released []*net.IPNet, window time.Duration, now time.Time) (*ForecastReport, error) {
+	capacity := c.capacityOf(records, released)
+
+	start := now.Add(-window)
+	days := window.Hours() / 24
+	report := &ForecastReport{
+		WindowStart: start.UTC().Format(time.RFC3339),
+		WindowDays:  days,
+		Pools:       make([]PoolForecast, 0, len(capacity.Pools)),
+		Skipped:     capacity.Skipped,
+	}
+	for _, pool := range capacity.Pools {
+		forecast := PoolForecast{Pool: pool.Pool, Base: pool.Base, Prefix: pool.Prefix, RemainingBlocks: pool.RemainingBlocks}
+		_, base, err := parseCIDR(pool.Base)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base %q: %w", pool.Base, err)
+		}
+
+		var addresses uint64
+		for _, record := range records {
+			if record.CreatedAt < start.Unix() || record.CreatedAt > now.Unix() {
+				continue
+			}
+			_, network, err := parseCIDR(record.CIDR)
+			if err != nil || !base.Contains(network.IP) {
+				continue
+			}
+			if first, last, ok := ipv4Range(network); ok {
+				addresses += last - first
+				forecast.AllocatedInWindow++
+			}
+		}
+
+		blockSize := uint64(1) << uint(32-pool.Prefix)
+		forecast.BlocksPerDay = float64(addresses) / float64(blockSize) / days
+		if forecast.BlocksPerDay > 0 {
+			remaining := float64(pool.RemainingBlocks) / forecast.BlocksPerDay
+			exhausts := time.Unix(now.Unix()+int64(remaining*86400), 0).UTC().Format(time.RFC3339)
+			forecast.DaysRemaining, forecast.ExhaustsAt = &remaining, &exhausts
+		}
+		report.Pools = append(report.Pools, forecast)
+	}
+	return report, nil
+}
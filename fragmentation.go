@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Formats of GET /fragmentation.
+const (
+	fragmentationFormatJSON       = "json"
+	fragmentationFormatPrometheus = "prometheus"
+)
+
+// contentTypePrometheus is the Prometheus text exposition format.
+const contentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+func parseFragmentationFormat(value string) (string, error) {
+	switch value {
+	case "", fragmentationFormatJSON:
+		return fragmentationFormatJSON, nil
+	case fragmentationFormatPrometheus:
+		return fragmentationFormatPrometheus, nil
+	}
+	return "", fmt.Errorf("format must be %q or %q, got %q", fragmentationFormatJSON, fragmentationFormatPrometheus, value)
+}
+
+// PoolFragmentation describes how scattered the free space of a pool is.
+// LargestFreeBlock is the largest aligned CIDR block that is still free, and
+// Score is the share of free addresses outside it: 0 when the free space
+// could be allocated as one block, approaching 1 as it splinters.
+type PoolFragmentation struct {
+	Pool                 string  `json:"pool,omitempty"`
+	Base                 string  `json:"base"`
+	FreeRanges           int     `json:"freeRanges"`
+	FreeAddresses        uint64  `json:"freeAddresses"`
+	LargestFreeBlock     *string `json:"largestFreeBlock"`
+	LargestFreeAddresses uint64  `json:"largestFreeAddresses"`
+	Score                float64 `json:"score"`
+}
+
+// FragmentationReport is the result of GET /fragmentation.
+type FragmentationReport struct {
+	Pools   []PoolFragmentation `json:"pools"`
+	Skipped []SkippedTarget     `json:"skipped,omitempty"`
+}
+
+// Fragmentation reports the free space of every pool reported by
+// GET /capacity. Excluded and forbidden ranges count as used, as they do for
+// allocation. Only IPv4 ranges are reported.
+func (c *CIDRService) Fragmentation(ctx context.Context) (*FragmentationReport, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	return c.fragmentationOf(records), nil
+}
+
+// fragmentationOf is Fragmentation for records already read.
+func (c *CIDRService) fragmentationOf(records []CIDRRecord) *FragmentationReport {
+	targets, skipped := c.capacityTargets()
+	report := &FragmentationReport{Pools: []PoolFragmentation{}, Skipped: skipped}
+	for _, target := range targets {
+		opts, base := target.opts, target.base
+		fragmentation := PoolFragmentation{Pool: opts.Pool, Base: base.String()}
+		var largest *net.IPNet
+		for _, r := range freeRanges(base, c.usedBy(records, opts)) {
+			fragmentation.FreeRanges++
+			fragmentation.FreeAddresses += r.end - r.start
+			if block := largestAlignedBlock(r); largest == nil || addressCount(block) > addressCount(largest) {
+				largest = block
+			}
+		}
+		if largest != nil {
+			cidr := largest.String()
+			fragmentation.LargestFreeBlock = &cidr
+			fragmentation.LargestFreeAddresses = addressCount(largest)
+			fragmentation.Score = 1 - float64(fragmentation.LargestFreeAddresses)/float64(fragmentation.FreeAddresses)
+		}
+		report.Pools = append(report.Pools, fragmentation)
+	}
+	return report
+}
+
+// largestAlignedBlock returns the largest CIDR block that fits in r on its
+// own boundary, the lowest one if several do.
+func largestAlignedBlock(r addrRange) *net.IPNet {
+	for prefix := 0; prefix <= 32; prefix++ {
+		size := uint64(1) << uint(32-prefix)
+		first := (r.start + size - 1) / size * size
+		if first+size <= r.end {
+			return &net.IPNet{IP: uint32ToIPv4(uint32(first)), Mask: net.CIDRMask(prefix, 32)}
+		}
+	}
+	return nil
+}
+
+func addressCount(network *net.IPNet) uint64 {
+	ones, bits := network.Mask.Size()
+	return uint64(1) << uint(bits-ones)
+}
+
+// prometheusGauges renders a report as Prometheus gauges labelled with the
+// pool, when there is one, and the base.
+func (r *FragmentationReport) prometheusGauges() string {
+	gauges := []struct {
+		name, help string
+		value      func(PoolFragmentation) float64
+	}{
+		{"cidrfinder_free_ranges", "Number of contiguous free ranges.", func(p PoolFragmentation) float64 { return float64(p.FreeRanges) }},
+		{"cidrfinder_free_addresses", "Number of free addresses.", func(p PoolFragmentation) float64 { return float64(p.FreeAddresses) }},
+		{"cidrfinder_largest_free_block_addresses", "Addresses in the largest free aligned block.", func(p PoolFragmentation) float64 { return float64(p.LargestFreeAddresses) }},
+		{"cidrfinder_fragmentation_score", "Share of free addresses outside the largest free block.", func(p PoolFragmentation) float64 { return p.Score }},
+	}
+
+	var b strings.Builder
+	for _, gauge := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, pool := range r.Pools {
+			labels := fmt.Sprintf("base=%q", pool.Base)
+			if pool.Pool != "" {
+				labels = fmt.Sprintf("pool=%q,%s", pool.Pool, labels)
+			}
+			fmt.Fprintf(&b, "%s{%s} %s\n", gauge.name, labels, strconv.FormatFloat(gauge.value(pool), 'f', -1, 64))
+		}
+	}
+	return b.String()
+}
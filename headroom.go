@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const headroomReachedCode = "HEADROOM_REACHED"
+
+// headroom is the free space RESERVE_HEADROOM holds back from normal
+// allocation, as a percentage of a base or a number of blocks. The zero value
+// holds nothing back.
+type headroom struct {
+	percent float64
+	blocks  uint64
+}
+
+// parseHeadroom parses RESERVE_HEADROOM, such as "10%" or "4".
+func parseHeadroom(value string) (headroom, error) {
+	if value == "" {
+		return headroom{}, nil
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p >= 100 {
+			return headroom{}, fmt.Errorf("RESERVE_HEADROOM percentage must be at least 0%% and below 100%%, got %q", value)
+		}
+		return headroom{percent: p}, nil
+	}
+	blocks, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return headroom{}, fmt.Errorf("RESERVE_HEADROOM must be a percentage such as 10%% or a block count, got %q", value)
+	}
+	return headroom{blocks: blocks}, nil
+}
+
+// addresses is the number of addresses held back in a base of capacity
+// addresses, counting blocks at prefix, never more than the base holds.
+func (h headroom) addresses(capacity uint64, prefix int) uint64 {
+	if h.percent > 0 {
+		return uint64(float64(capacity) * h.percent / 100)
+	}
+	block := uint64(1) << uint(32-prefix)
+	if h.blocks > capacity/block {
+		return capacity
+	}
+	return h.blocks * block
+}
+
+// HeadroomError reports an allocation refused because it would eat into the
+// space RESERVE_HEADROOM holds back. An emergency allocation may still use it.
+type HeadroomError struct {
+	CIDR     string
+	Base     *net.IPNet
+	Headroom uint64
+}
+
+func (e *HeadroomError) Error() string {
+	return fmt.Sprintf("headroom reached: allocating %s would leave fewer than the %d addresses held back in %s; retry with emergency=true to use them",
+		e.CIDR, e.Headroom, e.Base)
+}
+
+// checkHeadroom refuses next unless the free space of base left after
+// allocating it still covers the headroom, counting blocks of next's size.
+func (c *CIDRService) checkHeadroom(base, next *net.IPNet, used []*net.IPNet) error {
+	start, end, ok := ipv4Range(base)
+	if !ok {
+		return nil
+	}
+	prefix, _ := next.Mask.Size()
+	reserved := c.headroom.addresses(end-start, prefix)
+	if reserved == 0 {
+		return nil
+	}
+
+	var free uint64
+	for _, r := range freeRanges(base, used) {
+		free += r.end - r.start
+	}
+	nextStart, nextEnd, _ := ipv4Range(next)
+	if free-(nextEnd-nextStart) < reserved {
+		return &HeadroomError{CIDR: next.String(), Base: base, Headroom: reserved}
+	}
+	return nil
+}
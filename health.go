@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// STATUS_DETAIL levels of GET /health.
+const (
+	statusDetailMinimal = "minimal"
+	statusDetailFull    = "full"
+
+	defaultHealthCountInterval = 5 * time.Minute
+)
+
+const (
+	healthStatusOK    = "ok"
+	healthStatusError = "error"
+)
+
+// HealthStatus is the GET /health payload. The minimal level reports only
+// status and version; the full level adds the table, region and a cached
+// item count.
+type HealthStatus struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Table     string `json:"table,omitempty"`
+	Region    string `json:"region,omitempty"`
+	ItemCount *int   `json:"itemCount,omitempty"`
+	CountedAt string `json:"countedAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// healthCount caches the table's item count between refreshes, so status
+// pages polling GET /health do not scan the table on every request.
+type healthCount struct {
+	mu        sync.Mutex
+	count     int
+	countedAt time.Time
+}
+
+func parseStatusDetail(value string) (string, error) {
+	switch value {
+	case "", statusDetailMinimal:
+		return statusDetailMinimal, nil
+	case statusDetailFull:
+		return statusDetailFull, nil
+	}
+	return "", fmt.Errorf("STATUS_DETAIL must be %q or %q, got %q", statusDetailMinimal, statusDetailFull, value)
+}
+
+func parseHealthCountInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultHealthCountInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("HEALTH_COUNT_INTERVAL must be a positive duration such as 5m, got %q", value)
+	}
+	return interval, nil
+}
+
+// Health reports the service status at the STATUS_DETAIL level. The minimal
+// level makes no DynamoDB calls. The full level counts the table at most once
+// per HEALTH_COUNT_INTERVAL; when a count fails the status is "error", with
+// the last successful count if there is one.
+func (c *CIDRService) Health(ctx context.Context) HealthStatus {
+	status := HealthStatus{Status: healthStatusOK, Version: version}
+	if c.statusDetail != statusDetailFull {
+		return status
+	}
+	status.Table = c.tableName
+	status.Region = c.awsConfig.Region
+
+	c.healthCount.mu.Lock()
+	defer c.healthCount.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.healthCount.countedAt) >= c.healthCountInterval {
+		count, err := c.CountCIDRs(ctx)
+		if err != nil {
+			status.Status = healthStatusError
+			status.Error = err.Error()
+		} else {
+			c.healthCount.count, c.healthCount.countedAt = count, now
+		}
+	}
+	if !c.healthCount.countedAt.IsZero() {
+		count := c.healthCount.count
+		status.ItemCount = &count
+		status.CountedAt = c.healthCount.countedAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// auditFeed is the feed attribute of every audit entry. The
+	// feed-index GSI, keyed by feed and at, orders all entries by time.
+	auditFeed          = "all"
+	auditFeedIndexName = "feed-index"
+
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+// errAuditDisabled reports a history request without an audit table.
+var errAuditDisabled = errors.New("history is disabled; set AUDIT_TABLE_NAME to enable it")
+
+// HistoryQuery selects audit entries for GET /history: those of Key, or of
+// every key when Key is empty, between From and To inclusive.
+type HistoryQuery struct {
+	Key       string
+	From      string
+	To        string
+	Limit     int32
+	NextToken string
+}
+
+// HistoryPage is one page of audit entries, newest first. NextToken is set
+// when more entries follow.
+type HistoryPage struct {
+	Entries   []AuditEntry `json:"entries"`
+	NextToken string       `json:"nextToken,omitempty"`
+}
+
+// parseHistoryQuery reads the key, from, to, limit and nextToken query
+// parameters. from and to are RFC 3339 times.
+func parseHistoryQuery(query func(string) string) (HistoryQuery, error) {
+	q := HistoryQuery{Key: query("key"), Limit: defaultHistoryLimit, NextToken: query("nextToken")}
+
+	for name, bound := range map[string]*string{"from": &q.From, "to": &q.To} {
+		value := query(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return q, fmt.Errorf("%s must be an RFC 3339 time such as 2024-01-31T00:00:00Z, got %q", name, value)
+		}
+		*bound = t.UTC().Format(time.RFC3339Nano)
+	}
+	if q.From != "" && q.To != "" && q.From > q.To {
+		return q, fmt.Errorf("from must not be after to")
+	}
+
+	if value := query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d, got %q", maxHistoryLimit, value)
+		}
+		q.Limit = int32(limit)
+	}
+	return q, nil
+}
+
+// History returns a page of audit entries, newest first. A key's entries are
+// read from the audit table itself; the feed across all keys is read from
+// its feed-index. Entries written before the index was added carry no feed
+// attribute and only appear in per-key history.
+func (c *CIDRService) History(ctx context.Context, q HistoryQuery) (*HistoryPage, error) {
+	if c.auditTableName == "" {
+		return nil, errAuditDisabled
+	}
+
+	startKey, err := decodeHistoryToken(q.NextToken)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:         aws.String(c.auditTableName),
+		ScanIndexForward:  aws.Bool(false),
+		Limit:             aws.Int32(q.Limit),
+		ExclusiveStartKey: startKey,
+		ExpressionAttributeNames: map[string]string{
+			"#p": "key",
+			"#a": "at",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":p": &types.AttributeValueMemberS{Value: q.Key},
+		},
+	}
+	if q.Key == "" {
+		input.IndexName = aws.String(auditFeedIndexName)
+		input.ExpressionAttributeNames["#p"] = "feed"
+		input.ExpressionAttributeValues[":p"] = &types.AttributeValueMemberS{Value: auditFeed}
+	}
+
+	condition := "#p = :p"
+	switch {
+	case q.From != "" && q.To != "":
+		condition += " AND #a BETWEEN :from AND :to"
+	case q.From != "":
+		condition += " AND #a >= :from"
+	case q.To != "":
+		condition += " AND #a <= :to"
+	default:
+		delete(input.ExpressionAttributeNames, "#a")
+	}
+	if q.From != "" {
+		input.ExpressionAttributeValues[":from"] = &types.AttributeValueMemberS{Value: q.From}
+	}
+	if q.To != "" {
+		input.ExpressionAttributeValues[":to"] = &types.AttributeValueMemberS{Value: q.To}
+	}
+	input.KeyConditionExpression = aws.String(condition)
+
+	output, err := c.dynamoClient.Query(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit history: %w", err)
+	}
+
+	page := &HistoryPage{Entries: []AuditEntry{}}
+	if err := attributevalue.UnmarshalListOfMaps(output.Items, &page.Entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal audit entries: %w", err)
+	}
+	if page.NextToken, err = encodeHistoryToken(output.LastEvaluatedKey); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// encodeHistoryToken turns a LastEvaluatedKey, whose attributes are all
+// strings, into an opaque nextToken.
+func encodeHistoryToken(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	values := map[string]string{}
+	for name, value := range key {
+		s, ok := value.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", fmt.Errorf("unexpected audit key attribute %q", name)
+		}
+		values[name] = s.Value
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// errInvalidHistoryToken reports a nextToken that was not returned by
+// GET /history.
+var errInvalidHistoryToken = errors.New("invalid nextToken")
+
+func decodeHistoryToken(token string) (map[string]types.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidHistoryToken
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil || len(values) == 0 {
+		return nil, errInvalidHistoryToken
+	}
+	key := map[string]types.AttributeValue{}
+	for name, value := range values {
+		key[name] = &types.AttributeValueMemberS{Value: value}
+	}
+	return key, nil
+}
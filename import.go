@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// contentTypeCSV is the media type POST /import accepts.
+const contentTypeCSV = "text/csv"
+
+// Outcomes of importing one CSV row. A dry run stops at valid.
+const (
+	importImported = "imported"
+	importValid    = "valid"
+	importInvalid  = "invalid"
+	importFailed   = "failed"
+)
+
+// checkImportContentType accepts only CSV bodies.
+func checkImportContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != contentTypeCSV {
+		return fmt.Errorf("POST /import requires Content-Type %s", contentTypeCSV)
+	}
+	return nil
+}
+
+// importRow is one data row of an import, or the reason it could not be read.
+type importRow struct {
+	line   int
+	record CIDRRecord
+	err    error
+}
+
+// parseImportCSV reads key,cidr[,tag...] rows, each tag written key=value. A
+// first row naming the key and cidr columns is taken as a header and skipped.
+// Rows that are malformed, with a stray quote or too few fields, are returned
+// with an error so they can be reported alongside the rest.
+func parseImportCSV(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var rows []importRow
+	for first := true; ; first = false {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{line: parseErr.StartLine, err: fmt.Errorf("malformed CSV: %w", parseErr.Err)})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		if first && len(fields) >= 2 && strings.EqualFold(strings.TrimSpace(fields[0]), "key") &&
+			strings.EqualFold(strings.TrimSpace(fields[1]), "cidr") {
+			continue
+		}
+		rows = append(rows, parseImportRow(line, fields))
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("CSV body has no rows to import")
+	}
+	return rows, nil
+}
+
+func parseImportRow(line int, fields []string) importRow {
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 2 {
+		return importRow{line: line, err: fmt.Errorf("expected key,cidr[,tag=value...], got %d field(s)", len(fields))}
+	}
+
+	row := importRow{line: line, record: CIDRRecord{Key: fields[0], CIDR: unmapCIDR(fields[1])}}
+	for _, field := range fields[2:] {
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			row.err = fmt.Errorf("tag %q must be written key=value", field)
+			return row
+		}
+		if _, dup := row.record.Tags[key]; dup {
+			row.err = fmt.Errorf("tag %q is given twice", key)
+			return row
+		}
+		if row.record.Tags == nil {
+			row.record.Tags = Tags{}
+		}
+		row.record.Tags[key] = strings.TrimSpace(value)
+	}
+	return row
+}
+
+// ImportRowResult is the outcome of one CSV row. Line is the row's line in
+// the upload, and Error says why an invalid or failed row was not imported.
+type ImportRowResult struct {
+	Line   int    `json:"line"`
+	Key    string `json:"key,omitempty"`
+	CIDR   string `json:"cidr,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImportResult is the result of POST /import, with one entry per data row
+// in upload order.
+type ImportResult struct {
+	DryRun   bool              `json:"dryRun"`
+	Imported int               `json:"imported"`
+	Invalid  int               `json:"invalid"`
+	Failed   int               `json:"failed"`
+	Rows     []ImportRowResult `json:"rows"`
+}
+
+// Import registers the valid rows of a CSV upload with BatchWriteItem, in
+// chunks of 25. Each row is checked as a registration would be, against the
+// live records and the rows above it, and an invalid row is reported without
+// holding back the others; a chunk DynamoDB rejects is reported as failed.
+// With dryRun nothing is written and valid rows are reported as such.
+func (c *CIDRService) Import(ctx context.Context, rows []importRow, dryRun bool) (*ImportResult, error) {
+	existing, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	now := time.Now()
+	against := withoutExpired(existing, now)
+	result := &ImportResult{DryRun: dryRun, Rows: make([]ImportRowResult, len(rows))}
+	var valid []int
+	for i, row := range rows {
+		result.Rows[i] = ImportRowResult{Line: row.line, Key: row.record.Key, CIDR: row.record.CIDR, Status: importValid}
+		err := row.err
+		if err == nil {
+			err = c.validateImport(against, row.record)
+		}
+		if err != nil {
+			result.Rows[i].Status = importInvalid
+			result.Rows[i].Error = err.Error()
+			result.Invalid++
+			continue
+		}
+		against = append(against, row.record)
+		valid = append(valid, i)
+	}
+	if dryRun {
+		return result, nil
+	}
+	if err := c.checkRecordLimit(ctx, len(valid)); err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(valid); start += batchWriteLimit {
+		chunk := valid[start:min(start+batchWriteLimit, len(valid))]
+		records := make([]CIDRRecord, len(chunk))
+		requests := make([]types.WriteRequest, len(chunk))
+		for j, i := range chunk {
+			record := rows[i].record
+			record.CreatedAt, record.UpdatedAt = now.Unix(), now.Unix()
+			if c.partitioned {
+				_, network, _ := parseCIDR(record.CIDR)
+				record.Partition = c.partitionFor(network)
+			}
+			item, err := attributevalue.MarshalMap(record)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal record: %w", err)
+			}
+			records[j] = record
+			requests[j] = types.WriteRequest{PutRequest: &types.PutRequest{Item: item}}
+		}
+
+		err := c.batchWrite(ctx, requests)
+		for j, i := range chunk {
+			if err != nil {
+				result.Rows[i].Status = importFailed
+				result.Rows[i].Error = err.Error()
+				result.Failed++
+				continue
+			}
+			result.Rows[i].Status = importImported
+			result.Imported++
+			c.notifyRecord(ctx, auditActionRegister, records[j])
+		}
+	}
+	c.countAdded(ctx, result.Imported)
+
+	return result, nil
+}
+
+// validateImport applies the checks of a registration to an imported record,
+// against records already read rather than a fresh scan.
+func (c *CIDRService) validateImport(against []CIDRRecord, record CIDRRecord) error {
+	if record.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if err := c.validateCIDR(record.CIDR); err != nil {
+		return fmt.Errorf("invalid CIDR: %w", err)
+	}
+	if err := c.validateDescription(record.Description); err != nil {
+		return err
+	}
+	if err := c.checkTags(record, nil); err != nil {
+		return err
+	}
+	if err := c.validatePoolMembership(record); err != nil {
+		return err
+	}
+	if err := checkForbidden(c.forbidden, record.CIDR); err != nil {
+		return err
+	}
+	if err := checkScopedUniqueness(against, record, c.uniquenessScope); err != nil {
+		return err
+	}
+	return checkParent(against, record, c.requireParent)
+}
@@ -0,0 +1,223 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The integration tests run against DynamoDB Local:
+//
+//	docker run -p 8000:8000 amazon/dynamodb-local
+//	DYNAMODB_ENDPOINT=http://localhost:8000 go test -tags integration ./...
+//
+// Each test creates and drops its own table.
+
+func integrationService(t *testing.T) *CIDRService {
+	t.Helper()
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+
+	// DynamoDB Local accepts any credentials, but the SDK needs some.
+	for name, value := range map[string]string{
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "local",
+		"AWS_SECRET_ACCESS_KEY": "local",
+	} {
+		if os.Getenv(name) == "" {
+			t.Setenv(name, value)
+		}
+	}
+	tableName := fmt.Sprintf("cidr-registry-test-%d", time.Now().UnixNano())
+	t.Setenv("DYNAMODB_TABLE_NAME", tableName)
+	t.Setenv("BASE_CIDR", "10.0.0.0/16")
+	t.Setenv("ALLOCATION_PREFIX", "24")
+
+	ctx := context.Background()
+	service, err := NewCIDRService(ctx)
+	if err != nil {
+		t.Fatalf("NewCIDRService() error = %v", err)
+	}
+
+	_, err = service.dynamoClient.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("key"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("key"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+	t.Cleanup(func() {
+		service.dynamoClient.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(tableName)})
+	})
+
+	return service
+}
+
+func TestConcurrentAllocation(t *testing.T) {
+	service := integrationService(t)
+
+	const allocations = 32
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = map[string]string{}
+		errs    []error
+	)
+	for i := 0; i < allocations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("app-%02d", i)
+			stored, err := service.AllocateCIDR(context.Background(), CIDRRecord{Key: key}, AllocationOptions{})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				return
+			}
+			results[key] = stored.CIDR
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Errorf("AllocateCIDR() error = %v", err)
+	}
+
+	networks := map[string]*net.IPNet{}
+	for key, cidr := range results {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("%s got invalid CIDR %q", key, cidr)
+		}
+		for otherKey, other := range networks {
+			if network.Contains(other.IP) || other.Contains(network.IP) {
+				t.Errorf("%s got %s, which overlaps %s given to %s", key, cidr, other, otherKey)
+			}
+		}
+		networks[key] = network
+	}
+
+	records, err := service.scanRecords(context.Background(), service.dynamoClient, true)
+	if err != nil {
+		t.Fatalf("scanRecords() error = %v", err)
+	}
+	if len(records) != len(results) {
+		t.Errorf("table holds %d records, want the %d allocations that succeeded", len(records), len(results))
+	}
+	for _, record := range records {
+		if results[record.Key] != record.CIDR {
+			t.Errorf("stored %s = %s, but the allocation returned %s", record.Key, record.CIDR, results[record.Key])
+		}
+	}
+}
+
+func TestConcurrentLock(t *testing.T) {
+	service := integrationService(t)
+	ctx := context.Background()
+
+	service.lockTableName = service.tableName + "-locks"
+	_, err := service.dynamoClient.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(service.lockTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("name"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("name"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatalf("CreateTable() error = %v", err)
+	}
+	t.Cleanup(func() {
+		service.dynamoClient.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(service.lockTableName)})
+	})
+
+	const workers = 16
+	now := time.Now()
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		winners []string
+		holders = map[string]bool{}
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			owner := fmt.Sprintf("worker-%02d", i)
+			_, err := service.AcquireLock(ctx, "burst", owner, time.Minute, now)
+
+			mu.Lock()
+			defer mu.Unlock()
+			var held *LockHeldError
+			switch {
+			case err == nil:
+				winners = append(winners, owner)
+			case errors.As(err, &held) && held.Holder != nil:
+				holders[held.Holder.Owner] = true
+			default:
+				t.Errorf("%s: AcquireLock() error = %v, want success or LockHeldError", owner, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(winners) != 1 {
+		t.Fatalf("%d workers acquired the lock, want exactly one: %v", len(winners), winners)
+	}
+	winner := winners[0]
+	for owner := range holders {
+		if owner != winner {
+			t.Errorf("a loser saw holder %s, but %s won", owner, winner)
+		}
+	}
+
+	if _, err := service.HeartbeatLock(ctx, "burst", "intruder", time.Minute, now); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("HeartbeatLock(intruder) error = %v, want errLockNotHeld", err)
+	}
+	if err := service.ReleaseLock(ctx, "burst", "intruder"); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("ReleaseLock(intruder) error = %v, want errLockNotHeld", err)
+	}
+	lease, err := service.HeartbeatLock(ctx, "burst", winner, 2*time.Minute, now)
+	if err != nil || lease.ExpiresAt != now.Add(2*time.Minute).Unix() {
+		t.Errorf("HeartbeatLock(%s) = %+v, %v, want the lease extended", winner, lease, err)
+	}
+
+	// Once the lease runs out, another worker takes over and the old holder's
+	// heartbeat fails.
+	later := now.Add(3 * time.Minute)
+	if _, err := service.AcquireLock(ctx, "burst", "successor", time.Minute, later); err != nil {
+		t.Fatalf("AcquireLock() after expiry error = %v", err)
+	}
+	if _, err := service.HeartbeatLock(ctx, "burst", winner, time.Minute, later); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("HeartbeatLock(%s) after expiry error = %v, want errLockNotHeld", winner, err)
+	}
+	if err := service.ReleaseLock(ctx, "burst", "successor"); err != nil {
+		t.Errorf("ReleaseLock(successor) error = %v", err)
+	}
+	if _, err := service.AcquireLock(ctx, "burst", winner, time.Minute, later); err != nil {
+		t.Errorf("AcquireLock() after release error = %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes a JWT needs: cidr:write for requests that may modify the registry,
+// as isWriteRequest decides, and cidr:read for the rest.
+const (
+	scopeRead  = "cidr:read"
+	scopeWrite = "cidr:write"
+)
+
+const (
+	defaultJWKSRefresh = time.Hour
+
+	// jwksRefetchInterval limits how often the JWKS endpoint is fetched, so
+	// tokens with made-up key IDs, or an endpoint that is down, do not turn
+	// every request into a fetch.
+	jwksRefetchInterval = time.Minute
+	jwksFetchTimeout    = 5 * time.Second
+
+	// jwtLeeway absorbs clock skew between the issuer and this service.
+	jwtLeeway = time.Minute
+)
+
+var (
+	errTokenInvalid      = errors.New("invalid token")
+	errInsufficientScope = errors.New("insufficient scope")
+)
+
+// jwtAuthenticator verifies bearer JWTs, signed with HS256 and JWT_SECRET or
+// with RS256 or ES256 and a key from JWT_JWKS_URL.
+type jwtAuthenticator struct {
+	secret   []byte
+	jwks     *jwksCache
+	issuer   string
+	audience string
+}
+
+// jwtAuth is the JWT authentication configured by JWT_SECRET and
+// JWT_JWKS_URL, set by loadJWTAuth at startup. It is nil, and JWTs are not
+// required, while neither is set.
+var jwtAuth *jwtAuthenticator
+
+func loadJWTAuth() error {
+	a, err := parseJWTAuth(os.Getenv("JWT_SECRET"), os.Getenv("JWT_JWKS_URL"), os.Getenv("JWT_JWKS_REFRESH"))
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		a.issuer = os.Getenv("JWT_ISSUER")
+		a.audience = os.Getenv("JWT_AUDIENCE")
+	}
+	jwtAuth = a
+	return nil
+}
+
+func parseJWTAuth(secret, jwksURL, refresh string) (*jwtAuthenticator, error) {
+	if secret == "" && jwksURL == "" {
+		return nil, nil
+	}
+
+	a := &jwtAuthenticator{secret: []byte(secret)}
+	if jwksURL != "" {
+		if !strings.HasPrefix(jwksURL, "https://") && !strings.HasPrefix(jwksURL, "http://") {
+			return nil, fmt.Errorf("JWT_JWKS_URL must be an http(s) URL, got %q", jwksURL)
+		}
+		interval := defaultJWKSRefresh
+		if refresh != "" {
+			var err error
+			interval, err = time.ParseDuration(refresh)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("JWT_JWKS_REFRESH must be a positive duration such as 1h, got %q", refresh)
+			}
+		}
+		a.jwks = &jwksCache{url: jwksURL, refresh: interval, client: &http.Client{Timeout: jwksFetchTimeout}}
+	}
+	return a, nil
+}
+
+// jwtClaims are the registered claims checked on every token, plus the
+// scopes, which issuers put either in a space-separated "scope" or in an
+// "scp" array.
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	Scope     string      `json:"scope"`
+	Scp       []string    `json:"scp"`
+}
+
+// jwtAudience is the "aud" claim, a single string or an array of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// scopes returns the token's scopes from either claim.
+func (c *jwtClaims) scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+func (c *jwtClaims) hasScope(scope string) bool {
+	return slices.Contains(c.scopes(), scope)
+}
+
+// verify checks a compact JWT's signature and its exp, nbf, iss and aud
+// claims, and returns its claims. Every failure wraps errTokenInvalid.
+func (a *jwtAuthenticator) verify(ctx context.Context, token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", errTokenInvalid)
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", errTokenInvalid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", errTokenInvalid)
+	}
+	if err := a.checkSignature(ctx, header, parts[0]+"."+parts[1], signature, now); err != nil {
+		return nil, fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", errTokenInvalid)
+	}
+
+	switch {
+	case claims.ExpiresAt == 0:
+		return nil, fmt.Errorf("%w: exp claim is required", errTokenInvalid)
+	case now.Add(-jwtLeeway).Unix() >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: token has expired", errTokenInvalid)
+	case claims.NotBefore != 0 && now.Add(jwtLeeway).Unix() < claims.NotBefore:
+		return nil, fmt.Errorf("%w: token is not valid yet", errTokenInvalid)
+	case a.issuer != "" && claims.Issuer != a.issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errTokenInvalid, claims.Issuer)
+	case a.audience != "" && !slices.Contains(claims.Audience, a.audience):
+		return nil, fmt.Errorf("%w: token is not for audience %q", errTokenInvalid, a.audience)
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// checkSignature verifies signature over signed with the key the header
+// names. Algorithms are only accepted with their own key type, so an RSA
+// public key can never be used as an HMAC secret.
+func (a *jwtAuthenticator) checkSignature(ctx context.Context, header jwtHeader, signed string, signature []byte, now time.Time) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch header.Alg {
+	case "HS256":
+		if len(a.secret) == 0 {
+			return errors.New("HS256 tokens are not accepted without JWT_SECRET")
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("signature does not match")
+		}
+		return nil
+
+	case "RS256", "ES256":
+		if a.jwks == nil {
+			return fmt.Errorf("%s tokens are not accepted without JWT_JWKS_URL", header.Alg)
+		}
+		key, err := a.jwks.key(ctx, header.Kid, now)
+		if err != nil {
+			return err
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if header.Alg == "ES256" && len(signature) == 64 &&
+				ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+				return nil
+			}
+		}
+		return errors.New("signature does not match")
+	}
+	return fmt.Errorf("unsupported algorithm %q", header.Alg)
+}
+
+// jwksCache holds the keys of a JWKS endpoint by key ID. They are fetched
+// again once refresh has passed, or sooner when a token names a key ID the
+// cache doesn't know, as after the issuer rotates its keys.
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, known := c.keys[kid]
+	stale := now.Sub(c.fetchedAt) >= c.refresh
+	if (stale || !known) && now.Sub(c.attemptedAt) >= jwksRefetchInterval {
+		c.attemptedAt = now
+		keys, err := c.fetch(ctx)
+		if err != nil {
+			// Keep serving the keys already known while the endpoint is down.
+			logf(ctx, "failed to refresh JWKS from %s: %v", c.url, err)
+		} else {
+			c.keys, c.fetchedAt = keys, now
+			key, known = c.keys[kid]
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+// jsonWebKey is the part of an RFC 7517 key this service understands.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA or P-256 key.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key is not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// bearerToken returns the token of a Bearer Authorization header.
+func bearerToken(authorization string) (string, bool) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	return token, ok && token != ""
+}
+
+// jwtExempt reports whether a request may skip JWT authentication: CORS
+// preflights, health probes, GET /whoami, which checks the token itself, and
+// the static approver and admin tokens on the endpoints they gate.
+func jwtExempt(method, path, authorization string) bool {
+	switch {
+	case method == http.MethodOptions:
+		return true
+	case (method == http.MethodGet || method == http.MethodHead) && (path == "/health" || path == "/whoami"):
+		return true
+	case method == http.MethodPost && (path == "/approve" || path == "/reject"):
+		return isApprover(authorization)
+	case method == http.MethodPost && (path == "/lint/fix" || path == "/sweep"):
+		return hasBearerToken(authorization, adminToken())
+	}
+	return false
+}
+
+// authorize checks that a request carries a valid JWT with the scope its
+// method and path need. Its errors wrap errTokenInvalid (401) or
+// errInsufficientScope (403).
+func (a *jwtAuthenticator) authorize(ctx context.Context, method, path, authorization string, now time.Time) error {
+	token, ok := bearerToken(authorization)
+	if !ok {
+		return fmt.Errorf("%w: bearer token required", errTokenInvalid)
+	}
+	claims, err := a.verify(ctx, token, now)
+	if err != nil {
+		return err
+	}
+	if scope := requiredScope(method, path); !claims.hasScope(scope) {
+		return fmt.Errorf("%w: %s requires scope %s", errInsufficientScope, method, scope)
+	}
+	return nil
+}
+
+// checkJWT authenticates a request when JWT authentication is enabled and
+// the request is not exempt; otherwise it accepts the request as is.
+func checkJWT(ctx context.Context, method, path, authorization string) error {
+	if jwtAuth == nil || jwtExempt(method, path, authorization) {
+		return nil
+	}
+	return jwtAuth.authorize(ctx, method, path, authorization, time.Now())
+}
+
+// jwtErrorStatus is 403 for a valid token without the scope a request needs,
+// and 401 for any other refused token.
+func jwtErrorStatus(err error) int {
+	if errors.Is(err, errInsufficientScope) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+func requiredScope(method, path string) string {
+	if isWriteRequest(method, path) {
+		return scopeWrite
+	}
+	return scopeRead
+}
+
+// authenticateHeader is the WWW-Authenticate challenge for a refused request,
+// as RFC 6750 describes.
+func authenticateHeader(err error, method, path string) string {
+	if errors.Is(err, errInsufficientScope) {
+		return fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, requiredScope(method, path))
+	}
+	return `Bearer error="invalid_token"`
+}
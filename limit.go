@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// recordLimitCode tags the error response of a write refused by MAX_RECORDS.
+const recordLimitCode = "RECORD_LIMIT_REACHED"
+
+// recordCountInterval is how long a table's item count is trusted before
+// MAX_RECORDS counts it again.
+const recordCountInterval = 30 * time.Second
+
+// parseMaxRecords reads MAX_RECORDS. Zero, the default, is unlimited.
+func parseMaxRecords(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("MAX_RECORDS must be a positive integer, got %q", value)
+	}
+	return limit, nil
+}
+
+// RecordLimitError reports a write refused because the table would hold more
+// than MAX_RECORDS records.
+type RecordLimitError struct {
+	Max    int
+	Count  int
+	Adding int
+}
+
+func (e *RecordLimitError) Error() string {
+	return fmt.Sprintf("capacity limit reached: the table holds %d of the %d records MAX_RECORDS allows, so %d more cannot be added",
+		e.Count, e.Max, e.Adding)
+}
+
+// recordCounts caches the item count of each records table, with the records
+// this instance added since it was counted.
+type recordCounts struct {
+	mu     sync.Mutex
+	tables map[string]countedRecords
+}
+
+type countedRecords struct {
+	count     int
+	countedAt time.Time
+}
+
+// checkRecordLimit refuses adding records when the table would then hold
+// more than MAX_RECORDS. The count is a Select COUNT scan, refreshed every
+// recordCountInterval, plus the records this instance added or removed
+// since. The scan runs without the lock, so a recount holds up no other
+// write; of two concurrent recounts the later one is kept.
+func (c *CIDRService) checkRecordLimit(ctx context.Context, adding int) error {
+	if c.maxRecords == 0 || adding <= 0 {
+		return nil
+	}
+
+	table := c.table(ctx)
+	c.recordCounts.mu.Lock()
+	counted := c.recordCounts.tables[table]
+	c.recordCounts.mu.Unlock()
+
+	if now := time.Now(); now.Sub(counted.countedAt) >= recordCountInterval {
+		count, err := c.CountCIDRs(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check MAX_RECORDS: %w", err)
+		}
+
+		c.recordCounts.mu.Lock()
+		current, ok := c.recordCounts.tables[table]
+		if !ok || !current.countedAt.After(now) {
+			current = countedRecords{count: count, countedAt: now}
+			if c.recordCounts.tables == nil {
+				c.recordCounts.tables = make(map[string]countedRecords)
+			}
+			c.recordCounts.tables[table] = current
+		}
+		counted = current
+		c.recordCounts.mu.Unlock()
+	}
+
+	if counted.count+adding > c.maxRecords {
+		return &RecordLimitError{Max: c.maxRecords, Count: counted.count, Adding: adding}
+	}
+	return nil
+}
+
+// countAdded adds records written since the table was last counted. A
+// negative count removes them.
+func (c *CIDRService) countAdded(ctx context.Context, added int) {
+	if c.maxRecords == 0 || added == 0 {
+		return
+	}
+
+	c.recordCounts.mu.Lock()
+	defer c.recordCounts.mu.Unlock()
+
+	table := c.table(ctx)
+	if counted, ok := c.recordCounts.tables[table]; ok {
+		counted.count += added
+		c.recordCounts.tables[table] = counted
+	}
+}
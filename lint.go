@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// LintIssue is a record whose stored CIDR is not in canonical form. Canonical
+// is empty, and Error set, when the CIDR does not parse at all.
+type LintIssue struct {
+	Key       string `json:"key"`
+	CIDR      string `json:"cidr"`
+	Canonical string `json:"canonical,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// LintReport is the result of GET /lint.
+type LintReport struct {
+	Scanned int         `json:"scanned"`
+	Issues  []LintIssue `json:"issues"`
+}
+
+// LintFixResult is the result of POST /lint/fix.
+type LintFixResult struct {
+	Fixed  []LintIssue `json:"fixed"`
+	Failed []LintIssue `json:"failed"`
+}
+
+// adminToken is ADMIN_TOKEN, the bearer token POST /lint/fix and POST /sweep
+// require. Both endpoints are disabled while it is unset.
+func adminToken() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// hasBearerToken reports whether an Authorization header carries token.
+func hasBearerToken(authorization, token string) bool {
+	presented, ok := strings.CutPrefix(authorization, "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// canonicalCIDR returns cidr in canonical form: host bits cleared, IPv6
+// addresses lower-case and compressed, and IPv4-mapped IPv6 blocks such as
+// ::ffff:10.5.0.0/120 in their IPv4 form, 10.5.0.0/24.
+func canonicalCIDR(cidr string) (string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR format: %w", err)
+	}
+	if prefix.Addr().Is4In6() {
+		if prefix.Bits() < ipv4MappedPrefix {
+			return "", fmt.Errorf("IPv4-mapped CIDR %s must have a prefix of at least /%d", cidr, ipv4MappedPrefix)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-ipv4MappedPrefix)
+	}
+	return prefix.Masked().String(), nil
+}
+
+// lintRecords returns the records whose CIDR is not canonical.
+func lintRecords(records []CIDRRecord) []LintIssue {
+	issues := []LintIssue{}
+	for _, record := range records {
+		canonical, err := canonicalCIDR(record.CIDR)
+		switch {
+		case err != nil:
+			issues = append(issues, LintIssue{Key: record.Key, CIDR: record.CIDR, Error: err.Error()})
+		case canonical != record.CIDR:
+			issues = append(issues, LintIssue{Key: record.Key, CIDR: record.CIDR, Canonical: canonical})
+		}
+	}
+	return issues
+}
+
+// Lint scans every record for a non-canonical CIDR. Host bits are ignored by
+// the overlap checks, which parse the network, but string comparisons such as
+// duplicate detection see "10.0.0.1/24" and "10.0.0.0/24" as different.
+func (c *CIDRService) Lint(ctx context.Context) (*LintReport, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CIDRs: %w", err)
+	}
+	return &LintReport{Scanned: len(records), Issues: lintRecords(records)}, nil
+}
+
+// FixLint rewrites every non-canonical CIDR to its canonical form. Each
+// rewrite is conditional on the record still holding the CIDR that was
+// scanned; a record changed since, or one whose CIDR does not parse, is
+// reported as failed and left alone.
+func (c *CIDRService) FixLint(ctx context.Context) (*LintFixResult, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CIDRs: %w", err)
+	}
+
+	byKey := make(map[string]CIDRRecord, len(records))
+	for _, record := range records {
+		byKey[record.Key] = record
+	}
+
+	result := &LintFixResult{Fixed: []LintIssue{}, Failed: []LintIssue{}}
+	for _, issue := range lintRecords(records) {
+		if issue.Error != "" {
+			result.Failed = append(result.Failed, issue)
+			continue
+		}
+
+		old := byKey[issue.Key]
+		updated := old
+		updated.CIDR = issue.Canonical
+		updated.UpdatedAt = time.Now().Unix()
+		if err := c.replaceCIDR(ctx, old, updated); err != nil {
+			issue.Error = err.Error()
+			result.Failed = append(result.Failed, issue)
+			continue
+		}
+		result.Fixed = append(result.Fixed, issue)
+	}
+	return result, nil
+}
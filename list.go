@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordFilter narrows GET / to the records matching every non-empty field.
+type RecordFilter struct {
+	Account string
+	Region  string
+	// Status is "pending" or "active".
+	Status string
+	// CreatedBefore, in Unix seconds, keeps only records created before it.
+	// Records without a createdAt are of unknown age and never match.
+	CreatedBefore int64
+}
+
+func parseRecordFilter(query func(string) string, now time.Time) (RecordFilter, error) {
+	filter := RecordFilter{
+		Account: query("account"),
+		Region:  query("region"),
+		Status:  query("status"),
+	}
+	if value := query("olderThan"); value != "" {
+		age, err := parseAge(value)
+		if err != nil {
+			return filter, fmt.Errorf("olderThan %w", err)
+		}
+		filter.CreatedBefore = now.Add(-age).Unix()
+	}
+	return filter, nil
+}
+
+// parseAge parses an age such as "30d", or a Go duration such as "12h".
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("must be a number of days such as 30d or a duration such as 12h, got %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("must be a number of days such as 30d or a duration such as 12h, got %q", value)
+	}
+	return age, nil
+}
+
+func (f RecordFilter) matches(record CIDRRecord) bool {
+	status := record.Status
+	if status == "" {
+		status = recordStatusActive
+	}
+	return (f.Account == "" || record.Account == f.Account) &&
+		(f.Region == "" || record.Region == f.Region) &&
+		(f.Status == "" || status == f.Status) &&
+		(f.CreatedBefore == 0 || (record.CreatedAt != 0 && record.CreatedAt < f.CreatedBefore))
+}
+
+// withAges sets the age of every record that has a createdAt.
+func withAges(records []CIDRRecord, now time.Time) []CIDRRecord {
+	for i := range records {
+		records[i].setAge(now)
+	}
+	return records
+}
+
+// sortRecords orders records for GET /?sort=: "key" (the default) or "age",
+// oldest first, with records of unknown age last.
+func sortRecords(records []CIDRRecord, order string) error {
+	switch order {
+	case "", "key":
+		return nil
+	case "age":
+		sort.SliceStable(records, func(i, j int) bool {
+			a, b := records[i].CreatedAt, records[j].CreatedAt
+			if a == 0 || b == 0 {
+				return b == 0 && a != 0
+			}
+			return a < b
+		})
+		return nil
+	default:
+		return fmt.Errorf("sort must be %q or %q, got %q", "key", "age", order)
+	}
+}
+
+func filterRecords(records []CIDRRecord, filter RecordFilter) []CIDRRecord {
+	if filter == (RecordFilter{}) {
+		return records
+	}
+
+	filtered := []CIDRRecord{}
+	for _, record := range records {
+		if filter.matches(record) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+// namespaceSeparator splits hierarchical keys such as "team-a/prod/vpc1".
+const namespaceSeparator = "/"
+
+// Namespace groups the records whose keys share a path prefix. Count includes
+// the records of nested namespaces.
+type Namespace struct {
+	Name       string       `json:"name,omitempty"`
+	Count      int          `json:"count"`
+	Records    []CIDRRecord `json:"records,omitempty"`
+	Namespaces []*Namespace `json:"namespaces,omitempty"`
+
+	children map[string]*Namespace
+}
+
+// parseGroupBy returns the namespace depth requested by GET /?groupBy=namespace,
+// or 0 when no grouping was requested. depth defaults to 1.
+func parseGroupBy(query func(string) string) (int, error) {
+	switch query("groupBy") {
+	case "":
+		return 0, nil
+	case "namespace":
+	default:
+		return 0, fmt.Errorf("groupBy must be %q, got %q", "namespace", query("groupBy"))
+	}
+
+	value := query("depth")
+	if value == "" {
+		return 1, nil
+	}
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 1 {
+		return 0, fmt.Errorf("depth must be a positive integer, got %q", value)
+	}
+	return depth, nil
+}
+
+// groupByNamespace nests records under the first depth segments of their keys.
+// The last segment names the record itself, so a key with depth or fewer
+// segments is listed in the deepest namespace it has, and a key without a
+// separator is listed at the root.
+func groupByNamespace(records []CIDRRecord, depth int) *Namespace {
+	root := &Namespace{}
+	for _, record := range records {
+		segments := strings.Split(record.Key, namespaceSeparator)
+		segments = segments[:min(len(segments)-1, depth)]
+
+		node := root
+		node.Count++
+		for _, segment := range segments {
+			if node.children == nil {
+				node.children = map[string]*Namespace{}
+			}
+			child, ok := node.children[segment]
+			if !ok {
+				child = &Namespace{Name: segment}
+				node.children[segment] = child
+				node.Namespaces = append(node.Namespaces, child)
+			}
+			node = child
+			node.Count++
+		}
+		node.Records = append(node.Records, record)
+	}
+
+	sortNamespaces(root)
+	return root
+}
+
+func sortNamespaces(node *Namespace) {
+	sort.Slice(node.Namespaces, func(i, j int) bool {
+		return node.Namespaces[i].Name < node.Namespaces[j].Name
+	})
+	for _, child := range node.Namespaces {
+		sortNamespaces(child)
+	}
+}
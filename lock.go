@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Lease durations of POST /lock/acquire and POST /lock/heartbeat.
+const (
+	defaultLockTTL = 30 * time.Second
+	maxLockTTL     = time.Hour
+)
+
+// errLockNotHeld is returned when a heartbeat or release names a lock the
+// owner does not hold, because it was never taken, it was released, or its
+// lease ran out.
+var errLockNotHeld = errors.New("lock is not held by this owner")
+
+// lockRequest is the body of the /lock endpoints. TTLSeconds is ignored on
+// release.
+type lockRequest struct {
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	TTLSeconds int    `json:"ttlSeconds"`
+}
+
+func (r lockRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	if r.Name == "" {
+		errs["name"] = "required"
+	}
+	if r.Owner == "" {
+		errs["owner"] = "required"
+	}
+	if r.TTLSeconds < 0 || time.Duration(r.TTLSeconds)*time.Second > maxLockTTL {
+		errs["ttlSeconds"] = fmt.Sprintf("must be between 1 and %d", int(maxLockTTL/time.Second))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ttl is the requested lease duration, defaultLockTTL when none is given.
+func (r lockRequest) ttl() time.Duration {
+	if r.TTLSeconds == 0 {
+		return defaultLockTTL
+	}
+	return time.Duration(r.TTLSeconds) * time.Second
+}
+
+// Lease is a lock as stored in LOCK_TABLE_NAME. The table's TTL on expiresAt
+// removes leases that were never released; until then an expired lease is
+// free to take.
+type Lease struct {
+	Name       string `json:"name" dynamodbav:"name"`
+	Owner      string `json:"owner" dynamodbav:"owner"`
+	AcquiredAt int64  `json:"acquiredAt" dynamodbav:"acquiredAt"`
+	ExpiresAt  int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+// LockHeldError reports a lock another owner holds, with its lease so the
+// caller knows when to try again.
+type LockHeldError struct {
+	Holder *Lease
+}
+
+func (e *LockHeldError) Error() string {
+	if e.Holder == nil {
+		return "lock is held by another owner"
+	}
+	return fmt.Sprintf("lock '%s' is held by '%s' until %d", e.Holder.Name, e.Holder.Owner, e.Holder.ExpiresAt)
+}
+
+// AcquireLock takes a lock with a conditional write that only succeeds when
+// the lock is free, its lease has run out, or owner already holds it, in
+// which case the lease starts over.
+func (c *CIDRService) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration, now time.Time) (*Lease, error) {
+	result, err := c.dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(c.lockTableName),
+		Key:                 lockKey(name),
+		UpdateExpression:    aws.String("SET #o = :owner, #e = :expires, #a = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(#n) OR #e <= :now OR #o = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#n": "name",
+			"#o": "owner",
+			"#e": "expiresAt",
+			"#a": "acquiredAt",
+		},
+		ExpressionAttributeValues:           lockValues(owner, now.Add(ttl).Unix(), now),
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, &LockHeldError{Holder: leaseFromItem(conditionErr.Item)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock in DynamoDB: %w", err)
+	}
+	return leaseFromItem(result.Attributes), nil
+}
+
+// HeartbeatLock extends a lease owner holds to ttl from now. A lease that ran
+// out is not revived, even if nobody took the lock in the meantime, so a
+// holder that stalled past its lease learns it may have lost exclusivity.
+func (c *CIDRService) HeartbeatLock(ctx context.Context, name, owner string, ttl time.Duration, now time.Time) (*Lease, error) {
+	result, err := c.dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(c.lockTableName),
+		Key:                 lockKey(name),
+		UpdateExpression:    aws.String("SET #e = :expires"),
+		ConditionExpression: aws.String("#o = :owner AND #e > :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#o": "owner",
+			"#e": "expiresAt",
+		},
+		ExpressionAttributeValues: lockValues(owner, now.Add(ttl).Unix(), now),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, fmt.Errorf("lock '%s' %w", name, errLockNotHeld)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to extend lock in DynamoDB: %w", err)
+	}
+	return leaseFromItem(result.Attributes), nil
+}
+
+// ReleaseLock deletes a lock owner holds, or held until its lease ran out
+// and nobody has taken it since.
+func (c *CIDRService) ReleaseLock(ctx context.Context, name, owner string) error {
+	_, err := c.dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(c.lockTableName),
+		Key:                      lockKey(name),
+		ConditionExpression:      aws.String("#o = :owner"),
+		ExpressionAttributeNames: map[string]string{"#o": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return fmt.Errorf("lock '%s' %w", name, errLockNotHeld)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release lock in DynamoDB: %w", err)
+	}
+	return nil
+}
+
+func lockKey(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"name": &types.AttributeValueMemberS{Value: name},
+	}
+}
+
+func lockValues(owner string, expires int64, now time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":owner":   &types.AttributeValueMemberS{Value: owner},
+		":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires, 10)},
+		":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+	}
+}
+
+// leaseFromItem decodes a lock item, or returns nil for an empty or
+// unreadable one.
+func leaseFromItem(item map[string]types.AttributeValue) *Lease {
+	if len(item) == 0 {
+		return nil
+	}
+	var lease Lease
+	if err := attributevalue.UnmarshalMap(item, &lease); err != nil {
+		return nil
+	}
+	return &lease
+}
@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 )
 
 func createResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
 	var bodyStr string
 	if body != nil {
-		bodyBytes, err := json.Marshal(body)
+		bodyBytes, err := marshalResponse(body)
 		if err != nil {
 			return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response body: %w", err)
 		}
@@ -23,98 +28,1270 @@ func createResponse(statusCode int, body interface{}) (events.APIGatewayProxyRes
 	return events.APIGatewayProxyResponse{
 		StatusCode: statusCode,
 		Headers: map[string]string{
-			"Content-Type":                 "application/json",
+			"Content-Type":                 contentTypeJSON,
 			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "GET, POST, DELETE, OPTIONS",
-			"Access-Control-Allow-Headers": "Content-Type, Authorization",
+			"Access-Control-Allow-Methods": "GET, HEAD, POST, PATCH, DELETE, OPTIONS",
+			"Access-Control-Allow-Headers": "Content-Type, Authorization, X-Signature, X-Timestamp",
+			"Vary":                         "Accept",
 		},
 		Body: bodyStr,
 	}, nil
 }
 
+func createdResponse(cidr string) (events.APIGatewayProxyResponse, error) {
+	response, err := createResponse(http.StatusCreated, nil)
+	if err != nil {
+		return response, err
+	}
+	response.Headers["Location"] = recordLocation(cidr)
+	return response, nil
+}
+
+// textResponse is a 200 with a non-JSON body, such as a DOT graph.
+func textResponse(contentType, body string) (events.APIGatewayProxyResponse, error) {
+	response, err := createResponse(http.StatusOK, nil)
+	if err != nil {
+		return response, err
+	}
+	response.Headers["Content-Type"] = contentType
+	response.Body = body
+	return response, nil
+}
+
+// notModifiedResponse is a bodiless 304 carrying a GET response's caching
+// headers.
+func notModifiedResponse(headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	response, err := createResponse(http.StatusNotModified, nil)
+	if err != nil {
+		return response, err
+	}
+	delete(response.Headers, "Content-Type")
+	return withHeaders(response, headers), nil
+}
+
+// withHeaders adds headers to response.
+func withHeaders(response events.APIGatewayProxyResponse, headers map[string]string) events.APIGatewayProxyResponse {
+	for name, value := range headers {
+		response.Headers[name] = value
+	}
+	return response
+}
+
+// errorResponse reports a failed service call. Throttling that outlasted the
+// SDK's retries becomes 503 with Retry-After so clients back off.
+func errorResponse(statusCode int, err error, message string) (events.APIGatewayProxyResponse, error) {
+	if !isThrottlingError(err) {
+		return createResponse(statusCode, map[string]string{"error": message})
+	}
+
+	response, respErr := createResponse(http.StatusServiceUnavailable, map[string]string{"error": message})
+	if respErr != nil {
+		return response, respErr
+	}
+	response.Headers["Retry-After"] = throttleRetryAfter
+	return response, nil
+}
+
+// duplicateKeyResponse is the 409 for a registration under a taken key,
+// including the record that holds it.
+func duplicateKeyResponse(err *DuplicateKeyError) (events.APIGatewayProxyResponse, error) {
+	return createResponse(http.StatusConflict, map[string]interface{}{
+		"error":    err.Error(),
+		"existing": err.Existing,
+	})
+}
+
+// allocationFailedResponse is the 400, or 422 with STRICT_STATUS_CODES, for
+// an allocation refused for lack of space, tagged with a code clients can
+// match on.
+func allocationFailedResponse(err error, code string) (events.APIGatewayProxyResponse, error) {
+	return createResponse(rejectedStatus(), map[string]string{
+		"error": fmt.Sprintf("failed to allocate CIDR: %v", err),
+		"code":  code,
+	})
+}
+
+// recordLimitResponse is the 400, or 422 with STRICT_STATUS_CODES, for a
+// write refused by MAX_RECORDS.
+func recordLimitResponse(err *RecordLimitError) (events.APIGatewayProxyResponse, error) {
+	return createResponse(rejectedStatus(), map[string]string{
+		"error": err.Error(),
+		"code":  recordLimitCode,
+	})
+}
+
+// requestHeader returns a request header, matching its name without regard
+// to case as API Gateway passes headers through as the client sent them.
+func requestHeader(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// queryParam returns a lookup of the request's query string parameters.
+func queryParam(request events.APIGatewayProxyRequest) func(string) string {
+	return func(name string) string {
+		return request.QueryStringParameters[name]
+	}
+}
+
+// recordResponse answers GET /cidr?key=<key> with the stored record, its ETag
+// and its caching headers, or 304 when it is unchanged since If-Modified-Since.
+func recordResponse(ctx context.Context, cidrService *CIDRService, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	key := request.QueryStringParameters["key"]
+	if key == "" {
+		return createResponse(http.StatusBadRequest, map[string]string{
+			"error": "key parameter is required",
+		})
+	}
+
+	record, err := cidrService.GetRecord(ctx, key)
+	if errors.Is(err, errRecordNotFound) {
+		return createResponse(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, err,
+			fmt.Sprintf("failed to get CIDR: %v", err))
+	}
+
+	modified := recordModified(*record)
+	if notModified(requestHeader(request, "If-Modified-Since"), modified) {
+		return notModifiedResponse(cidrService.cacheHeaders(modified))
+	}
+
+	etag, err := recordETag(*record)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	record.setAge(time.Now())
+	response, err := createResponse(http.StatusOK, record)
+	if err != nil {
+		return response, err
+	}
+	response.Headers["ETag"] = etag
+	return withHeaders(response, cidrService.cacheHeaders(modified)), nil
+}
+
+// approvalResponse answers POST /approve?key=<key> and POST /reject?key=<key>,
+// which only approvers may call.
+func approvalResponse(ctx context.Context, cidrService *CIDRService, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if approverToken() == "" {
+		return createResponse(http.StatusNotFound, map[string]string{
+			"error": "approval workflow is disabled; set APPROVER_TOKEN to enable it",
+		})
+	}
+	if !isApprover(requestHeader(request, "Authorization")) {
+		return createResponse(http.StatusUnauthorized, map[string]string{
+			"error": "approver token required",
+		})
+	}
+
+	key := request.QueryStringParameters["key"]
+	if key == "" {
+		return createResponse(http.StatusBadRequest, map[string]string{
+			"error": "key parameter is required",
+		})
+	}
+
+	action, message := cidrService.ApproveRequest, "request approved"
+	if request.Path == "/reject" {
+		action, message = cidrService.RejectRequest, "request rejected"
+	}
+
+	record, err := action(ctx, key)
+	if errors.Is(err, errRecordNotFound) {
+		return createResponse(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if errors.Is(err, errNotPending) {
+		return createResponse(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, err,
+			fmt.Sprintf("failed to update request: %v", err))
+	}
+
+	return createResponse(http.StatusOK, map[string]interface{}{
+		"message": message,
+		"record":  record,
+	})
+}
+
+// lockResponse answers POST /lock/acquire, /lock/heartbeat and
+// /lock/release.
+func lockResponse(ctx context.Context, cidrService *CIDRService, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if cidrService.lockTableName == "" {
+		return createResponse(http.StatusNotFound, map[string]string{
+			"error": "locks are disabled; set LOCK_TABLE_NAME to enable them",
+		})
+	}
+
+	var lockBody lockRequest
+	if errs := decodeJSONBody(strings.NewReader(request.Body), &lockBody); errs != nil {
+		return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+	}
+	if errs := lockBody.validate(); errs != nil {
+		return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+	}
+
+	var lease *Lease
+	var err error
+	switch request.Path {
+	case "/lock/acquire":
+		lease, err = cidrService.AcquireLock(ctx, lockBody.Name, lockBody.Owner, lockBody.ttl(), time.Now())
+	case "/lock/heartbeat":
+		lease, err = cidrService.HeartbeatLock(ctx, lockBody.Name, lockBody.Owner, lockBody.ttl(), time.Now())
+	default:
+		err = cidrService.ReleaseLock(ctx, lockBody.Name, lockBody.Owner)
+	}
+
+	var held *LockHeldError
+	if errors.As(err, &held) {
+		return createResponse(http.StatusConflict, map[string]interface{}{
+			"error":  err.Error(),
+			"holder": held.Holder,
+		})
+	}
+	if errors.Is(err, errLockNotHeld) {
+		return createResponse(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, err,
+			fmt.Sprintf("failed to update lock: %v", err))
+	}
+	if lease == nil {
+		return createResponse(http.StatusOK, map[string]string{"message": "lock released"})
+	}
+	return createResponse(http.StatusOK, lease)
+}
+
 func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	cidrService, err := NewCIDRService(ctx)
+	if readOnly() && isWriteRequest(request.HTTPMethod, request.Path) {
+		return createResponse(http.StatusServiceUnavailable, map[string]string{
+			"error": "service is read-only",
+		})
+	}
+
+	if err := checkJWT(ctx, request.HTTPMethod, request.Path, requestHeader(request, "Authorization")); err != nil {
+		response, respErr := createResponse(jwtErrorStatus(err), map[string]string{
+			"error": err.Error(),
+		})
+		if respErr == nil {
+			response.Headers["WWW-Authenticate"] = authenticateHeader(err, request.HTTPMethod, request.Path)
+		}
+		return response, respErr
+	}
+
+	if signing.enabled() && isWriteRequest(request.HTTPMethod, request.Path) {
+		err := signing.verify(request.HTTPMethod, request.Path, canonicalQuery(parameterValues(request.QueryStringParameters)),
+			requestHeader(request, timestampHeader), requestHeader(request, signatureHeader),
+			[]byte(request.Body), time.Now())
+		if err != nil {
+			return createResponse(http.StatusUnauthorized, map[string]string{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	cidrService, err := getCIDRService(ctx)
 	if err != nil {
 		return createResponse(http.StatusInternalServerError, map[string]string{
 			"error": fmt.Sprintf("failed to initialize CIDR service: %v", err),
 		})
 	}
+	ctx = cidrService.withTableRoute(ctx, request.QueryStringParameters["tenant"], request.QueryStringParameters["pool"])
 
 	switch request.HTTPMethod {
 	case "GET":
 		if request.Path == "/next" || (request.QueryStringParameters != nil && request.QueryStringParameters["action"] == "next") {
-			nextCIDR, err := cidrService.GetNextAvailableCIDR(ctx)
+			opts, err := parseAllocationOptions(queryParam(request))
 			if err != nil {
-				return createResponse(http.StatusInternalServerError, map[string]string{
-					"error": fmt.Sprintf("failed to get next available CIDR: %v", err),
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
 				})
 			}
-			return createResponse(http.StatusOK, map[string]string{
-				"cidr": nextCIDR,
-			})
+			format, err := parseNextFormat(request.QueryStringParameters["format"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			if prefixesParam := request.QueryStringParameters["prefixes"]; prefixesParam != "" {
+				if opts.Prefix != 0 || request.QueryStringParameters["hosts"] != "" {
+					return createResponse(http.StatusBadRequest, map[string]string{
+						"error": "use the prefixes parameter without prefix or hosts",
+					})
+				}
+				if format == nextFormatEnv {
+					return createResponse(http.StatusBadRequest, map[string]string{
+						"error": "format=env describes a single block; use prefix or hosts instead of prefixes",
+					})
+				}
+
+				prefixes, err := parsePrefixList(prefixesParam)
+				if err != nil {
+					return createResponse(http.StatusBadRequest, map[string]string{
+						"error": err.Error(),
+					})
+				}
+				for _, prefix := range prefixes {
+					prefixOpts := opts
+					prefixOpts.Prefix = prefix
+					if _, _, _, err := cidrService.resolveAllocation(prefixOpts); err != nil {
+						return createResponse(rejectedStatus(), map[string]string{
+							"error": err.Error(),
+						})
+					}
+				}
+
+				next, err := cidrService.NextAvailableCIDRs(ctx, opts, prefixes)
+				if err != nil {
+					return errorResponse(http.StatusInternalServerError, err,
+						fmt.Sprintf("failed to get next available CIDRs: %v", err))
+				}
+				return createResponse(http.StatusOK, map[string]interface{}{"cidrs": next})
+			}
+
+			hostsParam := request.QueryStringParameters["hosts"]
+			if hostsParam != "" {
+				if opts.Prefix != 0 {
+					return createResponse(http.StatusBadRequest, map[string]string{
+						"error": "use either the hosts or the prefix parameter, not both",
+					})
+				}
+
+				hosts, err := strconv.Atoi(hostsParam)
+				if err != nil {
+					return createResponse(http.StatusBadRequest, map[string]string{
+						"error": "hosts parameter must be an integer",
+					})
+				}
+
+				opts.Prefix, err = cidrService.PrefixForHosts(hosts, opts.Base)
+				if err != nil {
+					return createResponse(http.StatusBadRequest, map[string]string{
+						"error": err.Error(),
+					})
+				}
+			}
+
+			if _, _, _, err := cidrService.resolveAllocation(opts); err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			nextCIDR, err := cidrService.GetNextAvailableCIDR(ctx, opts)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get next available CIDR: %v", err))
+			}
+
+			if format == nextFormatEnv {
+				snippet, err := envSnippet(nextCIDR)
+				if err != nil {
+					return errorResponse(http.StatusInternalServerError, err,
+						fmt.Sprintf("failed to describe CIDR: %v", err))
+				}
+				return textResponse(contentTypeText, snippet)
+			}
+			body := map[string]interface{}{"cidr": nextCIDR}
+			if hostsParam != "" {
+				body["prefix"] = opts.Prefix
+				body["usableHosts"] = usableHosts(opts.Prefix)
+			}
+			if source := cidrService.allocationSource(opts, nextCIDR); source != "" {
+				body["source"] = source
+			}
+			return createResponse(http.StatusOK, body)
+		}
+
+		if request.Path == "/available-blocks" {
+			opts, err := parseAllocationOptions(queryParam(request))
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			limit, err := parseAvailableLimit(request.QueryStringParameters["limit"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			from, err := decodeAvailableToken(request.QueryStringParameters["nextToken"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			base, _, _, err := cidrService.resolveAllocation(opts)
+			if err == nil {
+				err = checkAvailableBase(base)
+			}
+			if err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			page, err := cidrService.AvailableBlocks(ctx, opts, limit, from)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to list available blocks: %v", err))
+			}
+			return createResponse(http.StatusOK, page)
+		}
+
+		if request.Path == "/describe" {
+			cidr := request.QueryStringParameters["cidr"]
+			if cidr == "" {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": "cidr parameter is required",
+				})
+			}
+
+			if err := cidrService.validateCIDR(cidr); err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": fmt.Sprintf("invalid CIDR: %v", err),
+				})
+			}
+
+			description, err := cidrService.DescribeCIDR(ctx, cidr)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to describe CIDR: %v", err))
+			}
+			return createResponse(http.StatusOK, description)
+		}
+
+		if request.Path == "/adjacent" {
+			cidr := request.QueryStringParameters["cidr"]
+			if cidr == "" {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": "cidr parameter is required",
+				})
+			}
+
+			if err := cidrService.validateCIDR(cidr); err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": fmt.Sprintf("invalid CIDR: %v", err),
+				})
+			}
+
+			adjacent, err := cidrService.AdjacentBlocks(ctx, cidr)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to find adjacent blocks: %v", err))
+			}
+			return createResponse(http.StatusOK, adjacent)
+		}
+
+		if request.Path == "/tree" {
+			base, _, err := cidrService.resolveBase(request.QueryStringParameters["base"])
+			if err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			tree, err := cidrService.Tree(ctx, base, request.QueryStringParameters["free"] == "true")
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to build allocation tree: %v", err))
+			}
+			return createResponse(http.StatusOK, tree)
+		}
+
+		if request.Path == "/backup" {
+			backup, err := cidrService.Backup(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to back up CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, backup)
+		}
+
+		if request.Path == "/cidr" {
+			return recordResponse(ctx, cidrService, request)
+		}
+
+		if request.Path == "/keys" {
+			keys, err := cidrService.ListKeys(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to list keys: %v", err))
+			}
+			return createResponse(http.StatusOK, keys)
+		}
+
+		if request.Path == "/stats" {
+			stats, err := cidrService.GetStats(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get stats: %v", err))
+			}
+			return createResponse(http.StatusOK, stats)
+		}
+
+		if request.Path == "/capacity" {
+			report, err := cidrService.Capacity(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get capacity: %v", err))
+			}
+			return createResponse(http.StatusOK, report)
+		}
+
+		if request.Path == "/status-breakdown" {
+			breakdown, err := cidrService.StatusBreakdown(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get status breakdown: %v", err))
+			}
+			return createResponse(http.StatusOK, breakdown)
+		}
+
+		if request.Path == "/fragmentation" {
+			format, err := parseFragmentationFormat(request.QueryStringParameters["format"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			report, err := cidrService.Fragmentation(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get fragmentation: %v", err))
+			}
+			if format == fragmentationFormatPrometheus {
+				return textResponse(contentTypePrometheus, report.prometheusGauges())
+			}
+			return createResponse(http.StatusOK, report)
+		}
+
+		if request.Path == "/metrics/allocations" {
+			labels, err := parseAllocationMetricLabels(request.QueryStringParameters["labels"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			if redaction.appliesTo(ctx, request.HTTPMethod, requestHeader(request, "Authorization")) {
+				labels = redaction.withoutRedacted(labels)
+			}
+			records, err := cidrService.GetAllCIDRs(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get CIDRs: %v", err))
+			}
+			return textResponse(contentTypePrometheus, allocationGauges(withoutExpired(records, time.Now()), labels))
+		}
+
+		if request.Path == "/forecast" {
+			window, err := parseForecastWindow(request.QueryStringParameters["window"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			report, err := cidrService.Forecast(ctx, window, time.Now())
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get forecast: %v", err))
+			}
+			return createResponse(http.StatusOK, report)
+		}
+
+		if request.Path == "/lint" {
+			report, err := cidrService.Lint(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to lint CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, report)
+		}
+
+		if request.Path == "/whoami" {
+			signed := isSigned(request.HTTPMethod, request.Path, canonicalQuery(parameterValues(request.QueryStringParameters)),
+				requestHeader(request, timestampHeader), requestHeader(request, signatureHeader), []byte(request.Body))
+			principal := resolvePrincipal(ctx, requestHeader(request, "Authorization"), signed)
+			if principal == nil {
+				return createResponse(http.StatusUnauthorized, map[string]string{
+					"error": "request is not authenticated",
+				})
+			}
+			return createResponse(http.StatusOK, principal)
+		}
+
+		if request.Path == "/version" {
+			return createResponse(http.StatusOK, buildInfo())
+		}
+
+		if request.Path == "/health" {
+			health := cidrService.Health(ctx)
+			if health.Status != healthStatusOK {
+				return createResponse(http.StatusServiceUnavailable, health)
+			}
+			return createResponse(http.StatusOK, health)
+		}
+
+		if request.Path == "/history" {
+			query, err := parseHistoryQuery(queryParam(request))
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			page, err := cidrService.History(ctx, query)
+			switch {
+			case errors.Is(err, errAuditDisabled):
+				return createResponse(http.StatusNotFound, map[string]string{"error": err.Error()})
+			case errors.Is(err, errInvalidHistoryToken):
+				return createResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			case err != nil:
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get history: %v", err))
+			}
+			return createResponse(http.StatusOK, page)
+		}
+
+		if request.QueryStringParameters["countOnly"] == "true" {
+			count, err := cidrService.CountCIDRs(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to count CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, map[string]int{"count": count})
 		}
 
 		// Get all CIDRs
+		changed := cidrService.lastChanged(ctx)
 		records, err := cidrService.GetAllCIDRs(ctx)
 		if err != nil {
-			return createResponse(http.StatusInternalServerError, map[string]string{
-				"error": fmt.Sprintf("failed to get CIDRs: %v", err),
+			return errorResponse(http.StatusInternalServerError, err,
+				fmt.Sprintf("failed to get CIDRs: %v", err))
+		}
+		now := time.Now()
+		modified := listModified(changed, records, now)
+		filter, err := parseRecordFilter(queryParam(request), now)
+		if err != nil {
+			return createResponse(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+		records = withAges(filterRecords(records, filter), now)
+		if err := sortRecords(records, request.QueryStringParameters["sort"]); err != nil {
+			return createResponse(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
 			})
 		}
 
-		return createResponse(http.StatusOK, map[string]interface{}{
-			"records": records,
-			"count":   len(records),
-		})
+		format, err := parseListFormat(request.QueryStringParameters["format"])
+		if err != nil {
+			return createResponse(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+		depth, err := parseGroupBy(queryParam(request))
+		if err != nil {
+			return createResponse(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		cacheHeaders := cidrService.cacheHeaders(modified)
+		if notModified(requestHeader(request, "If-Modified-Since"), modified) {
+			return notModifiedResponse(cacheHeaders)
+		}
+
+		var response events.APIGatewayProxyResponse
+		switch {
+		case format == listFormatDOT:
+			response, err = textResponse(contentTypeDOT, dotGraph(cidrService.permittedBases(), records))
+		case depth > 0:
+			response, err = createResponse(http.StatusOK, groupByNamespace(records, depth))
+		default:
+			response, err = createResponse(http.StatusOK, map[string]interface{}{
+				"records": records,
+				"count":   len(records),
+			})
+		}
+		if err != nil {
+			return response, err
+		}
+		return withHeaders(response, cacheHeaders), nil
 
 	case "POST":
-		var requestBody struct {
-			Key  string `json:"key"`
-			CIDR string `json:"cidr"`
+		if request.Path == "/plan" {
+			var planBody planRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &planBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			if errs := planBody.validate(); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			plan, err := cidrService.PlanAllocations(ctx, planBody.Allocations)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to plan allocations: %v", err))
+			}
+			return createResponse(http.StatusOK, plan)
 		}
 
-		if err := json.Unmarshal([]byte(request.Body), &requestBody); err != nil {
-			return createResponse(http.StatusBadRequest, map[string]string{
-				"error": "invalid JSON body",
+		if request.Path == "/diff" {
+			var diffBody diffRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &diffBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			networks, errs := diffBody.networks()
+			if errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			diff, err := cidrService.DiffCIDRs(ctx, networks)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to diff CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, diff)
+		}
+
+		if request.Path == "/supernet-of" {
+			var supernetBody supernetRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &supernetBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			networks, errs := supernetBody.networks()
+			if errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			supernet := coveringSupernet(networks)
+			prefix, _ := supernet.Mask.Size()
+			return createResponse(http.StatusOK, map[string]interface{}{
+				"cidr":   supernet.String(),
+				"prefix": prefix,
 			})
 		}
 
-		if requestBody.Key == "" || requestBody.CIDR == "" {
-			return createResponse(http.StatusBadRequest, map[string]string{
-				"error": "both key and cidr fields are required",
+		if request.Path == "/resize" {
+			var resizeBody resizeRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &resizeBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			if errs := resizeBody.validate(); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			result, err := cidrService.ResizeCIDR(ctx, resizeBody.Key, resizeBody.NewPrefix)
+			if errors.Is(err, errRecordNotFound) {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			if err != nil {
+				return errorResponse(rejectedStatus(), err,
+					fmt.Sprintf("failed to resize CIDR: %v", err))
+			}
+			return createResponse(http.StatusOK, result)
+		}
+
+		if request.Path == "/reassign" {
+			var reassignBody reassignRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &reassignBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			if errs := reassignBody.validate(); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			record, err := cidrService.ReassignCIDR(ctx, reassignBody.OldKey, reassignBody.NewKey)
+			if errors.Is(err, errRecordNotFound) {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			var duplicate *DuplicateKeyError
+			if errors.As(err, &duplicate) {
+				return duplicateKeyResponse(duplicate)
+			}
+			if err != nil {
+				return errorResponse(rejectedStatus(), err,
+					fmt.Sprintf("failed to reassign CIDR: %v", err))
+			}
+			return createResponse(http.StatusOK, record)
+		}
+
+		if request.Path == "/delete-batch" {
+			var deleteBody batchDeleteRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &deleteBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			if errs := deleteBody.validate(); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			results, err := cidrService.DeleteBatch(ctx, deleteBody.Keys)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to delete CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, map[string]interface{}{
+				"results": results,
 			})
 		}
 
-		if err := cidrService.RegisterCIDR(ctx, requestBody.Key, requestBody.CIDR); err != nil {
+		if request.Path == "/sync-aws" {
+			if !cidrService.syncEnabled {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": "AWS sync is disabled; set SYNC_AWS_ENABLED=true to enable it",
+				})
+			}
+
+			result, err := cidrService.SyncAWS(ctx)
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				return recordLimitResponse(limit)
+			}
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to sync from AWS: %v", err))
+			}
+			return createResponse(http.StatusOK, result)
+		}
+
+		if request.Path == "/reconcile-aws" {
+			if !cidrService.syncEnabled {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": "AWS sync is disabled; set SYNC_AWS_ENABLED=true to enable it",
+				})
+			}
+
+			// Only an explicit dryRun=false deletes anything.
+			result, err := cidrService.ReconcileAWS(ctx, request.QueryStringParameters["dryRun"] != "false")
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to reconcile with AWS: %v", err))
+			}
+			return createResponse(http.StatusOK, result)
+		}
+
+		if request.Path == "/import" {
+			if err := checkImportContentType(requestHeader(request, "Content-Type")); err != nil {
+				return createResponse(http.StatusUnsupportedMediaType, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			rows, err := parseImportCSV(strings.NewReader(request.Body))
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			result, err := cidrService.Import(ctx, rows, request.QueryStringParameters["dryRun"] == "true")
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				return recordLimitResponse(limit)
+			}
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to import CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, result)
+		}
+
+		if request.Path == "/restore" {
+			mode, err := parseRestoreMode(request.QueryStringParameters["mode"])
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			var backup Backup
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &backup); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			if errs := backup.validate(); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+
+			result, err := cidrService.Restore(ctx, backup, mode)
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				return recordLimitResponse(limit)
+			}
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to restore CIDRs: %v", err))
+			}
+			if len(result.Conflicts) > 0 {
+				return createResponse(http.StatusConflict, result)
+			}
+			return createResponse(http.StatusOK, result)
+		}
+
+		if request.Path == "/approve" || request.Path == "/reject" {
+			return approvalResponse(ctx, cidrService, request)
+		}
+
+		if request.Path == "/lock/acquire" || request.Path == "/lock/heartbeat" || request.Path == "/lock/release" {
+			return lockResponse(ctx, cidrService, request)
+		}
+
+		if request.Path == "/lint/fix" {
+			if adminToken() == "" {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": "lint fixes are disabled; set ADMIN_TOKEN to enable them",
+				})
+			}
+			if !hasBearerToken(requestHeader(request, "Authorization"), adminToken()) {
+				return createResponse(http.StatusUnauthorized, map[string]string{
+					"error": "admin token required",
+				})
+			}
+			result, err := cidrService.FixLint(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to fix CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, result)
+		}
+
+		if request.Path == "/sweep" {
+			if adminToken() == "" {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": "manual sweeps are disabled; set ADMIN_TOKEN to enable them",
+				})
+			}
+			if !hasBearerToken(requestHeader(request, "Authorization"), adminToken()) {
+				return createResponse(http.StatusUnauthorized, map[string]string{
+					"error": "admin token required",
+				})
+			}
+			removed, err := cidrService.SweepExpired(ctx)
+			if err != nil {
+				return errorResponse(http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to sweep expired CIDRs: %v", err))
+			}
+			return createResponse(http.StatusOK, SweepResult{Removed: removed, Count: len(removed)})
+		}
+
+		if request.Path == "/allocate-contiguous" {
+			var contiguousBody contiguousRequest
+			if errs := decodeJSONBody(strings.NewReader(request.Body), &contiguousBody); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			if errs := contiguousBody.validate(); errs != nil {
+				return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+			}
+			record := contiguousBody.record()
+
+			opts, err := parseAllocationOptions(queryParam(request))
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			if opts.Prefix == 0 {
+				opts.Prefix = contiguousBody.Prefix
+			}
+			if opts.Pool == "" {
+				opts.Pool = contiguousBody.Pool
+			}
+			if opts.Tenant == "" {
+				opts.Tenant = contiguousBody.Tenant
+			}
+			if opts.Account == "" {
+				opts.Account = contiguousBody.Account
+			}
+
+			pool, err := cidrService.placePool(opts.Pool, record.Tags)
+			if err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+			opts.Pool = pool
+			ctx = cidrService.withTableRoute(ctx, opts.Tenant, opts.Pool)
+
+			if _, _, _, err := cidrService.resolveAllocation(opts); err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			allocation, err := cidrService.AllocateContiguous(ctx, record, contiguousBody.Count, contiguousBody.Aggregate, opts)
+			var duplicate *DuplicateKeyError
+			if errors.As(err, &duplicate) {
+				return duplicateKeyResponse(duplicate)
+			}
+			var invalid *ValidationError
+			if errors.As(err, &invalid) {
+				return createResponse(rejectedStatus(), validationErrorBody(invalid.Fields))
+			}
+			var noRun *NoContiguousRunError
+			if errors.As(err, &noRun) {
+				return allocationFailedResponse(noRun, noContiguousRunCode)
+			}
+			var reached *HeadroomError
+			if errors.As(err, &reached) {
+				return allocationFailedResponse(reached, headroomReachedCode)
+			}
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				return allocationFailedResponse(limit, recordLimitCode)
+			}
+			if errors.Is(err, errWriteConflict) {
+				return createResponse(http.StatusConflict, map[string]string{
+					"error": fmt.Sprintf("failed to allocate CIDR: %v", err),
+				})
+			}
+			if err != nil {
+				return errorResponse(rejectedStatus(), err,
+					fmt.Sprintf("failed to allocate CIDR: %v", err))
+			}
+			return createResponse(http.StatusCreated, allocation)
+		}
+
+		var requestBody registrationRequest
+		if errs := decodeJSONBody(strings.NewReader(request.Body), &requestBody); errs != nil {
+			return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+		}
+
+		// On /allocate, or without a cidr, the request is an allocation of the
+		// next free block.
+		allocate := request.Path == "/allocate" || requestBody.CIDR == ""
+		if errs := requestBody.validate(allocate); errs != nil {
+			return createResponse(http.StatusBadRequest, validationErrorBody(errs))
+		}
+		record := requestBody.record()
+
+		// POST /request holds the block as pending until an approver
+		// activates it.
+		if request.Path == "/request" {
+			if approverToken() == "" {
+				return createResponse(http.StatusNotFound, map[string]string{
+					"error": "approval workflow is disabled; set APPROVER_TOKEN to enable it",
+				})
+			}
+			record.Status = recordStatusPending
+		}
+
+		if allocate {
+			opts, err := parseAllocationOptions(queryParam(request))
+			if err != nil {
+				return createResponse(http.StatusBadRequest, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			if opts.Prefix == 0 {
+				opts.Prefix = requestBody.Prefix
+			}
+			if opts.Pool == "" {
+				opts.Pool = requestBody.Pool
+			}
+			if opts.Tenant == "" {
+				opts.Tenant = requestBody.Tenant
+			}
+			if opts.Account == "" {
+				opts.Account = requestBody.Account
+			}
+
+			pool, err := cidrService.placePool(opts.Pool, record.Tags)
+			if err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+			opts.Pool = pool
+			ctx = cidrService.withTableRoute(ctx, opts.Tenant, opts.Pool)
+
+			if _, _, _, err := cidrService.resolveAllocation(opts); err != nil {
+				return createResponse(rejectedStatus(), map[string]string{
+					"error": err.Error(),
+				})
+			}
+
+			stored, err := cidrService.AllocateCIDR(ctx, record, opts)
+			var duplicate *DuplicateKeyError
+			if errors.As(err, &duplicate) {
+				return duplicateKeyResponse(duplicate)
+			}
+			var invalid *ValidationError
+			if errors.As(err, &invalid) {
+				return createResponse(rejectedStatus(), validationErrorBody(invalid.Fields))
+			}
+			var exhausted *ExhaustedError
+			if errors.As(err, &exhausted) {
+				return allocationFailedResponse(exhausted, poolExhaustedCode)
+			}
+			var reached *HeadroomError
+			if errors.As(err, &reached) {
+				return allocationFailedResponse(reached, headroomReachedCode)
+			}
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				return allocationFailedResponse(limit, recordLimitCode)
+			}
+			if errors.Is(err, errWriteConflict) {
+				return createResponse(http.StatusConflict, map[string]string{
+					"error": fmt.Sprintf("failed to allocate CIDR: %v", err),
+				})
+			}
+			if err != nil {
+				return errorResponse(rejectedStatus(), err,
+					fmt.Sprintf("failed to allocate CIDR: %v", err))
+			}
+
+			if restStrict() {
+				return createdResponse(stored.CIDR)
+			}
+
+			body := map[string]interface{}{
+				"message": "CIDR allocated successfully",
+				"key":     stored.Key,
+				"cidr":    stored.CIDR,
+				"record":  stored,
+			}
+			if opts.Prefer != "" {
+				body["range"] = cidrService.allocationRange(opts, stored.CIDR)
+			}
+			if source := cidrService.allocationSource(opts, stored.CIDR); source != "" {
+				body["source"] = source
+			}
+			return createResponse(http.StatusCreated, body)
+		}
+
+		requireParent, err := parseRequireParent("requireParent parameter", request.QueryStringParameters["requireParent"])
+		if err != nil {
 			return createResponse(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		ctx = cidrService.withTableRoute(ctx, record.Tenant, record.Pool)
+		stored, err := cidrService.RegisterCIDR(ctx, record, RegistrationOptions{RequireParent: requireParent})
+		var duplicate *DuplicateKeyError
+		if errors.As(err, &duplicate) {
+			return duplicateKeyResponse(duplicate)
+		}
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			return createResponse(rejectedStatus(), validationErrorBody(invalid.Fields))
+		}
+		var limit *RecordLimitError
+		if errors.As(err, &limit) {
+			return recordLimitResponse(limit)
+		}
+		if errors.Is(err, errWriteConflict) {
+			return createResponse(http.StatusConflict, map[string]string{
 				"error": fmt.Sprintf("failed to register CIDR: %v", err),
 			})
 		}
+		if err != nil {
+			return errorResponse(rejectedStatus(), err,
+				fmt.Sprintf("failed to register CIDR: %v", err))
+		}
+
+		if restStrict() {
+			return createdResponse(stored.CIDR)
+		}
 
-		return createResponse(http.StatusCreated, map[string]string{
+		return createResponse(http.StatusCreated, map[string]interface{}{
 			"message": "CIDR registered successfully",
-			"key":     requestBody.Key,
-			"cidr":    requestBody.CIDR,
+			"key":     stored.Key,
+			"cidr":    stored.CIDR,
+			"record":  stored,
 		})
 
-	case "DELETE":
+	case "PATCH":
 		key := request.QueryStringParameters["key"]
 		if key == "" {
 			return createResponse(http.StatusBadRequest, map[string]string{
 				"error": "key parameter is required",
 			})
 		}
+		if err := checkPatchContentType(requestHeader(request, "Content-Type")); err != nil {
+			return createResponse(http.StatusUnsupportedMediaType, map[string]string{
+				"error": err.Error(),
+			})
+		}
 
-		if err := cidrService.DeleteCIDR(ctx, key); err != nil {
-			return createResponse(http.StatusInternalServerError, map[string]string{
-				"error": fmt.Sprintf("failed to delete CIDR: %v", err),
+		record, err := cidrService.PatchRecord(ctx, key, []byte(request.Body))
+		if errors.Is(err, errRecordNotFound) {
+			return createResponse(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			return createResponse(rejectedStatus(), validationErrorBody(invalid.Fields))
+		}
+		if errors.Is(err, errInvalidMergePatch) {
+			return createResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			return errorResponse(rejectedStatus(), err,
+				fmt.Sprintf("failed to patch CIDR: %v", err))
+		}
+		return createResponse(http.StatusOK, record)
+
+	case "DELETE":
+		key := request.QueryStringParameters["key"]
+		if key == "" {
+			return createResponse(http.StatusBadRequest, map[string]string{
+				"error": "key parameter is required",
 			})
 		}
 
-		return createResponse(http.StatusOK, map[string]string{
+		result, err := cidrService.DeleteCIDR(ctx, key, request.QueryStringParameters["cascade"] == "true")
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, err,
+				fmt.Sprintf("failed to delete CIDR: %v", err))
+		}
+
+		if restStrict() {
+			return createResponse(http.StatusNoContent, nil)
+		}
+
+		body := map[string]interface{}{
 			"message": "CIDR deleted successfully",
 			"key":     key,
-		})
+			"removed": result.Removed,
+		}
+		if len(result.Orphaned) > 0 {
+			body["warning"] = "the deleted block still has registered children; use cascade=true to delete them too"
+			body["orphaned"] = result.Orphaned
+		}
+		return createResponse(http.StatusOK, body)
+
+	case "HEAD":
+		if request.Path == "/cidr" {
+			response, err := recordResponse(ctx, cidrService, request)
+			if err != nil {
+				return response, err
+			}
+			response.Headers["Content-Length"] = strconv.Itoa(len(response.Body))
+			response.Body = ""
+			return response, nil
+		}
+
+		count, err := cidrService.CountCIDRs(ctx)
+		if err != nil {
+			return errorResponse(http.StatusInternalServerError, err,
+				fmt.Sprintf("failed to count CIDRs: %v", err))
+		}
+		response, err := createResponse(http.StatusOK, nil)
+		if err != nil {
+			return response, err
+		}
+		response.Headers[totalCountHeader] = strconv.Itoa(count)
+		return response, nil
 
 	case "OPTIONS":
 		return createResponse(http.StatusOK, nil)
@@ -126,6 +1303,122 @@ func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (
 	}
 }
 
+// handleWithRequestID tags the invocation with its AWS request ID, echoes it
+// in the X-Request-ID response header and logs the request under it.
+func handleWithRequestID(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var id string
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		id = lc.AwsRequestID
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx = withRequestID(ctx, id)
+
+	start := time.Now()
+	response, err := handleVersioned(ctx, request)
+	if err == nil && redaction.appliesTo(ctx, request.HTTPMethod, requestHeader(request, "Authorization")) {
+		response = redactResponse(ctx, response)
+	}
+	if err == nil && wantsXML(requestHeader(request, "Accept")) {
+		response = negotiateXML(ctx, response)
+	}
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers[requestIDHeader] = id
+	logf(ctx, "%s %s %d %s", request.HTTPMethod, request.Path, response.StatusCode, time.Since(start))
+
+	return response, err
+}
+
+// handleVersioned serves a request in the response envelope version the
+// client asked for.
+func handleVersioned(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	version, err := responseVersion(request.QueryStringParameters["v"], requestHeader(request, "Accept"))
+	if err != nil {
+		return createResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	response, err := handleRequest(ctx, request)
+	if err != nil || version == latestResponseVersion || response.Body == "" || response.Headers["Content-Type"] != contentTypeJSON {
+		return response, err
+	}
+	body, envErr := envelopeBody(version, response.StatusCode, []byte(response.Body))
+	if envErr != nil {
+		logf(ctx, "failed to apply response version %d: %v", version, envErr)
+		return response, nil
+	}
+	response.Body = string(body)
+	return response, nil
+}
+
+// redactResponse strips the REDACT_FIELDS from the records of a JSON
+// response. The response varies with the caller's credentials, and an ETag is
+// recomputed so it differs from the full representation's.
+func redactResponse(ctx context.Context, response events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	if response.Body == "" || response.Headers["Content-Type"] != contentTypeJSON {
+		return response
+	}
+
+	body, err := redaction.redact([]byte(response.Body))
+	if err != nil {
+		logf(ctx, "failed to redact response: %v", err)
+		return response
+	}
+	response.Body = string(body)
+	response.Headers["Vary"] = "Accept, Authorization"
+	if etag, ok := response.Headers["ETag"]; ok {
+		response.Headers["ETag"] = representationETag(etag, "redacted")
+	}
+	return response
+}
+
+// negotiateXML rewrites a JSON response as XML for a client that prefers it.
+// An ETag is recomputed over the XML, since it is a different representation.
+func negotiateXML(ctx context.Context, response events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	if response.Body == "" || response.Headers["Content-Type"] != contentTypeJSON {
+		return response
+	}
+
+	body, err := jsonToXML([]byte(response.Body))
+	if err != nil {
+		logf(ctx, "failed to convert response to XML: %v", err)
+		return response
+	}
+	response.Body = string(body)
+	response.Headers["Content-Type"] = contentTypeXML
+	if etag, ok := response.Headers["ETag"]; ok {
+		response.Headers["ETag"] = representationETag(etag, contentTypeXML)
+	}
+	return response
+}
+
 func main() {
-	lambda.Start(handleRequest)
+	if err := loadTagsFormat(); err != nil {
+		log.Fatalf("Invalid tags format: %v", err)
+	}
+	if err := loadResponseNaming(); err != nil {
+		log.Fatalf("Invalid response naming: %v", err)
+	}
+	if err := loadRequestSigning(); err != nil {
+		log.Fatalf("Invalid request signing: %v", err)
+	}
+	if err := loadRedaction(); err != nil {
+		log.Fatalf("Invalid field redaction: %v", err)
+	}
+	if err := loadJWTAuth(); err != nil {
+		log.Fatalf("Invalid JWT authentication: %v", err)
+	}
+
+	// Build the service during the Lambda INIT phase so the first invocation
+	// does not pay for loading the AWS config and creating the client, and so
+	// a misconfigured function fails its init with the reason in the logs
+	// instead of answering every request with a 500. The settings above are
+	// checked first, in the same order as the server's.
+	if _, err := getCIDRService(context.Background()); err != nil {
+		log.Fatalf("Failed to initialize CIDR service: %v", err)
+	}
+
+	lambda.Start(handleWithRequestID)
 }
@@ -1,7 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/aws/smithy-go"
 )
 
 func TestValidateCIDR(t *testing.T) {
@@ -80,3 +110,3868 @@ func TestNextAvailableCIDRLogic(t *testing.T) {
 		t.Errorf("Expected next available CIDR logic to work correctly")
 	}
 }
+
+func TestDescribeCIDR(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "base", CIDR: "10.2.0.0/16"},
+		{Key: "region", CIDR: "10.2.0.0/20"},
+		{Key: "exact", CIDR: "10.2.3.0/24"},
+		{Key: "child-a", CIDR: "10.2.3.0/26"},
+		{Key: "child-b", CIDR: "10.2.3.128/25"},
+		{Key: "before", CIDR: "10.2.2.0/24"},
+		{Key: "after", CIDR: "10.2.4.0/23"},
+		{Key: "unrelated", CIDR: "192.168.0.0/24"},
+	}
+
+	_, network, _ := net.ParseCIDR("10.2.3.0/24")
+	desc := describeCIDR(records, network)
+
+	if !desc.Registered || desc.Record == nil || desc.Record.Key != "exact" {
+		t.Errorf("expected exact block to be registered as 'exact', got %+v", desc.Record)
+	}
+	if desc.Parent == nil || desc.Parent.Key != "region" {
+		t.Errorf("expected narrowest parent 'region', got %+v", desc.Parent)
+	}
+	if len(desc.Children) != 2 || desc.Children[0].Key != "child-a" || desc.Children[1].Key != "child-b" {
+		t.Errorf("unexpected children: %+v", desc.Children)
+	}
+	if len(desc.Siblings) != 2 || desc.Siblings[0].Key != "before" || desc.Siblings[1].Key != "after" {
+		t.Errorf("unexpected siblings: %+v", desc.Siblings)
+	}
+
+	_, free, _ := net.ParseCIDR("172.16.0.0/24")
+	desc = describeCIDR(records, free)
+	if desc.Registered || desc.Parent != nil || len(desc.Children) != 0 || len(desc.Siblings) != 0 {
+		t.Errorf("expected empty description for unrelated block, got %+v", desc)
+	}
+}
+
+func TestNextFreeSubnet(t *testing.T) {
+	parse := func(cidrs ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, c := range cidrs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				t.Fatalf("bad test CIDR %q: %v", c, err)
+			}
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		prefix int
+		used   []*net.IPNet
+		want   string
+	}{
+		{
+			name:   "empty table",
+			prefix: 16,
+			want:   "10.0.0.0/16",
+		},
+		{
+			name:   "skips exact matches",
+			prefix: 16,
+			used:   parse("10.0.0.0/16", "10.1.0.0/16", "10.3.0.0/16"),
+			want:   "10.2.0.0/16",
+		},
+		{
+			name:   "skips blocks containing smaller allocations",
+			prefix: 16,
+			used:   parse("10.0.0.0/16", "10.1.200.0/24"),
+			want:   "10.2.0.0/16",
+		},
+		{
+			name:   "skips past larger allocations",
+			prefix: 24,
+			used:   parse("10.0.0.0/16", "10.1.0.0/24"),
+			want:   "10.1.1.0/24",
+		},
+		{
+			name:   "ignores networks outside the base",
+			prefix: 16,
+			used:   parse("192.168.0.0/16", "172.16.0.0/12"),
+			want:   "10.0.0.0/16",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextFreeSubnet(base, tt.prefix, tt.used)
+			if !ok {
+				t.Fatalf("nextFreeSubnet() found no free subnet, want %s", tt.want)
+			}
+			if got.String() != tt.want {
+				t.Errorf("nextFreeSubnet() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, ok := nextFreeSubnet(base, 8, parse("10.0.0.0/16")); ok {
+		t.Errorf("expected exhausted base to report no free subnet")
+	}
+}
+
+func TestPartitionFor(t *testing.T) {
+	service := &CIDRService{baseCIDR: "10.0.0.0/8"}
+
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{cidr: "10.2.0.0/16", want: "10.0.0.0/8"},
+		{cidr: "10.255.255.0/24", want: "10.0.0.0/8"},
+		{cidr: "10.0.0.0/7", want: "10.0.0.0/8"},
+		{cidr: "192.168.0.0/16", want: externalPartition},
+		{cidr: "fd00::/8", want: externalPartition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			_, network, _ := net.ParseCIDR(tt.cidr)
+			if got := service.partitionFor(network); got != tt.want {
+				t.Errorf("partitionFor(%s) = %s, want %s", tt.cidr, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkNewCIDRService(b *testing.B) {
+	b.Setenv("DYNAMODB_TABLE_NAME", "cidr-registry")
+	b.Setenv("AWS_REGION", "us-east-1")
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := NewCIDRService(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCIDRServiceCached(b *testing.B) {
+	b.Setenv("DYNAMODB_TABLE_NAME", "cidr-registry")
+	b.Setenv("AWS_REGION", "us-east-1")
+	ctx := context.Background()
+
+	if _, err := getCIDRService(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := getCIDRService(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestValidateDescription(t *testing.T) {
+	service := &CIDRService{}
+
+	tests := []struct {
+		name        string
+		description string
+		wantErr     bool
+	}{
+		{name: "empty", description: "", wantErr: false},
+		{name: "ticket link", description: "Provisioned for https://tickets.example.com/NET-123", wantErr: false},
+		{name: "at limit", description: strings.Repeat("a", maxDescriptionLength), wantErr: false},
+		{name: "multibyte at limit", description: strings.Repeat("é", maxDescriptionLength), wantErr: false},
+		{name: "over limit", description: strings.Repeat("a", maxDescriptionLength+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.validateDescription(tt.description)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateDescription() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrefixForHosts(t *testing.T) {
+	service := &CIDRService{baseCIDR: "10.0.0.0/8"}
+
+	tests := []struct {
+		hosts   int
+		want    int
+		wantErr bool
+	}{
+		{hosts: 1, want: 32},
+		{hosts: 2, want: 31},
+		{hosts: 3, want: 29},
+		{hosts: 254, want: 24},
+		{hosts: 255, want: 23},
+		{hosts: 500, want: 23},
+		{hosts: 510, want: 23},
+		{hosts: 511, want: 22},
+		{hosts: 16777214, want: 8},
+		{hosts: 16777215, wantErr: true},
+		{hosts: 0, wantErr: true},
+		{hosts: -5, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d hosts", tt.hosts), func(t *testing.T) {
+			got, err := service.PrefixForHosts(tt.hosts, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PrefixForHosts(%d) error = %v, wantErr %v", tt.hosts, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("PrefixForHosts(%d) = /%d, want /%d", tt.hosts, got, tt.want)
+			}
+		})
+	}
+
+	// Hosts are not counted in IPv6 bases, however long their prefix.
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	_, v6Small, _ := net.ParseCIDR("2001:db8:1::/48")
+	service.allowedBases = []*net.IPNet{v6, v6Small}
+	for _, base := range []string{"2001:db8::/32", "2001:db8:1::/48"} {
+		if got, err := service.PrefixForHosts(1, base); err == nil {
+			t.Errorf("PrefixForHosts(1, %s) = /%d, want an error", base, got)
+		}
+	}
+}
+
+func TestCheckUniqueness(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "vpc-prod", CIDR: "10.0.0.0/16"},
+		{Key: "app-a", CIDR: "10.2.0.0/24"},
+		{Key: "app-b", CIDR: "10.2.7.0/24"},
+	}
+
+	tests := []struct {
+		name      string
+		candidate CIDRRecord
+		wantErr   string
+	}{
+		{
+			name:      "new block",
+			candidate: CIDRRecord{Key: "vpc-dev", CIDR: "10.3.0.0/16"},
+		},
+		{
+			name:      "duplicate key",
+			candidate: CIDRRecord{Key: "vpc-prod", CIDR: "10.3.0.0/16"},
+			wantErr:   "key 'vpc-prod' already exists",
+		},
+		{
+			name:      "duplicate CIDR",
+			candidate: CIDRRecord{Key: "vpc-dev", CIDR: "10.0.0.0/16"},
+			wantErr:   "CIDR '10.0.0.0/16' already exists",
+		},
+		{
+			name:      "parent of existing allocations",
+			candidate: CIDRRecord{Key: "vpc-dev", CIDR: "10.2.0.0/16"},
+			wantErr:   "contains existing allocations app-a (10.2.0.0/24), app-b (10.2.7.0/24)",
+		},
+		{
+			name:      "reserved parent of existing allocations",
+			candidate: CIDRRecord{Key: "vpc-dev", CIDR: "10.2.0.0/16", Reserved: true},
+		},
+		{
+			name:      "subnet of an existing allocation is not a reverse containment",
+			candidate: CIDRRecord{Key: "vpc-dev", CIDR: "10.2.0.0/25"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUniqueness(records, tt.candidate)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkUniqueness() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkUniqueness() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A duplicate key carries the record holding it, for the 409 response.
+	err := checkUniqueness(records, CIDRRecord{Key: "vpc-prod", CIDR: "10.3.0.0/16"})
+	var duplicate *DuplicateKeyError
+	if !errors.As(fmt.Errorf("failed to register: %w", err), &duplicate) || duplicate.Existing.CIDR != "10.0.0.0/16" {
+		t.Errorf("checkUniqueness() error = %v, want a DuplicateKeyError for 10.0.0.0/16", err)
+	}
+}
+
+func TestIsThrottlingError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "provisioned throughput exceeded",
+			err:  fmt.Errorf("failed to scan DynamoDB table: %w", &types.ProvisionedThroughputExceededException{Message: aws.String("slow down")}),
+			want: true,
+		},
+		{
+			name: "request limit exceeded",
+			err:  fmt.Errorf("failed to put item in DynamoDB: %w", &types.RequestLimitExceeded{}),
+			want: true,
+		},
+		{
+			name: "generic throttling",
+			err:  fmt.Errorf("wrapped twice: %w", fmt.Errorf("inner: %w", &smithy.GenericAPIError{Code: "ThrottlingException"})),
+			want: true,
+		},
+		{
+			name: "other API error",
+			err:  fmt.Errorf("failed: %w", &types.ResourceNotFoundException{}),
+			want: false,
+		},
+		{
+			name: "plain error",
+			err:  fmt.Errorf("no available /16 CIDRs remaining in 10.0.0.0/8"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isThrottlingError(tt.err); got != tt.want {
+				t.Errorf("isThrottlingError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanAllocations(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "vpc-prod", CIDR: "10.0.0.0/16"},
+	}
+	allocations := []PlannedAllocation{
+		{Key: "vpc-dev", CIDR: "10.1.0.0/16"},
+		{Key: "vpc-dev-app", CIDR: "10.1.4.0/24"},
+		{Key: "vpc-prod", CIDR: "10.2.0.0/16"},
+		{Key: "vpc-prod-db", CIDR: "10.0.8.0/24"},
+		{Key: "vpc-dev", CIDR: "10.3.0.0/16"},
+		{Key: "broken", CIDR: "10.4.0.0/33"},
+		{Key: "vpc-test", CIDR: "10.5.0.0/16"},
+	}
+
+	plan := planAllocations(records, allocations)
+
+	if plan.Valid {
+		t.Errorf("expected plan with conflicts to be invalid")
+	}
+
+	wantCreate := []string{"vpc-dev", "vpc-test"}
+	if len(plan.Create) != len(wantCreate) {
+		t.Fatalf("Create = %+v, want keys %v", plan.Create, wantCreate)
+	}
+	for i, key := range wantCreate {
+		if plan.Create[i].Key != key {
+			t.Errorf("Create[%d] = %s, want %s", i, plan.Create[i].Key, key)
+		}
+	}
+
+	wantConflicts := []struct{ key, conflictType string }{
+		{"vpc-dev-app", conflictOverlapProposed},
+		{"vpc-prod", conflictKeyExists},
+		{"vpc-prod-db", conflictOverlapExisting},
+		{"vpc-dev", conflictDuplicateKey},
+		{"broken", conflictInvalidCIDR},
+	}
+	if len(plan.Conflicts) != len(wantConflicts) {
+		t.Fatalf("Conflicts = %+v, want %d conflicts", plan.Conflicts, len(wantConflicts))
+	}
+	for i, want := range wantConflicts {
+		got := plan.Conflicts[i]
+		if got.Key != want.key || got.Type != want.conflictType {
+			t.Errorf("Conflicts[%d] = %s/%s, want %s/%s", i, got.Key, got.Type, want.key, want.conflictType)
+		}
+	}
+	if with := plan.Conflicts[0].With; with == nil || with.Key != "vpc-dev" {
+		t.Errorf("expected overlap conflict to name vpc-dev, got %+v", with)
+	}
+
+	clean := planAllocations(records, []PlannedAllocation{{Key: "vpc-dev", CIDR: "10.1.0.0/16"}})
+	if !clean.Valid || len(clean.Create) != 1 || len(clean.Conflicts) != 0 {
+		t.Errorf("expected clean plan to be valid, got %+v", clean)
+	}
+}
+
+func TestWithoutExpired(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	records := []CIDRRecord{
+		{Key: "permanent", CIDR: "10.0.0.0/16"},
+		{Key: "expired", CIDR: "10.1.0.0/16", ExpiresAt: now.Add(-time.Hour).Unix()},
+		{Key: "expires-now", CIDR: "10.2.0.0/16", ExpiresAt: now.Unix()},
+		{Key: "future", CIDR: "10.3.0.0/16", ExpiresAt: now.Add(time.Hour).Unix()},
+	}
+
+	live := withoutExpired(records, now)
+	if len(live) != 2 || live[0].Key != "permanent" || live[1].Key != "future" {
+		t.Errorf("withoutExpired() = %+v, want permanent and future", live)
+	}
+
+	// An expired reservation must not keep its block from being handed out.
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	var used []*net.IPNet
+	for _, record := range live {
+		_, network, _ := net.ParseCIDR(record.CIDR)
+		used = append(used, network)
+	}
+	if next, _ := nextFreeSubnet(base, 16, used); next.String() != "10.1.0.0/16" {
+		t.Errorf("nextFreeSubnet() = %s, want expired block 10.1.0.0/16", next)
+	}
+}
+
+func TestResolveAllocation(t *testing.T) {
+	_, extra, _ := net.ParseCIDR("172.16.0.0/12")
+	pools, _ := parsePools("prod=10.16.0.0/12:20,scratch=10.32.0.0/12")
+	service := &CIDRService{
+		baseCIDR:         "10.0.0.0/8",
+		allocationPrefix: 16,
+		allowedBases:     []*net.IPNet{extra},
+		pools:            pools,
+	}
+
+	tests := []struct {
+		name       string
+		opts       AllocationOptions
+		wantBase   string
+		wantPrefix int
+		wantErr    bool
+	}{
+		{name: "defaults", opts: AllocationOptions{}, wantBase: "10.0.0.0/8", wantPrefix: 16},
+		{name: "prefix override", opts: AllocationOptions{Prefix: 24}, wantBase: "10.0.0.0/8", wantPrefix: 24},
+		{name: "allowed base", opts: AllocationOptions{Base: "172.16.0.0/12", Prefix: 24}, wantBase: "172.16.0.0/12", wantPrefix: 24},
+		{name: "sub-range of allowed base", opts: AllocationOptions{Base: "172.20.0.0/16", Prefix: 24}, wantBase: "172.20.0.0/16", wantPrefix: 24},
+		{name: "base outside allow-list", opts: AllocationOptions{Base: "192.168.0.0/16"}, wantErr: true},
+		{name: "base wider than allowed", opts: AllocationOptions{Base: "10.0.0.0/7"}, wantErr: true},
+		{name: "malformed base", opts: AllocationOptions{Base: "172.16.0.0"}, wantErr: true},
+		{name: "prefix shorter than base", opts: AllocationOptions{Base: "172.20.0.0/16", Prefix: 12}, wantErr: true},
+		{name: "pool prefix", opts: AllocationOptions{Pool: "prod"}, wantBase: "10.16.0.0/12", wantPrefix: 20},
+		{name: "pool matching prefix", opts: AllocationOptions{Pool: "prod", Prefix: 20}, wantBase: "10.16.0.0/12", wantPrefix: 20},
+		{name: "pool sub-range", opts: AllocationOptions{Pool: "prod", Base: "10.17.0.0/16"}, wantBase: "10.17.0.0/16", wantPrefix: 20},
+		{name: "pool without required prefix", opts: AllocationOptions{Pool: "scratch", Prefix: 24}, wantBase: "10.32.0.0/12", wantPrefix: 24},
+		{name: "pool prefix mismatch", opts: AllocationOptions{Pool: "prod", Prefix: 24}, wantErr: true},
+		{name: "base outside pool", opts: AllocationOptions{Pool: "prod", Base: "10.32.0.0/16"}, wantErr: true},
+		{name: "unknown pool", opts: AllocationOptions{Pool: "staging"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, _, prefix, err := service.resolveAllocation(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveAllocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if base.String() != tt.wantBase || prefix != tt.wantPrefix {
+				t.Errorf("resolveAllocation() = %s /%d, want %s /%d", base, prefix, tt.wantBase, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestRegistrationRequestValidation(t *testing.T) {
+	t.Setenv("STRICT_JSON", "true")
+	tests := []struct {
+		name     string
+		body     string
+		allocate bool
+		want     fieldErrors
+	}{
+		{name: "valid registration", body: `{"key":"web","cidr":"10.1.0.0/16"}`},
+		{name: "valid allocation", body: `{"key":"web","prefix":24}`, allocate: true},
+		{name: "missing key and bad cidr", body: `{"cidr":"10.1.0.0/33"}`,
+			want: fieldErrors{"key": "required", "cidr": "invalid format"}},
+		{name: "unknown field", body: `{"key":"web","cdir":"10.1.0.0/16"}`,
+			want: fieldErrors{"cdir": "unknown field"}},
+		{name: "createdAt is set by the service", body: `{"key":"web","cidr":"10.1.0.0/16","createdAt":1}`,
+			want: fieldErrors{"createdAt": "unknown field"}},
+		{name: "wrong type", body: `{"key":"web","prefix":"24"}`,
+			want: fieldErrors{"prefix": "must be of type int"}},
+		{name: "malformed JSON", body: `{"key":`, want: fieldErrors{"body": "invalid JSON"}},
+		{name: "empty body", body: ``, want: fieldErrors{"body": "required"}},
+		{name: "cidr on allocate", body: `{"key":"web","cidr":"10.1.0.0/16"}`, allocate: true,
+			want: fieldErrors{"cidr": "not allowed when allocating"}},
+		{name: "prefix with cidr", body: `{"key":"web","cidr":"10.1.0.0/16","prefix":24}`,
+			want: fieldErrors{"prefix": "only allowed when cidr is omitted"}},
+		{name: "expired", body: `{"key":"web","cidr":"10.1.0.0/16","expiresAt":1}`,
+			want: fieldErrors{"expiresAt": "must be in the future"}},
+		{name: "host prefix", body: `{"key":"web","prefix":32}`, allocate: true},
+		{name: "ipv6 prefix", body: `{"key":"web","prefix":56}`, allocate: true},
+		{name: "prefix too long", body: `{"key":"web","prefix":129}`, allocate: true,
+			want: fieldErrors{"prefix": "must be between 0 and 128, got 129"}},
+		{name: "negative prefix", body: `{"key":"web","prefix":-1}`, allocate: true,
+			want: fieldErrors{"prefix": "must be between 0 and 128, got -1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request registrationRequest
+			errs := decodeJSONBody(strings.NewReader(tt.body), &request)
+			if errs == nil {
+				errs = request.validate(tt.allocate)
+			}
+			if fmt.Sprint(errs) != fmt.Sprint(tt.want) {
+				t.Errorf("errors = %v, want %v", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseUtilization(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name          string
+		cidrs         []string
+		wantRecords   int
+		wantAllocated uint64
+	}{
+		{name: "empty", cidrs: nil, wantRecords: 0, wantAllocated: 0},
+		{name: "mixed prefixes", cidrs: []string{"10.0.0.0/16", "10.1.0.0/24", "10.1.1.0/24"},
+			wantRecords: 3, wantAllocated: 65536 + 2*256},
+		{name: "nested", cidrs: []string{"10.2.0.0/16", "10.2.3.0/24", "10.2.4.0/24"},
+			wantRecords: 3, wantAllocated: 65536},
+		{name: "duplicate", cidrs: []string{"10.3.0.0/24", "10.3.0.0/24"},
+			wantRecords: 2, wantAllocated: 256},
+		{name: "outside base", cidrs: []string{"192.168.0.0/16", "10.4.0.0/24"},
+			wantRecords: 1, wantAllocated: 256},
+		{name: "supernet clipped to base", cidrs: []string{"10.0.0.0/7"},
+			wantRecords: 1, wantAllocated: 1 << 24},
+		{name: "ipv4-mapped", cidrs: []string{"::ffff:10.5.0.0/120"},
+			wantRecords: 1, wantAllocated: 256},
+		{name: "ipv6 ignored", cidrs: []string{"2001:db8::/32"}, wantRecords: 0, wantAllocated: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var records []CIDRRecord
+			for i, cidr := range tt.cidrs {
+				records = append(records, CIDRRecord{Key: fmt.Sprintf("r%d", i), CIDR: cidr})
+			}
+
+			got, ok := baseUtilization(base, records)
+			if !ok {
+				t.Fatal("baseUtilization() ok = false")
+			}
+			if got.Records != tt.wantRecords || got.Allocated != tt.wantAllocated {
+				t.Errorf("records = %d, allocated = %d, want %d, %d",
+					got.Records, got.Allocated, tt.wantRecords, tt.wantAllocated)
+			}
+			if got.Capacity != 1<<24 || got.Available != got.Capacity-got.Allocated {
+				t.Errorf("capacity = %d, available = %d", got.Capacity, got.Available)
+			}
+		})
+	}
+}
+
+func TestValidateAllocationConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseCIDR string
+		prefix   int
+		wantErr  bool
+	}{
+		{name: "defaults", baseCIDR: defaultBaseCIDR, prefix: defaultAllocationPrefix, wantErr: false},
+		{name: "prefix equals base", baseCIDR: "172.16.0.0/12", prefix: 12, wantErr: false},
+		{name: "host prefix", baseCIDR: "192.168.0.0/16", prefix: 32, wantErr: false},
+		{name: "prefix shorter than base", baseCIDR: "10.0.0.0/16", prefix: 8, wantErr: true},
+		{name: "prefix too long", baseCIDR: "10.0.0.0/8", prefix: 33, wantErr: true},
+		{name: "prefix far out of range", baseCIDR: "10.0.0.0/8", prefix: 40, wantErr: true},
+		{name: "negative prefix", baseCIDR: "0.0.0.0/0", prefix: -1, wantErr: true},
+		{name: "malformed base", baseCIDR: "10.0.0.0", prefix: 16, wantErr: true},
+		{name: "base out of range", baseCIDR: "10.0.0.0/40", prefix: 16, wantErr: true},
+		{name: "ipv6 base", baseCIDR: "2001:db8::/32", prefix: 48, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAllocationConfig(tt.baseCIDR, tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateAllocationConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanRestore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	existing := []CIDRRecord{{Key: "vpc-prod", CIDR: "10.0.0.0/16"}}
+
+	tests := []struct {
+		name          string
+		existing      []CIDRRecord
+		incoming      []CIDRRecord
+		wantAccepted  int
+		wantSkipped   int
+		wantConflicts []string
+	}{
+		{name: "merge new records", existing: existing,
+			incoming:     []CIDRRecord{{Key: "vpc-dev", CIDR: "10.1.0.0/16"}},
+			wantAccepted: 1},
+		{name: "merge conflicts with existing", existing: existing,
+			incoming:      []CIDRRecord{{Key: "vpc-prod", CIDR: "10.1.0.0/16"}, {Key: "vpc-dev", CIDR: "10.0.0.0/16"}},
+			wantConflicts: []string{"vpc-prod", "vpc-dev"}},
+		{name: "replace ignores existing",
+			incoming:     []CIDRRecord{{Key: "vpc-prod", CIDR: "10.0.0.0/16"}},
+			wantAccepted: 1},
+		{name: "duplicates within backup",
+			incoming:      []CIDRRecord{{Key: "a", CIDR: "10.1.0.0/16"}, {Key: "a", CIDR: "10.2.0.0/16"}},
+			wantAccepted:  1,
+			wantConflicts: []string{"a"}},
+		{name: "invalid records",
+			incoming:      []CIDRRecord{{Key: "", CIDR: "10.1.0.0/16"}, {Key: "bad", CIDR: "10.1.0.0"}},
+			wantConflicts: []string{"bad", ""}},
+		{name: "reserved parent after its children",
+			incoming: []CIDRRecord{
+				{Key: "a-app", CIDR: "10.2.1.0/24"},
+				{Key: "b-db", CIDR: "10.2.2.0/24"},
+				{Key: "c-dev", CIDR: "10.2.0.0/16", Reserved: true},
+			},
+			wantAccepted: 3},
+		{name: "expired reservation skipped",
+			incoming:     []CIDRRecord{{Key: "tmp", CIDR: "10.3.0.0/24", ExpiresAt: now.Unix() - 1}},
+			wantSkipped:  1,
+			wantAccepted: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted, skipped, conflicts := planRestore(tt.existing, tt.incoming, now)
+			if len(accepted) != tt.wantAccepted || skipped != tt.wantSkipped {
+				t.Errorf("accepted = %d, skipped = %d, want %d, %d", len(accepted), skipped, tt.wantAccepted, tt.wantSkipped)
+			}
+
+			var keys []string
+			for _, conflict := range conflicts {
+				keys = append(keys, conflict.Key)
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(tt.wantConflicts) {
+				t.Errorf("conflicts = %v, want %v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestTransactionConditionFailed(t *testing.T) {
+	canceled := func(codes ...string) error {
+		reasons := make([]types.CancellationReason, len(codes))
+		for i, code := range codes {
+			reasons[i] = types.CancellationReason{Code: aws.String(code)}
+		}
+		return &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "record condition failed", err: canceled("ConditionalCheckFailed", "None"), want: true},
+		{name: "wrapped", err: fmt.Errorf("write: %w", canceled("ConditionalCheckFailed", "None")), want: true},
+		{name: "transaction conflict", err: canceled("TransactionConflict", "None"), want: false},
+		{name: "other error", err: fmt.Errorf("boom"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transactionConditionFailed(tt.err); got != tt.want {
+				t.Errorf("transactionConditionFailed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePoolMembership(t *testing.T) {
+	pools, err := parsePools("prod=10.16.0.0/12:20, dev=10.32.0.0/12:24")
+	if err != nil {
+		t.Fatalf("parsePools() error = %v", err)
+	}
+	service := &CIDRService{pools: pools}
+
+	tests := []struct {
+		name    string
+		record  CIDRRecord
+		wantErr bool
+	}{
+		{name: "no pool", record: CIDRRecord{Key: "a", CIDR: "192.168.0.0/16"}, wantErr: false},
+		{name: "matching prefix", record: CIDRRecord{Key: "a", CIDR: "10.16.16.0/20", Pool: "prod"}, wantErr: false},
+		{name: "dev block", record: CIDRRecord{Key: "a", CIDR: "10.33.1.0/24", Pool: "dev"}, wantErr: false},
+		{name: "prefix mismatch", record: CIDRRecord{Key: "a", CIDR: "10.16.1.0/24", Pool: "prod"}, wantErr: true},
+		{name: "outside pool", record: CIDRRecord{Key: "a", CIDR: "10.33.1.0/24", Pool: "prod"}, wantErr: true},
+		{name: "unknown pool", record: CIDRRecord{Key: "a", CIDR: "10.16.16.0/20", Pool: "staging"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.validatePoolMembership(tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePoolMembership() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, value := range []string{"prod", "prod=10.16.0.0", "prod=10.16.0.0/12:8", "prod=10.16.0.0/12:x", "a=10.0.0.0/8,a=11.0.0.0/8"} {
+		if _, err := parsePools(value); err == nil {
+			t.Errorf("parsePools(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	pools, err := parsePolicy([]byte(`{
+		"shared": {"base": "10.64.0.0/12", "prefix": 22, "minPrefix": 20, "maxPrefix": 24, "excluded": ["10.64.0.0/16"]},
+		"prod": {"base": "10.16.0.0/12", "requiredPrefix": 20}
+	}`))
+	if err != nil {
+		t.Fatalf("parsePolicy() error = %v", err)
+	}
+	if len(pools) != 2 || pools[0].Name != "prod" || pools[1].Name != "shared" {
+		t.Fatalf("parsePolicy() = %v, want prod and shared", pools)
+	}
+
+	service := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16, pools: pools}
+	if _, _, prefix, err := service.resolveAllocation(AllocationOptions{Pool: "shared"}); err != nil || prefix != 22 {
+		t.Errorf("resolveAllocation(shared) = /%d, %v, want the default /22", prefix, err)
+	}
+	if _, _, _, err := service.resolveAllocation(AllocationOptions{Pool: "shared", Prefix: 26}); err == nil {
+		t.Errorf("resolveAllocation(shared, /26) error = nil, want maxPrefix error")
+	}
+
+	tests := []struct {
+		name    string
+		record  CIDRRecord
+		wantErr bool
+	}{
+		{name: "within bounds", record: CIDRRecord{Key: "a", CIDR: "10.65.0.0/21", Pool: "shared"}, wantErr: false},
+		{name: "too large", record: CIDRRecord{Key: "a", CIDR: "10.66.0.0/19", Pool: "shared"}, wantErr: true},
+		{name: "excluded", record: CIDRRecord{Key: "a", CIDR: "10.64.4.0/22", Pool: "shared"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.validatePoolMembership(tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePoolMembership() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, policy := range []string{
+		`{"prod": {}}`,
+		`{"prod": {"base": "10.16.0.0/12", "requiredPrefix": 8}}`,
+		`{"prod": {"base": "10.16.0.0/12", "minPrefix": 24, "maxPrefix": 20}}`,
+		`{"prod": {"base": "10.16.0.0/12", "requiredPrefix": 20, "prefix": 24}}`,
+		`{"prod": {"base": "10.16.0.0/12", "excluded": ["10.32.0.0/16"]}}`,
+		`{"prod": {"base": "10.16.0.0/12", "size": 20}}`,
+	} {
+		if _, err := parsePolicy([]byte(policy)); err == nil {
+			t.Errorf("parsePolicy(%s) error = nil, want error", policy)
+		}
+	}
+
+	if pools, err := loadPools("", ""); err != nil || len(pools) != 0 {
+		t.Errorf("loadPools() with the embedded default = %v, %v, want no pools", pools, err)
+	}
+}
+
+func TestRequestIDOrNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantKeep bool
+	}{
+		{name: "client id", header: "req-1234", wantKeep: true},
+		{name: "uuid", header: "0b6e4f1c-3c1a-4c55-9d7e-0f6c2b1a9e3d", wantKeep: true},
+		{name: "missing", header: "", wantKeep: false},
+		{name: "too long", header: strings.Repeat("a", maxRequestIDLength+1), wantKeep: false},
+		{name: "newline", header: "abc\nrequest_id=forged", wantKeep: false},
+		{name: "space", header: "abc def", wantKeep: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requestIDOrNew(tt.header)
+			if tt.wantKeep && got != tt.header {
+				t.Errorf("requestIDOrNew(%q) = %q, want it kept", tt.header, got)
+			}
+			if !tt.wantKeep && (got == tt.header || len(got) != 32) {
+				t.Errorf("requestIDOrNew(%q) = %q, want a generated ID", tt.header, got)
+			}
+		})
+	}
+}
+
+func TestCheckScopedUniqueness(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "acme-vpc", CIDR: "10.1.0.0/16", Tenant: "acme", Pool: "prod", Account: "111111111111"},
+	}
+
+	tests := []struct {
+		name      string
+		candidate CIDRRecord
+		scope     string
+		wantErr   bool
+	}{
+		{name: "global rejects other tenant", scope: uniquenessScopeGlobal,
+			candidate: CIDRRecord{Key: "globex-vpc", CIDR: "10.1.0.0/16", Tenant: "globex", Pool: "dev"}, wantErr: true},
+		{name: "tenant allows other tenant", scope: uniquenessScopeTenant,
+			candidate: CIDRRecord{Key: "globex-vpc", CIDR: "10.1.0.0/16", Tenant: "globex", Pool: "prod"}, wantErr: false},
+		{name: "tenant rejects same tenant", scope: uniquenessScopeTenant,
+			candidate: CIDRRecord{Key: "acme-vpc2", CIDR: "10.1.0.0/16", Tenant: "acme", Pool: "dev"}, wantErr: true},
+		{name: "pool allows other pool", scope: uniquenessScopePool,
+			candidate: CIDRRecord{Key: "acme-dev", CIDR: "10.1.0.0/16", Tenant: "acme", Pool: "dev"}, wantErr: false},
+		{name: "pool rejects same pool", scope: uniquenessScopePool,
+			candidate: CIDRRecord{Key: "globex-vpc", CIDR: "10.1.0.0/16", Tenant: "globex", Pool: "prod"}, wantErr: true},
+		{name: "pool rejects containment in same pool", scope: uniquenessScopePool,
+			candidate: CIDRRecord{Key: "prod-agg", CIDR: "10.0.0.0/8", Pool: "prod"}, wantErr: true},
+		{name: "account allows other account", scope: uniquenessScopeAccount,
+			candidate: CIDRRecord{Key: "globex-vpc", CIDR: "10.1.0.0/16", Account: "222222222222"}, wantErr: false},
+		{name: "account rejects same account", scope: uniquenessScopeAccount,
+			candidate: CIDRRecord{Key: "acme-vpc2", CIDR: "10.1.0.0/16", Account: "111111111111"}, wantErr: true},
+		{name: "key stays global", scope: uniquenessScopeTenant,
+			candidate: CIDRRecord{Key: "acme-vpc", CIDR: "10.2.0.0/16", Tenant: "globex"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkScopedUniqueness(records, tt.candidate, tt.scope)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkScopedUniqueness() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := parseUniquenessScope(uniquenessScopeTenant, true); err == nil {
+		t.Error("parseUniquenessScope() with partitioned layout error = nil, want error")
+	}
+	if _, err := parseUniquenessScope("region", false); err == nil {
+		t.Error("parseUniquenessScope(\"region\") error = nil, want error")
+	}
+}
+
+func TestResizedBlock(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "dev", CIDR: "10.2.0.0/16", Reserved: true},
+		{Key: "app", CIDR: "10.2.2.0/24"},
+		{Key: "db", CIDR: "10.2.4.0/24"},
+		{Key: "db-replica", CIDR: "10.2.4.128/25"},
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		newPrefix int
+		want      string
+		wantErr   bool
+	}{
+		{name: "grow within reserved parent", key: "app", newPrefix: 23, want: "10.2.2.0/23"},
+		{name: "grow off boundary", key: "app", newPrefix: 22, wantErr: true},
+		{name: "grow over sibling", key: "db", newPrefix: 21, wantErr: true},
+		{name: "grow misaligned", key: "db-replica", newPrefix: 24, wantErr: true},
+		{name: "shrink empty block", key: "app", newPrefix: 25, want: "10.2.2.0/25"},
+		{name: "shrink with children", key: "db", newPrefix: 25, wantErr: true},
+		{name: "same prefix", key: "app", newPrefix: 24, wantErr: true},
+		{name: "prefix out of range", key: "app", newPrefix: 33, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record CIDRRecord
+			for _, r := range records {
+				if r.Key == tt.key {
+					record = r
+				}
+			}
+
+			got, err := resizedBlock(records, record, tt.newPrefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resizedBlock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("resizedBlock() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextFreeSubnetFrom(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/22")
+	parse := func(cidrs ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, n)
+		}
+		return nets
+	}
+
+	tests := []struct {
+		name  string
+		used  []*net.IPNet
+		index uint64
+		want  string
+	}{
+		{name: "start at index", index: 2, want: "10.0.2.0/24"},
+		{name: "index wraps modulo subnets", index: 6, want: "10.0.2.0/24"},
+		{name: "probe past collision", used: parse("10.0.2.0/24"), index: 2, want: "10.0.3.0/24"},
+		{name: "wrap to start", used: parse("10.0.3.0/24"), index: 3, want: "10.0.0.0/24"},
+		{name: "skip larger block then wrap", used: parse("10.0.2.0/23", "10.0.0.0/24"), index: 2, want: "10.0.1.0/24"},
+		{name: "full", used: parse("10.0.0.0/22"), index: 1, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextFreeSubnetFrom(base, 24, tt.used, tt.index)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("nextFreeSubnetFrom() = %s, want none", got)
+				}
+				return
+			}
+			if !ok || got.String() != tt.want {
+				t.Errorf("nextFreeSubnetFrom() = %v, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+
+	if hashedIndex("vpc-dev") != hashedIndex("vpc-dev") || hashedIndex("vpc-dev") == hashedIndex("vpc-prod") {
+		t.Error("hashedIndex() is not a stable, key-dependent index")
+	}
+}
+
+func TestNextFreeSubnetWithGap(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/22")
+	parse := func(cidrs ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, n)
+		}
+		return nets
+	}
+
+	tests := []struct {
+		name string
+		used []*net.IPNet
+		gap  int
+		want string
+	}{
+		{name: "no gap packs tightly", used: parse("10.0.0.0/24"), gap: 0, want: "10.0.1.0/24"},
+		{name: "gap skips neighbours", used: parse("10.0.0.0/24"), gap: 1, want: "10.0.2.0/24"},
+		{name: "gap around smaller block", used: parse("10.0.0.128/25"), gap: 2, want: "10.0.3.0/24"},
+		{name: "gap before later block", used: parse("10.0.2.0/24"), gap: 1, want: "10.0.0.0/24"},
+		{name: "falls back when space runs low", used: parse("10.0.0.0/24", "10.0.2.0/24"), gap: 1, want: "10.0.1.0/24"},
+		{name: "full", used: parse("10.0.0.0/22"), gap: 1, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextFreeSubnetWithGap(base, 24, tt.used, 0, tt.gap)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("nextFreeSubnetWithGap() = %s, want none", got)
+				}
+				return
+			}
+			if !ok || got.String() != tt.want {
+				t.Errorf("nextFreeSubnetWithGap() = %v, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+
+	// IPv6 gaps are counted in blocks of the IPv6 prefix.
+	_, v6, _ := net.ParseCIDR("2001:db8::/52")
+	if got, ok := nextFreeSubnetWithGap(v6, 56, parse("2001:db8::/56", "2001:db8:0:180::/57"), 0, 1); !ok || got.String() != "2001:db8:0:300::/56" {
+		t.Errorf("nextFreeSubnetWithGap(IPv6) = %v, %v, want 2001:db8:0:300::/56", got, ok)
+	}
+}
+
+func TestGroupByNamespace(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "legacy", CIDR: "10.9.0.0/16"},
+		{Key: "team-a/prod/vpc1", CIDR: "10.1.0.0/16"},
+		{Key: "team-a/prod/vpc2", CIDR: "10.2.0.0/16"},
+		{Key: "team-a/vpc3", CIDR: "10.3.0.0/16"},
+		{Key: "team-b/dev/eu/vpc4", CIDR: "10.4.0.0/16"},
+	}
+
+	root := groupByNamespace(records, 2)
+	if root.Count != 5 || len(root.Records) != 1 || root.Records[0].Key != "legacy" {
+		t.Fatalf("root = count %d, records %v, want 5 and [legacy]", root.Count, root.Records)
+	}
+	if len(root.Namespaces) != 2 || root.Namespaces[0].Name != "team-a" || root.Namespaces[1].Name != "team-b" {
+		t.Fatalf("root namespaces = %v, want [team-a team-b]", root.Namespaces)
+	}
+
+	teamA := root.Namespaces[0]
+	if teamA.Count != 3 || len(teamA.Records) != 1 || teamA.Records[0].Key != "team-a/vpc3" {
+		t.Errorf("team-a = count %d, records %v, want 3 and [team-a/vpc3]", teamA.Count, teamA.Records)
+	}
+	if len(teamA.Namespaces) != 1 || teamA.Namespaces[0].Name != "prod" || len(teamA.Namespaces[0].Records) != 2 {
+		t.Errorf("team-a namespaces = %v, want prod with 2 records", teamA.Namespaces)
+	}
+
+	// Segments beyond depth stay part of the record rather than nesting further.
+	dev := root.Namespaces[1].Namespaces[0]
+	if dev.Name != "dev" || len(dev.Namespaces) != 0 || len(dev.Records) != 1 {
+		t.Errorf("team-b/dev = %+v, want one record and no namespaces", dev)
+	}
+
+	for _, query := range []map[string]string{
+		{"groupBy": "tenant"},
+		{"groupBy": "namespace", "depth": "0"},
+		{"groupBy": "namespace", "depth": "x"},
+	} {
+		if _, err := parseGroupBy(func(name string) string { return query[name] }); err == nil {
+			t.Errorf("parseGroupBy(%v) succeeded, want error", query)
+		}
+	}
+}
+
+func TestParseScanSegments(t *testing.T) {
+	if got, err := parseScanSegments(""); err != nil || got != 1 {
+		t.Errorf("parseScanSegments(\"\") = %d, %v, want 1", got, err)
+	}
+	if got, err := parseScanSegments("8"); err != nil || got != 8 {
+		t.Errorf("parseScanSegments(\"8\") = %d, %v, want 8", got, err)
+	}
+	for _, value := range []string{"0", "-1", "x", "1000001"} {
+		if _, err := parseScanSegments(value); err == nil {
+			t.Errorf("parseScanSegments(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestIsWriteRequest(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/", false},
+		{"HEAD", "/cidr", false},
+		{"OPTIONS", "/", false},
+		{"POST", "/plan", false},
+		{"POST", "/diff", false},
+		{"POST", "/supernet-of", false},
+		{"POST", "/", true},
+		{"POST", "/allocate", true},
+		{"POST", "/restore", true},
+		{"PATCH", "/", true},
+		{"DELETE", "/", true},
+	}
+
+	for _, tt := range tests {
+		if got := isWriteRequest(tt.method, tt.path); got != tt.want {
+			t.Errorf("isWriteRequest(%s, %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrefixList(t *testing.T) {
+	got, err := parsePrefixList("16, /20,24")
+	if err != nil || !reflect.DeepEqual(got, []int{16, 20, 24}) {
+		t.Errorf("parsePrefixList() = %v, %v, want [16 20 24]", got, err)
+	}
+	for _, value := range []string{"16,,24", "x", "0"} {
+		if _, err := parsePrefixList(value); err == nil {
+			t.Errorf("parsePrefixList(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestPrefixLengthBounds(t *testing.T) {
+	tests := []struct {
+		prefix, bits int
+		wantErr      bool
+	}{
+		{0, maxIPv4Prefix, false},
+		{32, maxIPv4Prefix, false},
+		{33, maxIPv4Prefix, true},
+		{-1, maxIPv4Prefix, true},
+		{128, maxIPv6Prefix, false},
+		{129, maxIPv6Prefix, true},
+	}
+	for _, tt := range tests {
+		if err := checkPrefixLength(tt.prefix, tt.bits); (err != nil) != tt.wantErr {
+			t.Errorf("checkPrefixLength(%d, %d) error = %v, wantErr %v", tt.prefix, tt.bits, err, tt.wantErr)
+		}
+	}
+
+	for value, wantErr := range map[string]bool{"32": false, "0": false, "56": false, "128": false, "129": true, "-1": true} {
+		query := map[string]string{"prefix": value}
+		if _, err := parseAllocationOptions(func(name string) string { return query[name] }); (err != nil) != wantErr {
+			t.Errorf("parseAllocationOptions(prefix=%s) error = %v, wantErr %v", value, err, wantErr)
+		}
+	}
+
+	for newPrefix, wantErr := range map[int]bool{24: false, 128: false, 129: true, -8: true, 0: true} {
+		if errs := (resizeRequest{Key: "web", NewPrefix: newPrefix}).validate(); (errs != nil) != wantErr {
+			t.Errorf("resizeRequest{NewPrefix: %d}.validate() = %v, wantErr %v", newPrefix, errs, wantErr)
+		}
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	existing := []CIDRRecord{
+		{Key: "vpc-prod", CIDR: "10.0.0.0/16"},
+		{Key: "manual-subnet", CIDR: "10.5.1.0/24"},
+	}
+	discovered := []CIDRRecord{
+		{Key: "vpc-aaa/subnet-1", CIDR: "10.1.1.0/24", Account: "111111111111"},
+		{Key: "vpc-aaa", CIDR: "10.1.0.0/16", Account: "111111111111"},
+		{Key: "vpc-bbb", CIDR: "10.0.0.0/16", Account: "111111111111"},
+		{Key: "vpc-ccc", CIDR: "10.5.0.0/16", Account: "111111111111"},
+		{Key: "vpc-prod", CIDR: "10.6.0.0/16", Account: "111111111111"},
+	}
+
+	imported, skipped, conflicts := planSync(existing, discovered, uniquenessScopeGlobal, now)
+
+	var importedKeys []string
+	for _, record := range imported {
+		importedKeys = append(importedKeys, record.Key)
+	}
+	if want := []string{"vpc-aaa", "vpc-aaa/subnet-1"}; !reflect.DeepEqual(importedKeys, want) {
+		t.Errorf("imported = %v, want %v", importedKeys, want)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped = %d, want 1 (vpc-bbb is already tracked as vpc-prod)", skipped)
+	}
+
+	var conflictKeys []string
+	for _, conflict := range conflicts {
+		conflictKeys = append(conflictKeys, conflict.Key)
+	}
+	if want := []string{"vpc-ccc", "vpc-prod"}; !reflect.DeepEqual(conflictKeys, want) {
+		t.Errorf("conflicts = %v, want %v", conflictKeys, want)
+	}
+
+	targets, err := parseSyncTargets("us-east-1, eu-west-1=arn:aws:iam::222222222222:role/sync")
+	if err != nil || len(targets) != 2 || targets[1].RoleARN != "arn:aws:iam::222222222222:role/sync" {
+		t.Errorf("parseSyncTargets() = %v, %v", targets, err)
+	}
+	for _, value := range []string{"=arn:aws:iam::1:role/x", "us-east-1=role/x"} {
+		if _, err := parseSyncTargets(value); err == nil {
+			t.Errorf("parseSyncTargets(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestAdjacentBlocks(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	records := []CIDRRecord{
+		{Key: "all", CIDR: "10.0.0.0/8", Reserved: true},
+		{Key: "vpc-a", CIDR: "10.2.0.0/16"},
+		{Key: "app", CIDR: "10.3.4.0/24"},
+	}
+
+	tests := []struct {
+		name         string
+		cidr         string
+		base         *net.IPNet
+		wantPrevious string
+		wantNext     string
+		previousFree bool
+		nextFree     bool
+	}{
+		{name: "previous free, next partly used", cidr: "10.2.0.0/16", base: base,
+			wantPrevious: "10.1.0.0/16", previousFree: true, wantNext: "10.3.0.0/16", nextFree: false},
+		{name: "start of base", cidr: "10.0.0.0/16", base: base,
+			wantNext: "10.1.0.0/16", nextFree: true},
+		{name: "end of base", cidr: "10.255.0.0/16", base: base,
+			wantPrevious: "10.254.0.0/16", previousFree: true},
+		{name: "end of address space", cidr: "255.255.255.0/24",
+			wantPrevious: "255.255.254.0/24", previousFree: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, network, _ := net.ParseCIDR(tt.cidr)
+			got := adjacentBlocks(records, network, tt.base)
+
+			check := func(label string, block *AdjacentBlock, want string, wantFree bool) {
+				if want == "" {
+					if block != nil {
+						t.Errorf("%s = %s, want none", label, block.CIDR)
+					}
+					return
+				}
+				if block == nil || block.CIDR != want || block.Free != wantFree {
+					t.Errorf("%s = %+v, want %s free=%v", label, block, want, wantFree)
+				}
+			}
+			check("previous", got.Previous, tt.wantPrevious, tt.previousFree)
+			check("next", got.Next, tt.wantNext, tt.nextFree)
+		})
+	}
+}
+
+func TestResponseNaming(t *testing.T) {
+	body := map[string]interface{}{
+		"cidr":        "10.0.0.0/24",
+		"usableHosts": 254,
+		"records":     []CIDRRecord{{Key: "app", CIDR: "10.0.0.0/24", ExpiresAt: 1700000000, Tags: Tags{"costCenter": "42", "cidr": "lab"}}},
+	}
+
+	tests := []struct {
+		name     string
+		caseName string
+		fields   string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default keeps names", want: `{"cidr":"10.0.0.0/24","records":[{"key":"app","cidr":"10.0.0.0/24","expiresAt":1700000000,"tags":{"cidr":"lab","costCenter":"42"}}],"usableHosts":254}`},
+		{name: "snake case", caseName: "snake",
+			want: `{"cidr":"10.0.0.0/24","records":[{"cidr":"10.0.0.0/24","expires_at":1700000000,"key":"app","tags":{"cidr":"lab","costCenter":"42"}}],"usable_hosts":254}`},
+		{name: "custom field over case", caseName: "snake", fields: "cidr=cidr_block, usableHosts=hosts",
+			want: `{"cidr_block":"10.0.0.0/24","hosts":254,"records":[{"cidr_block":"10.0.0.0/24","expires_at":1700000000,"key":"app","tags":{"cidr":"lab","costCenter":"42"}}]}`},
+		{name: "unknown case", caseName: "kebab", wantErr: true},
+		{name: "malformed field", fields: "cidr", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := parseResponseNaming(tt.caseName, tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseResponseNaming() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			data, _ := json.Marshal(body)
+			got, err := n.rename(data)
+			if err != nil {
+				t.Fatalf("rename() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("rename() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBestFitSubnet(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/16")
+
+	tests := []struct {
+		name   string
+		used   []string
+		prefix int
+		want   string
+	}{
+		{name: "empty base", prefix: 24, want: "10.0.0.0/24"},
+		{name: "fills the smallest hole", used: []string{"10.0.0.0/24", "10.0.2.0/23", "10.0.5.0/24"}, prefix: 24,
+			want: "10.0.1.0/24"},
+		{name: "skips a hole it would strand space in", used: []string{"10.0.0.0/24", "10.0.4.0/22"}, prefix: 23,
+			want: "10.0.8.0/23"},
+		{name: "fails rather than fragment", used: []string{"10.0.0.0/24", "10.0.3.0/24", "10.0.4.0/22", "10.0.8.0/21", "10.0.16.0/20", "10.0.32.0/19", "10.0.64.0/18", "10.0.128.0/17"},
+			prefix: 23},
+		{name: "full base", used: []string{"10.0.0.0/16"}, prefix: 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var used []*net.IPNet
+			for _, cidr := range tt.used {
+				_, network, _ := net.ParseCIDR(cidr)
+				used = append(used, network)
+			}
+
+			got, ok := bestFitSubnet(base, tt.prefix, used)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("bestFitSubnet() = %s, want none", got)
+				}
+				return
+			}
+			if !ok || got.String() != tt.want {
+				t.Errorf("bestFitSubnet() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestSigning(t *testing.T) {
+	s, err := parseRequestSigning("shared-secret", "1m")
+	if err != nil {
+		t.Fatalf("parseRequestSigning() error = %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"key":"app"}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	query := canonicalQuery(parameterValues(map[string]string{"pool": "prod", "prefix": "24"}))
+	signature := s.sign("POST", "/allocate", query, timestamp, body)
+
+	tests := []struct {
+		name      string
+		path      string
+		query     string
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   bool
+	}{
+		{name: "valid", path: "/allocate", query: query, timestamp: timestamp, signature: signature, body: body},
+		{name: "missing signature", path: "/allocate", query: query, timestamp: timestamp, body: body, wantErr: true},
+		{name: "tampered body", path: "/allocate", query: query, timestamp: timestamp, signature: signature, body: []byte(`{"key":"other"}`), wantErr: true},
+		{name: "other query", path: "/allocate", query: "pool=dev&prefix=24", timestamp: timestamp, signature: signature, body: body, wantErr: true},
+		{name: "unsigned query", path: "/allocate", timestamp: timestamp, signature: signature, body: body, wantErr: true},
+		{name: "other path", path: "/", query: query, timestamp: timestamp, signature: signature, body: body, wantErr: true},
+		{name: "stale", path: "/allocate", query: query, timestamp: "1699999900",
+			signature: s.sign("POST", "/allocate", query, "1699999900", body), body: body, wantErr: true},
+		{name: "malformed timestamp", path: "/allocate", query: query, timestamp: "yesterday", signature: signature, body: body, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.verify("POST", tt.path, tt.query, tt.timestamp, tt.signature, tt.body, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := parseRequestSigning("shared-secret", "-1m"); err == nil {
+		t.Error("parseRequestSigning() accepted a negative skew")
+	}
+}
+
+func TestReassignItems(t *testing.T) {
+	old := CIDRRecord{Key: "team-a/app", CIDR: "10.1.0.0/16", Partition: "10.0.0.0/8", Description: "app"}
+	moved := old
+	moved.Key = "team-b/app"
+
+	keyed := &CIDRService{tableName: "cidr-registry"}
+	items, err := keyed.reassignItems(context.Background(), old, moved)
+	if err != nil {
+		t.Fatalf("reassignItems() error = %v", err)
+	}
+	if len(items) != 2 || items[0].Delete == nil || items[1].Put == nil {
+		t.Fatalf("key layout: got %+v, want a delete then a put", items)
+	}
+	if key := items[1].Put.Item["key"].(*types.AttributeValueMemberS).Value; key != "team-b/app" {
+		t.Errorf("put key = %q, want team-b/app", key)
+	}
+	if description := items[1].Put.Item["description"].(*types.AttributeValueMemberS).Value; description != "app" {
+		t.Errorf("put description = %q, want app", description)
+	}
+
+	partitioned := &CIDRService{tableName: "cidr-registry", partitioned: true}
+	items, err = partitioned.reassignItems(context.Background(), old, moved)
+	if err != nil {
+		t.Fatalf("reassignItems() error = %v", err)
+	}
+	if len(items) != 1 || items[0].Update == nil {
+		t.Fatalf("partitioned layout: got %+v, want a single update", items)
+	}
+}
+
+func TestRecycledSubnet(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	parse := func(cidrs ...string) []*net.IPNet {
+		var networks []*net.IPNet
+		for _, cidr := range cidrs {
+			_, network, _ := net.ParseCIDR(cidr)
+			networks = append(networks, network)
+		}
+		return networks
+	}
+
+	released := releasedOrder([]ReleasedBlock{
+		{CIDR: "10.9.0.0/16", ReleasedAt: 200},
+		{CIDR: "10.5.0.0/16", ReleasedAt: 100},
+		{CIDR: "172.16.0.0/16", ReleasedAt: 50},
+	})
+
+	tests := []struct {
+		name   string
+		prefix int
+		used   []*net.IPNet
+		want   string
+	}{
+		{name: "oldest release in base first", prefix: 16, want: "10.5.0.0/16"},
+		{name: "smaller block inside a partly reused release", prefix: 24,
+			used: parse("10.5.0.0/24"), want: "10.5.1.0/24"},
+		{name: "next release once one is reused", prefix: 16,
+			used: parse("10.5.0.0/16"), want: "10.9.0.0/16"},
+		{name: "larger than any release", prefix: 12},
+		{name: "every release reused", prefix: 16, used: parse("10.5.0.0/16", "10.9.0.0/16")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := recycledSubnet(released, base, tt.prefix, tt.used)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("recycledSubnet() = %s, want none", got)
+				}
+				return
+			}
+			if !ok || got.String() != tt.want {
+				t.Errorf("recycledSubnet() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWantsXML(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "*/*", want: false},
+		{accept: "application/json", want: false},
+		{accept: "application/xml", want: true},
+		{accept: "text/xml", want: true},
+		{accept: "application/xml, application/json", want: false},
+		{accept: "application/json;q=0.5, application/xml", want: true},
+		{accept: "application/xml;q=0.9, */*;q=0.1", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := wantsXML(tt.accept); got != tt.want {
+			t.Errorf("wantsXML(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestJSONToXML(t *testing.T) {
+	record := CIDRRecord{Key: "app", CIDR: "10.1.0.0/16", Description: "a < b", ExpiresAt: 1700000000}
+	data, _ := json.Marshal(map[string]interface{}{
+		"records": []CIDRRecord{record},
+		"next":    map[int]*string{16: nil},
+	})
+
+	got, err := jsonToXML(data)
+	if err != nil {
+		t.Fatalf("jsonToXML() error = %v", err)
+	}
+	want := xml.Header + `<response><next><entry key="16"></entry></next><records><item><key>app</key><cidr>10.1.0.0/16</cidr>` +
+		`<description>a &lt; b</description><expiresAt>1700000000</expiresAt></item></records></response>`
+	if string(got) != want {
+		t.Errorf("jsonToXML() = %s, want %s", got, want)
+	}
+
+	recordJSON, _ := json.Marshal(record)
+	recordXML, err := jsonToXML(recordJSON)
+	if err != nil {
+		t.Fatalf("jsonToXML() error = %v", err)
+	}
+	var decoded CIDRRecord
+	if err := xml.Unmarshal(recordXML, &decoded); err != nil {
+		t.Fatalf("xml.Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, record) {
+		t.Errorf("decoded record = %+v, want %+v", decoded, record)
+	}
+}
+
+func TestHeadroom(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/22")
+	parse := func(cidrs ...string) []*net.IPNet {
+		var networks []*net.IPNet
+		for _, cidr := range cidrs {
+			_, network, _ := net.ParseCIDR(cidr)
+			networks = append(networks, network)
+		}
+		return networks
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		used    []*net.IPNet
+		next    string
+		wantErr bool
+	}{
+		{name: "no headroom", used: parse("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"), next: "10.0.3.0/24"},
+		{name: "block count leaves the last block", value: "1", used: parse("10.0.0.0/24", "10.0.1.0/24"), next: "10.0.2.0/24"},
+		{name: "block count refuses the last block", value: "1", used: parse("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"),
+			next: "10.0.3.0/24", wantErr: true},
+		{name: "percentage", value: "50%", used: parse("10.0.0.0/24"), next: "10.0.1.0/24"},
+		{name: "percentage reached", value: "50%", used: parse("10.0.0.0/24", "10.0.1.0/24"), next: "10.0.2.0/24", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseHeadroom(tt.value)
+			if err != nil {
+				t.Fatalf("parseHeadroom() error = %v", err)
+			}
+			c := &CIDRService{headroom: h, allocationPrefix: 24}
+			_, next, _ := net.ParseCIDR(tt.next)
+
+			err = c.checkHeadroom(base, next, tt.used)
+			var reached *HeadroomError
+			if got := errors.As(err, &reached); got != tt.wantErr {
+				t.Errorf("checkHeadroom() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, value := range []string{"100%", "-1", "ten"} {
+		if _, err := parseHeadroom(value); err == nil {
+			t.Errorf("parseHeadroom(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+// fakeAssumeRoleClient records AssumeRole calls and returns fixed credentials.
+type fakeAssumeRoleClient struct {
+	input *sts.AssumeRoleInput
+}
+
+func (f *fakeAssumeRoleClient) AssumeRole(_ context.Context, input *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.input = input
+	return &sts.AssumeRoleOutput{
+		Credentials: &ststypes.Credentials{
+			AccessKeyId:     aws.String("ASIAEXAMPLE"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestWithAssumedRole(t *testing.T) {
+	base := aws.Config{Region: "us-east-1"}
+
+	if cfg := withAssumedRole(base, assumeRoleSettings{}, &fakeAssumeRoleClient{}); cfg.Credentials != nil {
+		t.Error("withAssumedRole() replaced the credentials without a role ARN")
+	}
+
+	client := &fakeAssumeRoleClient{}
+	settings := assumeRoleSettings{RoleARN: "arn:aws:iam::222222222222:role/cidrfinder", ExternalID: "ext-123"}
+	cfg := withAssumedRole(base, settings, client)
+
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if creds.AccessKeyID != "ASIAEXAMPLE" {
+		t.Errorf("AccessKeyID = %q, want ASIAEXAMPLE", creds.AccessKeyID)
+	}
+	if got := aws.ToString(client.input.RoleArn); got != settings.RoleARN {
+		t.Errorf("RoleArn = %q, want %q", got, settings.RoleARN)
+	}
+	if got := aws.ToString(client.input.ExternalId); got != "ext-123" {
+		t.Errorf("ExternalId = %q, want ext-123", got)
+	}
+	if got := aws.ToString(client.input.RoleSessionName); got != defaultAssumeRoleSessionName {
+		t.Errorf("RoleSessionName = %q, want %q", got, defaultAssumeRoleSessionName)
+	}
+}
+
+func TestCoveringSupernet(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+		want  string
+	}{
+		{name: "single input", cidrs: []string{"10.1.2.0/24"}, want: "10.1.2.0/24"},
+		{name: "siblings", cidrs: []string{"10.0.0.0/16", "10.1.0.0/16"}, want: "10.0.0.0/15"},
+		{name: "scattered", cidrs: []string{"10.0.4.0/24", "10.0.9.0/24", "10.0.15.128/25"}, want: "10.0.0.0/20"},
+		{name: "nested keeps the larger block", cidrs: []string{"10.0.0.0/8", "10.200.1.0/24"}, want: "10.0.0.0/8"},
+		{name: "whole space", cidrs: []string{"10.0.0.0/8", "192.168.0.0/16"}, want: "0.0.0.0/0"},
+		{name: "IPv6", cidrs: []string{"2001:db8::/48", "2001:db8:1::/48"}, want: "2001:db8::/47"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, errs := supernetRequest{CIDRs: tt.cidrs}.networks()
+			if errs != nil {
+				t.Fatalf("networks() errors = %v", errs)
+			}
+			if got := coveringSupernet(networks).String(); got != tt.want {
+				t.Errorf("coveringSupernet() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, cidrs := range [][]string{nil, {"10.0.0.0/8", "bogus"}, {"10.0.0.0/8", "2001:db8::/32"}} {
+		if _, errs := (supernetRequest{CIDRs: cidrs}).networks(); errs == nil {
+			t.Errorf("networks(%v) accepted invalid input", cidrs)
+		}
+	}
+}
+
+func TestApproval(t *testing.T) {
+	t.Setenv("APPROVER_TOKEN", "s3cret")
+	for header, want := range map[string]bool{
+		"Bearer s3cret": true,
+		"Bearer wrong":  false,
+		"s3cret":        false,
+		"":              false,
+	} {
+		if got := isApprover(header); got != want {
+			t.Errorf("isApprover(%q) = %v, want %v", header, got, want)
+		}
+	}
+
+	pending := CIDRRecord{Key: "a", CIDR: "10.0.0.0/24", Status: recordStatusPending}
+	active := CIDRRecord{Key: "b", CIDR: "10.0.1.0/24"}
+	filter := RecordFilter{Status: recordStatusPending}
+	if !filter.matches(pending) || filter.matches(active) {
+		t.Errorf("status=pending filter matched the wrong records")
+	}
+	filter.Status = recordStatusActive
+	if filter.matches(pending) || !filter.matches(active) {
+		t.Errorf("status=active filter matched the wrong records")
+	}
+}
+
+func TestResponseVersion(t *testing.T) {
+	tests := []struct {
+		query, accept string
+		want          int
+		wantErr       bool
+	}{
+		{"", "", responseVersion2, false},
+		{"1", "", responseVersion1, false},
+		{"v1", "application/json; version=2", responseVersion1, false},
+		{"", "application/json; version=1", responseVersion1, false},
+		{"", "text/html, application/vnd.cidrfinder.v1+json", responseVersion1, false},
+		{"", "application/vnd.cidrfinder.v2+json", responseVersion2, false},
+		{"3", "", 0, true},
+		{"", "application/json; version=x", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := responseVersion(tt.query, tt.accept)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("responseVersion(%q, %q) = %d, %v, want %d, error %v", tt.query, tt.accept, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	body := []byte(`{"error":"invalid request body","errors":{"key":"required"}}`)
+	got, err := envelopeBody(responseVersion1, http.StatusBadRequest, body)
+	if err != nil || string(got) != `{"error":"invalid request body"}` {
+		t.Errorf("envelopeBody(v1) = %s, %v", got, err)
+	}
+	if got, _ := envelopeBody(responseVersion2, http.StatusBadRequest, body); string(got) != string(body) {
+		t.Errorf("envelopeBody(v2) = %s, want body unchanged", got)
+	}
+}
+
+func TestNetworkDetailsSmallBlocks(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{"10.0.0.0/8", `{"family":"ipv4","network":"10.0.0.0","broadcast":"10.255.255.255","firstUsable":"10.0.0.1","lastUsable":"10.255.255.254","addresses":16777216,"usableHosts":16777214}`},
+		{"10.0.0.0/24", `{"family":"ipv4","network":"10.0.0.0","broadcast":"10.0.0.255","firstUsable":"10.0.0.1","lastUsable":"10.0.0.254","addresses":256,"usableHosts":254}`},
+		{"10.0.0.4/30", `{"family":"ipv4","network":"10.0.0.4","broadcast":"10.0.0.7","firstUsable":"10.0.0.5","lastUsable":"10.0.0.6","addresses":4,"usableHosts":2}`},
+		{"10.0.0.6/31", `{"family":"ipv4","network":"10.0.0.6","firstUsable":"10.0.0.6","lastUsable":"10.0.0.7","addresses":2,"usableHosts":2}`},
+		{"10.0.0.9/32", `{"family":"ipv4","network":"10.0.0.9","firstUsable":"10.0.0.9","lastUsable":"10.0.0.9","addresses":1,"usableHosts":1}`},
+		{"::ffff:10.0.0.0/120", `{"family":"ipv4","network":"10.0.0.0","broadcast":"10.0.0.255","firstUsable":"10.0.0.1","lastUsable":"10.0.0.254","addresses":256,"usableHosts":254}`},
+		{"2001:db8::/32", `{"family":"ipv6","network":"2001:db8::","firstUsable":"2001:db8::","lastUsable":"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff","addresses":79228162514264337593543950336,"usableHosts":79228162514264337593543950336}`},
+		{"2001:db8:1::/64", `{"family":"ipv6","network":"2001:db8:1::","firstUsable":"2001:db8:1::","lastUsable":"2001:db8:1:0:ffff:ffff:ffff:ffff","addresses":18446744073709551616,"usableHosts":18446744073709551616}`},
+		{"2001:db8::/127", `{"family":"ipv6","network":"2001:db8::","firstUsable":"2001:db8::","lastUsable":"2001:db8::1","addresses":2,"usableHosts":2}`},
+		{"2001:db8::5/128", `{"family":"ipv6","network":"2001:db8::5","firstUsable":"2001:db8::5","lastUsable":"2001:db8::5","addresses":1,"usableHosts":1}`},
+		{"::/0", `{"family":"ipv6","network":"::","firstUsable":"::","lastUsable":"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff","addresses":340282366920938463463374607431768211456,"usableHosts":340282366920938463463374607431768211456}`},
+	}
+
+	for _, tt := range tests {
+		_, network, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(networkDetails(network))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("networkDetails(%s) = %s, %v, want %s", tt.cidr, got, err, tt.want)
+		}
+		if details := networkDetails(network); details.Family == familyIPv4 {
+			if prefix, bits := network.Mask.Size(); usableHosts(prefix-(bits-32)) != details.UsableHosts.Uint64() {
+				t.Errorf("usableHosts(%d) = %d, want %s", prefix, usableHosts(prefix), details.UsableHosts)
+			}
+		}
+	}
+
+	_, base, _ := net.ParseCIDR("10.0.0.0/30")
+	_, host, _ := net.ParseCIDR("10.0.0.0/32")
+	_, link, _ := net.ParseCIDR("10.0.0.2/31")
+	used := []*net.IPNet{host, link}
+	if got, ok := nextFreeSubnet(base, 32, used); !ok || got.String() != "10.0.0.1/32" {
+		t.Errorf("nextFreeSubnet(/32) = %v, %v, want 10.0.0.1/32", got, ok)
+	}
+	if got, ok := nextFreeSubnet(base, 31, used); ok {
+		t.Errorf("nextFreeSubnet(/31) = %v, want none free", got)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var attempts int
+	var gotBody []byte
+	var gotSignature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gotBody, _ = io.ReadAll(r.Body)
+		gotSignature = r.Header.Get(webhookSignatureHeader)
+	}))
+	defer server.Close()
+
+	n := &webhookNotifier{url: server.URL, secret: []byte("s3cret"), retries: 2, client: server.Client()}
+	event := ChangeEvent{Action: auditActionAllocate, Key: "app", CIDR: "10.0.0.0/24", At: "2024-01-01T00:00:00Z"}
+	if err := n.Notify(context.Background(), event); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2 (one retry after 503)", attempts)
+	}
+	want := `{"action":"allocate","key":"app","cidr":"10.0.0.0/24","at":"2024-01-01T00:00:00Z"}`
+	if string(gotBody) != want {
+		t.Errorf("body = %s, want %s", gotBody, want)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(want))
+	if wantSig := "sha256=" + hex.EncodeToString(mac.Sum(nil)); gotSignature != wantSig {
+		t.Errorf("signature = %q, want %q", gotSignature, wantSig)
+	}
+
+	attempts = 0
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	n.url = rejecting.URL
+	if err := n.Notify(context.Background(), event); err == nil || attempts != 1 {
+		t.Errorf("Notify() to a 400 endpoint = %v after %d attempts, want an error without retries", err, attempts)
+	}
+}
+
+func TestRecordAge(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	day := int64(24 * 60 * 60)
+	records := []CIDRRecord{
+		{Key: "legacy", CIDR: "10.0.0.0/24"},
+		{Key: "new", CIDR: "10.0.1.0/24", CreatedAt: now.Unix() - day},
+		{Key: "old", CIDR: "10.0.2.0/24", CreatedAt: now.Unix() - 40*day},
+	}
+
+	filter, err := parseRecordFilter(func(name string) string {
+		return map[string]string{"olderThan": "30d"}[name]
+	}, now)
+	if err != nil {
+		t.Fatalf("parseRecordFilter() error = %v", err)
+	}
+	if got := filterRecords(records, filter); len(got) != 1 || got[0].Key != "old" {
+		t.Errorf("olderThan=30d kept %v, want only old", got)
+	}
+
+	sorted := withAges(append([]CIDRRecord(nil), records...), now)
+	if err := sortRecords(sorted, "age"); err != nil {
+		t.Fatalf("sortRecords() error = %v", err)
+	}
+	var keys []string
+	for _, record := range sorted {
+		keys = append(keys, record.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"old", "new", "legacy"}) {
+		t.Errorf("sort=age order = %v, want [old new legacy]", keys)
+	}
+	if sorted[0].AgeSeconds == nil || *sorted[0].AgeSeconds != 40*day || sorted[2].AgeSeconds != nil {
+		t.Errorf("ages = %v, %v, want %d and none for a record without createdAt", sorted[0].AgeSeconds, sorted[2].AgeSeconds, 40*day)
+	}
+
+	for _, value := range []string{"12h", "0d", "90m"} {
+		if _, err := parseAge(value); err != nil {
+			t.Errorf("parseAge(%q) error = %v", value, err)
+		}
+	}
+	for _, value := range []string{"d", "-1d", "soon", "-5h"} {
+		if _, err := parseAge(value); err == nil {
+			t.Errorf("parseAge(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestNextFreeSubnetIPv6(t *testing.T) {
+	_, base, _ := net.ParseCIDR("2001:db8::/32")
+	parse := func(cidrs ...string) []*net.IPNet {
+		var networks []*net.IPNet
+		for _, c := range cidrs {
+			_, n, _ := net.ParseCIDR(c)
+			networks = append(networks, n)
+		}
+		return networks
+	}
+
+	tests := []struct {
+		name  string
+		used  []*net.IPNet
+		index uint64
+		want  string
+	}{
+		{name: "empty base", want: "2001:db8::/56"},
+		{name: "skips used blocks", used: parse("2001:db8::/56", "2001:db8:0:100::/56"), want: "2001:db8:0:200::/56"},
+		{name: "skips a larger block as a whole", used: parse("2001:db8::/40"), want: "2001:db8:100::/56"},
+		{name: "ignores IPv4 records", used: parse("10.0.0.0/8"), want: "2001:db8::/56"},
+		// A /32 holds 2^24 /56s, so the index wraps modulo that count.
+		{name: "starts at index", index: 1<<24 + 3, want: "2001:db8:0:300::/56"},
+		{name: "wraps around", used: parse("2001:db8:ff00::/40"), index: 1<<24 - 1, want: "2001:db8::/56"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextFreeSubnetFrom(base, 56, tt.used, tt.index)
+			if !ok || got.String() != tt.want {
+				t.Errorf("nextFreeSubnetFrom() = %v, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+
+	_, full, _ := net.ParseCIDR("2001:db8::/120")
+	if got, ok := nextFreeSubnet(full, 121, parse("2001:db8::/121", "2001:db8::80/121")); ok {
+		t.Errorf("nextFreeSubnet() on a full base = %s, want none", got)
+	}
+
+	service := &CIDRService{baseCIDR: defaultBaseCIDR, allocationPrefix: defaultAllocationPrefix, allowedBases: []*net.IPNet{base}}
+	if _, _, prefix, err := service.resolveAllocation(AllocationOptions{Base: "2001:db8::/32", Prefix: 56}); err != nil || prefix != 56 {
+		t.Errorf("resolveAllocation(IPv6 /56) = /%d, %v, want /56", prefix, err)
+	}
+	if _, _, _, err := service.resolveAllocation(AllocationOptions{Base: "2001:db8::/32", Prefix: 129}); err == nil {
+		t.Error("resolveAllocation(/129) error = nil, want error")
+	}
+	if _, _, _, err := service.resolveAllocation(AllocationOptions{Base: "2001:db8::/32", Prefix: 56, NoFragment: true}); err == nil {
+		t.Error("resolveAllocation(IPv6 noFragment) error = nil, want error")
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	params := func(values map[string]string) func(string) string {
+		return func(name string) string { return values[name] }
+	}
+
+	q, err := parseHistoryQuery(params(map[string]string{"from": "2024-01-01T00:00:00+02:00", "limit": "10"}))
+	if err != nil {
+		t.Fatalf("parseHistoryQuery() error = %v", err)
+	}
+	if q.From != "2023-12-31T22:00:00Z" || q.To != "" || q.Limit != 10 {
+		t.Errorf("parseHistoryQuery() = %+v, want from in UTC and limit 10", q)
+	}
+	if q, _ := parseHistoryQuery(params(nil)); q.Limit != defaultHistoryLimit {
+		t.Errorf("default limit = %d, want %d", q.Limit, defaultHistoryLimit)
+	}
+	for _, bad := range []map[string]string{
+		{"from": "yesterday"},
+		{"from": "2024-02-01T00:00:00Z", "to": "2024-01-01T00:00:00Z"},
+		{"limit": "0"},
+		{"limit": "5000"},
+	} {
+		if _, err := parseHistoryQuery(params(bad)); err == nil {
+			t.Errorf("parseHistoryQuery(%v) error = nil, want error", bad)
+		}
+	}
+
+	key := map[string]types.AttributeValue{
+		"key":  &types.AttributeValueMemberS{Value: "app"},
+		"at":   &types.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+		"feed": &types.AttributeValueMemberS{Value: auditFeed},
+	}
+	token, err := encodeHistoryToken(key)
+	if err != nil || token == "" {
+		t.Fatalf("encodeHistoryToken() = %q, %v", token, err)
+	}
+	decoded, err := decodeHistoryToken(token)
+	if err != nil || !reflect.DeepEqual(decoded, key) {
+		t.Errorf("decodeHistoryToken() = %v, %v, want %v", decoded, err, key)
+	}
+	if _, err := decodeHistoryToken("not a token"); !errors.Is(err, errInvalidHistoryToken) {
+		t.Errorf("decodeHistoryToken(garbage) error = %v, want errInvalidHistoryToken", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	// Neither level may touch DynamoDB here: the service has no client, and
+	// the full level's count is still fresh.
+	service := &CIDRService{tableName: "cidr-registry", statusDetail: statusDetailMinimal, healthCountInterval: time.Minute}
+	if got := service.Health(context.Background()); got != (HealthStatus{Status: healthStatusOK, Version: version}) {
+		t.Errorf("minimal Health() = %+v, want only status and version", got)
+	}
+
+	service.statusDetail = statusDetailFull
+	service.awsConfig.Region = "us-west-2"
+	countedAt := time.Now().Add(-30 * time.Second)
+	service.healthCount.count, service.healthCount.countedAt = 7, countedAt
+	got := service.Health(context.Background())
+	if got.Status != healthStatusOK || got.Table != "cidr-registry" || got.Region != "us-west-2" ||
+		got.ItemCount == nil || *got.ItemCount != 7 || got.CountedAt != countedAt.UTC().Format(time.RFC3339) {
+		t.Errorf("full Health() = %+v, want the cached count of 7", got)
+	}
+
+	if _, err := parseStatusDetail("verbose"); err == nil {
+		t.Error("parseStatusDetail(verbose) error = nil, want error")
+	}
+	if _, err := parseHealthCountInterval("0s"); err == nil {
+		t.Error("parseHealthCountInterval(0s) error = nil, want error")
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	info := buildInfo()
+	if info.Version != version || info.Commit != commit || info.BuildTime != buildTime {
+		t.Errorf("buildInfo() = %+v, want the ldflags variables", info)
+	}
+	if !strings.HasPrefix(info.GoVersion, "go") || info.ModuleVersion == "" {
+		t.Errorf("buildInfo() = %+v, want the Go and module versions", info)
+	}
+}
+
+// stubReader serves reads from fixed items, standing in for the fallback
+// replica.
+type stubReader struct {
+	items []map[string]types.AttributeValue
+	calls int
+}
+
+func (s *stubReader) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	s.calls++
+	for _, item := range s.items {
+		if reflect.DeepEqual(item["key"], params.Key["key"]) {
+			return &dynamodb.GetItemOutput{Item: item}, nil
+		}
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (s *stubReader) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	s.calls++
+	return &dynamodb.QueryOutput{}, nil
+}
+
+func (s *stubReader) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	s.calls++
+	return &dynamodb.ScanOutput{Items: s.items, Count: int32(len(s.items))}, nil
+}
+
+func TestReadFallback(t *testing.T) {
+	var primaryCalls int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+
+	fallback := &stubReader{items: []map[string]types.AttributeValue{{
+		"key":  &types.AttributeValueMemberS{Value: "app"},
+		"cidr": &types.AttributeValueMemberS{Value: "10.1.0.0/16"},
+	}}}
+	service := &CIDRService{
+		tableName: "cidr-registry",
+		dynamoClient: dynamodb.New(dynamodb.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(primary.URL),
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+		fallback: fallback,
+	}
+	ctx := context.Background()
+
+	records, err := service.GetAllCIDRs(ctx)
+	if err != nil || len(records) != 1 || records[0].CIDR != "10.1.0.0/16" {
+		t.Errorf("GetAllCIDRs() = %v, %v, want the fallback's record", records, err)
+	}
+	record, err := service.GetRecord(ctx, "app")
+	if err != nil || record.CIDR != "10.1.0.0/16" {
+		t.Errorf("GetRecord() = %v, %v, want the fallback's record", record, err)
+	}
+	if _, err := service.GetRecord(ctx, "missing"); !errors.Is(err, errRecordNotFound) {
+		t.Errorf("GetRecord(missing) error = %v, want errRecordNotFound", err)
+	}
+	if primaryCalls != 3 || fallback.calls != 3 {
+		t.Errorf("primary served %d reads and fallback %d, want every read tried on both", primaryCalls, fallback.calls)
+	}
+
+	// Writes stay on the primary.
+	if _, err := service.RegisterCIDR(ctx, CIDRRecord{Key: "new", CIDR: "10.2.0.0/16"}, RegistrationOptions{}); err == nil {
+		t.Error("RegisterCIDR() error = nil, want the primary's failure")
+	}
+
+	service.fallback = nil
+	if _, err := service.GetAllCIDRs(ctx); err == nil {
+		t.Error("GetAllCIDRs() without a fallback error = nil, want the primary's failure")
+	}
+}
+
+func TestForbiddenCIDRs(t *testing.T) {
+	forbidden, err := parseForbiddenCIDRs("100.64.0.0/10, 169.254.0.0/16")
+	if err != nil || len(forbidden) != 2 {
+		t.Fatalf("parseForbiddenCIDRs() = %v, %v", forbidden, err)
+	}
+	if _, err := parseForbiddenCIDRs("100.64.0.0/10,nope"); err == nil {
+		t.Error("parseForbiddenCIDRs(invalid entry) error = nil, want error")
+	}
+
+	tests := []struct {
+		cidr string
+		hit  string
+	}{
+		{cidr: "100.100.0.0/16", hit: "100.64.0.0/10"},
+		{cidr: "100.0.0.0/8", hit: "100.64.0.0/10"},
+		{cidr: "169.254.169.254/32", hit: "169.254.0.0/16"},
+		{cidr: "10.0.0.0/8"},
+		{cidr: "100.128.0.0/16"},
+	}
+	for _, tt := range tests {
+		err := checkForbidden(forbidden, tt.cidr)
+		if tt.hit == "" && err != nil {
+			t.Errorf("checkForbidden(%s) error = %v, want nil", tt.cidr, err)
+		}
+		if tt.hit != "" && (err == nil || !strings.Contains(err.Error(), tt.hit)) {
+			t.Errorf("checkForbidden(%s) error = %v, want one naming %s", tt.cidr, err, tt.hit)
+		}
+	}
+
+	// The check runs before the table is read, so this service needs no client.
+	service := &CIDRService{forbidden: forbidden}
+	if _, err := service.RegisterCIDR(context.Background(), CIDRRecord{Key: "cgnat", CIDR: "100.64.1.0/24"}, RegistrationOptions{}); err == nil {
+		t.Error("RegisterCIDR(forbidden range) error = nil, want error")
+	}
+}
+
+func TestDOTGraph(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	records := []CIDRRecord{
+		{Key: "prod", CIDR: "10.1.0.0/16", Reserved: true},
+		{Key: "prod/web", CIDR: "10.1.1.0/24"},
+		{Key: "prod/web/lb", CIDR: "10.1.1.0/28"},
+		{Key: "dev", CIDR: "10.2.0.0/16"},
+		{Key: `odd "key"`, CIDR: "192.168.0.0/24"},
+	}
+
+	got := dotGraph([]*net.IPNet{base}, records)
+	for _, want := range []string{
+		"digraph cidrfinder {\n",
+		`base0 [label="10.0.0.0/8", style=bold];`,
+		`record1 [label="prod/web\n10.1.1.0/24"];`,
+		`record4 [label="odd \"key\"\n192.168.0.0/24"];`,
+		"base0 -> record0;",
+		"record0 -> record1;",
+		"record1 -> record2;",
+		"base0 -> record3;",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dotGraph() lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "-> record4") || strings.Contains(got, "record0 -> record2") {
+		t.Errorf("dotGraph() has unexpected edges:\n%s", got)
+	}
+
+	if _, err := parseListFormat("svg"); err == nil {
+		t.Error("parseListFormat(svg) error = nil, want error")
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// Examples from RFC 7386, appendix A.
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`["a","b"]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+	}
+	for _, tt := range tests {
+		var target, patch interface{}
+		json.Unmarshal([]byte(tt.target), &target)
+		json.Unmarshal([]byte(tt.patch), &patch)
+		got, _ := json.Marshal(mergePatch(target, patch))
+		if string(got) != tt.want {
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+
+	record := CIDRRecord{Key: "app", CIDR: "10.1.0.0/16", Description: "old", Pool: "prod"}
+	patched, err := applyRecordPatch(record, []byte(`{"description":"new","cidr":"10.2.0.0/16","pool":"prod"}`))
+	if err != nil || patched.Description != "new" || patched.CIDR != "10.2.0.0/16" || patched.Key != "app" || patched.Pool != "prod" {
+		t.Errorf("applyRecordPatch() = %+v, %v", patched, err)
+	}
+	if patched, err := applyRecordPatch(record, []byte(`{"description":null}`)); err != nil || patched.Description != "" {
+		t.Errorf("applyRecordPatch(null description) = %+v, %v, want it removed", patched, err)
+	}
+	for _, patch := range []string{`{"key":"other"}`, `{"cidr":null}`, `{"pool":"dev"}`, `{"unknown":1}`, `["cidr"]`, `{"description":5}`} {
+		if _, err := applyRecordPatch(record, []byte(patch)); err == nil {
+			t.Errorf("applyRecordPatch(%s) error = nil, want error", patch)
+		}
+	}
+
+	for contentType, ok := range map[string]bool{
+		"application/merge-patch+json":                true,
+		"application/merge-patch+json; charset=utf-8": true,
+		"application/json":                            false,
+		"":                                            false,
+	} {
+		if err := checkPatchContentType(contentType); (err == nil) != ok {
+			t.Errorf("checkPatchContentType(%q) error = %v", contentType, err)
+		}
+	}
+}
+
+func TestScheduledReservations(t *testing.T) {
+	now := time.Now()
+	hour := int64(time.Hour / time.Second)
+	at := func(hours int64) int64 { return now.Unix() + hours*hour }
+
+	for _, tt := range []struct {
+		record CIDRRecord
+		field  string
+	}{
+		{record: CIDRRecord{}},
+		{record: CIDRRecord{ActiveFrom: at(1), ActiveUntil: at(2)}},
+		{record: CIDRRecord{ActiveFrom: at(-1), ActiveUntil: at(2), ExpiresAt: at(2)}},
+		{record: CIDRRecord{ActiveUntil: at(2)}, field: "activeFrom"},
+		{record: CIDRRecord{ActiveFrom: at(1)}, field: "activeUntil"},
+		{record: CIDRRecord{ActiveFrom: at(2), ActiveUntil: at(1)}, field: "activeUntil"},
+		{record: CIDRRecord{ActiveFrom: at(-2), ActiveUntil: at(-1)}, field: "activeUntil"},
+		{record: CIDRRecord{ActiveFrom: at(1), ActiveUntil: at(2), ExpiresAt: at(3)}, field: "expiresAt"},
+	} {
+		if field, _ := activeWindowError(tt.record, now); field != tt.field {
+			t.Errorf("activeWindowError(%+v) field = %q, want %q", tt.record, field, tt.field)
+		}
+	}
+
+	record := CIDRRecord{ActiveFrom: at(1), ActiveUntil: at(2)}
+	if err := applyActiveWindow(&record, now); err != nil || record.ExpiresAt != at(2) {
+		t.Errorf("applyActiveWindow() expiresAt = %d, %v, want the end of the window", record.ExpiresAt, err)
+	}
+
+	// A block scheduled for tomorrow is free for a window today, but not
+	// for an overlapping window or a permanent registration.
+	existing := []CIDRRecord{{Key: "event", CIDR: "10.1.0.0/24", ActiveFrom: at(24), ActiveUntil: at(30), ExpiresAt: at(30)}}
+	tests := []struct {
+		name      string
+		candidate CIDRRecord
+		wantErr   bool
+	}{
+		{name: "earlier window", candidate: CIDRRecord{Key: "drill", CIDR: "10.1.0.0/24", ActiveFrom: at(1), ExpiresAt: at(2)}},
+		{name: "temporary reservation ending before", candidate: CIDRRecord{Key: "temp", CIDR: "10.1.0.0/24", ExpiresAt: at(24)}},
+		{name: "overlapping window", candidate: CIDRRecord{Key: "drill", CIDR: "10.1.0.0/24", ActiveFrom: at(29), ExpiresAt: at(31)}, wantErr: true},
+		{name: "permanent", candidate: CIDRRecord{Key: "app", CIDR: "10.1.0.0/24"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkScopedUniqueness(existing, tt.candidate, uniquenessScopeGlobal)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkScopedUniqueness() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if got := recordsActiveDuring(existing, at(1), at(2)); len(got) != 0 {
+		t.Errorf("recordsActiveDuring(earlier window) = %v, want none", got)
+	}
+	if got := recordsActiveDuring(existing, 0, 0); len(got) != 1 {
+		t.Errorf("recordsActiveDuring(unbounded) = %v, want the scheduled record", got)
+	}
+}
+
+func TestLintRecords(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "clean", CIDR: "10.0.0.0/24"},
+		{Key: "host-bits", CIDR: "10.0.1.7/24"},
+		{Key: "upper", CIDR: "2001:DB8::/32"},
+		{Key: "mapped", CIDR: "::ffff:10.5.0.0/120"},
+		{Key: "broken", CIDR: "10.0.0.0/33"},
+	}
+	got := lintRecords(records)
+	want := []LintIssue{
+		{Key: "host-bits", CIDR: "10.0.1.7/24", Canonical: "10.0.1.0/24"},
+		{Key: "upper", CIDR: "2001:DB8::/32", Canonical: "2001:db8::/32"},
+		{Key: "mapped", CIDR: "::ffff:10.5.0.0/120", Canonical: "10.5.0.0/24"},
+	}
+	if len(got) != 4 || !reflect.DeepEqual(got[:3], want) || got[3].Key != "broken" || got[3].Error == "" {
+		t.Errorf("lintRecords() = %+v, want %+v and an error for broken", got, want)
+	}
+
+	if !hasBearerToken("Bearer s3cret", "s3cret") || hasBearerToken("Bearer wrong", "s3cret") ||
+		hasBearerToken("s3cret", "s3cret") || hasBearerToken("Bearer ", "") {
+		t.Error("hasBearerToken() accepted a wrong or missing token")
+	}
+}
+
+func TestAllocatePast256Blocks(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+
+	// Fill the first 300 /24s, which spill out of 10.0.0.0/16 into 10.1.0.0/16.
+	var used []*net.IPNet
+	for i := 0; i < 300; i++ {
+		used = append(used, &net.IPNet{IP: net.IPv4(10, byte(i>>8), byte(i), 0).To4(), Mask: net.CIDRMask(24, 32)})
+	}
+
+	if got, ok := nextFreeSubnet(base, 24, used); !ok || got.String() != "10.1.44.0/24" {
+		t.Errorf("nextFreeSubnet() = %v, %v, want 10.1.44.0/24", got, ok)
+	}
+	if got, ok := bestFitSubnet(base, 24, used); !ok || got.String() != "10.1.44.0/24" {
+		t.Errorf("bestFitSubnet() = %v, %v, want 10.1.44.0/24", got, ok)
+	}
+	// The last of the 65536 /24s is reachable too.
+	if got, ok := nextFreeSubnetFrom(base, 24, used, 1<<16-1); !ok || got.String() != "10.255.255.0/24" {
+		t.Errorf("nextFreeSubnetFrom(last index) = %v, %v, want 10.255.255.0/24", got, ok)
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	record := CIDRRecord{Key: "updated", CIDR: "10.0.1.0/24", CreatedAt: now.Unix() - 300, UpdatedAt: now.Unix() - 10}
+
+	c := &CIDRService{cacheMaxAge: 30 * time.Second}
+	modified := recordModified(record)
+	if modified != now.Unix()-10 {
+		t.Errorf("recordModified() = %d, want the update %d", modified, now.Unix()-10)
+	}
+	if got := recordModified(CIDRRecord{}); got != 0 {
+		t.Errorf("recordModified(legacy) = %d, want 0", got)
+	}
+
+	records := []CIDRRecord{
+		record,
+		{Key: "expired", CIDR: "10.0.2.0/24", CreatedAt: now.Unix() - 300, ExpiresAt: now.Unix() - 5},
+		{Key: "expiring", CIDR: "10.0.3.0/24", CreatedAt: now.Unix() - 300, ExpiresAt: now.Unix() + 50},
+	}
+	if got := listModified(now.Unix()-60, records, now); got != now.Unix()-5 {
+		t.Errorf("listModified() = %d, want the expiry %d", got, now.Unix()-5)
+	}
+	// A delete leaves no record behind and is dated by the change marker.
+	if got := listModified(now.Unix()-1, records[:1], now); got != now.Unix()-1 {
+		t.Errorf("listModified() after a delete = %d, want the marker %d", got, now.Unix()-1)
+	}
+	if got := listModified(0, records, now); got != 0 {
+		t.Errorf("listModified(no marker) = %d, want 0", got)
+	}
+
+	headers := c.cacheHeaders(modified)
+	if headers["Cache-Control"] != "max-age=30" || headers["Last-Modified"] != "Tue, 14 Nov 2023 22:13:10 GMT" {
+		t.Errorf("cacheHeaders() = %v", headers)
+	}
+	if got := (&CIDRService{}).cacheHeaders(0); got["Cache-Control"] != "no-cache" || got["Last-Modified"] != "" {
+		t.Errorf("cacheHeaders(unknown) = %v, want no-cache without Last-Modified", got)
+	}
+
+	lastModified := headers["Last-Modified"]
+	if !notModified(lastModified, modified) {
+		t.Error("notModified(Last-Modified) = false, want true")
+	}
+	if notModified(lastModified, modified+1) || notModified("", modified) || notModified("yesterday", modified) {
+		t.Error("notModified() = true for a newer change or an unusable header")
+	}
+
+	if _, err := parseCacheMaxAge("-1s"); err == nil {
+		t.Error("parseCacheMaxAge(-1s) succeeded, want an error")
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	var items []string
+	var keys []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("project-%d", i)
+		keys = append(keys, key)
+		items = append(items, fmt.Sprintf(`{"key":{"S":%q},"cidr":{"S":"10.%d.0.0/16"}}`, key, i))
+	}
+	keys = append(keys, "missing")
+
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.Scan":
+			fmt.Fprintf(w, `{"Items":[%s],"Count":%d}`, strings.Join(items, ","), len(items))
+		case "DynamoDB_20120810.BatchWriteItem":
+			var input struct {
+				RequestItems map[string][]json.RawMessage
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+			batches = append(batches, len(input.RequestItems["cidr-registry"]))
+			if len(batches) > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException","message":"rejected"}`)
+				return
+			}
+			io.WriteString(w, `{"UnprocessedItems":{}}`)
+		case "DynamoDB_20120810.UpdateItem":
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("unexpected DynamoDB call %s", r.Header.Get("X-Amz-Target"))
+		}
+	}))
+	defer server.Close()
+
+	service := &CIDRService{
+		tableName: "cidr-registry",
+		dynamoClient: dynamodb.New(dynamodb.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(server.URL),
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+	}
+	results, err := service.DeleteBatch(context.Background(), keys)
+	if err != nil {
+		t.Fatalf("DeleteBatch() error = %v", err)
+	}
+	if !reflect.DeepEqual(batches, []int{25, 5}) {
+		t.Errorf("BatchWriteItem chunks = %v, want [25 5]", batches)
+	}
+	if results[0] != (BatchDeleteResult{Key: "project-0", Status: batchDeleteDeleted, CIDR: "10.0.0.0/16"}) {
+		t.Errorf("results[0] = %+v, want project-0 deleted", results[0])
+	}
+	if results[24].Status != batchDeleteDeleted || results[25].Status != batchDeleteFailed || results[25].Error == "" {
+		t.Errorf("results[24:26] = %+v, want the second chunk failed", results[24:26])
+	}
+	if results[30] != (BatchDeleteResult{Key: "missing", Status: batchDeleteNotFound}) {
+		t.Errorf("results[30] = %+v, want missing not found", results[30])
+	}
+
+	for _, tt := range []struct {
+		keys  []string
+		field string
+	}{
+		{nil, "keys"},
+		{make([]string, maxBatchDeleteKeys+1), "keys"},
+		{[]string{"a", ""}, "keys[1]"},
+		{[]string{"a", "b", "a"}, "keys[2]"},
+	} {
+		if errs := (batchDeleteRequest{Keys: tt.keys}).validate(); errs[tt.field] == "" {
+			t.Errorf("validate(%q) = %v, want an error for %s", tt.keys, errs, tt.field)
+		}
+	}
+	if errs := (batchDeleteRequest{Keys: []string{"a", "b"}}).validate(); errs != nil {
+		t.Errorf("validate() = %v, want nil", errs)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	pools, err := parsePools("prod=10.16.0.0/22:24,dev=10.32.0.0/16:24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, excluded, _ := net.ParseCIDR("10.32.255.0/24")
+	pools[1].Excluded = []*net.IPNet{excluded}
+
+	thresholds, err := parseCapacityThresholds("50%", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16, pools: pools, capacity: thresholds}
+	records := []CIDRRecord{
+		{Key: "prod-a", CIDR: "10.16.0.0/24", Pool: "prod"},
+		{Key: "prod-b", CIDR: "10.16.2.0/24", Pool: "prod"},
+		{Key: "prod-c", CIDR: "10.16.3.0/24", Pool: "prod"},
+		{Key: "expired", CIDR: "10.16.1.0/24", Pool: "prod", ExpiresAt: 1},
+	}
+
+	report := service.capacityOf(records, nil)
+	next := "10.16.1.0/24"
+	want := []PoolCapacity{
+		{Pool: "prod", Base: "10.16.0.0/22", Prefix: 24, RemainingBlocks: 1, Utilization: 75, Status: capacityStatusWarning, NextFree: &next},
+	}
+	if report.WarnAt != 50 || report.CritAt != defaultCritAt || len(report.Pools) != 2 || !reflect.DeepEqual(report.Pools[:1], want) {
+		t.Errorf("capacityOf() = %+v, want prod %+v", report, want[0])
+	}
+	if dev := report.Pools[1]; dev.RemainingBlocks != 255 || dev.Status != capacityStatusOK || dev.NextFree == nil || *dev.NextFree != "10.32.0.0/24" {
+		t.Errorf("dev capacity = %+v, want 255 blocks left with the excluded range counted as used", dev)
+	}
+
+	// Filling the last block leaves the pool critical and with no next block.
+	records = append(records, CIDRRecord{Key: "prod-d", CIDR: "10.16.1.0/24", Pool: "prod"})
+	report = service.capacityOf(records, nil)
+	if prod := report.Pools[0]; prod.Status != capacityStatusCritical || prod.RemainingBlocks != 0 || prod.NextFree != nil {
+		t.Errorf("full prod capacity = %+v, want critical with no next block", prod)
+	}
+
+	// Without pools, IPv6 bases are left out and a base too small for the
+	// default prefix is skipped rather than failing the report.
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	_, small, _ := net.ParseCIDR("192.168.0.0/24")
+	bases := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16, allowedBases: []*net.IPNet{v6, small}, capacity: thresholds}
+	report = bases.capacityOf(nil, nil)
+	if len(report.Pools) != 1 || report.Pools[0].Base != "10.0.0.0/8" || len(report.Skipped) != 1 || report.Skipped[0].Base != "192.168.0.0/24" {
+		t.Errorf("capacityOf(bases) = %+v, want 10.0.0.0/8 reported and 192.168.0.0/24 skipped", report)
+	}
+	if got := bases.fragmentationOf(nil); len(got.Pools) != 1 || len(got.Skipped) != 1 {
+		t.Errorf("fragmentationOf(bases) = %+v, want one pool and one skipped", got)
+	}
+
+	if _, err := parseCapacityThresholds("95", "90"); err == nil {
+		t.Error("parseCapacityThresholds(95, 90) succeeded, want WARN_AT below CRIT_AT")
+	}
+	if got := alignedBlocks(addrRange{start: 0x0a000080, end: 0x0a000280}, 24); got != 1 {
+		t.Errorf("alignedBlocks() = %d, want only the aligned /24", got)
+	}
+}
+
+func TestTagsFormat(t *testing.T) {
+	defer func(format string) { tagsFormat = format }(tagsFormat)
+
+	record := CIDRRecord{Key: "app", CIDR: "10.1.0.0/16", Tags: Tags{"env": "prod", "team": "net"}}
+	for _, tt := range []struct {
+		format string
+		want   types.AttributeValue
+	}{
+		{tagsFormatMap, &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"env":  &types.AttributeValueMemberS{Value: "prod"},
+			"team": &types.AttributeValueMemberS{Value: "net"},
+		}}},
+		{tagsFormatJSON, &types.AttributeValueMemberS{Value: `{"env":"prod","team":"net"}`}},
+	} {
+		tagsFormat = tt.format
+		item, err := attributevalue.MarshalMap(record)
+		if err != nil {
+			t.Fatalf("MarshalMap(%s) error = %v", tt.format, err)
+		}
+		if !reflect.DeepEqual(item["tags"], tt.want) {
+			t.Errorf("%s tags attribute = %#v, want %#v", tt.format, item["tags"], tt.want)
+		}
+
+		// Items are read back in either format whatever the setting.
+		for _, readFormat := range []string{tagsFormatMap, tagsFormatJSON} {
+			tagsFormat = readFormat
+			var got CIDRRecord
+			if err := attributevalue.UnmarshalMap(item, &got); err != nil || !reflect.DeepEqual(got, record) {
+				t.Errorf("UnmarshalMap(%s item) with TAGS_FORMAT=%s = %+v, %v, want %+v", tt.format, readFormat, got, err, record)
+			}
+		}
+	}
+
+	item, err := attributevalue.MarshalMap(CIDRRecord{Key: "bare", CIDR: "10.2.0.0/16"})
+	if _, ok := item["tags"]; err != nil || ok {
+		t.Errorf("MarshalMap(no tags) = %v, %v, want no tags attribute", item, err)
+	}
+	var bad CIDRRecord
+	if err := attributevalue.UnmarshalMap(map[string]types.AttributeValue{
+		"tags": &types.AttributeValueMemberS{Value: "env=prod"},
+	}, &bad); err == nil {
+		t.Error("UnmarshalMap(non-JSON tags) succeeded, want an error")
+	}
+	if _, err := parseTagsFormat("yaml"); err == nil {
+		t.Error("parseTagsFormat(yaml) succeeded, want an error")
+	}
+}
+
+func TestResolvePrincipal(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("APPROVER_TOKEN", "approver-secret")
+
+	tests := []struct {
+		name          string
+		authorization string
+		signed        bool
+		want          *Principal
+	}{
+		{name: "anonymous"},
+		{name: "wrong token", authorization: "Bearer guess"},
+		{name: "admin", authorization: "Bearer admin-secret",
+			want: &Principal{ID: "admin", Methods: []string{authMethodAdminToken}, Permissions: []string{permissionLintFix, permissionSweep, permissionUnredacted}}},
+		{name: "signed approver", authorization: "Bearer approver-secret", signed: true,
+			want: &Principal{ID: "approver", Methods: []string{authMethodApproverToken, authMethodHMAC}, Permissions: []string{permissionApprove, permissionWrite}}},
+		{name: "signed only", signed: true,
+			want: &Principal{ID: "hmac", Methods: []string{authMethodHMAC}, Permissions: []string{permissionWrite}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvePrincipal(context.Background(), tt.authorization, tt.signed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolvePrincipal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	defer func(s requestSigning) { signing = s }(signing)
+	signing, _ = parseRequestSigning("shared-secret", "")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	if !isSigned("GET", "/whoami", "", timestamp, signing.sign("GET", "/whoami", "", timestamp, nil), nil) {
+		t.Error("isSigned() = false for a valid signature")
+	}
+	if isSigned("GET", "/whoami", "", timestamp, "forged", nil) {
+		t.Error("isSigned() = true for a forged signature")
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	sign := func(alg, kid string, claims map[string]interface{}, signer func(signed string) []byte) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signer(signed))
+	}
+	hs256 := func(secret string) func(string) []byte {
+		return func(signed string) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(signed))
+			return mac.Sum(nil)
+		}
+	}
+	claims := func(scope string, exp time.Time) map[string]interface{} {
+		return map[string]interface{}{"sub": "ci", "scope": scope, "exp": exp.Unix(), "iss": "issuer", "aud": []string{"cidrfinder"}}
+	}
+
+	auth, err := parseJWTAuth("jwt-secret", "", "")
+	if err != nil {
+		t.Fatalf("parseJWTAuth: %v", err)
+	}
+	auth.issuer, auth.audience = "issuer", "cidrfinder"
+
+	later := now.Add(time.Hour)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   error
+	}{
+		{"read scope reads", http.MethodGet, "/keys", sign("HS256", "", claims("cidr:read", later), hs256("jwt-secret")), nil},
+		{"read scope plans", http.MethodPost, "/plan", sign("HS256", "", claims("cidr:read", later), hs256("jwt-secret")), nil},
+		{"read scope cannot write", http.MethodPost, "/cidr", sign("HS256", "", claims("cidr:read", later), hs256("jwt-secret")), errInsufficientScope},
+		{"write scope writes", http.MethodDelete, "/cidr", sign("HS256", "", claims("cidr:read cidr:write", later), hs256("jwt-secret")), nil},
+		{"expired", http.MethodGet, "/keys", sign("HS256", "", claims("cidr:read", now.Add(-time.Hour)), hs256("jwt-secret")), errTokenInvalid},
+		{"wrong secret", http.MethodGet, "/keys", sign("HS256", "", claims("cidr:read", later), hs256("other")), errTokenInvalid},
+		{"no bearer token", http.MethodGet, "/keys", "", errTokenInvalid},
+		{"not a JWT", http.MethodGet, "/keys", "opaque", errTokenInvalid},
+		{"RS256 without JWKS", http.MethodGet, "/keys", sign("RS256", "k1", claims("cidr:read", later), hs256("jwt-secret")), errTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorization := ""
+			if tt.token != "" {
+				authorization = "Bearer " + tt.token
+			}
+			err := auth.authorize(ctx, tt.method, tt.path, authorization, now)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("authorize = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	wrongAudience := claims("cidr:read", later)
+	wrongAudience["aud"] = "elsewhere"
+	if _, err := auth.verify(ctx, sign("HS256", "", wrongAudience, hs256("jwt-secret")), now); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("verify with wrong audience = %v, want errTokenInvalid", err)
+	}
+	if got := jwtErrorStatus(fmt.Errorf("%w: x", errInsufficientScope)); got != http.StatusForbidden {
+		t.Errorf("jwtErrorStatus(insufficient scope) = %d, want 403", got)
+	}
+
+	// RS256 keys come from the JWKS endpoint, which is fetched again when a
+	// token names a key the cache doesn't know.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	kid := "old"
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	auth, err = parseJWTAuth("", jwks.URL, "1h")
+	if err != nil {
+		t.Fatalf("parseJWTAuth: %v", err)
+	}
+	rs256 := func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		return signature
+	}
+	if _, err := auth.verify(ctx, sign("RS256", "old", claims("cidr:read", later), rs256), now); err != nil {
+		t.Fatalf("verify RS256: %v", err)
+	}
+	if _, err := auth.verify(ctx, sign("HS256", "old", claims("cidr:read", later), hs256("")), now); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("verify HS256 without a secret = %v, want errTokenInvalid", err)
+	}
+	kid = "new"
+	if _, err := auth.verify(ctx, sign("RS256", "new", claims("cidr:read", later), rs256), now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("verify RS256 after rotation: %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", fetches)
+	}
+
+	if _, err := parseJWTAuth("", "ftp://keys", ""); err == nil {
+		t.Error("parseJWTAuth accepted a non-http JWKS URL")
+	}
+
+	t.Setenv("APPROVER_TOKEN", "approver-secret")
+	if !jwtExempt(http.MethodPost, "/approve", "Bearer approver-secret") || jwtExempt(http.MethodPost, "/cidr", "Bearer approver-secret") {
+		t.Error("approver token should only skip JWT authentication on the endpoints it gates")
+	}
+}
+
+func TestForecast(t *testing.T) {
+	pools, err := parsePools("prod=10.16.0.0/20:24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16, pools: pools, capacity: capacityThresholds{warnAt: defaultWarnAt, critAt: defaultCritAt}}
+	now := time.Unix(1700000000, 0)
+	day := int64(24 * 60 * 60)
+	records := []CIDRRecord{
+		{Key: "recent-a", CIDR: "10.16.0.0/24", Pool: "prod", CreatedAt: now.Unix() - day},
+		{Key: "recent-b", CIDR: "10.16.2.0/23", Pool: "prod", CreatedAt: now.Unix() - 2*day},
+		{Key: "old", CIDR: "10.16.1.0/24", Pool: "prod", CreatedAt: now.Unix() - 60*day},
+		{Key: "undated", CIDR: "10.16.4.0/24", Pool: "prod"},
+	}
+
+	window, err := parseForecastWindow("3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := service.forecastOf(records, nil, window, now)
+	if err != nil {
+		t.Fatalf("forecastOf() error = %v", err)
+	}
+	if len(report.Pools) != 1 {
+		t.Fatalf("forecastOf() pools = %+v, want prod only", report.Pools)
+	}
+	// Three /24s over three days is one a day, and 11 of 16 are left.
+	prod := report.Pools[0]
+	if prod.RemainingBlocks != 11 || prod.AllocatedInWindow != 2 || prod.BlocksPerDay != 1 ||
+		prod.DaysRemaining == nil || *prod.DaysRemaining != 11 || *prod.ExhaustsAt != now.Add(11*24*time.Hour).UTC().Format(time.RFC3339) {
+		t.Errorf("prod forecast = %+v, want 11 blocks left at 1 a day", prod)
+	}
+
+	report, _ = service.forecastOf(records[2:], nil, window, now)
+	if prod := report.Pools[0]; prod.BlocksPerDay != 0 || prod.DaysRemaining != nil || prod.ExhaustsAt != nil {
+		t.Errorf("idle forecast = %+v, want no exhaustion date", prod)
+	}
+
+	for _, value := range []string{"0d", "-1h", "soon"} {
+		if _, err := parseForecastWindow(value); err == nil {
+			t.Errorf("parseForecastWindow(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestCheckParent(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "team-a", CIDR: "10.1.0.0/16", Reserved: true, Tenant: "a"},
+		{Key: "loose", CIDR: "10.2.0.0/16"},
+		{Key: "team-b", CIDR: "10.3.0.0/16", Reserved: true, Tenant: "b"},
+	}
+	tests := []struct {
+		name        string
+		candidate   CIDRRecord
+		requirement string
+		wantErr     string
+	}{
+		{"not required", CIDRRecord{CIDR: "10.9.0.0/24"}, requireParentNone, ""},
+		{"reserved parent", CIDRRecord{CIDR: "10.1.4.0/24"}, requireParentAny, ""},
+		{"owned parent", CIDRRecord{CIDR: "10.1.4.0/24", Tenant: "a"}, requireParentOwner, ""},
+		{"no parent", CIDRRecord{CIDR: "10.9.0.0/24"}, requireParentAny, "no record contains it"},
+		{"unreserved parent", CIDRRecord{CIDR: "10.2.4.0/24"}, requireParentAny, "loose (10.2.0.0/16) is not reserved"},
+		{"other tenant", CIDRRecord{CIDR: "10.3.4.0/24", Tenant: "a"}, requireParentOwner, "team-b (10.3.0.0/16) belongs to tenant 'b'"},
+		{"itself is no parent", CIDRRecord{CIDR: "10.1.0.0/16"}, requireParentAny, "no record contains it"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkParent(records, tt.candidate, tt.requirement)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkParent() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if got := stricterParentRequirement(requireParentOwner, requireParentAny); got != requireParentOwner {
+		t.Errorf("stricterParentRequirement() = %q, want a request unable to relax REQUIRE_PARENT", got)
+	}
+	if _, err := parseRequireParent("REQUIRE_PARENT", "always"); err == nil {
+		t.Error("parseRequireParent(always) succeeded, want an error")
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	pools, err := parsePools("prod=10.16.0.0/22:24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16, pools: pools}
+	records := []CIDRRecord{
+		{Key: "a", CIDR: "10.16.0.0/25", Pool: "prod"},
+		{Key: "b", CIDR: "10.16.2.0/24", Pool: "prod"},
+	}
+
+	report := service.fragmentationOf(records)
+	// Free: 10.16.0.128/25 to 10.16.1.255 and 10.16.3.0/24, 640 addresses,
+	// of which the largest aligned block is a /24.
+	block := "10.16.1.0/24"
+	want := PoolFragmentation{Pool: "prod", Base: "10.16.0.0/22", FreeRanges: 2, FreeAddresses: 640, LargestFreeBlock: &block, LargestFreeAddresses: 256, Score: 0.6}
+	if len(report.Pools) != 1 || !reflect.DeepEqual(report.Pools[0], want) {
+		t.Fatalf("fragmentationOf() = %+v, want %+v", report.Pools, want)
+	}
+
+	gauges := report.prometheusGauges()
+	for _, line := range []string{
+		"# TYPE cidrfinder_fragmentation_score gauge",
+		`cidrfinder_fragmentation_score{pool="prod",base="10.16.0.0/22"} 0.6`,
+		`cidrfinder_free_addresses{pool="prod",base="10.16.0.0/22"} 640`,
+	} {
+		if !strings.Contains(gauges, line+"\n") {
+			t.Errorf("prometheusGauges() is missing %q:\n%s", line, gauges)
+		}
+	}
+
+	report = service.fragmentationOf(nil)
+	if got := report.Pools[0]; got.Score != 0 || got.FreeRanges != 1 || *got.LargestFreeBlock != "10.16.0.0/22" {
+		t.Errorf("empty pool fragmentation = %+v, want one free block and a score of 0", got)
+	}
+}
+
+func TestRequiredTags(t *testing.T) {
+	required, err := parseRequiredTags(" owner, cost-center ,")
+	if err != nil || !reflect.DeepEqual(required, []string{"owner", "cost-center"}) {
+		t.Fatalf("parseRequiredTags() = %v, %v, want [owner cost-center]", required, err)
+	}
+	if required, err := parseRequiredTags(""); err != nil || required != nil {
+		t.Errorf("parseRequiredTags(\"\") = %v, %v, want no required tags", required, err)
+	}
+	if _, err := parseRequiredTags("owner,owner"); err == nil {
+		t.Error("parseRequiredTags(owner,owner) succeeded, want an error")
+	}
+
+	// Registrations stop at the forbidden range once the tags pass, so the
+	// service needs no client.
+	_, forbidden, _ := net.ParseCIDR("10.0.0.0/8")
+	service := &CIDRService{requiredTags: required, forbidden: []*net.IPNet{forbidden}}
+	ctx := context.Background()
+
+	_, err = service.RegisterCIDR(ctx, CIDRRecord{Key: "app", CIDR: "10.1.0.0/16", Tags: Tags{"owner": "net", "cost-center": ""}}, RegistrationOptions{})
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || !reflect.DeepEqual(invalid.Fields, fieldErrors{"tags.cost-center": "required"}) {
+		t.Fatalf("RegisterCIDR(missing cost-center) error = %v, want a tags.cost-center field error", err)
+	}
+	if got := validationErrorBody(invalid.Fields)["errors"]; !reflect.DeepEqual(got, fieldErrors{"tags.cost-center": "required"}) {
+		t.Errorf("validationErrorBody() errors = %v", got)
+	}
+
+	_, err = service.RegisterCIDR(ctx, CIDRRecord{Key: "app", CIDR: "10.1.0.0/16", Tags: Tags{"owner": "net", "cost-center": "cc-1"}}, RegistrationOptions{})
+	if err == nil || errors.As(err, &invalid) {
+		t.Errorf("RegisterCIDR(all tags) error = %v, want it past the tag check", err)
+	}
+
+	if err := (&CIDRService{}).checkTags(CIDRRecord{}, nil); err != nil {
+		t.Errorf("checkTags() without REQUIRED_TAGS = %v, want nil", err)
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	now := time.Now().Unix()
+	items := []string{
+		fmt.Sprintf(`{"key":{"S":"live"},"cidr":{"S":"10.1.0.0/16"},"expiresAt":{"N":"%d"}}`, now+3600),
+		fmt.Sprintf(`{"key":{"S":"expired"},"cidr":{"S":"10.2.0.0/16"},"expiresAt":{"N":"%d"}}`, now-60),
+		fmt.Sprintf(`{"key":{"S":"window-over"},"cidr":{"S":"10.3.0.0/16"},"activeFrom":{"N":"%d"},"activeUntil":{"N":"%d"}}`, now-7200, now-60),
+		`{"key":{"S":"permanent"},"cidr":{"S":"10.4.0.0/16"}}`,
+	}
+
+	var deleted, stamped []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.Scan":
+			var input struct{ FilterExpression string }
+			json.NewDecoder(r.Body).Decode(&input)
+			if input.FilterExpression != "attribute_not_exists(#m)" {
+				t.Errorf("Scan filter = %q, want the change marker left out", input.FilterExpression)
+			}
+			fmt.Fprintf(w, `{"Items":[%s],"Count":%d}`, strings.Join(items, ","), len(items))
+		case "DynamoDB_20120810.UpdateItem":
+			var input struct {
+				Key map[string]map[string]string
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+			stamped = append(stamped, input.Key["key"]["S"])
+			io.WriteString(w, `{}`)
+		case "DynamoDB_20120810.DeleteItem":
+			var input struct {
+				Key                 map[string]map[string]string
+				ConditionExpression string
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+			if input.ConditionExpression != "#e <= :now OR #u <= :now" {
+				t.Errorf("DeleteItem condition = %q", input.ConditionExpression)
+			}
+			deleted = append(deleted, input.Key["key"]["S"])
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("unexpected DynamoDB call %s", r.Header.Get("X-Amz-Target"))
+		}
+	}))
+	defer server.Close()
+
+	service := &CIDRService{
+		tableName: "cidr-registry",
+		dynamoClient: dynamodb.New(dynamodb.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(server.URL),
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+	}
+	removed, err := service.SweepExpired(context.Background())
+	if err != nil {
+		t.Fatalf("SweepExpired() error = %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"expired", "window-over"}) || len(removed) != 2 {
+		t.Errorf("SweepExpired() deleted %v and returned %d records, want expired and window-over", deleted, len(removed))
+	}
+	// Both deletes usually fall in the same second, which is stamped once.
+	if len(stamped) == 0 || len(stamped) > 2 || stamped[0] != changeMarkerKey {
+		t.Errorf("SweepExpired() stamped %v, want the change marker", stamped)
+	}
+}
+
+func TestStatusBreakdown(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "app", CIDR: "10.1.1.0/24"},
+		{Key: "approved", CIDR: "10.1.2.0/24", Status: recordStatusActive},
+		{Key: "group", CIDR: "10.1.0.0/16", Reserved: true},
+		{Key: "ci", CIDR: "10.2.0.0/24", ExpiresAt: 4102444800},
+		{Key: "temporary-group", CIDR: "10.3.0.0/16", Reserved: true, ExpiresAt: 4102444800},
+		{Key: "requested", CIDR: "10.4.0.0/24", Status: recordStatusPending},
+	}
+
+	got := statusBreakdown(records)
+	keys := func(records []CIDRRecord) []string {
+		names := []string{}
+		for _, record := range records {
+			names = append(names, record.Key)
+		}
+		return names
+	}
+	if !reflect.DeepEqual(keys(got.Active), []string{"app", "approved"}) ||
+		!reflect.DeepEqual(keys(got.Reserved), []string{"group"}) ||
+		!reflect.DeepEqual(keys(got.Held), []string{"ci", "temporary-group", "requested"}) {
+		t.Errorf("statusBreakdown() = active %v, reserved %v, held %v", keys(got.Active), keys(got.Reserved), keys(got.Held))
+	}
+	if got.Counts != (StatusBreakdownCount{Active: 2, Reserved: 1, Held: 3}) {
+		t.Errorf("statusBreakdown() counts = %+v", got.Counts)
+	}
+
+	body, _ := json.Marshal(statusBreakdown(nil))
+	if string(body) != `{"active":[],"reserved":[],"held":[],"counts":{"active":0,"reserved":0,"held":0}}` {
+		t.Errorf("empty breakdown = %s, want empty arrays", body)
+	}
+}
+
+func TestValidatePoolLayout(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	_, allowed, _ := net.ParseCIDR("172.16.0.0/12")
+	bases := []*net.IPNet{base, allowed}
+
+	tests := []struct {
+		pools   string
+		wantErr []string
+	}{
+		{"prod=10.16.0.0/12:20,dev=10.32.0.0/12:24,lab=172.16.0.0/16", nil},
+		{"prod=10.16.0.0/12,team=10.20.0.0/16", []string{"overlapping pools: prod (10.16.0.0/12) and team (10.20.0.0/16)"}},
+		{"a=10.1.0.0/16,b=10.1.0.0/16,c=10.1.128.0/17", []string{"a (10.1.0.0/16) and b (10.1.0.0/16)", "a (10.1.0.0/16) and c (10.1.128.0/17)", "b (10.1.0.0/16) and c (10.1.128.0/17)"}},
+		{"prod=10.16.0.0/12,home=192.168.0.0/16", []string{"pools outside BASE_CIDR and ALLOWED_BASES (10.0.0.0/8, 172.16.0.0/12): home (192.168.0.0/16)"}},
+		{"wide=0.0.0.0/0,prod=10.16.0.0/12", []string{"outside", "wide (0.0.0.0/0)", "overlapping pools: wide (0.0.0.0/0) and prod (10.16.0.0/12)"}},
+	}
+	for _, tt := range tests {
+		pools, err := parsePools(tt.pools)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = validatePoolLayout(pools, bases)
+		if tt.wantErr == nil && err != nil {
+			t.Errorf("validatePoolLayout(%s) error = %v, want nil", tt.pools, err)
+		}
+		for _, want := range tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("validatePoolLayout(%s) error = %v, want it to mention %q", tt.pools, err, want)
+			}
+		}
+	}
+}
+
+func TestStrictStatusCodes(t *testing.T) {
+	_, patchErr := applyRecordPatch(CIDRRecord{Key: "a", CIDR: "10.0.0.0/24"}, []byte(`[1]`))
+	if !errors.Is(patchErr, errInvalidMergePatch) {
+		t.Fatalf("applyRecordPatch() error = %v, want errInvalidMergePatch", patchErr)
+	}
+
+	for _, tt := range []struct {
+		strict string
+		want   int
+	}{
+		{"", http.StatusBadRequest},
+		{"false", http.StatusBadRequest},
+		{"true", http.StatusUnprocessableEntity},
+	} {
+		t.Setenv("STRICT_STATUS_CODES", tt.strict)
+		if got := rejectedStatus(); got != tt.want {
+			t.Errorf("STRICT_STATUS_CODES=%q: rejectedStatus() = %d, want %d", tt.strict, got, tt.want)
+		}
+		response, _ := allocationFailedResponse(errors.New("no space"), poolExhaustedCode)
+		if response.StatusCode != tt.want {
+			t.Errorf("STRICT_STATUS_CODES=%q: allocationFailedResponse() status = %d, want %d", tt.strict, response.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	upload := strings.Join([]string{
+		"key,cidr,tags",
+		`vpc-a,10.1.0.0/16,env=prod,"owner=net, ops"`,
+		"vpc-b,10.1.0.0/16",
+		"vpc-c,10.0.0.0/8",
+		"existing,10.9.0.0/16",
+		"vpc-d,not-a-cidr",
+		`vpc-e,"10.3.0.0/16`,
+	}, "\n")
+	rows, err := parseImportCSV(strings.NewReader(upload + "\n"))
+	if err != nil {
+		t.Fatalf("parseImportCSV() error = %v", err)
+	}
+	if len(rows) != 6 || rows[0].line != 2 || rows[0].record.Tags["owner"] != "net, ops" {
+		t.Fatalf("parseImportCSV() = %+v, want 6 rows with the header skipped", rows)
+	}
+	if rows[5].err == nil || !strings.Contains(rows[5].err.Error(), "malformed CSV") {
+		t.Errorf("unterminated quote: error = %v, want malformed CSV", rows[5].err)
+	}
+	if _, err := parseImportCSV(strings.NewReader("key,cidr\n")); err == nil {
+		t.Error("parseImportCSV(header only) error = nil, want no rows")
+	}
+
+	var written []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.Scan":
+			io.WriteString(w, `{"Items":[{"key":{"S":"existing"},"cidr":{"S":"10.2.0.0/16"}}],"Count":1}`)
+		case "DynamoDB_20120810.BatchWriteItem":
+			var input struct {
+				RequestItems map[string][]struct {
+					PutRequest struct {
+						Item map[string]map[string]interface{}
+					}
+				}
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+			for _, request := range input.RequestItems["cidr-registry"] {
+				written = append(written, request.PutRequest.Item["key"]["S"].(string))
+			}
+			io.WriteString(w, `{"UnprocessedItems":{}}`)
+		case "DynamoDB_20120810.UpdateItem":
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("unexpected DynamoDB call %s", r.Header.Get("X-Amz-Target"))
+		}
+	}))
+	defer server.Close()
+
+	service := &CIDRService{
+		tableName: "cidr-registry",
+		dynamoClient: dynamodb.New(dynamodb.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(server.URL),
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+	}
+	wantStatus := []string{importImported, importInvalid, importInvalid, importInvalid, importInvalid, importInvalid}
+
+	result, err := service.Import(context.Background(), rows, true)
+	if err != nil {
+		t.Fatalf("Import(dryRun) error = %v", err)
+	}
+	if len(written) != 0 || result.Rows[0].Status != importValid || result.Invalid != 5 {
+		t.Errorf("Import(dryRun) wrote %v and returned %+v, want nothing written and one valid row", written, result)
+	}
+
+	result, err = service.Import(context.Background(), rows, false)
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	for i, row := range result.Rows {
+		if row.Status != wantStatus[i] {
+			t.Errorf("row %d (line %d) status = %s (%s), want %s", i, row.Line, row.Status, row.Error, wantStatus[i])
+		}
+	}
+	if !reflect.DeepEqual(written, []string{"vpc-a"}) || result.Imported != 1 {
+		t.Errorf("Import() wrote %v, imported %d, want only vpc-a", written, result.Imported)
+	}
+	for i, want := range map[int]string{1: "already exists", 2: "contains existing allocations", 3: "key 'existing' already exists", 4: "invalid CIDR"} {
+		if !strings.Contains(result.Rows[i].Error, want) {
+			t.Errorf("row %d error = %q, want it to mention %q", i, result.Rows[i].Error, want)
+		}
+	}
+}
+
+func TestEnvSnippet(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{"10.2.0.0/16", "CIDR=10.2.0.0/16\nNETWORK=10.2.0.0\nPREFIX=16\nNETMASK=255.255.0.0\nGATEWAY=10.2.0.1\nBROADCAST=10.2.255.255\n"},
+		{"10.9.9.8/31", "CIDR=10.9.9.8/31\nNETWORK=10.9.9.8\nPREFIX=31\nNETMASK=255.255.255.254\nGATEWAY=10.9.9.8\n"},
+		{"fd00:1::/64", "CIDR=fd00:1::/64\nNETWORK=fd00:1::\nPREFIX=64\nGATEWAY=fd00:1::\n"},
+	}
+	for _, tt := range tests {
+		got, err := envSnippet(tt.cidr)
+		if err != nil || got != tt.want {
+			t.Errorf("envSnippet(%s) = %q, %v, want %q", tt.cidr, got, err, tt.want)
+		}
+	}
+	if _, err := parseNextFormat("yaml"); err == nil {
+		t.Error("parseNextFormat(yaml) error = nil, want an error")
+	}
+}
+
+func TestLockRequest(t *testing.T) {
+	tests := []struct {
+		body    lockRequest
+		wantErr fieldErrors
+		wantTTL time.Duration
+	}{
+		{lockRequest{Name: "burst", Owner: "worker-1"}, nil, defaultLockTTL},
+		{lockRequest{Name: "burst", Owner: "worker-1", TTLSeconds: 300}, nil, 5 * time.Minute},
+		{lockRequest{TTLSeconds: 7200}, fieldErrors{"name": "required", "owner": "required", "ttlSeconds": "must be between 1 and 3600"}, 0},
+		{lockRequest{Name: "burst", Owner: "worker-1", TTLSeconds: -1}, fieldErrors{"ttlSeconds": "must be between 1 and 3600"}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.body.validate(); !reflect.DeepEqual(got, tt.wantErr) {
+			t.Errorf("%+v.validate() = %v, want %v", tt.body, got, tt.wantErr)
+		}
+		if tt.wantErr == nil && tt.body.ttl() != tt.wantTTL {
+			t.Errorf("%+v.ttl() = %v, want %v", tt.body, tt.body.ttl(), tt.wantTTL)
+		}
+	}
+
+	response, _ := lockResponse(context.Background(), &CIDRService{}, events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/lock/acquire",
+		Body:       `{"name":"burst","owner":"worker-1"}`,
+	})
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("lockResponse() without LOCK_TABLE_NAME status = %d, want 404", response.StatusCode)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	if _, err := parseRedactFields("description,key"); err == nil {
+		t.Error("parseRedactFields(key) error = nil, want key to be refused")
+	}
+	r, err := parseRedactFields("description, account, tags.owner")
+	if err != nil {
+		t.Fatalf("parseRedactFields() error = %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"records": []CIDRRecord{
+			{Key: "vpc-a", CIDR: "10.1.0.0/16", Description: "secret", Account: "111111111111", Tags: Tags{"owner": "alice", "env": "prod"}},
+			{Key: "vpc-b", CIDR: "10.2.0.0/16", Tags: Tags{"owner": "bob"}},
+		},
+		"description": "not a record",
+	})
+	got, err := r.redact(body)
+	if err != nil {
+		t.Fatalf("redact() error = %v", err)
+	}
+	want := `{"description":"not a record","records":[{"cidr":"10.1.0.0/16","key":"vpc-a","tags":{"env":"prod"}},{"cidr":"10.2.0.0/16","key":"vpc-b"}]}`
+	if string(got) != want {
+		t.Errorf("redact() = %s, want %s", got, want)
+	}
+
+	// Tag keys are never renamed, so a snake_case tag is not taken for a
+	// renamed camelCase one.
+	snake, err := parseResponseNaming("snake", "")
+	if err != nil {
+		t.Fatalf("parseResponseNaming(snake) error = %v", err)
+	}
+	saved := naming
+	naming = snake
+	defer func() { naming = saved }()
+	r, _ = parseRedactFields("tags.costCenter")
+	got, err = r.redact([]byte(`{"cidr":"10.1.0.0/16","tags":{"costCenter":"42","cost_center":"eng"}}`))
+	if err != nil {
+		t.Fatalf("redact(snake) error = %v", err)
+	}
+	if want := `{"cidr":"10.1.0.0/16","tags":{"cost_center":"eng"}}`; string(got) != want {
+		t.Errorf("redact(snake) = %s, want %s", got, want)
+	}
+	r, _ = parseRedactFields("description, account, tags.owner")
+
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	for _, tt := range []struct {
+		method, authorization string
+		want                  bool
+	}{
+		{"GET", "", true},
+		{"HEAD", "Bearer wrong", true},
+		{"GET", "Bearer admin-secret", false},
+		{"POST", "", false},
+	} {
+		if got := r.appliesTo(context.Background(), tt.method, tt.authorization); got != tt.want {
+			t.Errorf("appliesTo(%s, %q) = %v, want %v", tt.method, tt.authorization, got, tt.want)
+		}
+	}
+	if (redactedFields{}).appliesTo(context.Background(), "GET", "") {
+		t.Error("appliesTo() without REDACT_FIELDS = true, want false")
+	}
+}
+
+func TestAvailableBlocks(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/22")
+	var used []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.2.128/25"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		used = append(used, network)
+	}
+
+	page := availableBlocks(base, 24, used, 256, 0)
+	if !reflect.DeepEqual(page.Blocks, []string{"10.0.1.0/24", "10.0.3.0/24"}) || page.Total != 2 || page.NextToken != "" {
+		t.Errorf("availableBlocks(/24) = %+v, want 10.0.1.0/24 and 10.0.3.0/24", page)
+	}
+
+	var all []string
+	var from uint64
+	for pages := 0; ; pages++ {
+		page := availableBlocks(base, 26, used, 4, from)
+		if page.Total != 10 {
+			t.Errorf("availableBlocks(/26) total = %d, want 10", page.Total)
+		}
+		all = append(all, page.Blocks...)
+		if page.NextToken == "" || pages > 5 {
+			break
+		}
+		next, err := decodeAvailableToken(page.NextToken)
+		if err != nil {
+			t.Fatalf("decodeAvailableToken(%q) error = %v", page.NextToken, err)
+		}
+		from = next
+	}
+	want := []string{
+		"10.0.1.0/26", "10.0.1.64/26", "10.0.1.128/26", "10.0.1.192/26",
+		"10.0.2.0/26", "10.0.2.64/26",
+		"10.0.3.0/26", "10.0.3.64/26", "10.0.3.128/26", "10.0.3.192/26",
+	}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("paged /26 blocks = %v, want %v", all, want)
+	}
+
+	if _, err := decodeAvailableToken("not-a-token!"); !errors.Is(err, errInvalidAvailableToken) {
+		t.Errorf("decodeAvailableToken(garbage) error = %v, want errInvalidAvailableToken", err)
+	}
+	if _, err := parseAvailableLimit("5000"); err == nil {
+		t.Error("parseAvailableLimit(5000) error = nil, want an error")
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	body := `{"key":"web","CIDR":"10.1.0.0/16","extra":true}`
+	for _, tt := range []struct {
+		strict string
+		want   fieldErrors
+	}{
+		{"", nil},
+		{"true", fieldErrors{"extra": "unknown field"}},
+		{"false", nil},
+	} {
+		t.Setenv("STRICT_JSON", tt.strict)
+		var request registrationRequest
+		errs := decodeJSONBody(strings.NewReader(body), &request)
+		if !reflect.DeepEqual(errs, tt.want) {
+			t.Errorf("STRICT_JSON=%q: errors = %v, want %v", tt.strict, errs, tt.want)
+		}
+		if tt.want == nil && (request.Key != "web" || request.CIDR != "10.1.0.0/16") {
+			t.Errorf("STRICT_JSON=%q: decoded %+v, want key and cidr", tt.strict, request)
+		}
+	}
+
+	t.Setenv("STRICT_JSON", "")
+	var lock lockRequest
+	if errs := decodeJSONBody(strings.NewReader(`{"name":"burst","owner":"w","ttl":5}`), &lock); errs != nil {
+		t.Errorf("default lock body errors = %v, want the unknown ttl ignored", errs)
+	}
+}
+
+func TestPlacePool(t *testing.T) {
+	pools, err := parsePolicy([]byte(`{
+		"prod": {"base": "10.16.0.0/12", "tags": {"env": "prod"}},
+		"prod-eu": {"base": "10.32.0.0/12", "tags": {"env": "prod", "region": "eu"}},
+		"dev": {"base": "10.48.0.0/12", "tags": {"env": "dev"}},
+		"shared": {"base": "10.64.0.0/12"}
+	}`))
+	if err != nil {
+		t.Fatalf("parsePolicy() error = %v", err)
+	}
+	service := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16, pools: pools}
+
+	tests := []struct {
+		name      string
+		requested string
+		tags      Tags
+		want      string
+		wantErr   bool
+	}{
+		{name: "matching pool", tags: Tags{"env": "prod"}, want: "prod"},
+		{name: "most specific pool", tags: Tags{"env": "prod", "region": "eu"}, want: "prod-eu"},
+		{name: "no pool accepts", tags: Tags{"env": "staging"}, wantErr: true},
+		{name: "unpoliced tags", tags: Tags{"team": "web"}, want: ""},
+		{name: "no tags", want: ""},
+		{name: "requested pool accepts", requested: "shared", tags: Tags{"env": "prod"}, want: "shared"},
+		{name: "requested pool rejects", requested: "dev", tags: Tags{"env": "prod"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.placePool(tt.requested, tt.tags)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("placePool(%q, %v) = %q, %v, want %q, wantErr %v", tt.requested, tt.tags, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	if err := service.validatePoolMembership(CIDRRecord{Key: "a", CIDR: "10.16.1.0/24", Pool: "prod"}); err == nil {
+		t.Errorf("validatePoolMembership(untagged record in prod) error = nil, want placement policy error")
+	}
+	// A patch that only touches tags is held to the policy too.
+	if err := service.validatePoolTags(CIDRRecord{Key: "a", CIDR: "10.16.1.0/24", Pool: "prod", Tags: Tags{"env": "dev"}}); err == nil {
+		t.Errorf("validatePoolTags(retagged record in prod) error = nil, want placement policy error")
+	}
+	if err := service.validatePoolTags(CIDRRecord{Key: "a", CIDR: "10.16.1.0/24", Pool: "prod", Tags: Tags{"env": "prod", "team": "web"}}); err != nil {
+		t.Errorf("validatePoolTags(prod-tagged record) error = %v, want nil", err)
+	}
+}
+
+func TestPlanReconcile(t *testing.T) {
+	aws := Tags{syncSourceTag: syncSourceAWS}
+	existing := []CIDRRecord{
+		{Key: "vpc-aaa", CIDR: "10.1.0.0/16", Account: "111111111111", Region: "us-east-1", Tags: aws},
+		{Key: "vpc-aaa/subnet-1", CIDR: "10.1.1.0/24", Account: "111111111111", Region: "us-east-1", Tags: aws},
+		{Key: "vpc-bbb", CIDR: "10.2.0.0/16", Account: "111111111111", Region: "us-east-1", Tags: aws},
+		{Key: "vpc-ccc", CIDR: "10.3.0.0/16", Account: "111111111111", Region: "eu-west-1", Tags: aws},
+		{Key: "vpc-ddd", CIDR: "10.5.0.0/16", Account: "222222222222", Region: "us-east-1", Tags: aws},
+		{Key: "manual", CIDR: "10.4.0.0/16", Account: "111111111111", Region: "us-east-1"},
+		{Key: "forged", CIDR: "10.6.0.0/16", Account: "111111111111", Region: "us-east-1", Tags: Tags{"source": syncSourceAWS}},
+	}
+	discovered := []CIDRRecord{
+		{Key: "vpc-aaa", CIDR: "10.1.0.0/16", Account: "111111111111", Region: "us-east-1"},
+		{Key: "vpc-bbb", CIDR: "10.9.0.0/16", Account: "111111111111", Region: "us-east-1"},
+	}
+
+	checked, stale := planReconcile(existing, discovered, map[reconcileScope]bool{{Region: "us-east-1", Account: "111111111111"}: true})
+	if checked != 3 {
+		t.Errorf("checked = %d, want 3 AWS-sourced records in us-east-1 of 111111111111", checked)
+	}
+	var keys []string
+	for _, record := range stale {
+		keys = append(keys, record.Key)
+	}
+	// vpc-bbb now has a different block, vpc-ccc is in a region and vpc-ddd
+	// in an account that were not scanned, manual was never imported, and
+	// forged only carries a user tag.
+	if want := []string{"vpc-aaa/subnet-1", "vpc-bbb"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("stale = %v, want %v", keys, want)
+	}
+
+	if err := (&CIDRService{}).checkTags(CIDRRecord{Tags: aws}, nil); err == nil {
+		t.Errorf("checkTags(%s) error = nil, want the tag refused", syncSourceTag)
+	}
+}
+
+func TestTableRoutes(t *testing.T) {
+	routes, err := parseTableRoutes("tenant:acme=cidr-acme, pool:prod=cidr-prod;endpoint=http://localhost:8000;role=arn:aws:iam::222222222222:role/cidrfinder")
+	if err != nil {
+		t.Fatalf("parseTableRoutes() error = %v", err)
+	}
+	want := []tableRoute{
+		{Scope: tableRouteTenant, Value: "acme", Table: "cidr-acme"},
+		{Scope: tableRoutePool, Value: "prod", Table: "cidr-prod", Endpoint: "http://localhost:8000", RoleARN: "arn:aws:iam::222222222222:role/cidrfinder"},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("parseTableRoutes() = %+v, want %+v", routes, want)
+	}
+
+	for _, value := range []string{
+		"acme=cidr-acme",
+		"account:111111111111=cidr-acct",
+		"tenant:acme=",
+		"tenant:acme=a,tenant:acme=b",
+		"pool:prod=cidr-prod;region=us-west-2",
+		"pool:prod=cidr-prod;role=admin",
+	} {
+		if _, err := parseTableRoutes(value); err == nil {
+			t.Errorf("parseTableRoutes(%q) error = nil, want error", value)
+		}
+	}
+
+	defaultClient := dynamodb.New(dynamodb.Options{Region: "us-east-1"})
+	service := &CIDRService{
+		tableName:    "cidr-registry",
+		dynamoClient: defaultClient,
+		tables:       routedTables(aws.Config{Region: "us-east-1"}, routes, defaultClient, nil),
+	}
+	tests := []struct {
+		tenant, pool string
+		want         string
+	}{
+		{"acme", "", "cidr-acme"},
+		{"acme", "prod", "cidr-acme"},
+		{"other", "prod", "cidr-prod"},
+		{"other", "dev", "cidr-registry"},
+		{"", "", "cidr-registry"},
+	}
+	for _, tt := range tests {
+		ctx := service.withTableRoute(context.Background(), tt.tenant, tt.pool)
+		if got := service.table(ctx); got != tt.want {
+			t.Errorf("table(tenant %q, pool %q) = %q, want %q", tt.tenant, tt.pool, got, tt.want)
+		}
+	}
+
+	acme := service.withTableRoute(context.Background(), "acme", "")
+	prod := service.withTableRoute(context.Background(), "", "prod")
+	if service.client(acme) != defaultClient || service.client(prod) == defaultClient {
+		t.Errorf("client() should share the default client unless a route sets an endpoint or role")
+	}
+}
+
+func TestAllocationGauges(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "web", CIDR: "10.1.0.0/16", Pool: "prod"},
+		{Key: "db", CIDR: "10.2.0.0/16", Pool: "prod"},
+		{Key: `odd"key`, CIDR: "10.3.0.0/16"},
+	}
+
+	got := allocationGauges(records, defaultAllocationMetricLabels)
+	want := `# HELP cidrfinder_cidr_allocated Number of unexpired records with these labels.
+# TYPE cidrfinder_cidr_allocated gauge
+cidrfinder_cidr_allocated{key="db",cidr="10.2.0.0/16",pool="prod"} 1
+cidrfinder_cidr_allocated{key="odd\"key",cidr="10.3.0.0/16"} 1
+cidrfinder_cidr_allocated{key="web",cidr="10.1.0.0/16",pool="prod"} 1
+`
+	if got != want {
+		t.Errorf("allocationGauges() =\n%s\nwant\n%s", got, want)
+	}
+
+	labels, err := parseAllocationMetricLabels("pool")
+	if err != nil {
+		t.Fatalf("parseAllocationMetricLabels(pool) error = %v", err)
+	}
+	if got := allocationGauges(records, labels); !strings.Contains(got, "cidrfinder_cidr_allocated 1\ncidrfinder_cidr_allocated{pool=\"prod\"} 2\n") {
+		t.Errorf("allocationGauges(pool) = %s, want records folded by pool", got)
+	}
+
+	if _, err := parseAllocationMetricLabels("key,tags"); err == nil {
+		t.Errorf("parseAllocationMetricLabels(key,tags) error = nil, want error")
+	}
+	if got := (redactedFields{fields: []string{"pool"}}).withoutRedacted(defaultAllocationMetricLabels); !reflect.DeepEqual(got, []string{"key", "cidr"}) {
+		t.Errorf("withoutRedacted() = %v, want key and cidr", got)
+	}
+}
+
+func TestPreferredRange(t *testing.T) {
+	service := &CIDRService{baseCIDR: "10.0.0.0/8", allocationPrefix: 16}
+	_, base, _ := net.ParseCIDR("10.0.0.0/8")
+	_, a, _ := net.ParseCIDR("10.0.0.0/16")
+	_, b, _ := net.ParseCIDR("10.100.0.0/16")
+	_, c, _ := net.ParseCIDR("10.101.0.0/16")
+	opts := AllocationOptions{Prefer: "10.100.0.0/15"}
+
+	used := []*net.IPNet{a}
+	next, ok := service.nextPreferred(base, 16, used, nil, opts)
+	if !ok || next.String() != "10.100.0.0/16" {
+		t.Errorf("nextPreferred() = %v, %v, want 10.100.0.0/16 from the preferred range", next, ok)
+	}
+	if got := service.allocationRange(opts, "10.100.0.0/16"); got != "10.100.0.0/15" {
+		t.Errorf("allocationRange(10.100.0.0/16) = %q, want the preferred range", got)
+	}
+
+	used = append(used, b, c)
+	next, ok = service.nextPreferred(base, 16, used, nil, opts)
+	if !ok || next.String() != "10.1.0.0/16" {
+		t.Errorf("nextPreferred() with the preferred range full = %v, %v, want a fallback to 10.1.0.0/16", next, ok)
+	}
+	if got := service.allocationRange(opts, "10.1.0.0/16"); got != "10.0.0.0/8" {
+		t.Errorf("allocationRange(10.1.0.0/16) = %q, want the base", got)
+	}
+
+	for _, prefer := range []string{"172.16.0.0/16", "10.100.0.0/24", "not-a-cidr"} {
+		if _, _, _, err := service.resolveAllocation(AllocationOptions{Prefer: prefer}); err == nil {
+			t.Errorf("resolveAllocation(prefer %s) error = nil, want error", prefer)
+		}
+	}
+}
+
+func TestIPv4MappedCIDRs(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "::ffff:10.0.0.0/120", want: "10.0.0.0/24"},
+		{cidr: "::ffff:10.0.0.0/96", want: "0.0.0.0/0"},
+		{cidr: "::ffff:10.0.0.0/8", wantErr: true},
+		{cidr: "10.0.0.0/24", want: "10.0.0.0/24"},
+		{cidr: "2001:db8::/32", want: "2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		_, network, err := parseCIDR(tt.cidr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCIDR(%s) error = %v, wantErr %v", tt.cidr, err, tt.wantErr)
+			continue
+		}
+		if err == nil && network.String() != tt.want {
+			t.Errorf("parseCIDR(%s) = %s, want %s", tt.cidr, network, tt.want)
+		}
+	}
+
+	if got := unmapCIDR("::ffff:10.0.0.5/120"); got != "10.0.0.5/24" {
+		t.Errorf("unmapCIDR(::ffff:10.0.0.5/120) = %s, want 10.0.0.5/24", got)
+	}
+	if got := unmapCIDR("2001:db8::/32"); got != "2001:db8::/32" {
+		t.Errorf("unmapCIDR(2001:db8::/32) = %s, want it unchanged", got)
+	}
+
+	// Overlap detection sees a mapped block and its native form as the same
+	// addresses, whichever is registered first.
+	for _, pair := range [][2]string{
+		{"::ffff:10.0.1.0/120", "10.0.0.0/16"},
+		{"10.0.1.0/24", "::ffff:10.0.0.0/112"},
+		{"::ffff:10.0.0.0/120", "10.0.0.0/24"},
+	} {
+		existing := []CIDRRecord{{Key: "existing", CIDR: pair[0]}}
+		candidate := CIDRRecord{Key: "candidate", CIDR: pair[1]}
+		if err := checkScopedUniqueness(existing, candidate, uniquenessScopeGlobal); err == nil {
+			t.Errorf("checkScopedUniqueness(%s against %s) error = nil, want overlap", pair[1], pair[0])
+		}
+	}
+}
+
+func TestRecordLimit(t *testing.T) {
+	for value, want := range map[string]int{"": 0, "100": 100} {
+		if got, err := parseMaxRecords(value); err != nil || got != want {
+			t.Errorf("parseMaxRecords(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"0", "-1", "many"} {
+		if _, err := parseMaxRecords(value); err == nil {
+			t.Errorf("parseMaxRecords(%q) error = nil, want error", value)
+		}
+	}
+
+	// A fresh count is trusted, so no DynamoDB call is made.
+	service := &CIDRService{tableName: "cidrs", maxRecords: 10}
+	service.recordCounts.tables = map[string]countedRecords{"cidrs": {count: 8, countedAt: time.Now()}}
+	ctx := context.Background()
+
+	if err := service.checkRecordLimit(ctx, 2); err != nil {
+		t.Fatalf("checkRecordLimit(2) with 8 of 10 error = %v, want nil", err)
+	}
+	service.countAdded(ctx, 1)
+	var limit *RecordLimitError
+	if err := service.checkRecordLimit(ctx, 2); !errors.As(err, &limit) {
+		t.Fatalf("checkRecordLimit(2) with 9 of 10 error = %v, want RecordLimitError", err)
+	}
+	if limit.Count != 9 || limit.Max != 10 || limit.Adding != 2 {
+		t.Errorf("RecordLimitError = %+v, want 9 of 10 adding 2", limit)
+	}
+	if err := service.checkRecordLimit(ctx, -5); err != nil {
+		t.Errorf("checkRecordLimit(-5) error = %v, want nil", err)
+	}
+
+	// A delete gives its record back; release only stamps the change marker.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if target := r.Header.Get("X-Amz-Target"); target != "DynamoDB_20120810.UpdateItem" {
+			t.Errorf("unexpected DynamoDB call %s", target)
+		}
+		io.WriteString(w, `{}`)
+	}))
+	defer server.Close()
+	service.dynamoClient = dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+	service.release(ctx, []CIDRRecord{{Key: "web", CIDR: "10.0.1.0/24"}})
+	if err := service.checkRecordLimit(ctx, 2); err != nil {
+		t.Errorf("checkRecordLimit(2) after a delete error = %v, want nil", err)
+	}
+
+	service.maxRecords = 0
+	if err := service.checkRecordLimit(ctx, 100); err != nil {
+		t.Errorf("checkRecordLimit without MAX_RECORDS error = %v, want nil", err)
+	}
+}
+
+func TestDiffCIDRs(t *testing.T) {
+	records := []CIDRRecord{
+		{Key: "vpc-prod", CIDR: "10.0.0.0/16"},
+		{Key: "vpc-dev", CIDR: "10.1.0.0/16"},
+		{Key: "vpc-dev-app", CIDR: "10.1.4.0/22"},
+		{Key: "vpc-legacy", CIDR: "10.5.0.0/16"},
+		{Key: "vpc-small", CIDR: "10.8.1.0/24"},
+	}
+	var proposed []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/16", "10.1.4.0/24", "10.8.0.0/16", "10.9.0.0/16", "10.0.0.0/16"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		proposed = append(proposed, network)
+	}
+
+	got := diffCIDRs(records, proposed)
+	want := &DiffResult{
+		Added:   []string{"10.8.0.0/16", "10.9.0.0/16"},
+		Removed: []DiffRecord{{Key: "vpc-legacy", CIDR: "10.5.0.0/16"}},
+		Unchanged: []DiffUnchanged{
+			{CIDR: "10.0.0.0/16", Match: diffExact, Record: DiffRecord{Key: "vpc-prod", CIDR: "10.0.0.0/16"}},
+			{CIDR: "10.1.4.0/24", Match: diffContained, Record: DiffRecord{Key: "vpc-dev-app", CIDR: "10.1.4.0/22"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffCIDRs() = %+v, want %+v", got, want)
+	}
+
+	if _, errs := (diffRequest{}).networks(); errs["cidrs"] != "required" {
+		t.Errorf("diffRequest{}.networks() errors = %v, want cidrs required", errs)
+	}
+	if _, errs := (diffRequest{CIDRs: []string{"10.0.0.0/16", "bogus"}}).networks(); errs["cidrs[1]"] != "invalid format" {
+		t.Errorf("networks() errors = %v, want cidrs[1] invalid format", errs)
+	}
+}
+
+func TestContiguousRun(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/16")
+	var used []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.5.0/24"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		used = append(used, network)
+	}
+
+	tests := []struct {
+		name      string
+		count     int
+		aggregate bool
+		first     string
+		supernet  string
+	}{
+		// 10.0.1.0-10.0.4.0 is free but not aligned to /22, so the run that
+		// summarizes starts at 10.0.8.0.
+		{name: "summarizing run preferred", count: 4, first: "10.0.8.0/24", supernet: "10.0.8.0/22"},
+		{name: "unaligned run fits first gap", count: 3, first: "10.0.1.0/24"},
+		{name: "aggregate", count: 2, aggregate: true, first: "10.0.2.0/24", supernet: "10.0.2.0/23"},
+	}
+	for _, tt := range tests {
+		blocks, supernet, ok := contiguousRun(base, 24, tt.count, tt.aggregate, used)
+		if !ok || len(blocks) != tt.count || blocks[0].String() != tt.first {
+			t.Errorf("%s: contiguousRun() = %v, %v, want %d blocks from %s", tt.name, blocks, ok, tt.count, tt.first)
+			continue
+		}
+		got := ""
+		if supernet != nil {
+			got = supernet.String()
+		}
+		if got != tt.supernet {
+			t.Errorf("%s: supernet = %q, want %q", tt.name, got, tt.supernet)
+		}
+	}
+
+	// A run that only exists unaligned cannot be aggregated.
+	_, small, _ := net.ParseCIDR("10.0.0.0/22")
+	_, first, _ := net.ParseCIDR("10.0.0.0/24")
+	_, last, _ := net.ParseCIDR("10.0.3.0/24")
+	ends := []*net.IPNet{first, last}
+	if _, _, ok := contiguousRun(small, 24, 2, true, ends); ok {
+		t.Errorf("contiguousRun(aggregate 2 in %s) = found, want no run", small)
+	}
+	if blocks, supernet, ok := contiguousRun(small, 24, 2, false, ends); !ok || blocks[0].String() != "10.0.1.0/24" || supernet != nil {
+		t.Errorf("contiguousRun(2 in %s) = %v, %v, %v, want 10.0.1.0/24 without a supernet", small, blocks, supernet, ok)
+	}
+
+	if errs := (contiguousRequest{registrationRequest: registrationRequest{Key: "edge"}, Count: 3, Aggregate: true}).validate(); errs["count"] == "" {
+		t.Errorf("validate(count 3, aggregate) errors = %v, want count error", errs)
+	}
+}
+
+func TestOverflowCIDR(t *testing.T) {
+	if overflow, err := parseOverflowCIDR("", "10.0.0.0/16", 24); overflow != nil || err != nil {
+		t.Errorf("parseOverflowCIDR(\"\") = %v, %v, want nil, nil", overflow, err)
+	}
+	for _, value := range []string{"bogus", "2001:db8::/32", "10.0.128.0/17", "10.0.0.0/8", "172.16.0.0/25"} {
+		if _, err := parseOverflowCIDR(value, "10.0.0.0/16", 24); err == nil {
+			t.Errorf("parseOverflowCIDR(%q) error = nil, want error", value)
+		}
+	}
+
+	// An overflow smaller than the default allocation could never be used.
+	if _, err := parseOverflowCIDR("100.64.0.0/20", "10.0.0.0/8", 16); err == nil {
+		t.Error("parseOverflowCIDR(100.64.0.0/20) with ALLOCATION_PREFIX /16 error = nil, want error")
+	}
+
+	overflow, err := parseOverflowCIDR("172.16.0.0/16", "10.0.0.0/16", 24)
+	if err != nil {
+		t.Fatalf("parseOverflowCIDR(172.16.0.0/16) error = %v", err)
+	}
+	_, other, _ := net.ParseCIDR("192.168.0.0/16")
+	service := &CIDRService{baseCIDR: "10.0.0.0/16", allowedBases: []*net.IPNet{overflow, other}, overflow: overflow}
+	_, base, _ := net.ParseCIDR("10.0.0.0/16")
+	_, part, _ := net.ParseCIDR("10.0.0.0/20")
+
+	tests := []struct {
+		name   string
+		base   *net.IPNet
+		prefix int
+		opts   AllocationOptions
+		want   bool
+	}{
+		{name: "default base", base: base, prefix: 24, want: true},
+		{name: "part of the default base", base: part, prefix: 24},
+		{name: "pool", base: base, prefix: 24, opts: AllocationOptions{Pool: "prod"}},
+		{name: "prefix larger than the overflow", base: base, prefix: 15},
+	}
+	for _, tt := range tests {
+		if got := service.overflows(tt.base, tt.prefix, tt.opts); got != tt.want {
+			t.Errorf("%s: overflows() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		cidr string
+		opts AllocationOptions
+		want string
+	}{
+		{cidr: "172.16.4.0/24", want: allocationSourceOverflow},
+		{cidr: "10.0.4.0/24", want: allocationSourcePrimary},
+		{cidr: "10.0.4.0/24", opts: AllocationOptions{Pool: "prod"}},
+		{cidr: "192.168.4.0/24", opts: AllocationOptions{Base: "192.168.0.0/16"}},
+	} {
+		if got := service.allocationSource(tt.opts, tt.cidr); got != tt.want {
+			t.Errorf("allocationSource(%+v, %s) = %q, want %q", tt.opts, tt.cidr, got, tt.want)
+		}
+	}
+	if got := (&CIDRService{}).allocationSource(AllocationOptions{}, "10.0.4.0/24"); got != "" {
+		t.Errorf("allocationSource without OVERFLOW_CIDR = %q, want empty", got)
+	}
+}
+
+func TestTagValidation(t *testing.T) {
+	if allowed, err := parseAllowedTagKeys("", []string{"owner"}); err != nil || allowed != nil {
+		t.Errorf("parseAllowedTagKeys(\"\") = %v, %v, want any key allowed", allowed, err)
+	}
+	allowed, err := parseAllowedTagKeys("env, owner", []string{"owner"})
+	if err != nil || !reflect.DeepEqual(allowed, map[string]bool{"env": true, "owner": true}) {
+		t.Fatalf("parseAllowedTagKeys(env, owner) = %v, %v", allowed, err)
+	}
+	if _, err := parseAllowedTagKeys("env", []string{"owner"}); err == nil {
+		t.Error("parseAllowedTagKeys(env) with owner required succeeded, want an error")
+	}
+
+	service := &CIDRService{}
+	err = service.checkTags(CIDRRecord{Tags: Tags{
+		allocationSourceTag:                    allocationSourceOverflow,
+		"env":                                  "prod",
+		"owner":                                "net, ops",
+		"":                                     "empty",
+		" padded":                              "x",
+		strings.Repeat("k", maxTagKeyLength+1): "x",
+		"note":                                 "line\nbreak",
+		"long":                                 strings.Repeat("v", maxTagValueLength+1),
+	}}, nil)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("checkTags() error = %v, want ValidationError", err)
+	}
+	wantFields := []string{"tags." + allocationSourceTag, "tags.", "tags. padded", "tags." + strings.Repeat("k", maxTagKeyLength+1), "tags.note", "tags.long"}
+	if len(invalid.Fields) != len(wantFields) {
+		t.Errorf("checkTags() fields = %v, want %v", invalid.Fields, wantFields)
+	}
+	for _, field := range wantFields {
+		if invalid.Fields[field] == "" {
+			t.Errorf("checkTags() has no error for %q: %v", field, invalid.Fields)
+		}
+	}
+
+	// With ALLOWED_TAG_KEYS only listed keys pass, and the service's own
+	// only when the record already carries them.
+	service.allowedTagKeys = allowed
+	stored := Tags{allocationSourceTag: allocationSourceOverflow}
+	err = service.checkTags(CIDRRecord{Tags: Tags{"env": "prod", "team": "net", allocationSourceTag: allocationSourceOverflow}}, stored)
+	if !errors.As(err, &invalid) || !reflect.DeepEqual(invalid.Fields, fieldErrors{"tags.team": "is not an allowed tag key"}) {
+		t.Errorf("checkTags(team) error = %v, want tags.team not allowed", err)
+	}
+	err = service.checkTags(CIDRRecord{Tags: Tags{allocationSourceTag: allocationSourcePrimary}}, stored)
+	if !errors.As(err, &invalid) || invalid.Fields["tags."+allocationSourceTag] == "" {
+		t.Errorf("checkTags(changed %s) error = %v, want it refused", allocationSourceTag, err)
+	}
+}
+
+func TestAllocationTree(t *testing.T) {
+	_, base, _ := net.ParseCIDR("10.0.0.0/16")
+	records := []CIDRRecord{
+		{Key: "app", CIDR: "10.0.4.0/24"},
+		{Key: "reserved", CIDR: "10.0.0.0/20", Reserved: true},
+		{Key: "db", CIDR: "10.0.0.0/24"},
+		{Key: "db-primary", CIDR: "10.0.0.0/25"},
+		{Key: "edge", CIDR: "10.0.128.0/17"},
+		{Key: "outside", CIDR: "192.168.0.0/24"},
+	}
+
+	// shape renders a tree as "cidr[children]" with free blocks starred.
+	var shape func(node *TreeNode) string
+	shape = func(node *TreeNode) string {
+		s := node.CIDR
+		if node.Free {
+			s += "*"
+		}
+		if len(node.Children) > 0 {
+			var children []string
+			for _, child := range node.Children {
+				children = append(children, shape(child))
+			}
+			s += "[" + strings.Join(children, " ") + "]"
+		}
+		return s
+	}
+
+	tree := allocationTree(base, records, false)
+	if got, want := shape(tree), "10.0.0.0/16[10.0.0.0/20[10.0.0.0/24[10.0.0.0/25] 10.0.4.0/24] 10.0.128.0/17]"; got != want {
+		t.Errorf("allocationTree() = %s, want %s", got, want)
+	}
+	if db := tree.Children[0].Children[0]; db.Key != "db" || db.Record == nil || db.Record.CIDR != "10.0.0.0/24" {
+		t.Errorf("first nested node = %+v, want the db record", db)
+	}
+
+	tree = allocationTree(base, records, true)
+	want := "10.0.0.0/16[10.0.0.0/20[10.0.0.0/24[10.0.0.0/25 10.0.0.128/25*] 10.0.1.0/24* 10.0.2.0/23* 10.0.4.0/24 10.0.5.0/24* 10.0.6.0/23* 10.0.8.0/21*] " +
+		"10.0.16.0/20* 10.0.32.0/19* 10.0.64.0/18* 10.0.128.0/17]"
+	if got := shape(tree); got != want {
+		t.Errorf("allocationTree(free) = %s, want %s", got, want)
+	}
+
+	if got, want := shape(allocationTree(base, nil, true)), "10.0.0.0/16[10.0.0.0/16*]"; got != want {
+		t.Errorf("allocationTree(empty, free) = %s, want %s", got, want)
+	}
+}
+
+func TestConfirmWriteBacksOutAuditEntry(t *testing.T) {
+	var transaction struct {
+		TransactItems []struct {
+			Delete struct {
+				TableName string
+				Key       map[string]map[string]string
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.Query":
+			var input struct {
+				IndexName      string
+				ConsistentRead bool
+			}
+			json.NewDecoder(r.Body).Decode(&input)
+			if input.IndexName != "" {
+				io.WriteString(w, `{"Items":[],"Count":0}`)
+				return
+			}
+			if !input.ConsistentRead {
+				t.Error("partition Query is not consistent")
+			}
+			io.WriteString(w, `{"Items":[`+
+				`{"partition":{"S":"10.0.0.0/16"},"key":{"S":"web"},"cidr":{"S":"10.0.0.0/23"}},`+
+				`{"partition":{"S":"10.0.0.0/16"},"key":{"S":"db"},"cidr":{"S":"10.0.1.0/24"}}],"Count":2}`)
+		case "DynamoDB_20120810.TransactWriteItems":
+			json.NewDecoder(r.Body).Decode(&transaction)
+			io.WriteString(w, `{}`)
+		case "DynamoDB_20120810.UpdateItem":
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("unexpected DynamoDB call %s", r.Header.Get("X-Amz-Target"))
+		}
+	}))
+	defer server.Close()
+
+	service := &CIDRService{
+		tableName:      "cidr-registry",
+		auditTableName: "cidr-audit",
+		partitioned:    true,
+		keyIndexName:   defaultKeyIndexName,
+		dynamoClient: dynamodb.New(dynamodb.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(server.URL),
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+	}
+	record := CIDRRecord{Key: "web", CIDR: "10.0.0.0/23", Partition: "10.0.0.0/16"}
+	entry := newAuditEntry(auditActionAllocate, record, time.Unix(1_700_000_000, 0))
+
+	err := service.confirmWrite(context.Background(), record, &entry)
+	if !errors.Is(err, errWriteConflict) {
+		t.Fatalf("confirmWrite() error = %v, want a write conflict", err)
+	}
+	items := transaction.TransactItems
+	if len(items) != 2 || items[0].Delete.TableName != "cidr-registry" || items[0].Delete.Key["cidr"]["S"] != record.CIDR {
+		t.Fatalf("back-out transaction = %+v, want the record deleted", items)
+	}
+	if items[1].Delete.TableName != "cidr-audit" || items[1].Delete.Key["key"]["S"] != "web" || items[1].Delete.Key["at"]["S"] != entry.At {
+		t.Errorf("back-out transaction = %+v, want the audit entry deleted with it", items)
+	}
+}
+
+func TestBatchWriteUnprocessedItems(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		attempts++
+		var input struct {
+			RequestItems map[string]json.RawMessage
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		fmt.Fprintf(w, `{"UnprocessedItems":{"cidr-registry":%s}}`, input.RequestItems["cidr-registry"])
+	}))
+	defer server.Close()
+
+	service := &CIDRService{
+		tableName: "cidr-registry",
+		dynamoClient: dynamodb.New(dynamodb.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(server.URL),
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+	}
+	requests := []types.WriteRequest{
+		{DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{"key": &types.AttributeValueMemberS{Value: "web"}}}},
+		{DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{"key": &types.AttributeValueMemberS{Value: "db"}}}},
+	}
+
+	// A cancelled request stops waiting to resubmit.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := service.batchWrite(ctx, requests); !errors.Is(err, context.Canceled) {
+		t.Errorf("batchWrite(cancelled) error = %v, want context.Canceled", err)
+	}
+
+	attempts = 0
+	err := service.batchWrite(context.Background(), requests)
+	if err == nil || !strings.Contains(err.Error(), "web, db still unprocessed") {
+		t.Errorf("batchWrite() error = %v, want the unprocessed keys named", err)
+	}
+	if attempts != maxBatchWriteAttempts {
+		t.Errorf("BatchWriteItem called %d times, want %d", attempts, maxBatchWriteAttempts)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// allocationMetric is the gauge GET /metrics/allocations reports for every
+// unexpired record.
+const allocationMetric = "cidrfinder_cidr_allocated"
+
+// allocationMetricLabels are the record fields GET /metrics/allocations can
+// label its gauge with, in the order they are written.
+var allocationMetricLabels = []string{"key", "cidr", "pool", "tenant", "account", "region"}
+
+// defaultAllocationMetricLabels identify each record, one series per record.
+var defaultAllocationMetricLabels = []string{"key", "cidr", "pool"}
+
+// parseAllocationMetricLabels reads the labels query parameter, a
+// comma-separated allow-list of allocationMetricLabels. An empty value keeps
+// the defaults.
+func parseAllocationMetricLabels(value string) ([]string, error) {
+	if value == "" {
+		return defaultAllocationMetricLabels, nil
+	}
+	allowed := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		known := false
+		for _, label := range allocationMetricLabels {
+			known = known || label == entry
+		}
+		if !known {
+			return nil, fmt.Errorf("labels must be a comma-separated list of %s, got %q",
+				strings.Join(allocationMetricLabels, ", "), entry)
+		}
+		allowed[entry] = true
+	}
+
+	var labels []string
+	for _, label := range allocationMetricLabels {
+		if allowed[label] {
+			labels = append(labels, label)
+		}
+	}
+	return labels, nil
+}
+
+// withoutRedacted drops the labels whose fields are redacted.
+func (r redactedFields) withoutRedacted(labels []string) []string {
+	kept := make([]string, 0, len(labels))
+	for _, label := range labels {
+		redacted := false
+		for _, field := range r.fields {
+			redacted = redacted || field == label
+		}
+		if !redacted {
+			kept = append(kept, label)
+		}
+	}
+	return kept
+}
+
+// allocationGauges renders records as a Prometheus gauge with one series per
+// distinct set of label values. With the default labels every record is its
+// own series with the value 1; a shorter allow-list folds records with the
+// same values into one series counting them, and an empty field leaves its
+// label out.
+func allocationGauges(records []CIDRRecord, labels []string) string {
+	counts := make(map[string]int)
+	for _, record := range records {
+		values := map[string]string{
+			"key":     record.Key,
+			"cidr":    record.CIDR,
+			"pool":    record.Pool,
+			"tenant":  record.Tenant,
+			"account": record.Account,
+			"region":  record.Region,
+		}
+		var pairs []string
+		for _, label := range labels {
+			if value := values[label]; value != "" {
+				pairs = append(pairs, label+`="`+prometheusLabelEscaper.Replace(value)+`"`)
+			}
+		}
+		counts[strings.Join(pairs, ",")]++
+	}
+
+	series := make([]string, 0, len(counts))
+	for labelSet := range counts {
+		series = append(series, labelSet)
+	}
+	sort.Strings(series)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s Number of unexpired records with these labels.\n# TYPE %s gauge\n", allocationMetric, allocationMetric)
+	for _, labelSet := range series {
+		if labelSet == "" {
+			fmt.Fprintf(&b, "%s %d\n", allocationMetric, counts[labelSet])
+			continue
+		}
+		fmt.Fprintf(&b, "%s{%s} %d\n", allocationMetric, labelSet, counts[labelSet])
+	}
+	return b.String()
+}
+
+// prometheusLabelEscaper escapes a label value for the text exposition
+// format, which only escapes backslashes, quotes and newlines.
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
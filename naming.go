@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	responseCaseCamel = "camel"
+	responseCaseSnake = "snake"
+)
+
+// responseNaming renames the fields of JSON responses. The zero value keeps
+// the field names as they are, which are camelCase.
+type responseNaming struct {
+	snake bool
+	// fields maps a field name to the name it is sent as, taking precedence
+	// over the case conversion.
+	fields map[string]string
+}
+
+// naming is the response naming configured by RESPONSE_CASE and
+// RESPONSE_FIELDS, set by loadResponseNaming at startup.
+var naming responseNaming
+
+func loadResponseNaming() error {
+	n, err := parseResponseNaming(os.Getenv("RESPONSE_CASE"), os.Getenv("RESPONSE_FIELDS"))
+	if err != nil {
+		return err
+	}
+	naming = n
+	return nil
+}
+
+// parseResponseNaming parses RESPONSE_CASE, camel or snake, and
+// RESPONSE_FIELDS, a comma-separated list of field=name renames such as
+// "cidr=cidr_block,key=name".
+func parseResponseNaming(caseValue, fields string) (responseNaming, error) {
+	var n responseNaming
+	switch caseValue {
+	case "", responseCaseCamel:
+	case responseCaseSnake:
+		n.snake = true
+	default:
+		return n, fmt.Errorf("RESPONSE_CASE must be %q or %q, got %q",
+			responseCaseCamel, responseCaseSnake, caseValue)
+	}
+
+	for _, entry := range strings.Split(fields, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		field, name, ok := strings.Cut(entry, "=")
+		if !ok || field == "" || name == "" {
+			return n, fmt.Errorf("invalid RESPONSE_FIELDS entry %q: want field=name", entry)
+		}
+		if n.fields == nil {
+			n.fields = make(map[string]string)
+		}
+		n.fields[field] = name
+	}
+	return n, nil
+}
+
+// marshalResponse marshals a response body with the configured field names.
+// A backup document keeps its own names so that it can be restored as is.
+func marshalResponse(body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if _, isBackup := body.(*Backup); err != nil || isBackup {
+		return data, err
+	}
+	return naming.rename(data)
+}
+
+// rename rewrites the object keys of a JSON document at every depth.
+func (n responseNaming) rename(data []byte) ([]byte, error) {
+	if !n.snake && len(n.fields) == 0 {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(n.renameValue(value))
+}
+
+// renameValue renames the object keys of a decoded JSON value. The keys of a
+// tags object are the caller's own tag keys rather than field names, so they
+// are sent as stored.
+func (n responseNaming) renameValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if _, isTags := field.(map[string]interface{}); isTags && key == "tags" {
+				renamed[n.name(key)] = field
+				continue
+			}
+			renamed[n.name(key)] = n.renameValue(field)
+		}
+		return renamed
+	case []interface{}:
+		for i, element := range v {
+			v[i] = n.renameValue(element)
+		}
+	}
+	return value
+}
+
+func (n responseNaming) name(field string) string {
+	if name, ok := n.fields[field]; ok {
+		return name
+	}
+	if n.snake {
+		return snakeCase(field)
+	}
+	return field
+}
+
+// snakeCase converts a camelCase name such as "expiresAt" to "expires_at".
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
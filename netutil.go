@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	mathbits "math/bits"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Prefix lengths are bounded by the number of address bits in each family.
+const (
+	maxIPv4Prefix = 32
+	maxIPv6Prefix = 128
+)
+
+// ipv4MappedPrefix is the length of ::ffff:0:0/96, the IPv6 prefix of
+// IPv4-mapped addresses.
+const ipv4MappedPrefix = 96
+
+// parseCIDR is net.ParseCIDR with IPv4-mapped IPv6 ranges, such as
+// ::ffff:10.0.0.0/120, turned into their IPv4 form, 10.0.0.0/24. Go parses them
+// to 16-byte networks that never overlap the 4-byte form of the same
+// addresses, so every CIDR is parsed here rather than with net.ParseCIDR. A
+// mapped range with a prefix under /96 reaches outside the mapped space and is
+// rejected.
+func parseCIDR(s string) (net.IP, *net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil || !strings.Contains(s, ":") || ip.To4() == nil {
+		return ip, network, err
+	}
+	ones, _ := network.Mask.Size()
+	if ones < ipv4MappedPrefix {
+		return nil, nil, fmt.Errorf("IPv4-mapped CIDR %s must have a prefix of at least /%d; write the IPv4 form instead", s, ipv4MappedPrefix)
+	}
+	return ip.To4(), &net.IPNet{IP: network.IP.To4(), Mask: net.CIDRMask(ones-ipv4MappedPrefix, 32)}, nil
+}
+
+// unmapCIDR returns an IPv4-mapped CIDR in its IPv4 form, keeping any host
+// bits, so records are stored the way they are compared. Other CIDRs, valid
+// or not, are returned unchanged.
+func unmapCIDR(s string) string {
+	if !strings.Contains(s, ":") {
+		return s
+	}
+	ip, network, err := parseCIDR(s)
+	if err != nil || len(ip) != net.IPv4len {
+		return s
+	}
+	ones, _ := network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+// checkPrefixLength rejects a prefix length outside 0 to bits, so a value
+// such as /40 for IPv4 is refused where it is accepted rather than producing
+// an invalid block later on.
+func checkPrefixLength(prefix, bits int) error {
+	if prefix < 0 || prefix > bits {
+		return fmt.Errorf("must be between 0 and %d, got %d", bits, prefix)
+	}
+	return nil
+}
+
+// lastIP returns the highest address contained in the network.
+func lastIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return ip
+}
+
+// nextIP returns ip+1, or nil if ip is the highest address of its family.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// prevIP returns ip-1, or nil if ip is the lowest address of its family.
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			return prev
+		}
+	}
+	return nil
+}
+
+// sameFamily reports whether both networks are IPv4 or both are IPv6.
+func sameFamily(a, b *net.IPNet) bool {
+	return len(a.IP) == len(b.IP)
+}
+
+// netContains reports whether inner lies entirely within outer.
+func netContains(outer, inner *net.IPNet) bool {
+	if !sameFamily(outer, inner) {
+		return false
+	}
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// netsOverlap reports whether the two networks share any address.
+func netsOverlap(a, b *net.IPNet) bool {
+	return netContains(a, b) || netContains(b, a)
+}
+
+// netsAdjacent reports whether the two networks touch without overlapping,
+// i.e. one ends at the address immediately before the other begins.
+func netsAdjacent(a, b *net.IPNet) bool {
+	if !sameFamily(a, b) || netsOverlap(a, b) {
+		return false
+	}
+	if next := nextIP(lastIP(a)); next != nil && bytes.Equal(next, b.IP) {
+		return true
+	}
+	if next := nextIP(lastIP(b)); next != nil && bytes.Equal(next, a.IP) {
+		return true
+	}
+	return false
+}
+
+func ipv4ToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIPv4(n uint32) net.IP {
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+}
+
+// nextFreeSubnet walks the prefix-sized subnets of base in address order and
+// returns the first one that overlaps none of the used networks.
+func nextFreeSubnet(base *net.IPNet, prefix int, used []*net.IPNet) (*net.IPNet, bool) {
+	return nextFreeSubnetFrom(base, prefix, used, 0)
+}
+
+// nextFreeSubnetFrom is nextFreeSubnet starting at the index-th subnet of base
+// (modulo the number of subnets) and wrapping around to the start of base.
+// Addresses are big.Int values, so IPv6 bases with more subnets than fit in
+// a uint64, such as the /56s of a /32, are searched the same way as IPv4.
+func nextFreeSubnetFrom(base *net.IPNet, prefix int, used []*net.IPNet, index uint64) (*net.IPNet, bool) {
+	basePrefix, bits := base.Mask.Size()
+	if prefix < basePrefix || prefix > bits {
+		return nil, false
+	}
+
+	start := ipToInt(base.IP, bits)
+	end := new(big.Int).Add(start, blockSize(bits, basePrefix))
+	subnets := new(big.Int).Lsh(big.NewInt(1), uint(prefix-basePrefix))
+	from := new(big.Int).Mod(new(big.Int).SetUint64(index), subnets)
+	from.Mul(from, blockSize(bits, prefix)).Add(from, start)
+
+	if subnet, ok := freeSubnetIn(from, end, prefix, bits, used); ok {
+		return subnet, true
+	}
+	return freeSubnetIn(start, from, prefix, bits, used)
+}
+
+// nextFreeSubnetWithGap is nextFreeSubnetFrom preferring a block with gap free
+// blocks on each side of every used network. Once no such block is left it
+// falls back to tight packing.
+func nextFreeSubnetWithGap(base *net.IPNet, prefix int, used []*net.IPNet, index uint64, gap int) (*net.IPNet, bool) {
+	if gap > 0 {
+		_, bits := base.Mask.Size()
+		if subnet, ok := nextFreeSubnetFrom(base, prefix, withGap(used, prefix, bits, gap), index); ok {
+			return subnet, true
+		}
+	}
+	return nextFreeSubnetFrom(base, prefix, used, index)
+}
+
+// withGap returns used plus, around each used network of the bits-wide
+// family, gap prefix-sized blocks on either side of the prefix-aligned range
+// that contains it. Treating those blocks as taken leaves room for
+// neighbouring allocations to grow.
+func withGap(used []*net.IPNet, prefix, bits, gap int) []*net.IPNet {
+	if gap <= 0 || prefix < 0 || prefix > bits {
+		return used
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	step := blockSize(bits, prefix)
+	limit := blockSize(bits, 0)
+	padded := append([]*net.IPNet(nil), used...)
+	for _, u := range used {
+		if len(u.IP)*8 != bits {
+			continue
+		}
+		start := ipToInt(u.IP, bits)
+		start.Div(start, step).Mul(start, step)
+		end := ipToInt(lastIP(u), bits)
+		end.Add(end, step).Div(end, step).Mul(end, step)
+		for i := 1; i <= gap; i++ {
+			offset := new(big.Int).Mul(big.NewInt(int64(i)), step)
+			if before := new(big.Int).Sub(start, offset); before.Sign() >= 0 {
+				padded = append(padded, &net.IPNet{IP: intToIP(before, bits), Mask: mask})
+			}
+			if after := new(big.Int).Add(end, offset.Sub(offset, step)); after.Cmp(limit) < 0 {
+				padded = append(padded, &net.IPNet{IP: intToIP(after, bits), Mask: mask})
+			}
+		}
+	}
+	return padded
+}
+
+// freeSubnetIn returns the first prefix-sized subnet in the bits-wide address
+// range [start, end) that overlaps none of the used networks. Candidates are
+// generated one at a time and a used block larger than a candidate is
+// skipped as a whole, so the search runs in time proportional to the number
+// of used blocks rather than the size of the range.
+func freeSubnetIn(start, end *big.Int, prefix, bits int, used []*net.IPNet) (*net.IPNet, bool) {
+	mask := net.CIDRMask(prefix, bits)
+	step := blockSize(bits, prefix)
+
+	for addr := new(big.Int).Set(start); addr.Cmp(end) < 0; {
+		candidate := &net.IPNet{IP: intToIP(addr, bits), Mask: mask}
+		next := new(big.Int).Add(addr, step)
+
+		free := true
+		for _, u := range used {
+			if !netsOverlap(candidate, u) {
+				continue
+			}
+			free = false
+			usedEnd := ipToInt(lastIP(u), bits)
+			if usedEnd.Add(usedEnd, big.NewInt(1)).Cmp(next) > 0 {
+				next = usedEnd
+			}
+		}
+		if free {
+			return candidate, true
+		}
+		addr = next
+	}
+
+	return nil, false
+}
+
+// ipToInt returns ip as an integer in a bits-wide address family.
+func ipToInt(ip net.IP, bits int) *big.Int {
+	return new(big.Int).SetBytes(familyIP(ip, bits))
+}
+
+// intToIP returns the bits-wide address n.
+func intToIP(n *big.Int, bits int) net.IP {
+	return n.FillBytes(make(net.IP, bits/8))
+}
+
+// blockSize is the number of addresses in a block of the given prefix length.
+func blockSize(bits, prefix int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-prefix))
+}
+
+// coveringSupernet returns the smallest network that contains every one of
+// networks, which must be non-empty and of one address family. Its prefix is
+// the number of leading bits all network addresses share, capped at the
+// shortest input prefix.
+func coveringSupernet(networks []*net.IPNet) *net.IPNet {
+	ones, bits := networks[0].Mask.Size()
+	ip := familyIP(networks[0].IP, bits)
+	for _, n := range networks[1:] {
+		prefix, _ := n.Mask.Size()
+		ones = min(ones, prefix, commonPrefixLen(ip, familyIP(n.IP, bits)))
+	}
+
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// familyIP returns ip in the byte length of a bits-wide address family.
+func familyIP(ip net.IP, bits int) net.IP {
+	if bits == 32 {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// commonPrefixLen is the number of leading bits a and b have in common.
+func commonPrefixLen(a, b net.IP) int {
+	for i := range a {
+		if diff := a[i] ^ b[i]; diff != 0 {
+			return i*8 + mathbits.LeadingZeros8(diff)
+		}
+	}
+	return len(a) * 8
+}
+
+// addrRange is a half-open IPv4 address range [start, end).
+type addrRange struct {
+	start, end uint64
+}
+
+// freeRanges returns the maximal address ranges of base that overlap none of
+// the used networks, in address order.
+func freeRanges(base *net.IPNet, used []*net.IPNet) []addrRange {
+	start, end, ok := ipv4Range(base)
+	if !ok {
+		return nil
+	}
+
+	var taken []addrRange
+	for _, u := range used {
+		if s, e, ok := ipv4Range(u); ok && s < end && e > start {
+			taken = append(taken, addrRange{max(s, start), min(e, end)})
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool { return taken[i].start < taken[j].start })
+
+	var free []addrRange
+	addr := start
+	for _, t := range taken {
+		if t.start > addr {
+			free = append(free, addrRange{addr, t.start})
+		}
+		addr = max(addr, t.end)
+	}
+	if addr < end {
+		free = append(free, addrRange{addr, end})
+	}
+	return free
+}
+
+// bestFitSubnet returns a prefix-sized block of base placed in the smallest
+// free range that can take it without leaving, on either side, free space too
+// small to hold another block of the same size. Within that range the lowest
+// such block is chosen.
+func bestFitSubnet(base *net.IPNet, prefix int, used []*net.IPNet) (*net.IPNet, bool) {
+	basePrefix, bits := base.Mask.Size()
+	if bits != 32 || prefix < basePrefix || prefix > 32 {
+		return nil, false
+	}
+	step := uint64(1) << uint(32-prefix)
+
+	var (
+		best     *net.IPNet
+		bestSize uint64
+	)
+	for _, free := range freeRanges(base, used) {
+		size := free.end - free.start
+		if size < step || (best != nil && size >= bestSize) {
+			continue
+		}
+		for addr := (free.start + step - 1) / step * step; addr+step <= free.end; addr += step {
+			before := addr == free.start || addr-step >= free.start
+			after := addr+step == free.end || addr+2*step <= free.end
+			if before && after {
+				best = &net.IPNet{IP: uint32ToIPv4(uint32(addr)), Mask: net.CIDRMask(prefix, 32)}
+				bestSize = size
+				break
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// usableHosts is the number of assignable IPv4 addresses in a block of the
+// given prefix length. The network and broadcast addresses are excluded,
+// except for /31 point-to-point links (RFC 3021) and /32 single hosts.
+func usableHosts(prefix int) uint64 {
+	switch {
+	case prefix == 32:
+		return 1
+	case prefix == 31:
+		return 2
+	default:
+		return (uint64(1) << uint(32-prefix)) - 2
+	}
+}
+
+// Address families of NetworkDetails.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// NetworkDetails describes the addresses of a block. IPv4 blocks set aside
+// their network and broadcast addresses, except /31 and /32 blocks, which
+// have no broadcast address: both addresses of a /31 and the single address
+// of a /32 are usable. IPv6 has no broadcast, so every address of an IPv6
+// block is in its usable range. The counts are big integers because an IPv6
+// block can hold more addresses than a uint64 can count.
+type NetworkDetails struct {
+	Family      string   `json:"family"`
+	Network     string   `json:"network"`
+	Broadcast   string   `json:"broadcast,omitempty"`
+	FirstUsable string   `json:"firstUsable"`
+	LastUsable  string   `json:"lastUsable"`
+	Addresses   *big.Int `json:"addresses"`
+	UsableHosts *big.Int `json:"usableHosts"`
+}
+
+// networkDetails returns the address details of network in its own family.
+// IPv4-mapped IPv6 networks are described as IPv4.
+func networkDetails(network *net.IPNet) *NetworkDetails {
+	start, end, ok := ipv4Range(network)
+	if !ok {
+		return ipv6Details(network)
+	}
+
+	details := &NetworkDetails{
+		Family:      familyIPv4,
+		Network:     uint32ToIPv4(uint32(start)).String(),
+		FirstUsable: uint32ToIPv4(uint32(start)).String(),
+		LastUsable:  uint32ToIPv4(uint32(end - 1)).String(),
+		Addresses:   new(big.Int).SetUint64(end - start),
+		UsableHosts: new(big.Int).SetUint64(end - start),
+	}
+	if end-start > 2 {
+		details.UsableHosts.SetUint64(end - start - 2)
+		details.Broadcast = details.LastUsable
+		details.FirstUsable = uint32ToIPv4(uint32(start + 1)).String()
+		details.LastUsable = uint32ToIPv4(uint32(end - 2)).String()
+	}
+	return details
+}
+
+// ipv6Details describes an IPv6 block, whose usable range is the whole block.
+func ipv6Details(network *net.IPNet) *NetworkDetails {
+	ones, bits := network.Mask.Size()
+	if bits != 128 {
+		return nil
+	}
+	first := network.IP.Mask(network.Mask).To16()
+	return &NetworkDetails{
+		Family:      familyIPv6,
+		Network:     first.String(),
+		FirstUsable: first.String(),
+		LastUsable:  lastIP(&net.IPNet{IP: first, Mask: network.Mask}).String(),
+		Addresses:   blockSize(bits, ones),
+		UsableHosts: blockSize(bits, ones),
+	}
+}
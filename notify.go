@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Change event actions, in addition to the audit actions register, allocate
+// and reassign.
+const (
+	changeActionDelete  = "delete"
+	changeActionResize  = "resize"
+	changeActionApprove = "approve"
+	changeActionReject  = "reject"
+	changeActionExpire  = "expire"
+	changeActionUpdate  = "update"
+)
+
+const (
+	webhookSignatureHeader = "X-Cidrfinder-Signature"
+	defaultWebhookRetries  = 3
+	webhookBackoff         = 500 * time.Millisecond
+	webhookTimeout         = 5 * time.Second
+	// notifyTimeout bounds a delivery, retries included.
+	notifyTimeout = 30 * time.Second
+)
+
+// ChangeEvent describes a successful write to the registry. OldKey is set
+// for a reassign and OldCIDR for a resize.
+type ChangeEvent struct {
+	Action  string      `json:"action"`
+	Key     string      `json:"key"`
+	CIDR    string      `json:"cidr"`
+	OldKey  string      `json:"oldKey,omitempty"`
+	OldCIDR string      `json:"oldCidr,omitempty"`
+	Record  *CIDRRecord `json:"record,omitempty"`
+	At      string      `json:"at"`
+}
+
+// notifier delivers change events to an outbound sink such as a webhook. A
+// new sink only needs to implement Notify and be returned by loadNotifier.
+type notifier interface {
+	Notify(ctx context.Context, event ChangeEvent) error
+}
+
+// loadNotifier returns the notifier configured by WEBHOOK_URL,
+// WEBHOOK_SECRET and WEBHOOK_RETRIES, or nil when WEBHOOK_URL is unset.
+func loadNotifier() (notifier, error) {
+	target := os.Getenv("WEBHOOK_URL")
+	if target == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("WEBHOOK_URL must be an http or https URL, got %q", target)
+	}
+
+	retries := defaultWebhookRetries
+	if value := os.Getenv("WEBHOOK_RETRIES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("WEBHOOK_RETRIES must be a non-negative integer, got %q", value)
+		}
+		retries = n
+	}
+
+	return &webhookNotifier{
+		url:     target,
+		secret:  []byte(os.Getenv("WEBHOOK_SECRET")),
+		retries: retries,
+		backoff: webhookBackoff,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+// webhookNotifier POSTs each event as JSON. With a secret, the body is signed
+// with HMAC-SHA256 in the X-Cidrfinder-Signature header as sha256=<hex>.
+// Network errors, 429 and 5xx responses are retried with exponential backoff.
+type webhookNotifier struct {
+	url     string
+	secret  []byte
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, event ChangeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal change event: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(n.backoff << attempt):
+		}
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying.
+func (n *webhookNotifier) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// notify delivers event in the background so the request that made the
+// change does not wait for the sink. Failures are logged. Every change passes
+// through here, so it also stamps the change marker that dates listings.
+func (c *CIDRService) notify(ctx context.Context, event ChangeEvent) {
+	c.markChanged(ctx)
+	if c.notifier == nil {
+		return
+	}
+	event.At = time.Now().UTC().Format(time.RFC3339)
+
+	// Keep the request ID for logging, but not the request's cancellation.
+	ctx = context.WithoutCancel(ctx)
+	c.notifications.Add(1)
+	go func() {
+		defer c.notifications.Done()
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		defer cancel()
+		if err := c.notifier.Notify(ctx, event); err != nil {
+			logf(ctx, "failed to deliver %s event for '%s': %v", event.Action, event.Key, err)
+		}
+	}()
+}
+
+// notifyRecord is notify for an event about a single record.
+func (c *CIDRService) notifyRecord(ctx context.Context, action string, record CIDRRecord) {
+	c.notify(ctx, ChangeEvent{Action: action, Key: record.Key, CIDR: record.CIDR, Record: &record})
+}
+
+// waitNotifications blocks until the events already handed to notify have
+// been delivered or have failed.
+func (c *CIDRService) waitNotifications() {
+	c.notifications.Wait()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Where an allocation came from when OVERFLOW_CIDR is set, written to the
+// allocationSourceTag of the record and the source of the response.
+const (
+	allocationSourcePrimary  = "primary"
+	allocationSourceOverflow = "overflow"
+)
+
+// allocationSourceTag is the tag that records whether a block was allocated
+// from BASE_CIDR or from OVERFLOW_CIDR.
+const allocationSourceTag = "allocationSource"
+
+// parseOverflowCIDR reads OVERFLOW_CIDR, an IPv4 supernet outside BASE_CIDR
+// that allocations from the default base continue in once it is full. It
+// must hold an ALLOCATION_PREFIX block. Empty disables overflow.
+func parseOverflowCIDR(value, baseCIDR string, allocationPrefix int) (*net.IPNet, error) {
+	if value == "" {
+		return nil, nil
+	}
+	_, overflow, err := parseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("OVERFLOW_CIDR %q is not a valid CIDR: %w", value, err)
+	}
+	if overflow.IP.To4() == nil {
+		return nil, fmt.Errorf("OVERFLOW_CIDR %q must be an IPv4 network", value)
+	}
+	if _, base, err := parseCIDR(baseCIDR); err == nil && netsOverlap(base, overflow) {
+		return nil, fmt.Errorf("OVERFLOW_CIDR %s must not overlap BASE_CIDR %s", overflow, base)
+	}
+	if overflowPrefix, _ := overflow.Mask.Size(); allocationPrefix < overflowPrefix {
+		return nil, fmt.Errorf("OVERFLOW_CIDR %s cannot hold an ALLOCATION_PREFIX /%d block", overflow, allocationPrefix)
+	}
+	return overflow, nil
+}
+
+// overflows reports whether an allocation of prefix from base may continue
+// in OVERFLOW_CIDR: only allocations from the whole default base outside any
+// pool do, and only with a prefix the overflow can hold.
+func (c *CIDRService) overflows(base *net.IPNet, prefix int, opts AllocationOptions) bool {
+	if c.overflow == nil || opts.Pool != "" || base.String() != c.permittedBases()[0].String() {
+		return false
+	}
+	overflowPrefix, _ := c.overflow.Mask.Size()
+	return prefix >= overflowPrefix
+}
+
+// nextOverflow is nextFree in OVERFLOW_CIDR, returning the networks used
+// there for the headroom check.
+func (c *CIDRService) nextOverflow(ctx context.Context, prefix int, released []*net.IPNet, opts AllocationOptions) (*net.IPNet, []*net.IPNet, bool, error) {
+	used, err := c.usedNetworks(ctx, c.overflow, opts)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	next, ok := c.nextFree(c.overflow, prefix, used, released, opts)
+	return next, used, ok, nil
+}
+
+// allocationSource says whether cidr, allocated with opts, came from
+// BASE_CIDR or from OVERFLOW_CIDR. It is "" when no overflow is configured
+// and for blocks of a pool or of another permitted base, which never
+// overflow.
+func (c *CIDRService) allocationSource(opts AllocationOptions, cidr string) string {
+	if c.overflow == nil || opts.Pool != "" {
+		return ""
+	}
+	_, network, err := parseCIDR(cidr)
+	switch {
+	case err != nil:
+		return ""
+	case netContains(c.overflow, network):
+		return allocationSourceOverflow
+	case netContains(c.permittedBases()[0], network):
+		return allocationSourcePrimary
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parent requirements of a registration, from REQUIRE_PARENT or the
+// requireParent query parameter: none, a reserved record containing the
+// block, or one that also belongs to the registration's tenant.
+const (
+	requireParentNone  = "false"
+	requireParentAny   = "true"
+	requireParentOwner = "owner"
+)
+
+func parseRequireParent(name, value string) (string, error) {
+	switch value {
+	case "", requireParentNone:
+		return requireParentNone, nil
+	case requireParentAny, requireParentOwner:
+		return value, nil
+	}
+	return "", fmt.Errorf("%s must be %q, %q or %q, got %q", name, requireParentNone, requireParentAny, requireParentOwner, value)
+}
+
+// stricterParentRequirement returns the stricter of two requirements, so a
+// request can tighten REQUIRE_PARENT but never relax it.
+func stricterParentRequirement(a, b string) string {
+	rank := map[string]int{requireParentNone: 0, requireParentAny: 1, requireParentOwner: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// RegistrationOptions are the per-request settings of a registration.
+type RegistrationOptions struct {
+	// RequireParent is requireParentAny or requireParentOwner to refuse a
+	// block no reserved record contains.
+	RequireParent string
+}
+
+// checkParent enforces a parent requirement: some reserved record must
+// strictly contain the candidate and, for requireParentOwner, share its
+// tenant. The error names the containing blocks that were rejected, if any.
+func checkParent(records []CIDRRecord, candidate CIDRRecord, requirement string) error {
+	if requirement == "" || requirement == requireParentNone {
+		return nil
+	}
+	_, network, err := parseCIDR(candidate.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR format: %w", err)
+	}
+	prefix, _ := network.Mask.Size()
+
+	var rejected []string
+	for _, record := range records {
+		_, parent, err := parseCIDR(record.CIDR)
+		if err != nil {
+			continue
+		}
+		parentPrefix, bits := parent.Mask.Size()
+		if bits != len(network.IP)*8 || parentPrefix >= prefix || !parent.Contains(network.IP) {
+			continue
+		}
+		switch {
+		case !record.Reserved:
+			rejected = append(rejected, fmt.Sprintf("%s (%s) is not reserved", record.Key, record.CIDR))
+		case requirement == requireParentOwner && record.Tenant != candidate.Tenant:
+			rejected = append(rejected, fmt.Sprintf("%s (%s) belongs to tenant '%s'", record.Key, record.CIDR, record.Tenant))
+		default:
+			return nil
+		}
+	}
+
+	owner := "reserved parent block"
+	if requirement == requireParentOwner {
+		owner = fmt.Sprintf("reserved parent block of tenant '%s'", candidate.Tenant)
+	}
+	if len(rejected) == 0 {
+		return fmt.Errorf("CIDR '%s' requires a %s, but no record contains it", candidate.CIDR, owner)
+	}
+	return fmt.Errorf("CIDR '%s' requires a %s: %s", candidate.CIDR, owner, strings.Join(rejected, ", "))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// With TABLE_LAYOUT=partitioned the table is keyed by (partition, cidr)
+// instead of key. Every record overlapping a permitted base shares that base's
+// partition so allocation can Query it; everything else lands in
+// externalPartition. A global secondary index on key serves key lookups.
+const (
+	tableLayoutKey         = "key"
+	tableLayoutPartitioned = "partitioned"
+
+	defaultKeyIndexName = "key-index"
+	externalPartition   = "external"
+
+	batchWriteLimit = 25
+	// maxBatchWriteAttempts bounds how often a chunk with unprocessed items
+	// is resubmitted before the write gives up.
+	maxBatchWriteAttempts = 8
+)
+
+func (c *CIDRService) partitionFor(network *net.IPNet) string {
+	for _, base := range c.permittedBases() {
+		if netsOverlap(base, network) {
+			return base.String()
+		}
+	}
+	return externalPartition
+}
+
+// GetCIDRsInBase returns the records that may overlap the given permitted
+// base. For partitioned tables this is a Query on the base's partition;
+// otherwise it falls back to a full scan.
+func (c *CIDRService) GetCIDRsInBase(ctx context.Context, base *net.IPNet) ([]CIDRRecord, error) {
+	if !c.partitioned {
+		return c.GetAllCIDRs(ctx)
+	}
+	return c.queryPartition(ctx, base.String(), false)
+}
+
+// queryPartition reads every record of a partition. A consistent query
+// reflects every write that succeeded before it started.
+func (c *CIDRService) queryPartition(ctx context.Context, partition string, consistent bool) ([]CIDRRecord, error) {
+	paginator := dynamodb.NewQueryPaginator(c.client(ctx), &dynamodb.QueryInput{
+		TableName:              aws.String(c.table(ctx)),
+		KeyConditionExpression: aws.String("#p = :p"),
+		ConsistentRead:         aws.Bool(consistent),
+		ExpressionAttributeNames: map[string]string{
+			"#p": "partition",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":p": &types.AttributeValueMemberS{Value: partition},
+		},
+	})
+
+	var records []CIDRRecord
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query DynamoDB partition: %w", err)
+		}
+
+		var pageRecords []CIDRRecord
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageRecords); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal DynamoDB items: %w", err)
+		}
+		records = append(records, pageRecords...)
+	}
+
+	return records, nil
+}
+
+// primaryKeyFor returns the DynamoDB primary key of the record stored under
+// key, or nil if there is none. Partitioned tables resolve it through the
+// key index.
+func (c *CIDRService) primaryKeyFor(ctx context.Context, client dynamoReader, key string) (map[string]types.AttributeValue, error) {
+	if !c.partitioned {
+		return map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: key},
+		}, nil
+	}
+
+	result, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(c.table(ctx)),
+		IndexName:              aws.String(c.keyIndexName),
+		KeyConditionExpression: aws.String("#k = :k"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": "key",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key index: %w", err)
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+
+	item := result.Items[0]
+	return map[string]types.AttributeValue{
+		"partition": item["partition"],
+		"cidr":      item["cidr"],
+	}, nil
+}
+
+// itemKey returns the DynamoDB primary key of a record read from the table.
+func (c *CIDRService) itemKey(record CIDRRecord) map[string]types.AttributeValue {
+	if !c.partitioned {
+		return map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: record.Key},
+		}
+	}
+	return map[string]types.AttributeValue{
+		"partition": &types.AttributeValueMemberS{Value: record.Partition},
+		"cidr":      &types.AttributeValueMemberS{Value: record.CIDR},
+	}
+}
+
+// MigrateToPartitioned copies every item of a key-keyed source table into
+// the service's partitioned table, adding the partition attribute. The source
+// table is left untouched. It returns the number of records copied.
+func (c *CIDRService) MigrateToPartitioned(ctx context.Context, sourceTable string) (int, error) {
+	if !c.partitioned {
+		return 0, fmt.Errorf("TABLE_LAYOUT must be %q to migrate", tableLayoutPartitioned)
+	}
+
+	paginator := dynamodb.NewScanPaginator(c.dynamoClient, &dynamodb.ScanInput{
+		TableName: aws.String(sourceTable),
+	})
+
+	var requests []types.WriteRequest
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan source table: %w", err)
+		}
+
+		for _, item := range page.Items {
+			// The target table keeps a change marker of its own.
+			if _, ok := item[changeMarkerAttribute]; ok {
+				continue
+			}
+			var record CIDRRecord
+			if err := attributevalue.UnmarshalMap(item, &record); err != nil {
+				return 0, fmt.Errorf("failed to unmarshal DynamoDB item: %w", err)
+			}
+
+			_, network, err := parseCIDR(record.CIDR)
+			if err != nil {
+				return 0, fmt.Errorf("record '%s' has invalid CIDR '%s': %w", record.Key, record.CIDR, err)
+			}
+			item["partition"] = &types.AttributeValueMemberS{Value: c.partitionFor(network)}
+
+			requests = append(requests, types.WriteRequest{
+				PutRequest: &types.PutRequest{Item: item},
+			})
+		}
+	}
+
+	if err := c.batchWrite(ctx, requests); err != nil {
+		return 0, err
+	}
+
+	return len(requests), nil
+}
+
+// batchWrite sends requests in BatchWriteItem-sized chunks, resubmitting any
+// unprocessed items with a growing delay, up to maxBatchWriteAttempts times.
+func (c *CIDRService) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	return c.batchWriteWith(ctx, c.client(ctx), c.table(ctx), requests)
+}
+
+// batchWriteTo is batchWrite for a table other than the registry.
+func (c *CIDRService) batchWriteTo(ctx context.Context, tableName string, requests []types.WriteRequest) error {
+	return c.batchWriteWith(ctx, c.dynamoClient, tableName, requests)
+}
+
+func (c *CIDRService) batchWriteWith(ctx context.Context, client *dynamodb.Client, tableName string, requests []types.WriteRequest) error {
+	for start := 0; start < len(requests); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		pending := map[string][]types.WriteRequest{tableName: requests[start:end]}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt >= maxBatchWriteAttempts {
+				return fmt.Errorf("failed to batch write items: %s still unprocessed after %d attempts",
+					strings.Join(writeRequestKeys(pending[tableName]), ", "), attempt)
+			}
+			if attempt > 0 {
+				if err := sleepContext(ctx, time.Duration(attempt)*100*time.Millisecond); err != nil {
+					return fmt.Errorf("failed to batch write items: %w", err)
+				}
+			}
+			result, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to batch write items: %w", err)
+			}
+			pending = result.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+// writeRequestKeys names the items of requests by their record key, or by
+// CIDR when a partitioned delete carries no key.
+func writeRequestKeys(requests []types.WriteRequest) []string {
+	names := make([]string, 0, len(requests))
+	for _, request := range requests {
+		item := map[string]types.AttributeValue{}
+		switch {
+		case request.PutRequest != nil:
+			item = request.PutRequest.Item
+		case request.DeleteRequest != nil:
+			item = request.DeleteRequest.Key
+		}
+		if key, ok := item["key"].(*types.AttributeValueMemberS); ok {
+			names = append(names, key.Value)
+		} else if cidr, ok := item["cidr"].(*types.AttributeValueMemberS); ok {
+			names = append(names, cidr.Value)
+		}
+	}
+	return names
+}
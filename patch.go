@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// contentTypeMergePatch is the media type of RFC 7386 JSON Merge Patch
+// documents, the only body PATCH accepts.
+const contentTypeMergePatch = "application/merge-patch+json"
+
+// errInvalidMergePatch marks a PATCH body that is not a usable merge patch,
+// as opposed to a well-formed patch the record's rules refuse.
+var errInvalidMergePatch = errors.New("invalid merge patch")
+
+// patchableFields are the record fields a merge patch may change.
+var patchableFields = map[string]bool{"description": true, "cidr": true, "tags": true}
+
+// checkPatchContentType accepts only merge patch bodies.
+func checkPatchContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != contentTypeMergePatch {
+		return fmt.Errorf("PATCH requires Content-Type %s", contentTypeMergePatch)
+	}
+	return nil
+}
+
+// mergePatch applies patch to target as RFC 7386 describes: members of an
+// object patch replace the target's, null members delete them, members the
+// patch leaves out are kept, and a patch that is not an object replaces the
+// target as a whole.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	merged := make(map[string]interface{}, len(targetObject))
+	for name, value := range targetObject {
+		merged[name] = value
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = mergePatch(merged[name], value)
+	}
+	return merged
+}
+
+// applyRecordPatch merges patch into record and returns the result. Only the
+// patchable fields may change: the key, in particular, is fixed, and the
+// CIDR may be replaced but not removed.
+func applyRecordPatch(record CIDRRecord, patch []byte) (CIDRRecord, error) {
+	var patchDoc interface{}
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return CIDRRecord{}, fmt.Errorf("%w: %v", errInvalidMergePatch, err)
+	}
+	if _, ok := patchDoc.(map[string]interface{}); !ok {
+		return CIDRRecord{}, fmt.Errorf("%w: must be a JSON object", errInvalidMergePatch)
+	}
+
+	// Age is computed for responses and never stored, so it is not part
+	// of the document being patched.
+	record.AgeSeconds = nil
+	current, err := recordDocument(record)
+	if err != nil {
+		return CIDRRecord{}, err
+	}
+	merged := mergePatch(current, patchDoc).(map[string]interface{})
+
+	var changed []string
+	for name := range merged {
+		if !reflect.DeepEqual(merged[name], current[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range current {
+		if _, ok := merged[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		switch {
+		case name == "key":
+			return CIDRRecord{}, fmt.Errorf("key cannot be changed; use POST /reassign")
+		case name == "cidr" && merged[name] == nil:
+			return CIDRRecord{}, fmt.Errorf("cidr cannot be removed")
+		case !patchableFields[name]:
+			return CIDRRecord{}, fmt.Errorf("%s cannot be changed by PATCH; only description, cidr and tags can", name)
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return CIDRRecord{}, err
+	}
+	var patched CIDRRecord
+	if err := json.Unmarshal(data, &patched); err != nil {
+		return CIDRRecord{}, fmt.Errorf("%w: %v", errInvalidMergePatch, err)
+	}
+	patched.Partition = record.Partition
+	return patched, nil
+}
+
+// recordDocument is record as the generic JSON object a merge patch is
+// applied to.
+func recordDocument(record CIDRRecord) (map[string]interface{}, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return document, nil
+}
+
+// PatchRecord applies a JSON Merge Patch to the record stored under key and
+// returns the merged record. A new CIDR is validated like a registration,
+// including the overlap check against every other record. The write is
+// conditional on the record still holding its old CIDR.
+func (c *CIDRService) PatchRecord(ctx context.Context, key string, patch []byte) (*CIDRRecord, error) {
+	record, err := c.GetRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := applyRecordPatch(*record, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validateDescription(patched.Description); err != nil {
+		return nil, err
+	}
+	// Records registered before REQUIRED_TAGS or ALLOWED_TAG_KEYS was set
+	// stay patchable until their tags are touched.
+	if !reflect.DeepEqual(patched.Tags, record.Tags) {
+		if err := c.checkTags(patched, record.Tags); err != nil {
+			return nil, err
+		}
+		if err := c.validatePoolTags(patched); err != nil {
+			return nil, err
+		}
+	}
+
+	patched.CIDR = unmapCIDR(patched.CIDR)
+	if patched.CIDR != record.CIDR {
+		if err := c.validateCIDR(patched.CIDR); err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %w", err)
+		}
+		if err := c.validatePoolMembership(patched); err != nil {
+			return nil, err
+		}
+		if err := checkForbidden(c.forbidden, patched.CIDR); err != nil {
+			return nil, err
+		}
+
+		records, err := c.GetAllCIDRs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check existing records: %w", err)
+		}
+		var others []CIDRRecord
+		for _, other := range withoutExpired(records, time.Now()) {
+			if other.Key != key {
+				others = append(others, other)
+			}
+		}
+		if err := checkScopedUniqueness(others, patched, c.uniquenessScope); err != nil {
+			return nil, err
+		}
+	}
+
+	patched.UpdatedAt = time.Now().Unix()
+	if err := c.storePatched(ctx, *record, patched); err != nil {
+		return nil, err
+	}
+	c.notify(ctx, ChangeEvent{Action: changeActionUpdate, Key: key, CIDR: patched.CIDR, OldCIDR: record.CIDR, Record: &patched})
+	return &patched, nil
+}
+
+// storePatched replaces old with updated. Partitioned tables key items by
+// CIDR, so a CIDR change there moves the item as a resize does. With
+// AUDIT_TABLE_NAME set, an update entry is written in the same transaction.
+func (c *CIDRService) storePatched(ctx context.Context, old, updated CIDRRecord) error {
+	if c.auditTableName != "" {
+		return c.storePatchedWithAudit(ctx, old, updated)
+	}
+	if c.partitioned && updated.CIDR != old.CIDR {
+		return c.replaceCIDR(ctx, old, updated)
+	}
+
+	item, err := attributevalue.MarshalMap(updated)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	_, err = c.client(ctx).PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(c.table(ctx)),
+		Item:                item,
+		ConditionExpression: aws.String("#k = :k AND #c = :old"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": "key",
+			"#c": "cidr",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k":   &types.AttributeValueMemberS{Value: old.Key},
+			":old": &types.AttributeValueMemberS{Value: old.CIDR},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("key '%s' was changed concurrently", old.Key)
+		}
+		return fmt.Errorf("failed to put item in DynamoDB: %w", err)
+	}
+	return nil
+}
+
+// storePatchedWithAudit is storePatched as one transaction with the update's
+// audit entry, so neither is stored without the other.
+func (c *CIDRService) storePatchedWithAudit(ctx context.Context, old, updated CIDRRecord) error {
+	var items []types.TransactWriteItem
+	if c.partitioned && updated.CIDR != old.CIDR {
+		moved, err := c.moveItems(ctx, old, updated)
+		if err != nil {
+			return err
+		}
+		items = moved
+	} else {
+		item, err := attributevalue.MarshalMap(updated)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:           aws.String(c.table(ctx)),
+				Item:                item,
+				ConditionExpression: aws.String("#k = :k AND #c = :old"),
+				ExpressionAttributeNames: map[string]string{
+					"#k": "key",
+					"#c": "cidr",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":k":   &types.AttributeValueMemberS{Value: old.Key},
+					":old": &types.AttributeValueMemberS{Value: old.CIDR},
+				},
+			},
+		})
+	}
+
+	audit, err := c.auditPut(newAuditEntry(auditActionUpdate, updated, time.Now()))
+	if err != nil {
+		return err
+	}
+	_, err = c.client(ctx).TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: append(items, audit),
+	})
+	if err != nil {
+		if transactionConditionFailed(err) {
+			return fmt.Errorf("key '%s' was changed concurrently", old.Key)
+		}
+		return fmt.Errorf("failed to write record and audit entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+const (
+	conflictInvalidCIDR     = "invalid_cidr"
+	conflictDuplicateKey    = "duplicate_key"
+	conflictKeyExists       = "key_exists"
+	conflictOverlapProposed = "overlap_proposed"
+	conflictOverlapExisting = "overlap_existing"
+)
+
+type PlannedAllocation struct {
+	Key  string `json:"key"`
+	CIDR string `json:"cidr"`
+}
+
+// PlanConflict explains why a proposed allocation cannot be created. With
+// names the proposed or existing allocation it collides with, if any.
+type PlanConflict struct {
+	Type    string             `json:"type"`
+	Key     string             `json:"key"`
+	CIDR    string             `json:"cidr"`
+	With    *PlannedAllocation `json:"with,omitempty"`
+	Message string             `json:"message"`
+}
+
+type PlanResult struct {
+	Valid     bool                `json:"valid"`
+	Create    []PlannedAllocation `json:"create"`
+	Conflicts []PlanConflict      `json:"conflicts"`
+}
+
+// PlanAllocations checks a set of proposed allocations against each other and
+// the registered records without writing anything.
+func (c *CIDRService) PlanAllocations(ctx context.Context, allocations []PlannedAllocation) (*PlanResult, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	return planAllocations(records, allocations), nil
+}
+
+func planAllocations(records []CIDRRecord, allocations []PlannedAllocation) *PlanResult {
+	result := &PlanResult{
+		Create:    []PlannedAllocation{},
+		Conflicts: []PlanConflict{},
+	}
+
+	type parsedRecord struct {
+		PlannedAllocation
+		network *net.IPNet
+	}
+
+	var existing []parsedRecord
+	existingKeys := make(map[string]bool)
+	for _, record := range records {
+		existingKeys[record.Key] = true
+		if _, network, err := parseCIDR(record.CIDR); err == nil {
+			existing = append(existing, parsedRecord{PlannedAllocation{record.Key, record.CIDR}, network})
+		}
+	}
+
+	// Entries are checked in order, so of two colliding entries only the
+	// later one is reported and the earlier one is still planned.
+	proposalKeys := make(map[string]bool)
+	var proposed []parsedRecord
+	for _, allocation := range allocations {
+		conflicts := len(result.Conflicts)
+		addConflict := func(conflictType string, with *PlannedAllocation, message string) {
+			result.Conflicts = append(result.Conflicts, PlanConflict{
+				Type:    conflictType,
+				Key:     allocation.Key,
+				CIDR:    allocation.CIDR,
+				With:    with,
+				Message: message,
+			})
+		}
+
+		if proposalKeys[allocation.Key] {
+			addConflict(conflictDuplicateKey, nil,
+				fmt.Sprintf("key '%s' appears earlier in the plan", allocation.Key))
+		}
+		proposalKeys[allocation.Key] = true
+		if existingKeys[allocation.Key] {
+			addConflict(conflictKeyExists, nil, fmt.Sprintf("key '%s' already exists", allocation.Key))
+		}
+
+		_, network, err := parseCIDR(allocation.CIDR)
+		if err != nil {
+			addConflict(conflictInvalidCIDR, nil, fmt.Sprintf("invalid CIDR format: %v", err))
+			continue
+		}
+
+		for _, other := range proposed {
+			if netsOverlap(network, other.network) {
+				with := other.PlannedAllocation
+				addConflict(conflictOverlapProposed, &with,
+					fmt.Sprintf("overlaps proposed allocation '%s' (%s)", other.Key, other.CIDR))
+			}
+		}
+		for _, record := range existing {
+			if netsOverlap(network, record.network) {
+				with := record.PlannedAllocation
+				addConflict(conflictOverlapExisting, &with,
+					fmt.Sprintf("overlaps existing allocation '%s' (%s)", record.Key, record.CIDR))
+			}
+		}
+
+		proposed = append(proposed, parsedRecord{allocation, network})
+		if len(result.Conflicts) == conflicts {
+			result.Create = append(result.Create, allocation)
+		}
+	}
+
+	result.Valid = len(result.Conflicts) == 0
+	return result
+}
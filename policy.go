@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultPolicy is compiled into the binary, so a Lambda deployment can ship
+// its pool policy without packaging a separate file. Edit policy.json and
+// rebuild to change it.
+//
+//go:embed policy.json
+var defaultPolicy []byte
+
+// poolPolicy is how a pool is described in a policy document, which maps pool
+// names to their rules.
+type poolPolicy struct {
+	Base           string   `json:"base"`
+	Prefix         int      `json:"prefix,omitempty"`
+	Excluded       []string `json:"excluded,omitempty"`
+	MinPrefix      int      `json:"minPrefix,omitempty"`
+	MaxPrefix      int      `json:"maxPrefix,omitempty"`
+	RequiredPrefix int      `json:"requiredPrefix,omitempty"`
+	// Tags is the pool's placement policy.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// loadPools returns the pools from POLICY_FILE if set, otherwise from POOLS,
+// otherwise from the embedded default policy.
+func loadPools(policyFile, poolsEnv string) ([]Pool, error) {
+	if policyFile != "" {
+		if poolsEnv != "" {
+			return nil, fmt.Errorf("set either POLICY_FILE or POOLS, not both")
+		}
+		data, err := os.ReadFile(policyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read POLICY_FILE: %w", err)
+		}
+		pools, err := parsePolicy(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid POLICY_FILE %s: %w", policyFile, err)
+		}
+		return pools, nil
+	}
+
+	if poolsEnv != "" {
+		return parsePools(poolsEnv)
+	}
+
+	pools, err := parsePolicy(defaultPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded policy.json: %w", err)
+	}
+	return pools, nil
+}
+
+// parsePolicy decodes and validates a policy document. Pools are returned
+// sorted by name.
+func parsePolicy(data []byte) ([]Pool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var policies map[string]poolPolicy
+	if err := decoder.Decode(&policies); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+
+	var pools []Pool
+	for name, policy := range policies {
+		pool, err := policy.pool(name)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+
+	return pools, nil
+}
+
+// pool validates the policy and converts it to a Pool.
+func (p poolPolicy) pool(name string) (Pool, error) {
+	if name == "" {
+		return Pool{}, fmt.Errorf("pool names must not be empty")
+	}
+	if p.Base == "" {
+		return Pool{}, fmt.Errorf("pool %q: base is required", name)
+	}
+	_, base, err := parseCIDR(p.Base)
+	if err != nil {
+		return Pool{}, fmt.Errorf("pool %q: invalid base: %w", name, err)
+	}
+
+	basePrefix, bits := base.Mask.Size()
+	for _, field := range []struct {
+		name   string
+		prefix int
+	}{
+		{"prefix", p.Prefix},
+		{"minPrefix", p.MinPrefix},
+		{"maxPrefix", p.MaxPrefix},
+		{"requiredPrefix", p.RequiredPrefix},
+	} {
+		if field.prefix != 0 && (field.prefix < basePrefix || field.prefix > bits) {
+			return Pool{}, fmt.Errorf("pool %q: %s must be between /%d and /%d, got /%d",
+				name, field.name, basePrefix, bits, field.prefix)
+		}
+	}
+	if p.MinPrefix != 0 && p.MaxPrefix != 0 && p.MinPrefix > p.MaxPrefix {
+		return Pool{}, fmt.Errorf("pool %q: minPrefix /%d is longer than maxPrefix /%d", name, p.MinPrefix, p.MaxPrefix)
+	}
+
+	pool := Pool{
+		Name:           name,
+		Base:           base,
+		RequiredPrefix: p.RequiredPrefix,
+		DefaultPrefix:  p.Prefix,
+		MinPrefix:      p.MinPrefix,
+		MaxPrefix:      p.MaxPrefix,
+	}
+	for key := range p.Tags {
+		if strings.TrimSpace(key) == "" {
+			return Pool{}, fmt.Errorf("pool %q: tags must not have empty keys", name)
+		}
+	}
+	if len(p.Tags) > 0 {
+		pool.Tags = Tags(p.Tags)
+	}
+	for _, prefix := range []int{p.RequiredPrefix, p.Prefix} {
+		if prefix == 0 {
+			continue
+		}
+		if err := pool.checkPrefix(prefix); err != nil {
+			return Pool{}, err
+		}
+	}
+
+	for _, value := range p.Excluded {
+		_, excluded, err := parseCIDR(value)
+		if err != nil {
+			return Pool{}, fmt.Errorf("pool %q: invalid excluded range: %w", name, err)
+		}
+		if !netContains(base, excluded) {
+			return Pool{}, fmt.Errorf("pool %q: excluded range %s is outside the pool's base %s", name, excluded, base)
+		}
+		pool.Excluded = append(pool.Excluded, excluded)
+	}
+
+	return pool, nil
+}
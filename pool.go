@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pool is a named range that records can be registered into and allocated
+// from. Zero prefix fields impose no rule.
+type Pool struct {
+	Name string
+	Base *net.IPNet
+	// RequiredPrefix is the block size every record in the pool must have.
+	RequiredPrefix int
+	// DefaultPrefix is allocated when a request names no prefix.
+	DefaultPrefix int
+	// MinPrefix and MaxPrefix bound the block sizes the pool accepts.
+	MinPrefix int
+	MaxPrefix int
+	// Excluded ranges are never allocated or registered within the pool.
+	Excluded []*net.IPNet
+	// Tags are the placement policy: every record in the pool must carry
+	// them, and allocations carrying them are placed in the pool.
+	Tags Tags
+}
+
+// parsePools parses POOLS, a comma-separated list of name=base[:prefix]
+// entries such as "prod=10.16.0.0/12:20,dev=10.32.0.0/12:24".
+func parsePools(value string) ([]Pool, error) {
+	var pools []Pool
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		name, spec, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid POOLS entry %q: want name=base[:prefix]", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("pool %q is defined more than once in POOLS", name)
+		}
+		seen[name] = true
+
+		baseValue, prefixValue, hasPrefix := strings.Cut(spec, ":")
+		_, base, err := parseCIDR(baseValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base for pool %q: %w", name, err)
+		}
+
+		pool := Pool{Name: name, Base: base}
+		if hasPrefix {
+			pool.RequiredPrefix, err = strconv.Atoi(prefixValue)
+			if err != nil {
+				return nil, fmt.Errorf("prefix for pool %q must be an integer, got %q", name, prefixValue)
+			}
+			basePrefix, bits := base.Mask.Size()
+			if pool.RequiredPrefix < basePrefix || pool.RequiredPrefix > bits {
+				return nil, fmt.Errorf("prefix for pool %q must be between /%d and /%d, got /%d",
+					name, basePrefix, bits, pool.RequiredPrefix)
+			}
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// validatePoolLayout checks that every pool lies within one of the permitted
+// bases and that no two pools overlap, since an overlap would let both pools
+// hand out the same space. The error lists every offending pool.
+func validatePoolLayout(pools []Pool, bases []*net.IPNet) error {
+	var problems []string
+
+	var outside []string
+	for _, pool := range pools {
+		within := false
+		for _, base := range bases {
+			if netContains(base, pool.Base) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			outside = append(outside, fmt.Sprintf("%s (%s)", pool.Name, pool.Base))
+		}
+	}
+	if len(outside) > 0 {
+		permitted := make([]string, len(bases))
+		for i, base := range bases {
+			permitted[i] = base.String()
+		}
+		problems = append(problems, fmt.Sprintf("pools outside BASE_CIDR and ALLOWED_BASES (%s): %s",
+			strings.Join(permitted, ", "), strings.Join(outside, ", ")))
+	}
+
+	var overlapping []string
+	for i, a := range pools {
+		for _, b := range pools[i+1:] {
+			if netsOverlap(a.Base, b.Base) {
+				overlapping = append(overlapping, fmt.Sprintf("%s (%s) and %s (%s)", a.Name, a.Base, b.Name, b.Base))
+			}
+		}
+	}
+	if len(overlapping) > 0 {
+		problems = append(problems, "overlapping pools: "+strings.Join(overlapping, ", "))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid pool layout: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkPrefix reports whether the pool accepts blocks of the given prefix.
+func (p Pool) checkPrefix(prefix int) error {
+	if p.RequiredPrefix != 0 && prefix != p.RequiredPrefix {
+		return fmt.Errorf("pool %q requires /%d blocks, got /%d", p.Name, p.RequiredPrefix, prefix)
+	}
+	if p.MinPrefix != 0 && prefix < p.MinPrefix {
+		return fmt.Errorf("pool %q accepts blocks no larger than /%d, got /%d", p.Name, p.MinPrefix, prefix)
+	}
+	if p.MaxPrefix != 0 && prefix > p.MaxPrefix {
+		return fmt.Errorf("pool %q accepts blocks no smaller than /%d, got /%d", p.Name, p.MaxPrefix, prefix)
+	}
+	return nil
+}
+
+func (c *CIDRService) pool(name string) (Pool, error) {
+	for _, pool := range c.pools {
+		if pool.Name == name {
+			return pool, nil
+		}
+	}
+	return Pool{}, fmt.Errorf("unknown pool %q", name)
+}
+
+// validatePoolMembership checks that a record registered into a pool lies
+// within the pool's range, outside its excluded ranges, and has a prefix the
+// pool accepts.
+func (c *CIDRService) validatePoolMembership(record CIDRRecord) error {
+	if record.Pool == "" {
+		return nil
+	}
+
+	pool, err := c.pool(record.Pool)
+	if err != nil {
+		return err
+	}
+
+	_, network, err := parseCIDR(record.CIDR)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR format: %w", err)
+	}
+	if !netContains(pool.Base, network) {
+		return fmt.Errorf("CIDR %s is outside pool %q (%s)", network, pool.Name, pool.Base)
+	}
+	for _, excluded := range pool.Excluded {
+		if netsOverlap(excluded, network) {
+			return fmt.Errorf("CIDR %s overlaps %s, which pool %q excludes", network, excluded, pool.Name)
+		}
+	}
+	prefix, _ := network.Mask.Size()
+	if err := pool.checkPrefix(prefix); err != nil {
+		return err
+	}
+	return pool.checkTags(record.Tags)
+}
+
+// validatePoolTags checks only that a record's tags satisfy its pool's
+// placement policy, for changes that leave its CIDR alone.
+func (c *CIDRService) validatePoolTags(record CIDRRecord) error {
+	if record.Pool == "" {
+		return nil
+	}
+	pool, err := c.pool(record.Pool)
+	if err != nil {
+		return err
+	}
+	return pool.checkTags(record.Tags)
+}
+
+// checkTags refuses tags that do not satisfy the pool's placement policy.
+func (p Pool) checkTags(tags Tags) error {
+	if !p.acceptsTags(tags) {
+		return fmt.Errorf("pool %q only accepts records tagged %s", p.Name, formatPlacementTags(p.Tags))
+	}
+	return nil
+}
+
+// acceptsTags reports whether tags satisfy the pool's placement policy. A
+// pool without one accepts any tags.
+func (p Pool) acceptsTags(tags Tags) bool {
+	for key, value := range p.Tags {
+		if tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// placePool picks the pool an allocation of a record with the given tags is
+// made from. A requested pool must accept the tags. Otherwise the pool whose
+// policy the tags satisfy is chosen, the one naming the most tags if several
+// do. Tags that no policy names leave the allocation unplaced, but tags a
+// policy names that no pool accepts, such as env=staging when only env=prod
+// has a pool, are an error rather than a silent fallback to BASE_CIDR.
+func (c *CIDRService) placePool(requested string, tags Tags) (string, error) {
+	if requested != "" {
+		pool, err := c.pool(requested)
+		if err != nil {
+			return "", err
+		}
+		if !pool.acceptsTags(tags) {
+			return "", fmt.Errorf("pool %q only accepts records tagged %s", pool.Name, formatPlacementTags(pool.Tags))
+		}
+		return requested, nil
+	}
+
+	policed := false
+	var best []string
+	bestTags := 0
+	for _, pool := range c.pools {
+		for key := range pool.Tags {
+			if _, ok := tags[key]; ok {
+				policed = true
+			}
+		}
+		if len(pool.Tags) == 0 || !pool.acceptsTags(tags) {
+			continue
+		}
+		switch {
+		case len(pool.Tags) > bestTags:
+			best, bestTags = []string{pool.Name}, len(pool.Tags)
+		case len(pool.Tags) == bestTags:
+			best = append(best, pool.Name)
+		}
+	}
+
+	switch {
+	case len(best) == 1:
+		return best[0], nil
+	case len(best) > 1:
+		return "", fmt.Errorf("tags %s match the placement policies of pools %s equally; name a pool",
+			formatPlacementTags(tags), strings.Join(best, ", "))
+	case policed:
+		return "", fmt.Errorf("no pool accepts tags %s", formatPlacementTags(tags))
+	}
+	return "", nil
+}
+
+// formatPlacementTags writes tags as sorted key=value pairs for errors.
+func formatPlacementTags(tags Tags) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -6,6 +6,9 @@ const config = new pulumi.Config();
 const functionName = config.get("function-name") || "cidr-finder";
 const tableName = config.get("table-name") || "cidr-registry";
 const lambdaZipPath = config.get("lambda-zip-path") || "../function.zip";
+const enableAwsSync = config.getBoolean("enable-aws-sync") || false;
+const awsSyncTargets = config.get("aws-sync-targets") || "";
+const recycleReleased = config.getBoolean("recycle-released") || false;
 
 // Default tags for all resources
 const defaultTags = {
@@ -23,12 +26,73 @@ const cidrRegistry = new aws.dynamodb.Table("cidr-registry", {
         name: "key",
         type: "S"
     }],
+    ttl: {
+        attributeName: "expiresAt",
+        enabled: true
+    },
     tags: {
         ...defaultTags,
         Name: tableName
     }
 });
 
+// DynamoDB table for the audit log of registrations and allocations
+const cidrAudit = new aws.dynamodb.Table("cidr-audit", {
+    name: `${tableName}-audit`,
+    billingMode: "PAY_PER_REQUEST",
+    hashKey: "key",
+    rangeKey: "at",
+    attributes: [
+        { name: "key", type: "S" },
+        { name: "at", type: "S" },
+        { name: "feed", type: "S" }
+    ],
+    // Orders entries of every key by time for GET /history
+    globalSecondaryIndexes: [{
+        name: "feed-index",
+        hashKey: "feed",
+        rangeKey: "at",
+        projectionType: "ALL"
+    }],
+    tags: {
+        ...defaultTags,
+        Name: `${tableName}-audit`
+    }
+});
+
+// DynamoDB table for deleted blocks that allocation reuses first when
+// recycle-released is set
+const cidrReleased = new aws.dynamodb.Table("cidr-released", {
+    name: `${tableName}-released`,
+    billingMode: "PAY_PER_REQUEST",
+    hashKey: "cidr",
+    attributes: [
+        { name: "cidr", type: "S" }
+    ],
+    tags: {
+        ...defaultTags,
+        Name: `${tableName}-released`
+    }
+});
+
+// DynamoDB table for the leases of POST /lock/acquire
+const cidrLocks = new aws.dynamodb.Table("cidr-locks", {
+    name: `${tableName}-locks`,
+    billingMode: "PAY_PER_REQUEST",
+    hashKey: "name",
+    attributes: [
+        { name: "name", type: "S" }
+    ],
+    ttl: {
+        attributeName: "expiresAt",
+        enabled: true
+    },
+    tags: {
+        ...defaultTags,
+        Name: `${tableName}-locks`
+    }
+});
+
 // IAM role for Lambda
 const lambdaRole = new aws.iam.Role("cidr-lambda-role", {
     name: `${functionName}-role`,
@@ -48,7 +112,7 @@ const lambdaRole = new aws.iam.Role("cidr-lambda-role", {
 // IAM policy for DynamoDB access
 const dynamodbPolicy = new aws.iam.Policy("dynamodb-policy", {
     name: `${functionName}-dynamodb-policy`,
-    policy: pulumi.all([cidrRegistry.arn]).apply(([tableArn]) =>
+    policy: pulumi.all([cidrRegistry.arn, cidrAudit.arn, cidrReleased.arn, cidrLocks.arn]).apply(([tableArn, auditTableArn, releasedTableArn, lockTableArn]) =>
         JSON.stringify({
             Version: "2012-10-17",
             Statement: [{
@@ -59,9 +123,10 @@ const dynamodbPolicy = new aws.iam.Policy("dynamodb-policy", {
                     "dynamodb:UpdateItem",
                     "dynamodb:DeleteItem",
                     "dynamodb:Scan",
-                    "dynamodb:Query"
+                    "dynamodb:Query",
+                    "dynamodb:BatchWriteItem"
                 ],
-                Resource: tableArn
+                Resource: [tableArn, auditTableArn, `${auditTableArn}/index/*`, releasedTableArn, lockTableArn]
             }]
         })
     )
@@ -73,6 +138,31 @@ const lambdaDynamodbPolicyAttachment = new aws.iam.RolePolicyAttachment("lambda-
     policyArn: dynamodbPolicy.arn
 });
 
+// IAM policy for POST /sync-aws and POST /reconcile-aws. Roles named in
+// aws-sync-targets must trust the Lambda role.
+if (enableAwsSync) {
+    const awsSyncPolicy = new aws.iam.Policy("aws-sync-policy", {
+        name: `${functionName}-aws-sync-policy`,
+        policy: JSON.stringify({
+            Version: "2012-10-17",
+            Statement: [{
+                Effect: "Allow",
+                Action: [
+                    "ec2:DescribeVpcs",
+                    "ec2:DescribeSubnets",
+                    "sts:AssumeRole"
+                ],
+                Resource: "*"
+            }]
+        })
+    });
+
+    new aws.iam.RolePolicyAttachment("lambda-aws-sync-policy", {
+        role: lambdaRole.name,
+        policyArn: awsSyncPolicy.arn
+    });
+}
+
 // Attach basic execution role for Lambda
 const lambdaBasicExecutionAttachment = new aws.iam.RolePolicyAttachment("lambda-basic-execution", {
     role: lambdaRole.name,
@@ -90,7 +180,13 @@ const cidrFinderLambda = new aws.lambda.Function("cidr-finder", {
     memorySize: 128,
     environment: {
         variables: {
-            DYNAMODB_TABLE_NAME: cidrRegistry.name
+            DYNAMODB_TABLE_NAME: cidrRegistry.name,
+            AUDIT_TABLE_NAME: cidrAudit.name,
+            SYNC_AWS_ENABLED: String(enableAwsSync),
+            SYNC_AWS_TARGETS: awsSyncTargets,
+            RECYCLE_RELEASED: String(recycleReleased),
+            RELEASED_TABLE_NAME: cidrReleased.name,
+            LOCK_TABLE_NAME: cidrLocks.name
         }
     },
     tags: {
@@ -107,8 +203,8 @@ const cidrApi = new aws.apigatewayv2.Api("cidr-api", {
     protocolType: "HTTP",
     corsConfiguration: {
         allowCredentials: false,
-        allowHeaders: ["content-type", "authorization"],
-        allowMethods: ["GET", "POST", "DELETE", "OPTIONS"],
+        allowHeaders: ["content-type", "authorization", "x-signature", "x-timestamp"],
+        allowMethods: ["GET", "HEAD", "POST", "PATCH", "DELETE", "OPTIONS"],
         allowOrigins: ["*"],
         maxAge: 86400
     },
@@ -139,12 +235,258 @@ const getNextCidrRoute = new aws.apigatewayv2.Route("get-next-cidr", {
     target: pulumi.interpolate`integrations/${cidrIntegration.id}`
 });
 
+const getDescribeCidrRoute = new aws.apigatewayv2.Route("get-describe-cidr", {
+    apiId: cidrApi.id,
+    routeKey: "GET /describe",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
 const postCidrRoute = new aws.apigatewayv2.Route("post-cidr", {
     apiId: cidrApi.id,
     routeKey: "POST /",
     target: pulumi.interpolate`integrations/${cidrIntegration.id}`
 });
 
+const postAllocateRoute = new aws.apigatewayv2.Route("post-allocate", {
+    apiId: cidrApi.id,
+    routeKey: "POST /allocate",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postPlanRoute = new aws.apigatewayv2.Route("post-plan", {
+    apiId: cidrApi.id,
+    routeKey: "POST /plan",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getStatsRoute = new aws.apigatewayv2.Route("get-stats", {
+    apiId: cidrApi.id,
+    routeKey: "GET /stats",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getBackupRoute = new aws.apigatewayv2.Route("get-backup", {
+    apiId: cidrApi.id,
+    routeKey: "GET /backup",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postRestoreRoute = new aws.apigatewayv2.Route("post-restore", {
+    apiId: cidrApi.id,
+    routeKey: "POST /restore",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postResizeRoute = new aws.apigatewayv2.Route("post-resize", {
+    apiId: cidrApi.id,
+    routeKey: "POST /resize",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getCidrRoute = new aws.apigatewayv2.Route("get-cidr", {
+    apiId: cidrApi.id,
+    routeKey: "GET /cidr",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const headCidrRoute = new aws.apigatewayv2.Route("head-cidr", {
+    apiId: cidrApi.id,
+    routeKey: "HEAD /cidr",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const headCidrsRoute = new aws.apigatewayv2.Route("head-cidrs", {
+    apiId: cidrApi.id,
+    routeKey: "HEAD /",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postSyncAwsRoute = new aws.apigatewayv2.Route("post-sync-aws", {
+    apiId: cidrApi.id,
+    routeKey: "POST /sync-aws",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getAdjacentRoute = new aws.apigatewayv2.Route("get-adjacent", {
+    apiId: cidrApi.id,
+    routeKey: "GET /adjacent",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postReassignRoute = new aws.apigatewayv2.Route("post-reassign", {
+    apiId: cidrApi.id,
+    routeKey: "POST /reassign",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getKeysRoute = new aws.apigatewayv2.Route("get-keys", {
+    apiId: cidrApi.id,
+    routeKey: "GET /keys",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postSupernetOfRoute = new aws.apigatewayv2.Route("post-supernet-of", {
+    apiId: cidrApi.id,
+    routeKey: "POST /supernet-of",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postRequestRoute = new aws.apigatewayv2.Route("post-request", {
+    apiId: cidrApi.id,
+    routeKey: "POST /request",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postApproveRoute = new aws.apigatewayv2.Route("post-approve", {
+    apiId: cidrApi.id,
+    routeKey: "POST /approve",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postRejectRoute = new aws.apigatewayv2.Route("post-reject", {
+    apiId: cidrApi.id,
+    routeKey: "POST /reject",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getHistoryRoute = new aws.apigatewayv2.Route("get-history", {
+    apiId: cidrApi.id,
+    routeKey: "GET /history",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getHealthRoute = new aws.apigatewayv2.Route("get-health", {
+    apiId: cidrApi.id,
+    routeKey: "GET /health",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getVersionRoute = new aws.apigatewayv2.Route("get-version", {
+    apiId: cidrApi.id,
+    routeKey: "GET /version",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const patchCidrRoute = new aws.apigatewayv2.Route("patch-cidr", {
+    apiId: cidrApi.id,
+    routeKey: "PATCH /",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getLintRoute = new aws.apigatewayv2.Route("get-lint", {
+    apiId: cidrApi.id,
+    routeKey: "GET /lint",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const fixLintRoute = new aws.apigatewayv2.Route("fix-lint", {
+    apiId: cidrApi.id,
+    routeKey: "POST /lint/fix",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postDeleteBatchRoute = new aws.apigatewayv2.Route("post-delete-batch", {
+    apiId: cidrApi.id,
+    routeKey: "POST /delete-batch",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getCapacityRoute = new aws.apigatewayv2.Route("get-capacity", {
+    apiId: cidrApi.id,
+    routeKey: "GET /capacity",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getWhoamiRoute = new aws.apigatewayv2.Route("get-whoami", {
+    apiId: cidrApi.id,
+    routeKey: "GET /whoami",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getForecastRoute = new aws.apigatewayv2.Route("get-forecast", {
+    apiId: cidrApi.id,
+    routeKey: "GET /forecast",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getFragmentationRoute = new aws.apigatewayv2.Route("get-fragmentation", {
+    apiId: cidrApi.id,
+    routeKey: "GET /fragmentation",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postSweepRoute = new aws.apigatewayv2.Route("post-sweep", {
+    apiId: cidrApi.id,
+    routeKey: "POST /sweep",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getStatusBreakdownRoute = new aws.apigatewayv2.Route("get-status-breakdown", {
+    apiId: cidrApi.id,
+    routeKey: "GET /status-breakdown",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postImportRoute = new aws.apigatewayv2.Route("post-import", {
+    apiId: cidrApi.id,
+    routeKey: "POST /import",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postLockAcquireRoute = new aws.apigatewayv2.Route("post-lock-acquire", {
+    apiId: cidrApi.id,
+    routeKey: "POST /lock/acquire",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postLockHeartbeatRoute = new aws.apigatewayv2.Route("post-lock-heartbeat", {
+    apiId: cidrApi.id,
+    routeKey: "POST /lock/heartbeat",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postLockReleaseRoute = new aws.apigatewayv2.Route("post-lock-release", {
+    apiId: cidrApi.id,
+    routeKey: "POST /lock/release",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getAvailableBlocksRoute = new aws.apigatewayv2.Route("get-available-blocks", {
+    apiId: cidrApi.id,
+    routeKey: "GET /available-blocks",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postReconcileAwsRoute = new aws.apigatewayv2.Route("post-reconcile-aws", {
+    apiId: cidrApi.id,
+    routeKey: "POST /reconcile-aws",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getMetricsAllocationsRoute = new aws.apigatewayv2.Route("get-metrics-allocations", {
+    apiId: cidrApi.id,
+    routeKey: "GET /metrics/allocations",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postDiffRoute = new aws.apigatewayv2.Route("post-diff", {
+    apiId: cidrApi.id,
+    routeKey: "POST /diff",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const postAllocateContiguousRoute = new aws.apigatewayv2.Route("post-allocate-contiguous", {
+    apiId: cidrApi.id,
+    routeKey: "POST /allocate-contiguous",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
+const getTreeRoute = new aws.apigatewayv2.Route("get-tree", {
+    apiId: cidrApi.id,
+    routeKey: "GET /tree",
+    target: pulumi.interpolate`integrations/${cidrIntegration.id}`
+});
+
 const deleteCidrRoute = new aws.apigatewayv2.Route("delete-cidr", {
     apiId: cidrApi.id,
     routeKey: "DELETE /",
@@ -177,3 +519,6 @@ export const lambdaFunctionName = cidrFinderLambda.name;
 export const lambdaFunctionArn = cidrFinderLambda.arn;
 export const dynamodbTableName = cidrRegistry.name;
 export const dynamodbTableArn = cidrRegistry.arn;
+export const auditTableName = cidrAudit.name;
+export const releasedTableName = cidrReleased.name;
+export const lockTableName = cidrLocks.name;
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ReassignCIDR moves the record stored under oldKey to newKey, keeping every
+// other attribute, and returns the moved record. The block is never free in
+// between: the move is a single transaction, conditional on the old record
+// still holding its CIDR and, with the key layout, on newKey being free.
+func (c *CIDRService) ReassignCIDR(ctx context.Context, oldKey, newKey string) (*CIDRRecord, error) {
+	record, err := c.GetRecord(ctx, oldKey)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := c.GetRecord(ctx, newKey)
+	if err == nil {
+		return nil, &DuplicateKeyError{Existing: *existing}
+	}
+	if !errors.Is(err, errRecordNotFound) {
+		return nil, err
+	}
+
+	moved := *record
+	moved.Key = newKey
+	moved.UpdatedAt = time.Now().Unix()
+
+	items, err := c.reassignItems(ctx, *record, moved)
+	if err != nil {
+		return nil, err
+	}
+	if c.auditTableName != "" {
+		audit, err := c.auditPut(newAuditEntry(auditActionReassign, moved, time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, audit)
+	}
+
+	_, err = c.client(ctx).TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		if transactionConditionFailed(err) {
+			return nil, fmt.Errorf("key '%s' or '%s' was changed concurrently", oldKey, newKey)
+		}
+		return nil, fmt.Errorf("failed to reassign item in DynamoDB: %w", err)
+	}
+
+	c.notify(ctx, ChangeEvent{Action: auditActionReassign, Key: newKey, CIDR: moved.CIDR, OldKey: oldKey, Record: &moved})
+	return &moved, nil
+}
+
+// reassignItems returns the transaction items that move old to moved. With
+// the key layout the key is the primary key, so the old item is deleted and
+// the new one put. Partitioned tables key items by CIDR, so the key attribute
+// is updated in place; newKey was checked through the key index beforehand.
+func (c *CIDRService) reassignItems(ctx context.Context, old, moved CIDRRecord) ([]types.TransactWriteItem, error) {
+	if c.partitioned {
+		return []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName:           aws.String(c.table(ctx)),
+					Key:                 c.itemKey(old),
+					UpdateExpression:    aws.String("SET #k = :new, #u = :updated"),
+					ConditionExpression: aws.String("#k = :old"),
+					ExpressionAttributeNames: map[string]string{
+						"#k": "key",
+						"#u": "updatedAt",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":new":     &types.AttributeValueMemberS{Value: moved.Key},
+						":old":     &types.AttributeValueMemberS{Value: old.Key},
+						":updated": &types.AttributeValueMemberN{Value: fmt.Sprint(moved.UpdatedAt)},
+					},
+				},
+			},
+		}, nil
+	}
+
+	item, err := attributevalue.MarshalMap(moved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Delete: &types.Delete{
+				TableName:           aws.String(c.table(ctx)),
+				Key:                 c.itemKey(old),
+				ConditionExpression: aws.String("#c = :c"),
+				ExpressionAttributeNames: map[string]string{
+					"#c": "cidr",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":c": &types.AttributeValueMemberS{Value: old.CIDR},
+				},
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName:           aws.String(c.table(ctx)),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(#k)"),
+				ExpressionAttributeNames: map[string]string{
+					"#k": "key",
+				},
+			},
+		},
+	}, nil
+}
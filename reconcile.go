@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Outcomes of reconciling one stale record. A dry run stops at stale.
+const (
+	reconcileStale   = "stale"
+	reconcileRemoved = "removed"
+	reconcileFailed  = "failed"
+)
+
+// StaleRecord is a record imported by POST /sync-aws whose VPC or subnet is
+// no longer in AWS. Error says why a failed removal failed.
+type StaleRecord struct {
+	Key     string `json:"key"`
+	CIDR    string `json:"cidr"`
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// reconcileScope is a region and account whose VPCs a POST /reconcile-aws
+// run described.
+type reconcileScope struct {
+	Region  string
+	Account string
+}
+
+// ReconcileResult reports a POST /reconcile-aws run. Checked counts the
+// AWS-sourced records in the scanned regions and accounts.
+type ReconcileResult struct {
+	DryRun  bool          `json:"dryRun"`
+	Checked int           `json:"checked"`
+	Removed int           `json:"removed"`
+	Stale   []StaleRecord `json:"stale"`
+}
+
+// ReconcileAWS finds the records POST /sync-aws imported whose blocks are no
+// longer in the SYNC_AWS_TARGETS regions and accounts and, unless dryRun,
+// deletes them with BatchWriteItem in chunks of 25. Every target is described
+// before anything is deleted, so a target that cannot be read fails the run
+// rather than making all of its records look stale.
+func (c *CIDRService) ReconcileAWS(ctx context.Context, dryRun bool) (*ReconcileResult, error) {
+	targets := c.syncTargets
+	if len(targets) == 0 {
+		targets = []syncTarget{{Region: c.awsConfig.Region}}
+	}
+
+	scopes := make(map[reconcileScope]bool, len(targets))
+	var discovered []CIDRRecord
+	for _, target := range targets {
+		records, err := c.discoverVPCs(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe VPCs in %s: %w", target.Region, err)
+		}
+		account, err := c.targetAccount(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to identify the account of %s: %w", target.Region, err)
+		}
+		discovered = append(discovered, records...)
+		scopes[reconcileScope{Region: target.Region, Account: account}] = true
+	}
+
+	existing, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	checked, stale := planReconcile(existing, discovered, scopes)
+	result := &ReconcileResult{DryRun: dryRun, Checked: checked, Stale: make([]StaleRecord, len(stale))}
+	for i, record := range stale {
+		result.Stale[i] = StaleRecord{
+			Key:     record.Key,
+			CIDR:    record.CIDR,
+			Account: record.Account,
+			Region:  record.Region,
+			Status:  reconcileStale,
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	for start := 0; start < len(stale); start += batchWriteLimit {
+		end := min(start+batchWriteLimit, len(stale))
+		requests := make([]types.WriteRequest, 0, end-start)
+		for _, record := range stale[start:end] {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: c.itemKey(record)},
+			})
+		}
+
+		err := c.batchWrite(ctx, requests)
+		for i := start; i < end; i++ {
+			if err != nil {
+				result.Stale[i].Status = reconcileFailed
+				result.Stale[i].Error = err.Error()
+				continue
+			}
+			result.Stale[i].Status = reconcileRemoved
+			result.Removed++
+		}
+		if err == nil {
+			c.release(ctx, stale[start:end])
+		}
+	}
+
+	return result, nil
+}
+
+// planReconcile returns how many records carry the sync source tag in the
+// scanned scopes and which of those have no discovered block with the same
+// key and CIDR, sorted by key. Records from a region and account that were
+// not scanned together, such as a VPC shared from another account, and
+// records registered by hand, are never stale.
+func planReconcile(existing, discovered []CIDRRecord, scopes map[reconcileScope]bool) (checked int, stale []CIDRRecord) {
+	present := make(map[[2]string]bool, len(discovered))
+	for _, record := range discovered {
+		present[[2]string{record.Key, record.CIDR}] = true
+	}
+
+	stale = []CIDRRecord{}
+	for _, record := range existing {
+		if record.Tags[syncSourceTag] != syncSourceAWS || !scopes[reconcileScope{Region: record.Region, Account: record.Account}] {
+			continue
+		}
+		checked++
+		if !present[[2]string{record.Key, record.CIDR}] {
+			stale = append(stale, record)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Key < stale[j].Key })
+	return checked, stale
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ReleasedBlock is a block that was allocated and later deleted. With
+// RECYCLE_RELEASED=true, released blocks are kept in RELEASED_TABLE_NAME,
+// keyed by cidr, so allocation can tell them apart from never-used space.
+type ReleasedBlock struct {
+	CIDR       string `dynamodbav:"cidr"`
+	Key        string `dynamodbav:"key"`
+	ReleasedAt int64  `dynamodbav:"releasedAt"`
+}
+
+// parseReleasedTable returns the table released blocks are kept in, or ""
+// when RECYCLE_RELEASED is off.
+func parseReleasedTable(recycle, tableName string) (string, error) {
+	switch recycle {
+	case "", "false":
+		return "", nil
+	case "true":
+		if tableName == "" {
+			return "", fmt.Errorf("RELEASED_TABLE_NAME is required when RECYCLE_RELEASED=true")
+		}
+		return tableName, nil
+	default:
+		return "", fmt.Errorf("RECYCLE_RELEASED must be true or false, got %q", recycle)
+	}
+}
+
+// recordReleased adds the deleted records' blocks to the released table.
+// Reserved supernets are not recorded, since they were never allocations.
+func (c *CIDRService) recordReleased(ctx context.Context, removed []CIDRRecord, now time.Time) error {
+	var requests []types.WriteRequest
+	for _, record := range removed {
+		if record.Reserved {
+			continue
+		}
+		item, err := attributevalue.MarshalMap(ReleasedBlock{CIDR: record.CIDR, Key: record.Key, ReleasedAt: now.Unix()})
+		if err != nil {
+			return fmt.Errorf("failed to marshal released block: %w", err)
+		}
+		requests = append(requests, types.WriteRequest{
+			PutRequest: &types.PutRequest{Item: item},
+		})
+	}
+	return c.batchWriteTo(ctx, c.releasedTableName, requests)
+}
+
+// releasedNetworks returns the released blocks, oldest release first, or nil
+// when recycling is off.
+func (c *CIDRService) releasedNetworks(ctx context.Context) ([]*net.IPNet, error) {
+	if c.releasedTableName == "" {
+		return nil, nil
+	}
+
+	var released []ReleasedBlock
+	paginator := dynamodb.NewScanPaginator(c.dynamoClient, &dynamodb.ScanInput{
+		TableName: aws.String(c.releasedTableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan released blocks: %w", err)
+		}
+		var blocks []ReleasedBlock
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &blocks); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal released blocks: %w", err)
+		}
+		released = append(released, blocks...)
+	}
+
+	return releasedOrder(released), nil
+}
+
+// releasedOrder parses released blocks into networks, oldest release first
+// and, for blocks released together, in address order.
+func releasedOrder(released []ReleasedBlock) []*net.IPNet {
+	sort.SliceStable(released, func(i, j int) bool {
+		if released[i].ReleasedAt != released[j].ReleasedAt {
+			return released[i].ReleasedAt < released[j].ReleasedAt
+		}
+		return released[i].CIDR < released[j].CIDR
+	})
+
+	var networks []*net.IPNet
+	for _, block := range released {
+		if _, network, err := parseCIDR(block.CIDR); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// recycledSubnet returns the first free prefix-sized block inside a released
+// block within base, trying released blocks in order.
+func recycledSubnet(released []*net.IPNet, base *net.IPNet, prefix int, used []*net.IPNet) (*net.IPNet, bool) {
+	for _, block := range released {
+		if !netContains(base, block) {
+			continue
+		}
+		if blockPrefix, _ := block.Mask.Size(); prefix < blockPrefix {
+			continue
+		}
+		if subnet, ok := nextFreeSubnet(block, prefix, used); ok {
+			return subnet, true
+		}
+	}
+	return nil, false
+}
+
+// forgetReleased removes a block from the released table once it has been
+// allocated again as a whole. Partly reused blocks stay listed so the rest of
+// their space is still preferred.
+func (c *CIDRService) forgetReleased(ctx context.Context, cidr string) error {
+	_, err := c.dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(c.releasedTableName),
+		Key: map[string]types.AttributeValue{
+			"cidr": &types.AttributeValueMemberS{Value: cidr},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete released block: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// redactableFields are the record fields REDACT_FIELDS may name. A record's
+// key and CIDR identify it and are always shown.
+var redactableFields = map[string]bool{
+	"description": true,
+	"pool":        true,
+	"tenant":      true,
+	"account":     true,
+	"region":      true,
+	"tags":        true,
+}
+
+// redactedFields are the record fields hidden from GET responses for callers
+// without permissionUnredacted. The zero value hides nothing.
+type redactedFields struct {
+	fields []string
+	// tags are the tag keys hidden when the tags as a whole are not.
+	tags []string
+}
+
+// redaction is the field redaction configured by REDACT_FIELDS, set by
+// loadRedaction at startup.
+var redaction redactedFields
+
+func loadRedaction() error {
+	r, err := parseRedactFields(os.Getenv("REDACT_FIELDS"))
+	if err != nil {
+		return err
+	}
+	redaction = r
+	return nil
+}
+
+// parseRedactFields parses REDACT_FIELDS, a comma-separated list of record
+// fields such as "description,account", where "tags.<key>" names one tag.
+func parseRedactFields(value string) (redactedFields, error) {
+	var r redactedFields
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if tag, ok := strings.CutPrefix(entry, "tags."); ok {
+			if tag == "" {
+				return r, fmt.Errorf("invalid REDACT_FIELDS entry %q: want tags.<key>", entry)
+			}
+			r.tags = append(r.tags, tag)
+			continue
+		}
+		if !redactableFields[entry] {
+			return r, fmt.Errorf("REDACT_FIELDS cannot redact %q; want description, pool, tenant, account, region, tags or tags.<key>", entry)
+		}
+		r.fields = append(r.fields, entry)
+	}
+	return r, nil
+}
+
+func (r redactedFields) enabled() bool {
+	return len(r.fields) > 0 || len(r.tags) > 0
+}
+
+// appliesTo reports whether a request's response must be redacted: a GET or
+// HEAD whose caller did not authenticate with permissionUnredacted.
+func (r redactedFields) appliesTo(ctx context.Context, method, authorization string) bool {
+	if !r.enabled() || (method != "GET" && method != "HEAD") {
+		return false
+	}
+	principal := resolvePrincipal(ctx, authorization, false)
+	if principal == nil {
+		return true
+	}
+	for _, permission := range principal.Permissions {
+		if permission == permissionUnredacted {
+			return false
+		}
+	}
+	return true
+}
+
+// redact strips the redacted fields from every record of a JSON response,
+// at any depth, so lists, single records, descriptions and backups are all
+// covered. A record is any object with a cidr field. Fields are matched under
+// both their own names and the RESPONSE_CASE and RESPONSE_FIELDS names, since
+// backups keep the former.
+func (r redactedFields) redact(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	r.redactValue(value)
+	return json.Marshal(value)
+}
+
+func (r redactedFields) redactValue(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		_, isRecord := v["cidr"]
+		if _, renamed := v[naming.name("cidr")]; renamed {
+			isRecord = true
+		}
+		if isRecord {
+			for _, field := range r.fields {
+				delete(v, field)
+				delete(v, naming.name(field))
+			}
+			for _, name := range []string{"tags", naming.name("tags")} {
+				if tags, ok := v[name].(map[string]interface{}); ok {
+					// Tag keys are sent as stored, never renamed.
+					for _, tag := range r.tags {
+						delete(tags, tag)
+					}
+					if len(tags) == 0 {
+						delete(v, name)
+					}
+				}
+			}
+		}
+		for _, field := range v {
+			r.redactValue(field)
+		}
+	case []interface{}:
+		for _, element := range v {
+			r.redactValue(element)
+		}
+	}
+}
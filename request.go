@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// registrationRequest is the body of POST / and POST /allocate.
+type registrationRequest struct {
+	Key         string            `json:"key"`
+	CIDR        string            `json:"cidr"`
+	Description string            `json:"description"`
+	Reserved    bool              `json:"reserved"`
+	ExpiresAt   int64             `json:"expiresAt"`
+	Prefix      int               `json:"prefix"`
+	Pool        string            `json:"pool"`
+	Tenant      string            `json:"tenant"`
+	Account     string            `json:"account"`
+	Region      string            `json:"region"`
+	ActiveFrom  int64             `json:"activeFrom"`
+	ActiveUntil int64             `json:"activeUntil"`
+	Tags        map[string]string `json:"tags"`
+}
+
+func (r registrationRequest) record() CIDRRecord {
+	return CIDRRecord{
+		Key:         r.Key,
+		CIDR:        r.CIDR,
+		Description: r.Description,
+		Reserved:    r.Reserved,
+		ExpiresAt:   r.ExpiresAt,
+		Pool:        r.Pool,
+		Tenant:      r.Tenant,
+		Account:     r.Account,
+		Region:      r.Region,
+		ActiveFrom:  r.ActiveFrom,
+		ActiveUntil: r.ActiveUntil,
+		Tags:        r.Tags,
+	}
+}
+
+// contiguousRequest is the body of POST /allocate-contiguous: an allocation
+// body with the number of blocks to allocate and whether to register them as
+// one supernet.
+type contiguousRequest struct {
+	registrationRequest
+	Count     int  `json:"count"`
+	Aggregate bool `json:"aggregate"`
+}
+
+func (r contiguousRequest) validate() fieldErrors {
+	errs := r.registrationRequest.validate(true)
+	if errs == nil {
+		errs = fieldErrors{}
+	}
+	if r.Count < 2 || r.Count > maxContiguousBlocks {
+		errs["count"] = fmt.Sprintf("must be between 2 and %d", maxContiguousBlocks)
+	} else if r.Aggregate && r.Count&(r.Count-1) != 0 {
+		errs["count"] = "must be a power of two with aggregate"
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// planRequest is the body of POST /plan.
+type planRequest struct {
+	Allocations []PlannedAllocation `json:"allocations"`
+}
+
+// reassignRequest is the body of POST /reassign.
+type reassignRequest struct {
+	OldKey string `json:"oldKey"`
+	NewKey string `json:"newKey"`
+}
+
+func (r reassignRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	if r.OldKey == "" {
+		errs["oldKey"] = "required"
+	}
+	if r.NewKey == "" {
+		errs["newKey"] = "required"
+	} else if r.NewKey == r.OldKey {
+		errs["newKey"] = "must differ from oldKey"
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// supernetRequest is the body of POST /supernet-of.
+type supernetRequest struct {
+	CIDRs []string `json:"cidrs"`
+}
+
+// networks validates the CIDRs and returns them parsed.
+func (r supernetRequest) networks() ([]*net.IPNet, fieldErrors) {
+	if len(r.CIDRs) == 0 {
+		return nil, fieldErrors{"cidrs": "required"}
+	}
+
+	errs := fieldErrors{}
+	var networks []*net.IPNet
+	for i, cidr := range r.CIDRs {
+		_, network, err := parseCIDR(cidr)
+		if err != nil {
+			errs[fmt.Sprintf("cidrs[%d]", i)] = "invalid format"
+			continue
+		}
+		if len(networks) > 0 && !sameFamily(networks[0], network) {
+			errs[fmt.Sprintf("cidrs[%d]", i)] = "must be the same address family as the other cidrs"
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return networks, nil
+}
+
+// diffRequest is the body of POST /diff.
+type diffRequest struct {
+	CIDRs []string `json:"cidrs"`
+}
+
+// networks validates the CIDRs and returns them parsed. An empty list is a
+// proposal to remove every record, but the field must be present.
+func (r diffRequest) networks() ([]*net.IPNet, fieldErrors) {
+	if r.CIDRs == nil {
+		return nil, fieldErrors{"cidrs": "required"}
+	}
+
+	errs := fieldErrors{}
+	networks := make([]*net.IPNet, 0, len(r.CIDRs))
+	for i, cidr := range r.CIDRs {
+		_, network, err := parseCIDR(cidr)
+		if err != nil {
+			errs[fmt.Sprintf("cidrs[%d]", i)] = "invalid format"
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return networks, nil
+}
+
+// resizeRequest is the body of POST /resize.
+type resizeRequest struct {
+	Key       string `json:"key"`
+	NewPrefix int    `json:"newPrefix"`
+}
+
+func (r resizeRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	if r.Key == "" {
+		errs["key"] = "required"
+	}
+	// The record's address family is not known yet; resizing checks the
+	// family's own limit.
+	if r.NewPrefix == 0 {
+		errs["newPrefix"] = "required"
+	} else if err := checkPrefixLength(r.NewPrefix, maxIPv6Prefix); err != nil {
+		errs["newPrefix"] = err.Error()
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// fieldErrors maps a request field name to what is wrong with it.
+type fieldErrors map[string]string
+
+// strictJSON reports whether request bodies are decoded strictly, which they
+// are only with STRICT_JSON=true.
+func strictJSON() bool {
+	return os.Getenv("STRICT_JSON") == "true"
+}
+
+// decodeJSONBody decodes a JSON request body into v. With STRICT_JSON=true it
+// rejects unknown fields, so typos such as "cdir" are reported rather than
+// ignored.
+func decodeJSONBody(body io.Reader, v interface{}) fieldErrors {
+	decoder := json.NewDecoder(body)
+	if strictJSON() {
+		decoder.DisallowUnknownFields()
+	}
+
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fieldErrors{typeErr.Field: fmt.Sprintf("must be of type %s", typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return fieldErrors{field: "unknown field"}
+	case errors.Is(err, io.EOF):
+		return fieldErrors{"body": "required"}
+	default:
+		return fieldErrors{"body": "invalid JSON"}
+	}
+}
+
+// validate checks the fields of a registration or, when allocate is set, an
+// allocation request.
+func (r registrationRequest) validate(allocate bool) fieldErrors {
+	errs := fieldErrors{}
+
+	if r.Key == "" {
+		errs["key"] = "required"
+	}
+
+	if r.CIDR != "" {
+		if allocate {
+			errs["cidr"] = "not allowed when allocating"
+		} else if _, _, err := parseCIDR(r.CIDR); err != nil {
+			errs["cidr"] = "invalid format"
+		}
+		if !allocate && r.Prefix != 0 {
+			errs["prefix"] = "only allowed when cidr is omitted"
+		}
+	}
+
+	// The base's own family limit is checked once the base is known.
+	if _, set := errs["prefix"]; !set {
+		if err := checkPrefixLength(r.Prefix, maxIPv6Prefix); err != nil {
+			errs["prefix"] = err.Error()
+		}
+	}
+
+	if n := utf8.RuneCountInString(r.Description); n > maxDescriptionLength {
+		errs["description"] = fmt.Sprintf("must be at most %d characters", maxDescriptionLength)
+	}
+
+	if r.ExpiresAt != 0 && r.ExpiresAt <= time.Now().Unix() {
+		errs["expiresAt"] = "must be in the future"
+	}
+
+	if field, message := activeWindowError(r.record(), time.Now()); field != "" {
+		errs[field] = message
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (r planRequest) validate() fieldErrors {
+	if len(r.Allocations) == 0 {
+		return fieldErrors{"allocations": "required"}
+	}
+
+	errs := fieldErrors{}
+	for i, allocation := range r.Allocations {
+		if allocation.Key == "" {
+			errs[fmt.Sprintf("allocations[%d].key", i)] = "required"
+		}
+		if allocation.CIDR == "" {
+			errs[fmt.Sprintf("allocations[%d].cidr", i)] = "required"
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validationErrorBody is the response body for a request that failed field
+// validation. "error" is kept for clients that only read the summary.
+func validationErrorBody(errs fieldErrors) map[string]interface{} {
+	return map[string]interface{}{
+		"error":  "invalid request body",
+		"errors": errs,
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDOrNew returns the client-supplied request ID if it is usable, so
+// callers can correlate their own logs, and a fresh one otherwise. IDs with
+// control characters or of excessive length are replaced rather than logged.
+func requestIDOrNew(header string) string {
+	if header == "" || len(header) > maxRequestIDLength {
+		return newRequestID()
+	}
+	for _, r := range header {
+		if r < 0x21 || r > 0x7e {
+			return newRequestID()
+		}
+	}
+	return header
+}
+
+// logf logs a line prefixed with the request ID carried by ctx, if any.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFrom(ctx); id != "" {
+		format = "request_id=" + id + " " + format
+	}
+	log.Printf(format, args...)
+}
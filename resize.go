@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var errRecordNotFound = errors.New("record not found")
+
+type ResizeResult struct {
+	Key     string `json:"key"`
+	OldCIDR string `json:"oldCidr"`
+	NewCIDR string `json:"newCidr"`
+}
+
+// GetRecord returns the record stored under key, or errRecordNotFound.
+func (c *CIDRService) GetRecord(ctx context.Context, key string) (*CIDRRecord, error) {
+	return readWithFallback(ctx, c, func(client dynamoReader) (*CIDRRecord, error) {
+		return c.getRecord(ctx, client, key)
+	})
+}
+
+func (c *CIDRService) getRecord(ctx context.Context, client dynamoReader, key string) (*CIDRRecord, error) {
+	primaryKey, err := c.primaryKeyFor(ctx, client, key)
+	if err != nil {
+		return nil, err
+	}
+	if primaryKey == nil {
+		return nil, fmt.Errorf("key '%s': %w", key, errRecordNotFound)
+	}
+
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(c.table(ctx)),
+		Key:       primaryKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item from DynamoDB: %w", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("key '%s': %w", key, errRecordNotFound)
+	}
+
+	var record CIDRRecord
+	if err := attributevalue.UnmarshalMap(result.Item, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal DynamoDB item: %w", err)
+	}
+	return &record, nil
+}
+
+// ResizeCIDR changes the prefix length of the block registered under key,
+// keeping its network address. The write is conditional on the record still
+// holding its old CIDR.
+func (c *CIDRService) ResizeCIDR(ctx context.Context, key string, newPrefix int) (*ResizeResult, error) {
+	record, err := c.GetRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	scoped := inScope(withoutExpired(records, time.Now()), *record, c.uniquenessScope)
+	resized, err := resizedBlock(scoped, *record, newPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *record
+	updated.CIDR = resized.String()
+	updated.UpdatedAt = time.Now().Unix()
+	if err := c.validatePoolMembership(updated); err != nil {
+		return nil, err
+	}
+	if err := checkForbidden(c.forbidden, updated.CIDR); err != nil {
+		return nil, err
+	}
+
+	if err := c.replaceCIDR(ctx, *record, updated); err != nil {
+		return nil, err
+	}
+	c.notify(ctx, ChangeEvent{Action: changeActionResize, Key: key, CIDR: updated.CIDR, OldCIDR: record.CIDR, Record: &updated})
+
+	return &ResizeResult{Key: key, OldCIDR: record.CIDR, NewCIDR: updated.CIDR}, nil
+}
+
+// resizedBlock returns record's block at newPrefix. Growing must keep the
+// network address aligned and may not swallow other records; shrinking is
+// refused while records are registered inside the block.
+func resizedBlock(records []CIDRRecord, record CIDRRecord, newPrefix int) (*net.IPNet, error) {
+	_, network, err := parseCIDR(record.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("record '%s' has invalid CIDR '%s': %w", record.Key, record.CIDR, err)
+	}
+
+	oldPrefix, bits := network.Mask.Size()
+	if newPrefix < 0 || newPrefix > bits {
+		return nil, fmt.Errorf("newPrefix must be between /0 and /%d, got /%d", bits, newPrefix)
+	}
+	if newPrefix == oldPrefix {
+		return nil, fmt.Errorf("%s is already a /%d", network, newPrefix)
+	}
+
+	resized := &net.IPNet{IP: network.IP, Mask: net.CIDRMask(newPrefix, bits)}
+	if !resized.IP.Equal(resized.IP.Mask(resized.Mask)) {
+		return nil, fmt.Errorf("%s cannot grow to /%d: %s is not aligned on a /%d boundary",
+			network, newPrefix, network.IP, newPrefix)
+	}
+
+	var others []CIDRRecord
+	for _, other := range records {
+		if other.Key != record.Key {
+			others = append(others, other)
+		}
+	}
+
+	target, verb := resized, "grown"
+	if newPrefix > oldPrefix {
+		target, verb = network, "shrunk"
+	}
+
+	var blocking []string
+	for _, other := range others {
+		_, otherNet, err := parseCIDR(other.CIDR)
+		if err != nil {
+			continue
+		}
+		if netContains(target, otherNet) {
+			blocking = append(blocking, fmt.Sprintf("%s (%s)", other.Key, other.CIDR))
+		}
+	}
+	if len(blocking) > 0 {
+		return nil, fmt.Errorf("%s cannot be %s to /%d: it would conflict with %s",
+			network, verb, newPrefix, strings.Join(blocking, ", "))
+	}
+
+	return resized, nil
+}
+
+// replaceCIDR stores updated in place of old. With the key layout this is a
+// conditional update; partitioned tables key items by CIDR, so the old item is
+// deleted and the new one put in one transaction.
+func (c *CIDRService) replaceCIDR(ctx context.Context, old, updated CIDRRecord) error {
+	if !c.partitioned {
+		_, err := c.client(ctx).UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(c.table(ctx)),
+			Key:                 c.itemKey(old),
+			UpdateExpression:    aws.String("SET #c = :new, #u = :updated"),
+			ConditionExpression: aws.String("#c = :old"),
+			ExpressionAttributeNames: map[string]string{
+				"#c": "cidr",
+				"#u": "updatedAt",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":new":     &types.AttributeValueMemberS{Value: updated.CIDR},
+				":old":     &types.AttributeValueMemberS{Value: old.CIDR},
+				":updated": &types.AttributeValueMemberN{Value: fmt.Sprint(updated.UpdatedAt)},
+			},
+		})
+		if err != nil {
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				return fmt.Errorf("key '%s' was changed concurrently", old.Key)
+			}
+			return fmt.Errorf("failed to update item in DynamoDB: %w", err)
+		}
+		return nil
+	}
+
+	items, err := c.moveItems(ctx, old, updated)
+	if err != nil {
+		return err
+	}
+	_, err = c.client(ctx).TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		if transactionConditionFailed(err) {
+			return fmt.Errorf("key '%s' or CIDR '%s' was changed concurrently", old.Key, updated.CIDR)
+		}
+		return fmt.Errorf("failed to replace item in DynamoDB: %w", err)
+	}
+	return nil
+}
+
+// moveItems returns the transaction items that move a record of a
+// partitioned table from old's CIDR to updated's: the old item is deleted
+// and the new one put, with updated's partition.
+func (c *CIDRService) moveItems(ctx context.Context, old, updated CIDRRecord) ([]types.TransactWriteItem, error) {
+	_, network, _ := parseCIDR(updated.CIDR)
+	updated.Partition = c.partitionFor(network)
+	item, err := attributevalue.MarshalMap(updated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Delete: &types.Delete{
+				TableName:           aws.String(c.table(ctx)),
+				Key:                 c.itemKey(old),
+				ConditionExpression: aws.String("#k = :k"),
+				ExpressionAttributeNames: map[string]string{
+					"#k": "key",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":k": &types.AttributeValueMemberS{Value: old.Key},
+				},
+			},
+		},
+		{
+			Put: &types.Put{
+				TableName:           aws.String(c.table(ctx)),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(#c)"),
+				ExpressionAttributeNames: map[string]string{
+					"#c": "cidr",
+				},
+			},
+		},
+	}, nil
+}
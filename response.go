@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/aws/smithy-go"
+)
+
+// throttleRetryAfter is the Retry-After value, in seconds, sent with 503
+// responses caused by DynamoDB throttling.
+const throttleRetryAfter = "5"
+
+// restStrict reports whether REST_STRICT=true, in which case DELETE answers
+// 204 with no body and POST answers 201 with only a Location header.
+func restStrict() bool {
+	return os.Getenv("REST_STRICT") == "true"
+}
+
+// strictStatusCodes reports whether STRICT_STATUS_CODES=true, in which case
+// a well-formed request refused by a business rule answers 422 rather than
+// 400, which is then kept for bodies and parameters that cannot be parsed.
+func strictStatusCodes() bool {
+	return os.Getenv("STRICT_STATUS_CODES") == "true"
+}
+
+// rejectedStatus is the status of a well-formed request that a business rule
+// refuses, such as an overlapping registration or a prefix a pool rejects.
+func rejectedStatus() int {
+	if strictStatusCodes() {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// readOnly reports whether READ_ONLY=true, in which case requests that could
+// modify the registry are refused.
+func readOnly() bool {
+	return os.Getenv("READ_ONLY") == "true"
+}
+
+// isWriteRequest reports whether a request may modify the registry. POST /plan,
+// POST /diff and POST /supernet-of only compute answers, so they stay
+// available in read-only mode.
+func isWriteRequest(method, path string) bool {
+	switch method {
+	case "POST":
+		return path != "/plan" && path != "/diff" && path != "/supernet-of"
+	case "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// recordLocation is the Location of a newly registered record.
+func recordLocation(cidr string) string {
+	return "/describe?cidr=" + url.QueryEscape(cidr)
+}
+
+// isThrottlingError reports whether err wraps a DynamoDB throughput or
+// request-rate error. These surface only once the SDK has exhausted its own
+// retries.
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException", "RequestLimitExceeded", "ThrottlingException":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// maxScanSegments is DynamoDB's limit on TotalSegments.
+const maxScanSegments = 1000000
+
+func parseScanSegments(value string) (int, error) {
+	if value == "" {
+		return 1, nil
+	}
+	segments, err := strconv.Atoi(value)
+	if err != nil || segments < 1 || segments > maxScanSegments {
+		return 0, fmt.Errorf("SCAN_SEGMENTS must be an integer between 1 and %d, got %q", maxScanSegments, value)
+	}
+	return segments, nil
+}
+
+// scanPages runs input as a parallel Scan over SCAN_SEGMENTS segments and
+// calls handle for every page. Calls to handle are serialized, so it needs no
+// locking of its own, but pages arrive in no particular order. The first
+// failing segment cancels the others and its error is returned, so callers
+// never see a partial table as a success.
+func (c *CIDRService) scanPages(ctx context.Context, client dynamodb.ScanAPIClient, input *dynamodb.ScanInput, handle func(*dynamodb.ScanOutput) error) error {
+	segments := max(c.scanSegments, 1)
+	if segments == 1 {
+		paginator := dynamodb.NewScanPaginator(client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			if err := handle(page); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for segment := 0; segment < segments; segment++ {
+		segmentInput := *input
+		segmentInput.Segment = aws.Int32(int32(segment))
+		segmentInput.TotalSegments = aws.Int32(int32(segments))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			paginator := dynamodb.NewScanPaginator(client, &segmentInput)
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+
+				mu.Lock()
+				if err == nil && firstErr == nil {
+					err = handle(page)
+				}
+				if err != nil {
+					fail(fmt.Errorf("segment %d: %w", *segmentInput.Segment, err))
+				}
+				stop := firstErr != nil
+				mu.Unlock()
+
+				if stop {
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+
+// UNIQUENESS_SCOPE decides which records a CIDR must not collide with. Keys
+// are the table's primary key and stay globally unique in every scope. The
+// account scope suits VPCs in accounts that are not peered, which may
+// legitimately reuse ranges.
+const (
+	uniquenessScopeGlobal  = "global"
+	uniquenessScopeTenant  = "tenant"
+	uniquenessScopePool    = "pool"
+	uniquenessScopeAccount = "account"
+)
+
+func parseUniquenessScope(value string, partitioned bool) (string, error) {
+	switch value {
+	case "", uniquenessScopeGlobal:
+		return uniquenessScopeGlobal, nil
+	case uniquenessScopeTenant, uniquenessScopePool, uniquenessScopeAccount:
+		// The partitioned layout keys items by CIDR, so it cannot hold the
+		// same block twice.
+		if partitioned {
+			return "", fmt.Errorf("UNIQUENESS_SCOPE %q requires TABLE_LAYOUT %q", value, tableLayoutKey)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("UNIQUENESS_SCOPE must be %q, %q, %q or %q, got %q",
+			uniquenessScopeGlobal, uniquenessScopeTenant, uniquenessScopePool, uniquenessScopeAccount, value)
+	}
+}
+
+// inScope returns the records that share the candidate's tenant, pool or
+// account, or all of them for the global scope.
+func inScope(records []CIDRRecord, candidate CIDRRecord, scope string) []CIDRRecord {
+	if scope == "" || scope == uniquenessScopeGlobal {
+		return records
+	}
+
+	var scoped []CIDRRecord
+	for _, record := range records {
+		switch {
+		case scope == uniquenessScopeTenant && record.Tenant == candidate.Tenant,
+			scope == uniquenessScopePool && record.Pool == candidate.Pool,
+			scope == uniquenessScopeAccount && record.Account == candidate.Account:
+			scoped = append(scoped, record)
+		}
+	}
+	return scoped
+}
+
+// checkScopedUniqueness applies checkUniqueness within the candidate's scope,
+// after checking the key against every record.
+func checkScopedUniqueness(records []CIDRRecord, candidate CIDRRecord, scope string) error {
+	for _, record := range records {
+		if record.Key == candidate.Key {
+			return &DuplicateKeyError{Existing: record}
+		}
+	}
+	return checkUniqueness(concurrentRecords(inScope(records, candidate, scope), candidate), candidate)
+}
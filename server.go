@@ -1,18 +1,48 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	defaultSweepInterval = 5 * time.Minute
+	shutdownTimeout      = 10 * time.Second
+)
+
+// routes are the paths served by handleCIDRs, relative to basePath.
+var routes = []string{"/", "/cidr", "/keys", "/next", "/available-blocks", "/describe", "/adjacent", "/tree", "/stats", "/capacity", "/forecast", "/fragmentation", "/metrics/allocations", "/status-breakdown", "/health", "/version", "/whoami", "/history", "/lint", "/lint/fix", "/sweep", "/backup", "/allocate", "/allocate-contiguous", "/plan", "/diff", "/supernet-of", "/restore", "/import", "/resize", "/reassign", "/delete-batch", "/request", "/approve", "/reject", "/lock/acquire", "/lock/heartbeat", "/lock/release", "/sync-aws", "/reconcile-aws"}
+
+// basePath is the BASE_PATH prefix every route is mounted under, e.g. /api/v1.
+var basePath string
+
+// routePath returns the request path with basePath removed.
+func routePath(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, basePath)
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
 func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentTypeJSON)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Signature, X-Timestamp")
+	w.Header().Set("Vary", "Accept")
 }
 
 func writeJSONResponse(w http.ResponseWriter, statusCode int, data interface{}) {
@@ -20,9 +50,36 @@ func writeJSONResponse(w http.ResponseWriter, statusCode int, data interface{})
 	w.WriteHeader(statusCode)
 
 	if data != nil {
-		if err := json.NewEncoder(w).Encode(data); err != nil {
+		body, err := marshalResponse(data)
+		if err != nil {
 			log.Printf("Error encoding JSON response: %v", err)
+			return
 		}
+		w.Write(append(body, '\n'))
+	}
+}
+
+// writeTextResponse is a 200 with a non-JSON body, such as a DOT graph.
+func writeTextResponse(w http.ResponseWriter, contentType, body string) {
+	setCORSHeaders(w)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
+}
+
+// writeNotModified is a bodiless 304 carrying a GET response's caching
+// headers.
+func writeNotModified(w http.ResponseWriter, headers map[string]string) {
+	setCORSHeaders(w)
+	w.Header().Del("Content-Type")
+	setHeaders(w, headers)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// setHeaders adds headers to the response about to be written.
+func setHeaders(w http.ResponseWriter, headers map[string]string) {
+	for name, value := range headers {
+		w.Header().Set(name, value)
 	}
 }
 
@@ -30,15 +87,227 @@ func writeErrorResponse(w http.ResponseWriter, statusCode int, message string) {
 	writeJSONResponse(w, statusCode, map[string]string{"error": message})
 }
 
+// writeDuplicateKeyResponse is the 409 for a registration under a taken key,
+// including the record that holds it.
+func writeDuplicateKeyResponse(w http.ResponseWriter, err *DuplicateKeyError) {
+	writeJSONResponse(w, http.StatusConflict, map[string]interface{}{
+		"error":    err.Error(),
+		"existing": err.Existing,
+	})
+}
+
+// writeAllocationFailedResponse is the 400, or 422 with STRICT_STATUS_CODES,
+// for an allocation refused for lack of space, tagged with a code clients can
+// match on.
+func writeAllocationFailedResponse(w http.ResponseWriter, err error, code string) {
+	writeJSONResponse(w, rejectedStatus(), map[string]string{
+		"error": fmt.Sprintf("failed to allocate CIDR: %v", err),
+		"code":  code,
+	})
+}
+
+// writeRecordLimitResponse is the 400, or 422 with STRICT_STATUS_CODES, for a
+// write refused by MAX_RECORDS.
+func writeRecordLimitResponse(w http.ResponseWriter, err *RecordLimitError) {
+	writeJSONResponse(w, rejectedStatus(), map[string]string{
+		"error": err.Error(),
+		"code":  recordLimitCode,
+	})
+}
+
+// writeServiceError reports a failed service call. Throttling that outlasted
+// the SDK's retries becomes 503 with Retry-After so clients back off.
+func writeServiceError(w http.ResponseWriter, statusCode int, err error, message string) {
+	if isThrottlingError(err) {
+		w.Header().Set("Retry-After", throttleRetryAfter)
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeErrorResponse(w, statusCode, message)
+}
+
+func writeCreatedResponse(w http.ResponseWriter, cidr string) {
+	w.Header().Set("Location", recordLocation(cidr))
+	writeJSONResponse(w, http.StatusCreated, nil)
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withRequestIDMiddleware attaches a request ID, the caller's X-Request-ID
+// or a generated one, to the request context and the response, and logs the
+// request under it.
+func withRequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestIDOrNew(r.Header.Get(requestIDHeader))
+		ctx := withRequestID(r.Context(), id)
+		w.Header().Set(requestIDHeader, id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		logf(ctx, "%s %s %d %s", r.Method, r.URL.Path, recorder.status, time.Since(start))
+	})
+}
+
+// bufferedResponse holds a handler's status and body so they can be rewritten
+// before being sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// withXMLNegotiation rewrites JSON responses as XML for clients whose Accept
+// header prefers it. An ETag is recomputed over the XML, since it is a
+// different representation.
+func withXMLNegotiation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wantsXML(r.Header.Get("Accept")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		body := buffered.body.Bytes()
+		if len(body) > 0 && w.Header().Get("Content-Type") == contentTypeJSON {
+			converted, err := jsonToXML(body)
+			if err != nil {
+				logf(r.Context(), "failed to convert response to XML: %v", err)
+			} else {
+				body = converted
+				w.Header().Set("Content-Type", contentTypeXML)
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				if w.Header().Get("ETag") != "" {
+					w.Header().Set("ETag", representationETag(w.Header().Get("ETag"), contentTypeXML))
+				}
+			}
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(body)
+	})
+}
+
+// withRedaction strips the REDACT_FIELDS from the records of JSON responses
+// to callers without permission to see them. The response varies with the
+// caller's credentials, and an ETag is recomputed so it differs from the full
+// representation's.
+func withRedaction(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !redaction.appliesTo(r.Context(), r.Method, r.Header.Get("Authorization")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		body := buffered.body.Bytes()
+		if len(body) > 0 && w.Header().Get("Content-Type") == contentTypeJSON {
+			redacted, err := redaction.redact(body)
+			if err != nil {
+				logf(r.Context(), "failed to redact response: %v", err)
+			} else {
+				body = append(redacted, '\n')
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Header().Set("Vary", "Accept, Authorization")
+				if w.Header().Get("ETag") != "" {
+					w.Header().Set("ETag", representationETag(w.Header().Get("ETag"), "redacted"))
+				}
+			}
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(body)
+	})
+}
+
+// withResponseVersion serves a request in the response envelope version the
+// client asked for.
+func withResponseVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, err := responseVersion(r.URL.Query().Get("v"), r.Header.Get("Accept"))
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if version == latestResponseVersion {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		body := buffered.body.Bytes()
+		if len(body) > 0 && w.Header().Get("Content-Type") == contentTypeJSON {
+			// writeJSONResponse ends bodies with a newline.
+			enveloped, err := envelopeBody(version, buffered.status, bytes.TrimSuffix(body, []byte("\n")))
+			if err != nil {
+				logf(r.Context(), "failed to apply response version %d: %v", version, err)
+			} else {
+				body = append(enveloped, '\n')
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(body)
+	})
+}
+
 func handleCIDRs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	path := routePath(r)
+
+	if readOnly() && isWriteRequest(r.Method, path) {
+		writeErrorResponse(w, http.StatusServiceUnavailable, "service is read-only")
+		return
+	}
+
+	if err := checkJWT(ctx, r.Method, path, r.Header.Get("Authorization")); err != nil {
+		w.Header().Set("WWW-Authenticate", authenticateHeader(err, r.Method, path))
+		writeErrorResponse(w, jwtErrorStatus(err), err.Error())
+		return
+	}
+
+	if signing.enabled() && isWriteRequest(r.Method, path) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to read request body: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		err = signing.verify(r.Method, path, canonicalQuery(r.URL.Query()), r.Header.Get(timestampHeader), r.Header.Get(signatureHeader), body, time.Now())
+		if err != nil {
+			writeErrorResponse(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
 
-	cidrService, err := NewCIDRService(ctx)
+	cidrService, err := getCIDRService(ctx)
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError,
 			fmt.Sprintf("failed to initialize CIDR service: %v", err))
 		return
 	}
+	ctx = cidrService.withTableRoute(ctx, r.URL.Query().Get("tenant"), r.URL.Query().Get("pool"))
 
 	switch r.Method {
 	case "OPTIONS":
@@ -46,92 +315,1341 @@ func handleCIDRs(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 
 	case "GET":
-		if r.URL.Path == "/next" || r.URL.Query().Get("action") == "next" {
-			nextCIDR, err := cidrService.GetNextAvailableCIDR(ctx)
+		if path == "/next" || r.URL.Query().Get("action") == "next" {
+			opts, err := parseAllocationOptions(r.URL.Query().Get)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			format, err := parseNextFormat(r.URL.Query().Get("format"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			if prefixesParam := r.URL.Query().Get("prefixes"); prefixesParam != "" {
+				if opts.Prefix != 0 || r.URL.Query().Get("hosts") != "" {
+					writeErrorResponse(w, http.StatusBadRequest,
+						"use the prefixes parameter without prefix or hosts")
+					return
+				}
+				if format == nextFormatEnv {
+					writeErrorResponse(w, http.StatusBadRequest,
+						"format=env describes a single block; use prefix or hosts instead of prefixes")
+					return
+				}
+
+				prefixes, err := parsePrefixList(prefixesParam)
+				if err != nil {
+					writeErrorResponse(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				for _, prefix := range prefixes {
+					prefixOpts := opts
+					prefixOpts.Prefix = prefix
+					if _, _, _, err := cidrService.resolveAllocation(prefixOpts); err != nil {
+						writeErrorResponse(w, rejectedStatus(), err.Error())
+						return
+					}
+				}
+
+				next, err := cidrService.NextAvailableCIDRs(ctx, opts, prefixes)
+				if err != nil {
+					writeServiceError(w, http.StatusInternalServerError, err,
+						fmt.Sprintf("failed to get next available CIDRs: %v", err))
+					return
+				}
+				writeJSONResponse(w, http.StatusOK, map[string]interface{}{"cidrs": next})
+				return
+			}
+
+			hostsParam := r.URL.Query().Get("hosts")
+			if hostsParam != "" {
+				if opts.Prefix != 0 {
+					writeErrorResponse(w, http.StatusBadRequest,
+						"use either the hosts or the prefix parameter, not both")
+					return
+				}
+
+				hosts, err := strconv.Atoi(hostsParam)
+				if err != nil {
+					writeErrorResponse(w, http.StatusBadRequest, "hosts parameter must be an integer")
+					return
+				}
+
+				opts.Prefix, err = cidrService.PrefixForHosts(hosts, opts.Base)
+				if err != nil {
+					writeErrorResponse(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+
+			if _, _, _, err := cidrService.resolveAllocation(opts); err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+
+			nextCIDR, err := cidrService.GetNextAvailableCIDR(ctx, opts)
 			if err != nil {
-				writeErrorResponse(w, http.StatusInternalServerError,
+				writeServiceError(w, http.StatusInternalServerError, err,
 					fmt.Sprintf("failed to get next available CIDR: %v", err))
 				return
 			}
-			writeJSONResponse(w, http.StatusOK, map[string]string{"cidr": nextCIDR})
+
+			if format == nextFormatEnv {
+				snippet, err := envSnippet(nextCIDR)
+				if err != nil {
+					writeServiceError(w, http.StatusInternalServerError, err,
+						fmt.Sprintf("failed to describe CIDR: %v", err))
+					return
+				}
+				writeTextResponse(w, contentTypeText, snippet)
+				return
+			}
+			body := map[string]interface{}{"cidr": nextCIDR}
+			if hostsParam != "" {
+				body["prefix"] = opts.Prefix
+				body["usableHosts"] = usableHosts(opts.Prefix)
+			}
+			if source := cidrService.allocationSource(opts, nextCIDR); source != "" {
+				body["source"] = source
+			}
+			writeJSONResponse(w, http.StatusOK, body)
 			return
 		}
 
-		records, err := cidrService.GetAllCIDRs(ctx)
-		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError,
-				fmt.Sprintf("failed to get CIDRs: %v", err))
+		if path == "/available-blocks" {
+			opts, err := parseAllocationOptions(r.URL.Query().Get)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			limit, err := parseAvailableLimit(r.URL.Query().Get("limit"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			from, err := decodeAvailableToken(r.URL.Query().Get("nextToken"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			base, _, _, err := cidrService.resolveAllocation(opts)
+			if err == nil {
+				err = checkAvailableBase(base)
+			}
+			if err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+
+			page, err := cidrService.AvailableBlocks(ctx, opts, limit, from)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to list available blocks: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, page)
 			return
 		}
 
-		writeJSONResponse(w, http.StatusOK, map[string]interface{}{
-			"records": records,
-			"count":   len(records),
-		})
+		if path == "/describe" {
+			cidr := r.URL.Query().Get("cidr")
+			if cidr == "" {
+				writeErrorResponse(w, http.StatusBadRequest, "cidr parameter is required")
+				return
+			}
 
-	case "POST":
-		var requestBody struct {
-			Key  string `json:"key"`
-			CIDR string `json:"cidr"`
+			if err := cidrService.validateCIDR(cidr); err != nil {
+				writeErrorResponse(w, http.StatusBadRequest,
+					fmt.Sprintf("invalid CIDR: %v", err))
+				return
+			}
+
+			description, err := cidrService.DescribeCIDR(ctx, cidr)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to describe CIDR: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, description)
+			return
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-			writeErrorResponse(w, http.StatusBadRequest, "invalid JSON body")
+		if path == "/adjacent" {
+			cidr := r.URL.Query().Get("cidr")
+			if cidr == "" {
+				writeErrorResponse(w, http.StatusBadRequest, "cidr parameter is required")
+				return
+			}
+
+			if err := cidrService.validateCIDR(cidr); err != nil {
+				writeErrorResponse(w, http.StatusBadRequest,
+					fmt.Sprintf("invalid CIDR: %v", err))
+				return
+			}
+
+			adjacent, err := cidrService.AdjacentBlocks(ctx, cidr)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to find adjacent blocks: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, adjacent)
 			return
 		}
 
-		if requestBody.Key == "" || requestBody.CIDR == "" {
-			writeErrorResponse(w, http.StatusBadRequest,
-				"both key and cidr fields are required")
+		if path == "/tree" {
+			base, _, err := cidrService.resolveBase(r.URL.Query().Get("base"))
+			if err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+
+			tree, err := cidrService.Tree(ctx, base, r.URL.Query().Get("free") == "true")
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to build allocation tree: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, tree)
 			return
 		}
 
-		if err := cidrService.RegisterCIDR(ctx, requestBody.Key, requestBody.CIDR); err != nil {
-			writeErrorResponse(w, http.StatusBadRequest,
-				fmt.Sprintf("failed to register CIDR: %v", err))
+		if path == "/backup" {
+			backup, err := cidrService.Backup(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to back up CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, backup)
 			return
 		}
 
-		writeJSONResponse(w, http.StatusCreated, map[string]string{
-			"message": "CIDR registered successfully",
-			"key":     requestBody.Key,
-			"cidr":    requestBody.CIDR,
-		})
+		if path == "/cidr" {
+			writeRecordResponse(w, r, cidrService, r.URL.Query().Get("key"))
+			return
+		}
 
-	case "DELETE":
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			writeErrorResponse(w, http.StatusBadRequest, "key parameter is required")
+		if path == "/keys" {
+			keys, err := cidrService.ListKeys(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to list keys: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, keys)
 			return
 		}
 
-		if err := cidrService.DeleteCIDR(ctx, key); err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError,
-				fmt.Sprintf("failed to delete CIDR: %v", err))
+		if path == "/stats" {
+			stats, err := cidrService.GetStats(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get stats: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, stats)
 			return
 		}
 
-		writeJSONResponse(w, http.StatusOK, map[string]string{
-			"message": "CIDR deleted successfully",
-			"key":     key,
-		})
+		if path == "/capacity" {
+			report, err := cidrService.Capacity(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get capacity: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, report)
+			return
+		}
 
-	default:
-		writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-	}
-}
+		if path == "/status-breakdown" {
+			breakdown, err := cidrService.StatusBreakdown(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get status breakdown: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, breakdown)
+			return
+		}
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+		if path == "/fragmentation" {
+			format, err := parseFragmentationFormat(r.URL.Query().Get("format"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			report, err := cidrService.Fragmentation(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get fragmentation: %v", err))
+				return
+			}
+			if format == fragmentationFormatPrometheus {
+				writeTextResponse(w, contentTypePrometheus, report.prometheusGauges())
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, report)
+			return
+		}
+
+		if path == "/metrics/allocations" {
+			labels, err := parseAllocationMetricLabels(r.URL.Query().Get("labels"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if redaction.appliesTo(ctx, r.Method, r.Header.Get("Authorization")) {
+				labels = redaction.withoutRedacted(labels)
+			}
+			records, err := cidrService.GetAllCIDRs(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get CIDRs: %v", err))
+				return
+			}
+			writeTextResponse(w, contentTypePrometheus, allocationGauges(withoutExpired(records, time.Now()), labels))
+			return
+		}
+
+		if path == "/forecast" {
+			window, err := parseForecastWindow(r.URL.Query().Get("window"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			report, err := cidrService.Forecast(ctx, window, time.Now())
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get forecast: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, report)
+			return
+		}
+
+		if path == "/lint" {
+			report, err := cidrService.Lint(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to lint CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, report)
+			return
+		}
+
+		if path == "/whoami" {
+			// The signature covers the body, as the Lambda's does, even on a
+			// GET.
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to read request body: %v", err))
+				return
+			}
+			signed := isSigned(r.Method, path, canonicalQuery(r.URL.Query()), r.Header.Get(timestampHeader), r.Header.Get(signatureHeader), body)
+			principal := resolvePrincipal(ctx, r.Header.Get("Authorization"), signed)
+			if principal == nil {
+				writeErrorResponse(w, http.StatusUnauthorized, "request is not authenticated")
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, principal)
+			return
+		}
+
+		if path == "/version" {
+			writeJSONResponse(w, http.StatusOK, buildInfo())
+			return
+		}
 
-	http.HandleFunc("/", handleCIDRs)
-	http.HandleFunc("/next", handleCIDRs)
+		if path == "/health" {
+			health := cidrService.Health(ctx)
+			if health.Status != healthStatusOK {
+				writeJSONResponse(w, http.StatusServiceUnavailable, health)
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, health)
+			return
+		}
 
-	log.Printf("Starting server on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+		if path == "/history" {
+			query, err := parseHistoryQuery(r.URL.Query().Get)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			page, err := cidrService.History(ctx, query)
+			switch {
+			case errors.Is(err, errAuditDisabled):
+				writeErrorResponse(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, errInvalidHistoryToken):
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			case err != nil:
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to get history: %v", err))
+			default:
+				writeJSONResponse(w, http.StatusOK, page)
+			}
+			return
+		}
+
+		if r.URL.Query().Get("countOnly") == "true" {
+			count, err := cidrService.CountCIDRs(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to count CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, map[string]int{"count": count})
+			return
+		}
+
+		changed := cidrService.lastChanged(ctx)
+		records, err := cidrService.GetAllCIDRs(ctx)
+		if err != nil {
+			writeServiceError(w, http.StatusInternalServerError, err,
+				fmt.Sprintf("failed to get CIDRs: %v", err))
+			return
+		}
+		now := time.Now()
+		modified := listModified(changed, records, now)
+		filter, err := parseRecordFilter(r.URL.Query().Get, now)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		records = withAges(filterRecords(records, filter), now)
+		if err := sortRecords(records, r.URL.Query().Get("sort")); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		format, err := parseListFormat(r.URL.Query().Get("format"))
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		depth, err := parseGroupBy(r.URL.Query().Get)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		cacheHeaders := cidrService.cacheHeaders(modified)
+		if notModified(r.Header.Get("If-Modified-Since"), modified) {
+			writeNotModified(w, cacheHeaders)
+			return
+		}
+		setHeaders(w, cacheHeaders)
+		if format == listFormatDOT {
+			writeTextResponse(w, contentTypeDOT, dotGraph(cidrService.permittedBases(), records))
+			return
+		}
+		if depth > 0 {
+			writeJSONResponse(w, http.StatusOK, groupByNamespace(records, depth))
+			return
+		}
+
+		writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"records": records,
+			"count":   len(records),
+		})
+
+	case "POST":
+		if path == "/plan" {
+			var planBody planRequest
+			if errs := decodeJSONBody(r.Body, &planBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			if errs := planBody.validate(); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			plan, err := cidrService.PlanAllocations(ctx, planBody.Allocations)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to plan allocations: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, plan)
+			return
+		}
+
+		if path == "/diff" {
+			var diffBody diffRequest
+			if errs := decodeJSONBody(r.Body, &diffBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			networks, errs := diffBody.networks()
+			if errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			diff, err := cidrService.DiffCIDRs(ctx, networks)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to diff CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, diff)
+			return
+		}
+
+		if path == "/supernet-of" {
+			var supernetBody supernetRequest
+			if errs := decodeJSONBody(r.Body, &supernetBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			networks, errs := supernetBody.networks()
+			if errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			supernet := coveringSupernet(networks)
+			prefix, _ := supernet.Mask.Size()
+			writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+				"cidr":   supernet.String(),
+				"prefix": prefix,
+			})
+			return
+		}
+
+		if path == "/resize" {
+			var resizeBody resizeRequest
+			if errs := decodeJSONBody(r.Body, &resizeBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			if errs := resizeBody.validate(); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			result, err := cidrService.ResizeCIDR(ctx, resizeBody.Key, resizeBody.NewPrefix)
+			if errors.Is(err, errRecordNotFound) {
+				writeErrorResponse(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if err != nil {
+				writeServiceError(w, rejectedStatus(), err,
+					fmt.Sprintf("failed to resize CIDR: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, result)
+			return
+		}
+
+		if path == "/reassign" {
+			var reassignBody reassignRequest
+			if errs := decodeJSONBody(r.Body, &reassignBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			if errs := reassignBody.validate(); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			record, err := cidrService.ReassignCIDR(ctx, reassignBody.OldKey, reassignBody.NewKey)
+			if errors.Is(err, errRecordNotFound) {
+				writeErrorResponse(w, http.StatusNotFound, err.Error())
+				return
+			}
+			var duplicate *DuplicateKeyError
+			if errors.As(err, &duplicate) {
+				writeDuplicateKeyResponse(w, duplicate)
+				return
+			}
+			if err != nil {
+				writeServiceError(w, rejectedStatus(), err,
+					fmt.Sprintf("failed to reassign CIDR: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, record)
+			return
+		}
+
+		if path == "/delete-batch" {
+			var deleteBody batchDeleteRequest
+			if errs := decodeJSONBody(r.Body, &deleteBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			if errs := deleteBody.validate(); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			results, err := cidrService.DeleteBatch(ctx, deleteBody.Keys)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to delete CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+				"results": results,
+			})
+			return
+		}
+
+		if path == "/sync-aws" {
+			if !cidrService.syncEnabled {
+				writeErrorResponse(w, http.StatusNotFound,
+					"AWS sync is disabled; set SYNC_AWS_ENABLED=true to enable it")
+				return
+			}
+
+			result, err := cidrService.SyncAWS(ctx)
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				writeRecordLimitResponse(w, limit)
+				return
+			}
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to sync from AWS: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, result)
+			return
+		}
+
+		if path == "/reconcile-aws" {
+			if !cidrService.syncEnabled {
+				writeErrorResponse(w, http.StatusNotFound,
+					"AWS sync is disabled; set SYNC_AWS_ENABLED=true to enable it")
+				return
+			}
+
+			// Only an explicit dryRun=false deletes anything.
+			result, err := cidrService.ReconcileAWS(ctx, r.URL.Query().Get("dryRun") != "false")
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to reconcile with AWS: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, result)
+			return
+		}
+
+		if path == "/import" {
+			if err := checkImportContentType(r.Header.Get("Content-Type")); err != nil {
+				writeErrorResponse(w, http.StatusUnsupportedMediaType, err.Error())
+				return
+			}
+			rows, err := parseImportCSV(r.Body)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			result, err := cidrService.Import(ctx, rows, r.URL.Query().Get("dryRun") == "true")
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				writeRecordLimitResponse(w, limit)
+				return
+			}
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to import CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, result)
+			return
+		}
+
+		if path == "/restore" {
+			mode, err := parseRestoreMode(r.URL.Query().Get("mode"))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			var backup Backup
+			if errs := decodeJSONBody(r.Body, &backup); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			if errs := backup.validate(); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+
+			result, err := cidrService.Restore(ctx, backup, mode)
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				writeRecordLimitResponse(w, limit)
+				return
+			}
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to restore CIDRs: %v", err))
+				return
+			}
+			if len(result.Conflicts) > 0 {
+				writeJSONResponse(w, http.StatusConflict, result)
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, result)
+			return
+		}
+
+		if path == "/approve" || path == "/reject" {
+			writeApprovalResponse(w, r, cidrService, path)
+			return
+		}
+
+		if path == "/lock/acquire" || path == "/lock/heartbeat" || path == "/lock/release" {
+			writeLockResponse(w, r, cidrService, path)
+			return
+		}
+
+		if path == "/lint/fix" {
+			if adminToken() == "" {
+				writeErrorResponse(w, http.StatusNotFound,
+					"lint fixes are disabled; set ADMIN_TOKEN to enable them")
+				return
+			}
+			if !hasBearerToken(r.Header.Get("Authorization"), adminToken()) {
+				writeErrorResponse(w, http.StatusUnauthorized, "admin token required")
+				return
+			}
+			result, err := cidrService.FixLint(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to fix CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, result)
+			return
+		}
+
+		if path == "/sweep" {
+			if adminToken() == "" {
+				writeErrorResponse(w, http.StatusNotFound,
+					"manual sweeps are disabled; set ADMIN_TOKEN to enable them")
+				return
+			}
+			if !hasBearerToken(r.Header.Get("Authorization"), adminToken()) {
+				writeErrorResponse(w, http.StatusUnauthorized, "admin token required")
+				return
+			}
+			removed, err := cidrService.SweepExpired(ctx)
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, err,
+					fmt.Sprintf("failed to sweep expired CIDRs: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusOK, SweepResult{Removed: removed, Count: len(removed)})
+			return
+		}
+
+		if path == "/allocate-contiguous" {
+			var contiguousBody contiguousRequest
+			if errs := decodeJSONBody(r.Body, &contiguousBody); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			if errs := contiguousBody.validate(); errs != nil {
+				writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+				return
+			}
+			record := contiguousBody.record()
+
+			opts, err := parseAllocationOptions(r.URL.Query().Get)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if opts.Prefix == 0 {
+				opts.Prefix = contiguousBody.Prefix
+			}
+			if opts.Pool == "" {
+				opts.Pool = contiguousBody.Pool
+			}
+			if opts.Tenant == "" {
+				opts.Tenant = contiguousBody.Tenant
+			}
+			if opts.Account == "" {
+				opts.Account = contiguousBody.Account
+			}
+
+			pool, err := cidrService.placePool(opts.Pool, record.Tags)
+			if err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+			opts.Pool = pool
+			ctx = cidrService.withTableRoute(ctx, opts.Tenant, opts.Pool)
+
+			if _, _, _, err := cidrService.resolveAllocation(opts); err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+
+			allocation, err := cidrService.AllocateContiguous(ctx, record, contiguousBody.Count, contiguousBody.Aggregate, opts)
+			var duplicate *DuplicateKeyError
+			if errors.As(err, &duplicate) {
+				writeDuplicateKeyResponse(w, duplicate)
+				return
+			}
+			var invalid *ValidationError
+			if errors.As(err, &invalid) {
+				writeJSONResponse(w, rejectedStatus(), validationErrorBody(invalid.Fields))
+				return
+			}
+			var noRun *NoContiguousRunError
+			if errors.As(err, &noRun) {
+				writeAllocationFailedResponse(w, noRun, noContiguousRunCode)
+				return
+			}
+			var reached *HeadroomError
+			if errors.As(err, &reached) {
+				writeAllocationFailedResponse(w, reached, headroomReachedCode)
+				return
+			}
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				writeAllocationFailedResponse(w, limit, recordLimitCode)
+				return
+			}
+			if errors.Is(err, errWriteConflict) {
+				writeErrorResponse(w, http.StatusConflict, fmt.Sprintf("failed to allocate CIDR: %v", err))
+				return
+			}
+			if err != nil {
+				writeServiceError(w, rejectedStatus(), err,
+					fmt.Sprintf("failed to allocate CIDR: %v", err))
+				return
+			}
+			writeJSONResponse(w, http.StatusCreated, allocation)
+			return
+		}
+
+		var requestBody registrationRequest
+		if errs := decodeJSONBody(r.Body, &requestBody); errs != nil {
+			writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+			return
+		}
+
+		// On /allocate, or without a cidr, the request is an allocation of the
+		// next free block.
+		allocate := path == "/allocate" || requestBody.CIDR == ""
+		if errs := requestBody.validate(allocate); errs != nil {
+			writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+			return
+		}
+		record := requestBody.record()
+
+		// POST /request holds the block as pending until an approver
+		// activates it.
+		if path == "/request" {
+			if approverToken() == "" {
+				writeErrorResponse(w, http.StatusNotFound,
+					"approval workflow is disabled; set APPROVER_TOKEN to enable it")
+				return
+			}
+			record.Status = recordStatusPending
+		}
+
+		if allocate {
+			opts, err := parseAllocationOptions(r.URL.Query().Get)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if opts.Prefix == 0 {
+				opts.Prefix = requestBody.Prefix
+			}
+			if opts.Pool == "" {
+				opts.Pool = requestBody.Pool
+			}
+			if opts.Tenant == "" {
+				opts.Tenant = requestBody.Tenant
+			}
+			if opts.Account == "" {
+				opts.Account = requestBody.Account
+			}
+
+			pool, err := cidrService.placePool(opts.Pool, record.Tags)
+			if err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+			opts.Pool = pool
+			ctx = cidrService.withTableRoute(ctx, opts.Tenant, opts.Pool)
+
+			if _, _, _, err := cidrService.resolveAllocation(opts); err != nil {
+				writeErrorResponse(w, rejectedStatus(), err.Error())
+				return
+			}
+
+			stored, err := cidrService.AllocateCIDR(ctx, record, opts)
+			var duplicate *DuplicateKeyError
+			if errors.As(err, &duplicate) {
+				writeDuplicateKeyResponse(w, duplicate)
+				return
+			}
+			var invalid *ValidationError
+			if errors.As(err, &invalid) {
+				writeJSONResponse(w, rejectedStatus(), validationErrorBody(invalid.Fields))
+				return
+			}
+			var exhausted *ExhaustedError
+			if errors.As(err, &exhausted) {
+				writeAllocationFailedResponse(w, exhausted, poolExhaustedCode)
+				return
+			}
+			var reached *HeadroomError
+			if errors.As(err, &reached) {
+				writeAllocationFailedResponse(w, reached, headroomReachedCode)
+				return
+			}
+			var limit *RecordLimitError
+			if errors.As(err, &limit) {
+				writeAllocationFailedResponse(w, limit, recordLimitCode)
+				return
+			}
+			if errors.Is(err, errWriteConflict) {
+				writeErrorResponse(w, http.StatusConflict, fmt.Sprintf("failed to allocate CIDR: %v", err))
+				return
+			}
+			if err != nil {
+				writeServiceError(w, rejectedStatus(), err,
+					fmt.Sprintf("failed to allocate CIDR: %v", err))
+				return
+			}
+
+			if restStrict() {
+				writeCreatedResponse(w, stored.CIDR)
+				return
+			}
+
+			body := map[string]interface{}{
+				"message": "CIDR allocated successfully",
+				"key":     stored.Key,
+				"cidr":    stored.CIDR,
+				"record":  stored,
+			}
+			if opts.Prefer != "" {
+				body["range"] = cidrService.allocationRange(opts, stored.CIDR)
+			}
+			if source := cidrService.allocationSource(opts, stored.CIDR); source != "" {
+				body["source"] = source
+			}
+			writeJSONResponse(w, http.StatusCreated, body)
+			return
+		}
+
+		requireParent, err := parseRequireParent("requireParent parameter", r.URL.Query().Get("requireParent"))
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx = cidrService.withTableRoute(ctx, record.Tenant, record.Pool)
+		stored, err := cidrService.RegisterCIDR(ctx, record, RegistrationOptions{RequireParent: requireParent})
+		var duplicate *DuplicateKeyError
+		if errors.As(err, &duplicate) {
+			writeDuplicateKeyResponse(w, duplicate)
+			return
+		}
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			writeJSONResponse(w, rejectedStatus(), validationErrorBody(invalid.Fields))
+			return
+		}
+		var limit *RecordLimitError
+		if errors.As(err, &limit) {
+			writeRecordLimitResponse(w, limit)
+			return
+		}
+		if errors.Is(err, errWriteConflict) {
+			writeErrorResponse(w, http.StatusConflict, fmt.Sprintf("failed to register CIDR: %v", err))
+			return
+		}
+		if err != nil {
+			writeServiceError(w, rejectedStatus(), err,
+				fmt.Sprintf("failed to register CIDR: %v", err))
+			return
+		}
+
+		if restStrict() {
+			writeCreatedResponse(w, stored.CIDR)
+			return
+		}
+
+		writeJSONResponse(w, http.StatusCreated, map[string]interface{}{
+			"message": "CIDR registered successfully",
+			"key":     stored.Key,
+			"cidr":    stored.CIDR,
+			"record":  stored,
+		})
+
+	case "PATCH":
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeErrorResponse(w, http.StatusBadRequest, "key parameter is required")
+			return
+		}
+		if err := checkPatchContentType(r.Header.Get("Content-Type")); err != nil {
+			writeErrorResponse(w, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+
+		patch, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to read request body: %v", err))
+			return
+		}
+		record, err := cidrService.PatchRecord(ctx, key, patch)
+		if errors.Is(err, errRecordNotFound) {
+			writeErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		}
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			writeJSONResponse(w, rejectedStatus(), validationErrorBody(invalid.Fields))
+			return
+		}
+		if errors.Is(err, errInvalidMergePatch) {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeServiceError(w, rejectedStatus(), err,
+				fmt.Sprintf("failed to patch CIDR: %v", err))
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, record)
+
+	case "DELETE":
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeErrorResponse(w, http.StatusBadRequest, "key parameter is required")
+			return
+		}
+
+		result, err := cidrService.DeleteCIDR(ctx, key, r.URL.Query().Get("cascade") == "true")
+		if err != nil {
+			writeServiceError(w, http.StatusInternalServerError, err,
+				fmt.Sprintf("failed to delete CIDR: %v", err))
+			return
+		}
+
+		if restStrict() {
+			writeJSONResponse(w, http.StatusNoContent, nil)
+			return
+		}
+
+		body := map[string]interface{}{
+			"message": "CIDR deleted successfully",
+			"key":     key,
+			"removed": result.Removed,
+		}
+		if len(result.Orphaned) > 0 {
+			body["warning"] = "the deleted block still has registered children; use cascade=true to delete them too"
+			body["orphaned"] = result.Orphaned
+		}
+		writeJSONResponse(w, http.StatusOK, body)
+
+	case "HEAD":
+		if path == "/cidr" {
+			writeRecordResponse(w, r, cidrService, r.URL.Query().Get("key"))
+			return
+		}
+
+		count, err := cidrService.CountCIDRs(ctx)
+		if err != nil {
+			writeServiceError(w, http.StatusInternalServerError, err,
+				fmt.Sprintf("failed to count CIDRs: %v", err))
+			return
+		}
+		setCORSHeaders(w)
+		w.Header().Set(totalCountHeader, strconv.Itoa(count))
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// writeApprovalResponse answers POST /approve?key=<key> and
+// POST /reject?key=<key>, which only approvers may call.
+func writeApprovalResponse(w http.ResponseWriter, r *http.Request, cidrService *CIDRService, path string) {
+	if approverToken() == "" {
+		writeErrorResponse(w, http.StatusNotFound,
+			"approval workflow is disabled; set APPROVER_TOKEN to enable it")
+		return
+	}
+	if !isApprover(r.Header.Get("Authorization")) {
+		writeErrorResponse(w, http.StatusUnauthorized, "approver token required")
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "key parameter is required")
+		return
+	}
+
+	action, message := cidrService.ApproveRequest, "request approved"
+	if path == "/reject" {
+		action, message = cidrService.RejectRequest, "request rejected"
+	}
+
+	record, err := action(r.Context(), key)
+	if errors.Is(err, errRecordNotFound) {
+		writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, errNotPending) {
+		writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeServiceError(w, http.StatusInternalServerError, err,
+			fmt.Sprintf("failed to update request: %v", err))
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"message": message,
+		"record":  record,
+	})
+}
+
+// writeLockResponse answers POST /lock/acquire, /lock/heartbeat and
+// /lock/release.
+func writeLockResponse(w http.ResponseWriter, r *http.Request, cidrService *CIDRService, path string) {
+	if cidrService.lockTableName == "" {
+		writeErrorResponse(w, http.StatusNotFound, "locks are disabled; set LOCK_TABLE_NAME to enable them")
+		return
+	}
+
+	var lockBody lockRequest
+	if errs := decodeJSONBody(r.Body, &lockBody); errs != nil {
+		writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+		return
+	}
+	if errs := lockBody.validate(); errs != nil {
+		writeJSONResponse(w, http.StatusBadRequest, validationErrorBody(errs))
+		return
+	}
+
+	var lease *Lease
+	var err error
+	switch path {
+	case "/lock/acquire":
+		lease, err = cidrService.AcquireLock(r.Context(), lockBody.Name, lockBody.Owner, lockBody.ttl(), time.Now())
+	case "/lock/heartbeat":
+		lease, err = cidrService.HeartbeatLock(r.Context(), lockBody.Name, lockBody.Owner, lockBody.ttl(), time.Now())
+	default:
+		err = cidrService.ReleaseLock(r.Context(), lockBody.Name, lockBody.Owner)
+	}
+
+	var held *LockHeldError
+	if errors.As(err, &held) {
+		writeJSONResponse(w, http.StatusConflict, map[string]interface{}{
+			"error":  err.Error(),
+			"holder": held.Holder,
+		})
+		return
+	}
+	if errors.Is(err, errLockNotHeld) {
+		writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeServiceError(w, http.StatusInternalServerError, err,
+			fmt.Sprintf("failed to update lock: %v", err))
+		return
+	}
+	if lease == nil {
+		writeJSONResponse(w, http.StatusOK, map[string]string{"message": "lock released"})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, lease)
+}
+
+// writeRecordResponse answers GET and HEAD /cidr?key=<key> with the stored
+// record, its ETag and its length; HEAD omits the body.
+func writeRecordResponse(w http.ResponseWriter, r *http.Request, cidrService *CIDRService, key string) {
+	if key == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "key parameter is required")
+		return
+	}
+
+	record, err := cidrService.GetRecord(r.Context(), key)
+	if errors.Is(err, errRecordNotFound) {
+		writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeServiceError(w, http.StatusInternalServerError, err,
+			fmt.Sprintf("failed to get CIDR: %v", err))
+		return
+	}
+
+	modified := recordModified(*record)
+	if notModified(r.Header.Get("If-Modified-Since"), modified) {
+		writeNotModified(w, cidrService.cacheHeaders(modified))
+		return
+	}
+
+	etag, err := recordETag(*record)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError,
+			fmt.Sprintf("failed to marshal record: %v", err))
+		return
+	}
+	record.setAge(time.Now())
+	body, err := marshalResponse(record)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError,
+			fmt.Sprintf("failed to marshal record: %v", err))
+		return
+	}
+
+	setCORSHeaders(w)
+	setHeaders(w, cidrService.cacheHeaders(modified))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func main() {
+	migrateFrom := flag.String("migrate-from", "",
+		"copy records from this key-keyed table into the partitioned DYNAMODB_TABLE_NAME and exit")
+	flag.Parse()
+
+	if err := loadTagsFormat(); err != nil {
+		log.Fatalf("Invalid tags format: %v", err)
+	}
+
+	if *migrateFrom != "" {
+		ctx := context.Background()
+		cidrService, err := NewCIDRService(ctx)
+		if err != nil {
+			log.Fatalf("Failed to initialize CIDR service: %v", err)
+		}
+
+		count, err := cidrService.MigrateToPartitioned(ctx, *migrateFrom)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		log.Printf("Migrated %d records from %s", count, *migrateFrom)
+		return
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	basePath = strings.TrimRight(os.Getenv("BASE_PATH"), "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		log.Fatalf("BASE_PATH must start with '/', got %q", basePath)
+	}
+	if err := loadResponseNaming(); err != nil {
+		log.Fatalf("Invalid response naming: %v", err)
+	}
+	if err := loadRequestSigning(); err != nil {
+		log.Fatalf("Invalid request signing: %v", err)
+	}
+	if err := loadRedaction(); err != nil {
+		log.Fatalf("Invalid field redaction: %v", err)
+	}
+	if err := loadJWTAuth(); err != nil {
+		log.Fatalf("Invalid JWT authentication: %v", err)
+	}
+
+	sweepInterval := defaultSweepInterval
+	if value := os.Getenv("SWEEP_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid SWEEP_INTERVAL %q: %v", value, err)
+		}
+		sweepInterval = interval
+	}
+
+	// Validate the configuration before listening rather than failing each
+	// request with the same error.
+	if _, err := getCIDRService(context.Background()); err != nil {
+		log.Fatalf("Failed to initialize CIDR service: %v", err)
+	}
+
+	for _, route := range routes {
+		http.Handle(basePath+route, withRequestIDMiddleware(withXMLNegotiation(withRedaction(withResponseVersion(http.HandlerFunc(handleCIDRs))))))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if sweepInterval > 0 {
+		go runSweeper(ctx, sweepInterval)
+	}
+
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("Starting server on port %s", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error during server shutdown: %v", err)
+	}
+	if service, err := getCIDRService(context.Background()); err == nil {
+		service.waitNotifications()
+	}
+}
+
+// runSweeper deletes expired records every interval until ctx is cancelled.
+func runSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if readOnly() {
+				continue
+			}
+
+			cidrService, err := getCIDRService(ctx)
+			if err != nil {
+				log.Printf("Sweeper failed to initialize CIDR service: %v", err)
+				continue
+			}
+
+			removed, err := cidrService.SweepExpired(ctx)
+			if err != nil {
+				log.Printf("Sweeper error: %v", err)
+			}
+			for _, record := range removed {
+				log.Printf("Sweeper removed expired record %s (%s)", record.Key, record.CIDR)
+			}
+		}
 	}
 }
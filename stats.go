@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// BaseUtilization is the share of a permitted base's address space taken by
+// registered blocks.
+type BaseUtilization struct {
+	Base        string  `json:"base"`
+	Records     int     `json:"records"`
+	Capacity    uint64  `json:"capacity"`
+	Allocated   uint64  `json:"allocated"`
+	Available   uint64  `json:"available"`
+	Utilization float64 `json:"utilization"`
+	// Headroom is set when RESERVE_HEADROOM is configured.
+	Headroom *HeadroomUsage `json:"headroom,omitempty"`
+}
+
+// HeadroomUsage is the part of a base's free space RESERVE_HEADROOM holds
+// back, counting blocks at ALLOCATION_PREFIX. Remaining is less than Reserved
+// once emergency allocations have used some of it.
+type HeadroomUsage struct {
+	Reserved    uint64 `json:"reserved"`
+	Remaining   uint64 `json:"remaining"`
+	Allocatable uint64 `json:"allocatable"`
+}
+
+type Stats struct {
+	Records int               `json:"records"`
+	Bases   []BaseUtilization `json:"bases"`
+}
+
+// GetStats reports utilization for every permitted base. Expired
+// reservations do not count as allocated.
+func (c *CIDRService) GetStats(ctx context.Context) (*Stats, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+	records = withoutExpired(records, time.Now())
+
+	stats := &Stats{
+		Records: len(records),
+		Bases:   []BaseUtilization{},
+	}
+	for _, base := range c.permittedBases() {
+		if utilization, ok := baseUtilization(base, records); ok {
+			if c.headroom != (headroom{}) {
+				utilization.Headroom = headroomUsage(utilization, c.headroom.addresses(utilization.Capacity, c.allocationPrefix))
+			}
+			stats.Bases = append(stats.Bases, utilization)
+		}
+	}
+
+	return stats, nil
+}
+
+// baseUtilization counts the addresses of base covered by records. Blocks are
+// clipped to the base and merged first, so nested or overlapping records (a
+// reserved /16 and the /24s inside it) are only counted once. Only IPv4 bases
+// are supported.
+func baseUtilization(base *net.IPNet, records []CIDRRecord) (BaseUtilization, bool) {
+	baseStart, baseEnd, ok := ipv4Range(base)
+	if !ok {
+		return BaseUtilization{}, false
+	}
+
+	type span struct{ start, end uint64 }
+	var spans []span
+	count := 0
+	for _, record := range records {
+		_, network, err := parseCIDR(record.CIDR)
+		if err != nil {
+			continue
+		}
+		start, end, ok := ipv4Range(network)
+		if !ok || end <= baseStart || start >= baseEnd {
+			continue
+		}
+		count++
+		spans = append(spans, span{max(start, baseStart), min(end, baseEnd)})
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+
+	var allocated, covered uint64
+	for _, s := range spans {
+		if s.start < covered {
+			s.start = covered
+		}
+		if s.end > s.start {
+			allocated += s.end - s.start
+			covered = s.end
+		}
+	}
+
+	capacity := baseEnd - baseStart
+	return BaseUtilization{
+		Base:        base.String(),
+		Records:     count,
+		Capacity:    capacity,
+		Allocated:   allocated,
+		Available:   capacity - allocated,
+		Utilization: float64(allocated) / float64(capacity) * 100,
+	}, true
+}
+
+func headroomUsage(utilization BaseUtilization, reserved uint64) *HeadroomUsage {
+	remaining := min(reserved, utilization.Available)
+	return &HeadroomUsage{
+		Reserved:    reserved,
+		Remaining:   remaining,
+		Allocatable: utilization.Available - remaining,
+	}
+}
+
+// ipv4Range returns the half-open address range [start, end) of an IPv4
+// network. IPv4-mapped IPv6 networks such as ::ffff:10.0.0.0/104 are treated
+// as the equivalent IPv4 network.
+func ipv4Range(network *net.IPNet) (start, end uint64, ok bool) {
+	ip := network.IP.To4()
+	if ip == nil {
+		return 0, 0, false
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits == 128 {
+		if ones < 96 {
+			return 0, 0, false
+		}
+		ones -= 96
+	}
+
+	start = uint64(ipv4ToUint32(ip))
+	return start, start + uint64(1)<<uint(32-ones), true
+}
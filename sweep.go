@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// isExpired reports whether the record carries an expiresAt that has passed.
+// DynamoDB TTL can take up to 48 hours to remove such items, so callers treat
+// them as gone as soon as they expire.
+func isExpired(record CIDRRecord, now time.Time) bool {
+	return record.ExpiresAt != 0 && record.ExpiresAt <= now.Unix()
+}
+
+// withoutExpired returns the records that have not expired at now.
+func withoutExpired(records []CIDRRecord, now time.Time) []CIDRRecord {
+	live := make([]CIDRRecord, 0, len(records))
+	for _, record := range records {
+		if !isExpired(record, now) {
+			live = append(live, record)
+		}
+	}
+	return live
+}
+
+// isSweepable reports whether the sweeper removes the record: its expiresAt
+// or, for a scheduled reservation, the end of its active window has passed.
+func isSweepable(record CIDRRecord, now time.Time) bool {
+	return isExpired(record, now) || (record.ActiveUntil != 0 && record.ActiveUntil <= now.Unix())
+}
+
+// SweepResult is the result of POST /sweep.
+type SweepResult struct {
+	Removed []CIDRRecord `json:"removed"`
+	Count   int          `json:"count"`
+}
+
+// SweepExpired hard-deletes every record whose expiresAt or activeUntil has
+// passed and returns the records removed. Each delete is conditional on the
+// item still being expired, so a key re-registered since the scan is left
+// alone.
+func (c *CIDRService) SweepExpired(ctx context.Context) ([]CIDRRecord, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	now := time.Now()
+	removed := []CIDRRecord{}
+	for _, record := range records {
+		if !isSweepable(record, now) {
+			continue
+		}
+
+		_, err := c.client(ctx).DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:           aws.String(c.table(ctx)),
+			Key:                 c.itemKey(record),
+			ConditionExpression: aws.String("#e <= :now OR #u <= :now"),
+			ExpressionAttributeNames: map[string]string{
+				"#e": "expiresAt",
+				"#u": "activeUntil",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+			},
+		})
+		if err != nil {
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				continue
+			}
+			return removed, fmt.Errorf("failed to delete expired record '%s': %w", record.Key, err)
+		}
+		removed = append(removed, record)
+		c.countAdded(ctx, -1)
+		c.notifyRecord(ctx, changeActionExpire, record)
+	}
+
+	return removed, nil
+}
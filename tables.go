@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Scopes a TABLE_ROUTES entry can route by.
+const (
+	tableRouteTenant = "tenant"
+	tableRoutePool   = "pool"
+)
+
+// tableRoute sends the records of one tenant or pool to their own table,
+// optionally through a client with its own endpoint or assumed role.
+type tableRoute struct {
+	Scope    string
+	Value    string
+	Table    string
+	Endpoint string
+	RoleARN  string
+}
+
+// parseTableRoutes parses TABLE_ROUTES, a comma-separated list of
+// scope:value=table entries such as "tenant:acme=cidr-acme,pool:prod=cidr-prod".
+// An entry may add ;endpoint=<url> and ;role=<arn> options for a table
+// served by another endpoint or account.
+func parseTableRoutes(value string) ([]tableRoute, error) {
+	var routes []tableRoute
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		options := strings.Split(entry, ";")
+		target, table, _ := strings.Cut(options[0], "=")
+		scope, name, _ := strings.Cut(target, ":")
+		if (scope != tableRouteTenant && scope != tableRoutePool) || name == "" || table == "" {
+			return nil, fmt.Errorf("invalid TABLE_ROUTES entry %q: want tenant:<name>=<table> or pool:<name>=<table>", entry)
+		}
+		if seen[target] {
+			return nil, fmt.Errorf("%s is routed more than once in TABLE_ROUTES", target)
+		}
+		seen[target] = true
+
+		route := tableRoute{Scope: scope, Value: name, Table: table}
+		for _, option := range options[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			switch {
+			case key == "endpoint" && value != "":
+				route.Endpoint = value
+			case key == "role" && strings.HasPrefix(value, "arn:"):
+				route.RoleARN = value
+			default:
+				return nil, fmt.Errorf("invalid TABLE_ROUTES option %q in %q: want endpoint=<url> or role=<arn>", option, entry)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// recordTable is a table records are read from and written to, with the
+// client that reaches it.
+type recordTable struct {
+	name   string
+	client *dynamodb.Client
+}
+
+// routedTables builds the table of each route, keyed by scope:value. Routes
+// without an endpoint or role share the default client.
+func routedTables(cfg aws.Config, routes []tableRoute, defaultClient *dynamodb.Client, dynamoOptions []func(*dynamodb.Options)) map[string]recordTable {
+	tables := make(map[string]recordTable, len(routes))
+	for _, route := range routes {
+		table := recordTable{name: route.Table, client: defaultClient}
+		if route.Endpoint != "" || route.RoleARN != "" {
+			routeCfg := withAssumedRole(cfg, assumeRoleSettings{RoleARN: route.RoleARN}, sts.NewFromConfig(cfg))
+			options := dynamoOptions
+			if route.Endpoint != "" {
+				endpoint := route.Endpoint
+				options = append(options[:len(options):len(options)], func(o *dynamodb.Options) {
+					o.BaseEndpoint = aws.String(endpoint)
+				})
+			}
+			table.client = dynamodb.NewFromConfig(routeCfg, options...)
+		}
+		tables[route.Scope+":"+route.Value] = table
+	}
+	return tables
+}
+
+type recordTableKey struct{}
+
+// withTableRoute returns ctx routed to the table of tenant or, failing that,
+// of pool. Without a route for either, ctx is returned unchanged and the
+// default table is used.
+func (c *CIDRService) withTableRoute(ctx context.Context, tenant, pool string) context.Context {
+	for _, key := range []string{tableRouteTenant + ":" + tenant, tableRoutePool + ":" + pool} {
+		if table, ok := c.tables[key]; ok {
+			return context.WithValue(ctx, recordTableKey{}, &table)
+		}
+	}
+	return ctx
+}
+
+// routedTable returns the table ctx was routed to, or nil for the default.
+func routedTable(ctx context.Context) *recordTable {
+	table, _ := ctx.Value(recordTableKey{}).(*recordTable)
+	return table
+}
+
+// table is the name of the records table for ctx.
+func (c *CIDRService) table(ctx context.Context) string {
+	if table := routedTable(ctx); table != nil {
+		return table.name
+	}
+	return c.tableName
+}
+
+// client is the DynamoDB client for the records table of ctx.
+func (c *CIDRService) client(ctx context.Context) *dynamodb.Client {
+	if table := routedTable(ctx); table != nil {
+		return table.client
+	}
+	return c.dynamoClient
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Storage formats of record tags.
+const (
+	tagsFormatMap  = "map"
+	tagsFormatJSON = "json"
+)
+
+// tagsFormat is how tags are written, configured by TAGS_FORMAT and set by
+// loadTagsFormat at startup.
+var tagsFormat = tagsFormatMap
+
+func loadTagsFormat() error {
+	format, err := parseTagsFormat(os.Getenv("TAGS_FORMAT"))
+	if err != nil {
+		return err
+	}
+	tagsFormat = format
+	return nil
+}
+
+func parseTagsFormat(value string) (string, error) {
+	switch value {
+	case "", tagsFormatMap:
+		return tagsFormatMap, nil
+	case tagsFormatJSON:
+		return tagsFormatJSON, nil
+	}
+	return "", fmt.Errorf("TAGS_FORMAT must be %q or %q, got %q", tagsFormatMap, tagsFormatJSON, value)
+}
+
+// Tags are free-form labels on a record. In DynamoDB they are a native map
+// or, with TAGS_FORMAT=json, a JSON object in a string attribute. Both are
+// read back whatever the setting, so a table written one way can be served
+// by a service configured the other.
+type Tags map[string]string
+
+// MarshalDynamoDBAttributeValue writes tags in the configured format. Empty
+// tags are NULL, which omitempty leaves out of the item.
+func (t Tags) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	if len(t) == 0 {
+		return &types.AttributeValueMemberNULL{Value: true}, nil
+	}
+	if tagsFormat == tagsFormatJSON {
+		data, err := json.Marshal(map[string]string(t))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tags: %w", err)
+		}
+		return &types.AttributeValueMemberS{Value: string(data)}, nil
+	}
+	return attributevalue.Marshal(map[string]string(t))
+}
+
+// UnmarshalDynamoDBAttributeValue reads tags stored in either format.
+func (t *Tags) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	var tags map[string]string
+	switch v := av.(type) {
+	case *types.AttributeValueMemberNULL:
+	case *types.AttributeValueMemberS:
+		if err := json.Unmarshal([]byte(v.Value), &tags); err != nil {
+			return fmt.Errorf("tags attribute is not a JSON object of strings: %w", err)
+		}
+	default:
+		if err := attributevalue.Unmarshal(av, &tags); err != nil {
+			return fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+	}
+	*t = tags
+	return nil
+}
+
+// parseRequiredTags parses REQUIRED_TAGS, a comma-separated list of tag keys
+// every registered record must carry, such as "owner,cost-center".
+func parseRequiredTags(value string) ([]string, error) {
+	var required []string
+	seen := map[string]bool{}
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("REQUIRED_TAGS lists %q twice", key)
+		}
+		seen[key] = true
+		required = append(required, key)
+	}
+	return required, nil
+}
+
+// ValidationError reports a record whose fields break a configured rule,
+// with the same per-field messages as a malformed request body.
+type ValidationError struct {
+	Fields fieldErrors
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field, message := range e.Fields {
+		fields = append(fields, fmt.Sprintf("%s %s", field, message))
+	}
+	sort.Strings(fields)
+	return "invalid record: " + strings.Join(fields, ", ")
+}
+
+// Limits on a tag, the same as AWS resource tags have.
+const (
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// systemTags are set by the service itself, so callers may not set them and
+// ALLOWED_TAG_KEYS need not list them.
+var systemTags = map[string]bool{syncSourceTag: true, allocationSourceTag: true}
+
+// parseAllowedTagKeys parses ALLOWED_TAG_KEYS, the comma-separated tag keys
+// records may carry. Empty allows any key.
+func parseAllowedTagKeys(value string, required []string) (map[string]bool, error) {
+	var allowed map[string]bool
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if message := tagKeyError(key); message != "" {
+			return nil, fmt.Errorf("ALLOWED_TAG_KEYS entry %q: %s", key, message)
+		}
+		if allowed == nil {
+			allowed = make(map[string]bool)
+		}
+		allowed[key] = true
+	}
+	for _, key := range required {
+		if allowed != nil && !allowed[key] {
+			return nil, fmt.Errorf("REQUIRED_TAGS lists %q, which ALLOWED_TAG_KEYS does not allow", key)
+		}
+	}
+	return allowed, nil
+}
+
+// printableTagText reports whether s holds only printable characters, which
+// rules out control characters such as newlines and tabs and invisible ones
+// such as zero-width spaces.
+func printableTagText(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagKeyError says what is wrong with a tag key, or "" if nothing is.
+func tagKeyError(key string) string {
+	switch {
+	case key == "":
+		return "key must not be empty"
+	case utf8.RuneCountInString(key) > maxTagKeyLength:
+		return fmt.Sprintf("key must be at most %d characters", maxTagKeyLength)
+	case strings.TrimSpace(key) != key:
+		return "key must not start or end with whitespace"
+	case !printableTagText(key):
+		return "key must not contain control or non-printing characters"
+	}
+	return ""
+}
+
+// tagValueError says what is wrong with a tag value, or "" if nothing is.
+func tagValueError(value string) string {
+	switch {
+	case utf8.RuneCountInString(value) > maxTagValueLength:
+		return fmt.Sprintf("value must be at most %d characters", maxTagValueLength)
+	case !printableTagText(value):
+		return "value must not contain control or non-printing characters"
+	}
+	return ""
+}
+
+// checkTags rejects a record with a malformed tag, with a tag key that
+// ALLOWED_TAG_KEYS does not list, setting one of the systemTags, or missing
+// any of the REQUIRED_TAGS or carrying one with an empty value, naming each
+// as a "tags.<key>" field. A system tag is accepted unchanged from stored,
+// the tags the record already carries.
+func (c *CIDRService) checkTags(record CIDRRecord, stored Tags) error {
+	errs := fieldErrors{}
+	for key, value := range record.Tags {
+		message := tagKeyError(key)
+		if message == "" {
+			message = tagValueError(value)
+		}
+		switch {
+		case message != "":
+		case systemTags[key]:
+			if storedValue, kept := stored[key]; !kept || storedValue != value {
+				message = "is set by the service and cannot be changed"
+			}
+		case c.allowedTagKeys != nil && !c.allowedTagKeys[key]:
+			message = "is not an allowed tag key"
+		}
+		if message != "" {
+			errs["tags."+key] = message
+		}
+	}
+	for _, key := range c.requiredTags {
+		if _, set := errs["tags."+key]; !set && record.Tags[key] == "" {
+			errs["tags."+key] = "required"
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: errs}
+}
@@ -27,11 +27,89 @@ resource "aws_dynamodb_table" "cidr_registry" {
     type = "S"
   }
 
+  ttl {
+    attribute_name = "expiresAt"
+    enabled        = true
+  }
+
   tags = merge(var.default_tags, {
     Name = var.table_name
   })
 }
 
+# DynamoDB table for the audit log of registrations and allocations
+resource "aws_dynamodb_table" "cidr_audit" {
+  name         = "${var.table_name}-audit"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "key"
+  range_key    = "at"
+
+  attribute {
+    name = "key"
+    type = "S"
+  }
+
+  attribute {
+    name = "at"
+    type = "S"
+  }
+
+  attribute {
+    name = "feed"
+    type = "S"
+  }
+
+  # Orders entries of every key by time for GET /history
+  global_secondary_index {
+    name            = "feed-index"
+    hash_key        = "feed"
+    range_key       = "at"
+    projection_type = "ALL"
+  }
+
+  tags = merge(var.default_tags, {
+    Name = "${var.table_name}-audit"
+  })
+}
+
+# DynamoDB table for deleted blocks that allocation reuses first when
+# recycle_released is set
+resource "aws_dynamodb_table" "cidr_released" {
+  name         = "${var.table_name}-released"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "cidr"
+
+  attribute {
+    name = "cidr"
+    type = "S"
+  }
+
+  tags = merge(var.default_tags, {
+    Name = "${var.table_name}-released"
+  })
+}
+
+# DynamoDB table for the leases of POST /lock/acquire
+resource "aws_dynamodb_table" "cidr_locks" {
+  name         = "${var.table_name}-locks"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "name"
+
+  attribute {
+    name = "name"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "expiresAt"
+    enabled        = true
+  }
+
+  tags = merge(var.default_tags, {
+    Name = "${var.table_name}-locks"
+  })
+}
+
 # IAM role for Lambda
 resource "aws_iam_role" "cidr_lambda_role" {
   name = "${var.function_name}-role"
@@ -65,9 +143,16 @@ resource "aws_iam_policy" "dynamodb_policy" {
           "dynamodb:UpdateItem",
           "dynamodb:DeleteItem",
           "dynamodb:Scan",
-          "dynamodb:Query"
+          "dynamodb:Query",
+          "dynamodb:BatchWriteItem"
+        ]
+        Resource = [
+          aws_dynamodb_table.cidr_registry.arn,
+          aws_dynamodb_table.cidr_audit.arn,
+          "${aws_dynamodb_table.cidr_audit.arn}/index/*",
+          aws_dynamodb_table.cidr_released.arn,
+          aws_dynamodb_table.cidr_locks.arn
         ]
-        Resource = aws_dynamodb_table.cidr_registry.arn
       }
     ]
   })
@@ -79,6 +164,34 @@ resource "aws_iam_role_policy_attachment" "lambda_dynamodb_policy" {
   policy_arn = aws_iam_policy.dynamodb_policy.arn
 }
 
+# IAM policy for POST /sync-aws and POST /reconcile-aws. Roles named in
+# aws_sync_targets must trust the Lambda role.
+resource "aws_iam_policy" "aws_sync_policy" {
+  count = var.enable_aws_sync ? 1 : 0
+  name  = "${var.function_name}-aws-sync-policy"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "ec2:DescribeVpcs",
+          "ec2:DescribeSubnets",
+          "sts:AssumeRole"
+        ]
+        Resource = "*"
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy_attachment" "lambda_aws_sync_policy" {
+  count      = var.enable_aws_sync ? 1 : 0
+  role       = aws_iam_role.cidr_lambda_role.name
+  policy_arn = aws_iam_policy.aws_sync_policy[0].arn
+}
+
 # Attach basic execution role for Lambda
 resource "aws_iam_role_policy_attachment" "lambda_basic_execution" {
   role       = aws_iam_role.cidr_lambda_role.name
@@ -98,6 +211,12 @@ resource "aws_lambda_function" "cidr_finder" {
   environment {
     variables = {
       DYNAMODB_TABLE_NAME = aws_dynamodb_table.cidr_registry.name
+      AUDIT_TABLE_NAME    = aws_dynamodb_table.cidr_audit.name
+      SYNC_AWS_ENABLED    = tostring(var.enable_aws_sync)
+      SYNC_AWS_TARGETS    = var.aws_sync_targets
+      RECYCLE_RELEASED    = tostring(var.recycle_released)
+      RELEASED_TABLE_NAME = aws_dynamodb_table.cidr_released.name
+      LOCK_TABLE_NAME     = aws_dynamodb_table.cidr_locks.name
     }
   }
 
@@ -114,8 +233,8 @@ resource "aws_apigatewayv2_api" "cidr_api" {
 
   cors_configuration {
     allow_credentials = false
-    allow_headers     = ["content-type", "authorization"]
-    allow_methods     = ["GET", "POST", "DELETE", "OPTIONS"]
+    allow_headers     = ["content-type", "authorization", "x-signature", "x-timestamp"]
+    allow_methods     = ["GET", "HEAD", "POST", "PATCH", "DELETE", "OPTIONS"]
     allow_origins     = ["*"]
     max_age          = 86400
   }
@@ -142,12 +261,258 @@ resource "aws_apigatewayv2_route" "get_next_cidr" {
   target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
 }
 
+resource "aws_apigatewayv2_route" "get_describe_cidr" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /describe"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
 resource "aws_apigatewayv2_route" "post_cidr" {
   api_id    = aws_apigatewayv2_api.cidr_api.id
   route_key = "POST /"
   target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
 }
 
+resource "aws_apigatewayv2_route" "post_allocate" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /allocate"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_plan" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /plan"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_stats" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /stats"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_backup" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /backup"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_restore" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /restore"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_resize" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /resize"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_cidr" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /cidr"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "head_cidr" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "HEAD /cidr"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "head_cidrs" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "HEAD /"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_sync_aws" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /sync-aws"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_adjacent" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /adjacent"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_reassign" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /reassign"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_keys" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /keys"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_supernet_of" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /supernet-of"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_request" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /request"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_approve" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /approve"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_reject" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /reject"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_history" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /history"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_health" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /health"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_version" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /version"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "patch_cidr" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "PATCH /"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_lint" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /lint"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "fix_lint" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /lint/fix"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_delete_batch" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /delete-batch"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_capacity" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /capacity"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_whoami" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /whoami"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_forecast" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /forecast"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_fragmentation" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /fragmentation"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_sweep" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /sweep"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_status_breakdown" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /status-breakdown"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_import" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /import"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_lock_acquire" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /lock/acquire"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_lock_heartbeat" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /lock/heartbeat"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_lock_release" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /lock/release"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_available_blocks" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /available-blocks"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_reconcile_aws" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /reconcile-aws"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_metrics_allocations" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /metrics/allocations"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_diff" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /diff"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "post_allocate_contiguous" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "POST /allocate-contiguous"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "get_tree" {
+  api_id    = aws_apigatewayv2_api.cidr_api.id
+  route_key = "GET /tree"
+  target    = "integrations/${aws_apigatewayv2_integration.cidr_integration.id}"
+}
+
 resource "aws_apigatewayv2_route" "delete_cidr" {
   api_id    = aws_apigatewayv2_api.cidr_api.id
   route_key = "DELETE /"
@@ -22,3 +22,18 @@ output "dynamodb_table_arn" {
   description = "ARN of the DynamoDB table"
   value       = aws_dynamodb_table.cidr_registry.arn
 }
+
+output "audit_table_name" {
+  description = "Name of the DynamoDB audit table"
+  value       = aws_dynamodb_table.cidr_audit.name
+}
+
+output "released_table_name" {
+  description = "Name of the DynamoDB table of released blocks"
+  value       = aws_dynamodb_table.cidr_released.name
+}
+
+output "lock_table_name" {
+  description = "Name of the DynamoDB table of lock leases"
+  value       = aws_dynamodb_table.cidr_locks.name
+}
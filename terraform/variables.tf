@@ -22,6 +22,24 @@ variable "lambda_zip_path" {
   default     = "../function.zip"
 }
 
+variable "enable_aws_sync" {
+  description = "Enable POST /sync-aws, which imports VPC and subnet CIDRs from EC2"
+  type        = bool
+  default     = false
+}
+
+variable "aws_sync_targets" {
+  description = "Comma-separated region[=roleArn] entries to import VPCs from; empty means the function's own region"
+  type        = string
+  default     = ""
+}
+
+variable "recycle_released" {
+  description = "Reuse the space of deleted blocks before allocating never-used space"
+  type        = bool
+  default     = false
+}
+
 variable "default_tags" {
   description = "Default tags to apply to all resources"
   type        = map(string)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// TreeNode is a block of GET /tree: the base at the root, a record, or, with
+// Free set, a free block. Children are the blocks directly inside it, in
+// address order.
+type TreeNode struct {
+	CIDR     string      `json:"cidr"`
+	Key      string      `json:"key,omitempty"`
+	Free     bool        `json:"free,omitempty"`
+	Record   *CIDRRecord `json:"record,omitempty"`
+	Children []*TreeNode `json:"children,omitempty"`
+
+	network *net.IPNet
+}
+
+// Tree reads the unexpired records with a single scan and nests those within
+// base under it.
+func (c *CIDRService) Tree(ctx context.Context, base *net.IPNet, free bool) (*TreeNode, error) {
+	records, err := c.GetAllCIDRs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing CIDRs: %w", err)
+	}
+
+	return allocationTree(base, withoutExpired(records, time.Now()), free), nil
+}
+
+// allocationTree nests each record within base under the narrowest record
+// that strictly contains it, or under the base when none does, so records
+// with the same CIDR are siblings. With free, each IPv4 node that has
+// children also lists the space they leave free, as the largest aligned
+// blocks that cover it; the base always does, so an empty base is one free
+// block.
+func allocationTree(base *net.IPNet, records []CIDRRecord, free bool) *TreeNode {
+	root := &TreeNode{CIDR: base.String(), network: base}
+
+	var nodes []*TreeNode
+	for i := range records {
+		_, network, err := parseCIDR(records[i].CIDR)
+		if err != nil || !netContains(base, network) {
+			continue
+		}
+		nodes = append(nodes, &TreeNode{CIDR: records[i].CIDR, Key: records[i].Key, Record: &records[i], network: network})
+	}
+
+	// Sorted by first address and then widest first, every node's parent is
+	// the innermost node still open before it.
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if cmp := bytes.Compare(nodes[i].network.IP, nodes[j].network.IP); cmp != 0 {
+			return cmp < 0
+		}
+		iOnes, _ := nodes[i].network.Mask.Size()
+		jOnes, _ := nodes[j].network.Mask.Size()
+		return iOnes < jOnes
+	})
+	open := []*TreeNode{root}
+	for _, node := range nodes {
+		for len(open) > 1 && !strictlyContains(open[len(open)-1].network, node.network) {
+			open = open[:len(open)-1]
+		}
+		parent := open[len(open)-1]
+		parent.Children = append(parent.Children, node)
+		open = append(open, node)
+	}
+
+	if free && base.IP.To4() != nil {
+		addFreeBlocks(root, true)
+	}
+	return root
+}
+
+// strictlyContains reports whether inner lies within outer and is smaller.
+func strictlyContains(outer, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outerOnes < innerOnes && netContains(outer, inner)
+}
+
+// addFreeBlocks adds the free blocks left between the children of node, and
+// of every node below it, keeping children in address order. Leaf records
+// are left alone, since a record is allocated in full.
+func addFreeBlocks(node *TreeNode, isRoot bool) {
+	if len(node.Children) == 0 && !isRoot {
+		return
+	}
+
+	used := make([]*net.IPNet, len(node.Children))
+	for i, child := range node.Children {
+		used[i] = child.network
+		addFreeBlocks(child, false)
+	}
+	for _, r := range freeRanges(node.network, used) {
+		for _, block := range rangeBlocks(r) {
+			node.Children = append(node.Children, &TreeNode{CIDR: block.String(), Free: true, network: block})
+		}
+	}
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		return bytes.Compare(node.Children[i].network.IP.To4(), node.Children[j].network.IP.To4()) < 0
+	})
+}
+
+// rangeBlocks splits r into the fewest aligned CIDR blocks that cover it, in
+// address order.
+func rangeBlocks(r addrRange) []*net.IPNet {
+	var blocks []*net.IPNet
+	for start := r.start; start < r.end; {
+		prefix := 32
+		for prefix > 0 {
+			size := uint64(1) << uint(32-prefix+1)
+			if start%size != 0 || start+size > r.end {
+				break
+			}
+			prefix--
+		}
+		blocks = append(blocks, &net.IPNet{IP: uint32ToIPv4(uint32(start)), Mask: net.CIDRMask(prefix, 32)})
+		start += uint64(1) << uint(32-prefix)
+	}
+	return blocks
+}
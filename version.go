@@ -0,0 +1,41 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=...".
+// See the Makefile's build target.
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// BuildInfo is the GET /version payload.
+type BuildInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit"`
+	BuildTime     string `json:"buildTime"`
+	ModuleVersion string `json:"moduleVersion"`
+	GoVersion     string `json:"goVersion"`
+}
+
+// buildInfo reports the ldflags variables, the main module version recorded
+// by the Go toolchain ("(devel)" for builds from a checkout) and the Go
+// runtime version.
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:       version,
+		Commit:        commit,
+		BuildTime:     buildTime,
+		ModuleVersion: "unknown",
+		GoVersion:     runtime.Version(),
+	}
+	if module, ok := debug.ReadBuildInfo(); ok && module.Main.Version != "" {
+		info.ModuleVersion = module.Main.Version
+	}
+	return info
+}
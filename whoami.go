@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Ways a request can authenticate.
+const (
+	authMethodJWT           = "jwt"
+	authMethodAdminToken    = "admin-token"
+	authMethodApproverToken = "approver-token"
+	authMethodHMAC          = "hmac"
+)
+
+// Permissions a principal can hold.
+const (
+	// permissionWrite is needed for writes while HMAC_SECRET is set.
+	permissionWrite = "write"
+	// permissionApprove allows POST /approve and POST /reject.
+	permissionApprove = "approve"
+	// permissionLintFix allows POST /lint/fix.
+	permissionLintFix = "lint:fix"
+	// permissionSweep allows POST /sweep.
+	permissionSweep = "sweep"
+	// permissionUnredacted shows the REDACT_FIELDS in GET responses.
+	permissionUnredacted = "read:unredacted"
+)
+
+// Principal is who a request authenticated as and what it may do. ID is the
+// subject of a JWT, the admin or approver role for a static bearer token, or
+// "hmac" for a request that is only signed. A JWT's scopes are listed among
+// the permissions.
+type Principal struct {
+	ID          string   `json:"id"`
+	Methods     []string `json:"methods"`
+	Permissions []string `json:"permissions"`
+}
+
+// isSigned reports whether a request carries a valid HMAC signature. It is
+// always false while signing is disabled.
+func isSigned(method, path, query, timestamp, signature string, body []byte) bool {
+	return signing.enabled() && signing.verify(method, path, query, timestamp, signature, body, time.Now()) == nil
+}
+
+// resolvePrincipal works out the principal of a request from its
+// Authorization header and whether it carries a valid HMAC signature. It
+// returns nil for a request that authenticated in no way.
+func resolvePrincipal(ctx context.Context, authorization string, signed bool) *Principal {
+	principal := &Principal{Methods: []string{}, Permissions: []string{}}
+	if token, ok := bearerToken(authorization); ok && jwtAuth != nil {
+		if claims, err := jwtAuth.verify(ctx, token, time.Now()); err == nil {
+			principal.ID = claims.Subject
+			principal.Methods = append(principal.Methods, authMethodJWT)
+			principal.Permissions = append(principal.Permissions, claims.scopes()...)
+		}
+	}
+	if hasBearerToken(authorization, adminToken()) {
+		if principal.ID == "" {
+			principal.ID = "admin"
+		}
+		principal.Methods = append(principal.Methods, authMethodAdminToken)
+		principal.Permissions = append(principal.Permissions, permissionLintFix, permissionSweep, permissionUnredacted)
+	}
+	if isApprover(authorization) {
+		if principal.ID == "" {
+			principal.ID = "approver"
+		}
+		principal.Methods = append(principal.Methods, authMethodApproverToken)
+		principal.Permissions = append(principal.Permissions, permissionApprove)
+	}
+	if signed {
+		if principal.ID == "" {
+			principal.ID = "hmac"
+		}
+		principal.Methods = append(principal.Methods, authMethodHMAC)
+		principal.Permissions = append(principal.Permissions, permissionWrite)
+	}
+
+	if len(principal.Methods) == 0 {
+		return nil
+	}
+	return principal
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// A scheduled reservation holds its block only between activeFrom and
+// activeUntil, both Unix seconds. Its expiresAt is activeUntil, so the TTL and
+// the expiry sweeper release it once the window has passed.
+
+// activeWindowError checks a record's active window and returns the field at
+// fault and why, or empty strings when the window is sane: both ends set,
+// activeFrom before activeUntil, activeUntil in the future, and expiresAt, if
+// given, equal to activeUntil.
+func activeWindowError(record CIDRRecord, now time.Time) (field, message string) {
+	switch {
+	case record.ActiveFrom == 0 && record.ActiveUntil == 0:
+		return "", ""
+	case record.ActiveFrom == 0:
+		return "activeFrom", "required with activeUntil"
+	case record.ActiveUntil == 0:
+		return "activeUntil", "required with activeFrom"
+	case record.ActiveFrom >= record.ActiveUntil:
+		return "activeUntil", "must be after activeFrom"
+	case record.ActiveUntil <= now.Unix():
+		return "activeUntil", "must be in the future"
+	case record.ExpiresAt != 0 && record.ExpiresAt != record.ActiveUntil:
+		return "expiresAt", "must be omitted or equal activeUntil for a scheduled reservation"
+	}
+	return "", ""
+}
+
+// applyActiveWindow validates record's active window and, for a scheduled
+// reservation, sets expiresAt to the end of the window.
+func applyActiveWindow(record *CIDRRecord, now time.Time) error {
+	if field, message := activeWindowError(*record, now); field != "" {
+		return fmt.Errorf("%s %s", field, message)
+	}
+	if record.ActiveUntil != 0 {
+		record.ExpiresAt = record.ActiveUntil
+	}
+	return nil
+}
+
+// activePeriod is the time a record holds its block, as Unix seconds from
+// start to end. Records without a window hold it from their registration
+// until they expire, or forever when they don't.
+func activePeriod(activeFrom, expiresAt int64) (start, end int64) {
+	start, end = activeFrom, expiresAt
+	if start == 0 {
+		start = math.MinInt64
+	}
+	if end == 0 {
+		end = math.MaxInt64
+	}
+	return start, end
+}
+
+// concurrentRecords returns the records whose active periods overlap the
+// candidate's, so a block scheduled for one window stays free for another.
+func concurrentRecords(records []CIDRRecord, candidate CIDRRecord) []CIDRRecord {
+	return recordsActiveDuring(records, candidate.ActiveFrom, candidate.ExpiresAt)
+}
+
+// recordsActiveDuring returns the records that hold their block at some time
+// between from and until, either of which may be zero for unbounded.
+func recordsActiveDuring(records []CIDRRecord, from, until int64) []CIDRRecord {
+	start, end := activePeriod(from, until)
+	concurrent := make([]CIDRRecord, 0, len(records))
+	for _, record := range records {
+		recordStart, recordEnd := activePeriod(record.ActiveFrom, record.ExpiresAt)
+		if recordStart < end && start < recordEnd {
+			concurrent = append(concurrent, record)
+		}
+	}
+	return concurrent
+}
+
+// parseActiveWindow reads the activeFrom and activeUntil query parameters.
+func parseActiveWindow(query func(string) string) (from, until int64, err error) {
+	for name, value := range map[string]*int64{"activeFrom": &from, "activeUntil": &until} {
+		raw := query(name)
+		if raw == "" {
+			continue
+		}
+		if *value, err = strconv.ParseInt(raw, 10, 64); err != nil || *value <= 0 {
+			return 0, 0, fmt.Errorf("%s parameter must be a Unix timestamp in seconds", name)
+		}
+	}
+	if field, message := activeWindowError(CIDRRecord{ActiveFrom: from, ActiveUntil: until}, time.Now()); field != "" {
+		return 0, 0, fmt.Errorf("%s parameter %s", field, message)
+	}
+	return from, until, nil
+}
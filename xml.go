@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeXML  = "application/xml"
+
+	// xmlRoot is the document element of every XML response.
+	xmlRoot = "response"
+	// xmlItem is the element each array element is written as.
+	xmlItem = "item"
+	// xmlEntry is the element written, with a key attribute, for an object
+	// member whose name is not a valid XML name, such as a prefix length.
+	xmlEntry = "entry"
+)
+
+// wantsXML reports whether an Accept header prefers XML to JSON. A missing
+// header, */*, or a tie leaves the response as JSON.
+func wantsXML(accept string) bool {
+	var jsonQ, xmlQ float64
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case contentTypeXML, "text/xml":
+			xmlQ = max(xmlQ, q)
+		case contentTypeJSON, "*/*", "application/*":
+			jsonQ = max(jsonQ, q)
+		default:
+			if strings.HasSuffix(mediaType, "+json") {
+				jsonQ = max(jsonQ, q)
+			}
+		}
+	}
+	return xmlQ > jsonQ
+}
+
+// jsonToXML converts a JSON response body to XML, keeping the field order.
+// Objects become elements named after their members, array elements become
+// <item> elements, and null becomes an empty element, so
+// {"records":[{"key":"a"}]} is <response><records><item><key>a</key></item></records></response>.
+func jsonToXML(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	if err := writeXMLValue(encoder, decoder, xml.StartElement{Name: xml.Name{Local: xmlRoot}}); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeXMLValue writes the next JSON value from decoder as the element start.
+func writeXMLValue(encoder *xml.Encoder, decoder *json.Decoder, start xml.StartElement) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read JSON: %w", err)
+	}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		if value == '{' {
+			for decoder.More() {
+				nameToken, err := decoder.Token()
+				if err != nil {
+					return fmt.Errorf("failed to read JSON: %w", err)
+				}
+				if err := writeXMLValue(encoder, decoder, xmlMember(nameToken.(string))); err != nil {
+					return err
+				}
+			}
+		} else {
+			for decoder.More() {
+				if err := writeXMLValue(encoder, decoder, xml.StartElement{Name: xml.Name{Local: xmlItem}}); err != nil {
+					return err
+				}
+			}
+		}
+		// Consume the closing delimiter.
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to read JSON: %w", err)
+		}
+	case nil:
+	default:
+		if err := encoder.EncodeToken(xml.CharData(fmt.Sprint(value))); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+// xmlMember is the element an object member is written as.
+func xmlMember(name string) xml.StartElement {
+	if isXMLName(name) {
+		return xml.StartElement{Name: xml.Name{Local: name}}
+	}
+	return xml.StartElement{
+		Name: xml.Name{Local: xmlEntry},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+	}
+}
+
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || unicode.IsLetter(r) {
+			continue
+		}
+		if i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)) {
+			continue
+		}
+		return false
+	}
+	return true
+}